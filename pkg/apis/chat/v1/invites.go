@@ -0,0 +1,48 @@
+package v1
+
+import (
+	"time"
+
+	metav1 "github.com/yhlooo/bangbang/pkg/apis/meta/v1"
+)
+
+const KindInvite = "Invite"
+
+// Invite 邀请
+//
+// 用于服务发现不可用时（比如跨 VLAN 或客户端隔离的网络）手动加入房间
+type Invite struct {
+	metav1.APIMeta
+	metav1.ObjectMeta `json:"meta,omitempty"`
+
+	// 房间 UID
+	Room metav1.UID `json:"room,omitempty"`
+	// 证书签名
+	CertSign string `json:"certSign,omitempty"`
+	// 访问端点地址
+	Endpoints []string `json:"endpoints,omitempty"`
+	// 过期时间
+	ExpireTime time.Time `json:"expireTime,omitempty"`
+}
+
+var _ metav1.Object = (*Invite)(nil)
+
+// DeepCopy 深拷贝
+func (obj *Invite) DeepCopy() *Invite {
+	if obj == nil {
+		return nil
+	}
+	var endpoints []string
+	if obj.Endpoints != nil {
+		endpoints = make([]string, len(obj.Endpoints))
+		copy(endpoints, obj.Endpoints)
+	}
+	return &Invite{
+		APIMeta:    *obj.APIMeta.DeepCopy(),
+		ObjectMeta: *obj.ObjectMeta.DeepCopy(),
+		Room:       obj.Room,
+		CertSign:   obj.CertSign,
+		Endpoints:  endpoints,
+		ExpireTime: obj.ExpireTime,
+	}
+}
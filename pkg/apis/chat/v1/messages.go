@@ -1,8 +1,16 @@
 package v1
 
-import metav1 "github.com/yhlooo/bangbang/pkg/apis/meta/v1"
+import (
+	"encoding/json"
+	"time"
 
-const KindMessage = "Message"
+	metav1 "github.com/yhlooo/bangbang/pkg/apis/meta/v1"
+)
+
+const (
+	KindMessage     = "Message"
+	KindMessageList = "MessageList"
+)
 
 // Message 消息
 type Message struct {
@@ -11,22 +19,94 @@ type Message struct {
 
 	// 发送人
 	From metav1.ObjectMeta `json:"from,omitempty"`
+	// 发送人身份公钥（ PKIX DER 格式），房间自己产生的消息为空
+	FromKey []byte `json:"fromKey,omitempty"`
+	// 发送人使用身份私钥对除 Signature 和 FromSignature 外的其余字段的签名
+	FromSignature []byte `json:"fromSignature,omitempty"`
 	// 消息内容
 	Content MessageContent `json:"content,omitempty"`
+
+	// 反序列化时收到的原始 JSON ，可能包括当前版本不认识的字段
+	raw []byte
 }
 
 var _ metav1.Object = (*Message)(nil)
 
+// UnmarshalJSON 反序列化，同时保留原始 JSON
+func (obj *Message) UnmarshalJSON(data []byte) error {
+	type message Message
+	if err := json.Unmarshal(data, (*message)(obj)); err != nil {
+		return err
+	}
+	obj.raw = make([]byte, len(data))
+	copy(obj.raw, data)
+	return nil
+}
+
+// RawJSON 返回反序列化时收到的原始 JSON ，不是反序列化得到的消息时返回 nil
+//
+// 校验签名和转发消息时使用原始 JSON ，不会丢失当前版本不认识的字段
+func (obj *Message) RawJSON() []byte {
+	return obj.raw
+}
+
+// ResetRawJSON 清除原始 JSON ，修改反序列化得到的消息后需要调用
+func (obj *Message) ResetRawJSON() {
+	obj.raw = nil
+}
+
 // DeepCopy 深拷贝
 func (obj *Message) DeepCopy() *Message {
 	if obj == nil {
 		return nil
 	}
+	var fromKey, fromSignature []byte
+	if obj.FromKey != nil {
+		fromKey = make([]byte, len(obj.FromKey))
+		copy(fromKey, obj.FromKey)
+	}
+	if obj.FromSignature != nil {
+		fromSignature = make([]byte, len(obj.FromSignature))
+		copy(fromSignature, obj.FromSignature)
+	}
+	var raw []byte
+	if obj.raw != nil {
+		raw = make([]byte, len(obj.raw))
+		copy(raw, obj.raw)
+	}
 	return &Message{
-		APIMeta:    *obj.APIMeta.DeepCopy(),
-		ObjectMeta: *obj.ObjectMeta.DeepCopy(),
-		From:       *obj.From.DeepCopy(),
-		Content:    *obj.Content.DeepCopy(),
+		APIMeta:       *obj.APIMeta.DeepCopy(),
+		ObjectMeta:    *obj.ObjectMeta.DeepCopy(),
+		From:          *obj.From.DeepCopy(),
+		FromKey:       fromKey,
+		FromSignature: fromSignature,
+		Content:       *obj.Content.DeepCopy(),
+		raw:           raw,
+	}
+}
+
+// MessageList 消息列表
+type MessageList struct {
+	metav1.APIMeta
+
+	Items []Message `json:"items"`
+}
+
+// DeepCopy 深拷贝
+func (obj *MessageList) DeepCopy() *MessageList {
+	if obj == nil {
+		return nil
+	}
+	var items []Message
+	if obj.Items != nil {
+		items = make([]Message, len(obj.Items))
+		for i, item := range obj.Items {
+			items[i] = *item.DeepCopy()
+		}
+	}
+	return &MessageList{
+		APIMeta: *obj.APIMeta.DeepCopy(),
+		Items:   items,
 	}
 }
 
@@ -40,6 +120,14 @@ type MessageContent struct {
 	Join *MembersChangeMessageContent `json:"join,omitempty"`
 	// 成员离开
 	Leave *MembersChangeMessageContent `json:"leave,omitempty"`
+	// 管理操作
+	Moderation *ModerationMessageContent `json:"moderation,omitempty"`
+	// 成员请求加入，等待批准
+	JoinRequest *MembersChangeMessageContent `json:"joinRequest,omitempty"`
+	// 发送者密钥分发
+	SenderKey *SenderKeyMessageContent `json:"senderKey,omitempty"`
+	// 端到端加密的消息
+	Encrypted *EncryptedMessageContent `json:"encrypted,omitempty"`
 }
 
 // DeepCopy 深拷贝
@@ -48,9 +136,13 @@ func (obj *MessageContent) DeepCopy() *MessageContent {
 		return nil
 	}
 	return &MessageContent{
-		Text:  obj.Text.DeepCopy(),
-		Join:  obj.Join.DeepCopy(),
-		Leave: obj.Leave.DeepCopy(),
+		Text:        obj.Text.DeepCopy(),
+		Join:        obj.Join.DeepCopy(),
+		Leave:       obj.Leave.DeepCopy(),
+		Moderation:  obj.Moderation.DeepCopy(),
+		JoinRequest: obj.JoinRequest.DeepCopy(),
+		SenderKey:   obj.SenderKey.DeepCopy(),
+		Encrypted:   obj.Encrypted.DeepCopy(),
 	}
 }
 
@@ -72,6 +164,8 @@ func (obj *TextMessageContent) DeepCopy() *TextMessageContent {
 // MembersChangeMessageContent 成员变化消息
 type MembersChangeMessageContent struct {
 	User metav1.ObjectMeta `json:"user,omitempty"`
+	// 成员身份公钥指纹，由成员连接的房间根据其客户端证书填写
+	Key string `json:"key,omitempty"`
 }
 
 // DeepCopy 深拷贝
@@ -81,5 +175,188 @@ func (obj *MembersChangeMessageContent) DeepCopy() *MembersChangeMessageContent
 	}
 	return &MembersChangeMessageContent{
 		User: *obj.User.DeepCopy(),
+		Key:  obj.Key,
+	}
+}
+
+// ModerationAction 管理操作类型
+type ModerationAction string
+
+const (
+	// ModerationKick 踢出用户，用户可以重新加入
+	ModerationKick ModerationAction = "Kick"
+	// ModerationMute 禁言用户
+	ModerationMute ModerationAction = "Mute"
+	// ModerationUnmute 解除禁言
+	ModerationUnmute ModerationAction = "Unmute"
+	// ModerationBan 封禁用户，踢出并禁止重新加入
+	ModerationBan ModerationAction = "Ban"
+	// ModerationUnban 解除封禁
+	ModerationUnban ModerationAction = "Unban"
+	// ModerationGrantAdmin 授予管理员
+	ModerationGrantAdmin ModerationAction = "GrantAdmin"
+	// ModerationRevokeAdmin 撤销管理员
+	ModerationRevokeAdmin ModerationAction = "RevokeAdmin"
+	// ModerationLock 锁定房间，拒绝新成员加入
+	ModerationLock ModerationAction = "Lock"
+	// ModerationUnlock 解除锁定
+	ModerationUnlock ModerationAction = "Unlock"
+	// ModerationEnableAdmission 开启准入模式，新成员加入需要批准
+	ModerationEnableAdmission ModerationAction = "EnableAdmission"
+	// ModerationDisableAdmission 关闭准入模式
+	ModerationDisableAdmission ModerationAction = "DisableAdmission"
+	// ModerationAdmit 批准用户加入
+	ModerationAdmit ModerationAction = "Admit"
+	// ModerationDeny 拒绝用户加入
+	ModerationDeny ModerationAction = "Deny"
+	// ModerationRekey 更换房间密钥，只有房间签发者可以执行
+	ModerationRekey ModerationAction = "Rekey"
+	// ModerationSetViewerKey 设置或关闭只读观察者密钥，只有房间签发者可以执行
+	ModerationSetViewerKey ModerationAction = "SetViewerKey"
+)
+
+// ModerationMessageContent 管理操作消息
+//
+// 由房间树根房主或其授权的管理员使用身份私钥签名
+type ModerationMessageContent struct {
+	// 操作类型
+	Action ModerationAction `json:"action"`
+	// 操作对象用户
+	User metav1.ObjectMeta `json:"user,omitempty"`
+	// 操作对象用户的身份公钥指纹，禁言、封禁、踢出和准入按该指纹生效
+	UserKey string `json:"userKey,omitempty"`
+	// 授予或撤销管理员时管理员的公钥指纹
+	AdminKey string `json:"adminKey,omitempty"`
+	// 原因
+	Reason string `json:"reason,omitempty"`
+	// 更换房间密钥或设置观察者密钥时使用当前房间密钥的内容加密子密钥加密的新密钥，关闭观察者时为空
+	Secret []byte `json:"secret,omitempty"`
+	// 签发时间
+	IssueTime time.Time `json:"issueTime"`
+	// 签发者公钥（ PKIX DER 格式）
+	Issuer []byte `json:"issuer,omitempty"`
+	// 签发者使用私钥对其余字段的签名
+	Signature []byte `json:"signature,omitempty"`
+}
+
+// DeepCopy 深拷贝
+func (obj *ModerationMessageContent) DeepCopy() *ModerationMessageContent {
+	if obj == nil {
+		return nil
+	}
+	var secret, issuer, signature []byte
+	if obj.Secret != nil {
+		secret = make([]byte, len(obj.Secret))
+		copy(secret, obj.Secret)
+	}
+	if obj.Issuer != nil {
+		issuer = make([]byte, len(obj.Issuer))
+		copy(issuer, obj.Issuer)
+	}
+	if obj.Signature != nil {
+		signature = make([]byte, len(obj.Signature))
+		copy(signature, obj.Signature)
+	}
+	return &ModerationMessageContent{
+		Action:    obj.Action,
+		User:      *obj.User.DeepCopy(),
+		UserKey:   obj.UserKey,
+		AdminKey:  obj.AdminKey,
+		Reason:    obj.Reason,
+		Secret:    secret,
+		IssueTime: obj.IssueTime,
+		Issuer:    issuer,
+		Signature: signature,
+	}
+}
+
+// SenderKeyMessageContent 发送者密钥分发消息
+//
+// 成员将自己的发送者密钥分别加密给其它成员，并使用身份私钥签名
+type SenderKeyMessageContent struct {
+	// 发送者的 X25519 公钥，用于与其它成员协商加密发送者密钥的密钥
+	PublicKey []byte `json:"publicKey"`
+	// 发送者密钥 ID
+	KeyID string `json:"keyID"`
+	// 分别加密给各成员的发送者密钥
+	Recipients []SenderKeyRecipient `json:"recipients,omitempty"`
+	// 签发时间
+	IssueTime time.Time `json:"issueTime"`
+	// 签发者公钥（ PKIX DER 格式）
+	Issuer []byte `json:"issuer,omitempty"`
+	// 签发者使用私钥对其余字段的签名
+	Signature []byte `json:"signature,omitempty"`
+}
+
+// DeepCopy 深拷贝
+func (obj *SenderKeyMessageContent) DeepCopy() *SenderKeyMessageContent {
+	if obj == nil {
+		return nil
+	}
+	var recipients []SenderKeyRecipient
+	if obj.Recipients != nil {
+		recipients = make([]SenderKeyRecipient, len(obj.Recipients))
+		for i, recipient := range obj.Recipients {
+			recipients[i] = *recipient.DeepCopy()
+		}
+	}
+	return &SenderKeyMessageContent{
+		PublicKey:  copyBytes(obj.PublicKey),
+		KeyID:      obj.KeyID,
+		Recipients: recipients,
+		IssueTime:  obj.IssueTime,
+		Issuer:     copyBytes(obj.Issuer),
+		Signature:  copyBytes(obj.Signature),
+	}
+}
+
+// SenderKeyRecipient 加密给一个成员的发送者密钥
+type SenderKeyRecipient struct {
+	// 接收成员 UID
+	UID metav1.UID `json:"uid"`
+	// 加密的发送者密钥
+	Key []byte `json:"key"`
+}
+
+// DeepCopy 深拷贝
+func (obj *SenderKeyRecipient) DeepCopy() *SenderKeyRecipient {
+	if obj == nil {
+		return nil
+	}
+	return &SenderKeyRecipient{
+		UID: obj.UID,
+		Key: copyBytes(obj.Key),
+	}
+}
+
+// EncryptedMessageContent 使用发送者密钥加密的消息内容
+type EncryptedMessageContent struct {
+	// 发送者密钥 ID
+	KeyID string `json:"keyID"`
+	// 随机 nonce 与加密的文本消息内容的拼接
+	Ciphertext []byte `json:"ciphertext"`
+	// 使用只读观察者密钥的内容加密子密钥加密的发送者密钥，房间没有观察者时为空
+	ViewerKey []byte `json:"viewerKey,omitempty"`
+}
+
+// DeepCopy 深拷贝
+func (obj *EncryptedMessageContent) DeepCopy() *EncryptedMessageContent {
+	if obj == nil {
+		return nil
+	}
+	return &EncryptedMessageContent{
+		KeyID:      obj.KeyID,
+		Ciphertext: copyBytes(obj.Ciphertext),
+		ViewerKey:  copyBytes(obj.ViewerKey),
+	}
+}
+
+// copyBytes 拷贝字节切片
+func copyBytes(b []byte) []byte {
+	if b == nil {
+		return nil
 	}
+	out := make([]byte, len(b))
+	copy(out, b)
+	return out
 }
@@ -5,6 +5,7 @@ import metav1 "github.com/yhlooo/bangbang/pkg/apis/meta/v1"
 const (
 	KindRoom        = "Room"
 	KindRoomRequest = "RoomRequest"
+	KindSealedRoom  = "SealedRoom"
 )
 
 // Room 房间
@@ -18,6 +19,12 @@ type Room struct {
 	CertSign string `json:"certSign,omitempty"`
 	// 访问端点地址
 	Endpoints []string `json:"endpoints,omitempty"`
+	// 房间在房间树中的深度，没有上游时为 0
+	Depth int `json:"depth,omitempty"`
+	// 房间树根房主的公钥指纹，只有其或其授权的管理员可以签发管理操作
+	Authority string `json:"authority,omitempty"`
+	// 回复的请求挑战（服务发现时）
+	Challenges []string `json:"challenges,omitempty"`
 }
 
 var _ metav1.Object = (*Room)(nil)
@@ -32,12 +39,20 @@ func (obj *Room) DeepCopy() *Room {
 		endpoints = make([]string, len(obj.Endpoints))
 		copy(endpoints, obj.Endpoints)
 	}
+	var challenges []string
+	if obj.Challenges != nil {
+		challenges = make([]string, len(obj.Challenges))
+		copy(challenges, obj.Challenges)
+	}
 	return &Room{
 		APIMeta:    *obj.APIMeta.DeepCopy(),
 		ObjectMeta: *obj.ObjectMeta.DeepCopy(),
 		Owner:      *obj.Owner.DeepCopy(),
 		CertSign:   obj.CertSign,
 		Endpoints:  endpoints,
+		Depth:      obj.Depth,
+		Authority:  obj.Authority,
+		Challenges: challenges,
 	}
 }
 
@@ -45,6 +60,11 @@ func (obj *Room) DeepCopy() *Room {
 type RoomRequest struct {
 	metav1.APIMeta
 	metav1.ObjectMeta `json:"meta,omitempty"`
+
+	// 是否要求以单播回复到请求来源地址（组播不可用时）
+	Unicast bool `json:"unicast,omitempty"`
+	// 随机挑战，应答的 Room 中需要带上该挑战，用于防止重放
+	Challenge string `json:"challenge,omitempty"`
 }
 
 var _ metav1.Object = (*RoomRequest)(nil)
@@ -57,5 +77,34 @@ func (obj *RoomRequest) DeepCopy() *RoomRequest {
 	return &RoomRequest{
 		APIMeta:    *obj.APIMeta.DeepCopy(),
 		ObjectMeta: *obj.ObjectMeta.DeepCopy(),
+		Unicast:    obj.Unicast,
+		Challenge:  obj.Challenge,
+	}
+}
+
+// SealedRoom 加密的房间信息
+//
+// 用于服务发现，只有知道房间密钥的成员可以解密，其他人只能知道存在一个房间
+type SealedRoom struct {
+	metav1.APIMeta
+
+	// 临时标识，定期轮换，同一时段内同一房间的标识相同
+	ID string `json:"id"`
+	// 随机数
+	Nonce []byte `json:"nonce"`
+	// 加密的签名 Room
+	Data []byte `json:"data"`
+}
+
+// DeepCopy 深拷贝
+func (obj *SealedRoom) DeepCopy() *SealedRoom {
+	if obj == nil {
+		return nil
+	}
+	return &SealedRoom{
+		APIMeta: *obj.APIMeta.DeepCopy(),
+		ID:      obj.ID,
+		Nonce:   append([]byte(nil), obj.Nonce...),
+		Data:    append([]byte(nil), obj.Data...),
 	}
 }
@@ -11,6 +11,9 @@ const (
 type User struct {
 	metav1.APIMeta
 	metav1.ObjectMeta `json:"meta,omitempty"`
+
+	// 身份公钥指纹，未知时为空
+	Key string `json:"key,omitempty"`
 }
 
 var _ metav1.Object = (*User)(nil)
@@ -23,6 +26,7 @@ func (obj *User) DeepCopy() *User {
 	return &User{
 		APIMeta:    *obj.APIMeta.DeepCopy(),
 		ObjectMeta: *obj.ObjectMeta.DeepCopy(),
+		Key:        obj.Key,
 	}
 }
 
@@ -84,6 +84,7 @@ func (obj *ObjectMeta) DeepCopy() *ObjectMeta {
 		UID:       obj.UID,
 		Name:      obj.Name,
 		Signature: obj.Signature,
+		SignTime:  obj.SignTime,
 	}
 }
 
@@ -0,0 +1,254 @@
+package audit
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// EventType 安全事件类型
+type EventType string
+
+const (
+	// EventDiscoverySignatureInvalid 发现请求签名校验失败
+	EventDiscoverySignatureInvalid EventType = "DiscoverySignatureInvalid"
+	// EventClientCertificateRejected 服务端拒绝客户端证书
+	EventClientCertificateRejected EventType = "ClientCertificateRejected"
+	// EventServerCertificateMismatch 房间服务端证书与发现时的签名不一致
+	EventServerCertificateMismatch EventType = "ServerCertificateMismatch"
+	// EventPeerCertificateChanged 已知用户的证书发生变化
+	EventPeerCertificateChanged EventType = "PeerCertificateChanged"
+	// EventRequestRejected 拒绝 API 请求
+	EventRequestRejected EventType = "RequestRejected"
+	// EventUserKicked 用户被踢出
+	EventUserKicked EventType = "UserKicked"
+	// EventUserBanned 用户被封禁
+	EventUserBanned EventType = "UserBanned"
+	// EventRoomRekeyed 房间更换密钥
+	EventRoomRekeyed EventType = "RoomRekeyed"
+)
+
+const (
+	// suppressInterval 相同事件的最小记录间隔，间隔内的重复事件只计数
+	suppressInterval = time.Minute
+	// maxFileSize 日志文件最大大小，超过后轮转到 .1 文件
+	maxFileSize = 4 << 20
+)
+
+// Event 安全事件
+type Event struct {
+	// 发生时间
+	Time time.Time `json:"time"`
+	// 类型
+	Type EventType `json:"type"`
+	// 来源地址
+	Source string `json:"source,omitempty"`
+	// 描述
+	Message string `json:"message"`
+	// 在此之前被合并而未单独记录的相同事件数
+	Suppressed int `json:"suppressed,omitempty"`
+}
+
+// NewRecorder 创建安全事件记录器，将事件以 JSON Lines 格式追加写入 path
+func NewRecorder(path string) *Recorder {
+	return &Recorder{
+		state: &recorderState{
+			path:    path,
+			last:    map[string]time.Time{},
+			pending: map[string]*Event{},
+			now:     time.Now,
+		},
+	}
+}
+
+// Recorder 安全事件记录器，值为 nil 时不记录任何事件
+type Recorder struct {
+	source string
+	state  *recorderState
+}
+
+// recorderState 记录器共享状态
+type recorderState struct {
+	lock sync.Mutex
+	path string
+	// 各事件最近一次写入的时间
+	last map[string]time.Time
+	// 间隔内被合并而尚未写入的事件， Time 为最近一次发生时间
+	pending map[string]*Event
+	// 写入被合并事件的定时器
+	timer *time.Timer
+	now   func() time.Time
+}
+
+// WithSource 返回记录来源地址为 source 的记录器
+func (r *Recorder) WithSource(source string) *Recorder {
+	if r == nil {
+		return nil
+	}
+	return &Recorder{source: source, state: r.state}
+}
+
+// Record 记录事件
+//
+// 间隔内的相同事件只计数，在下次相同事件、间隔结束或 Close 时写入
+func (r *Recorder) Record(eventType EventType, message string) {
+	if r == nil {
+		return
+	}
+	s := r.state
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := s.now()
+	key := string(eventType) + "\x00" + r.source + "\x00" + message
+	if last, ok := s.last[key]; ok && now.Sub(last) < suppressInterval {
+		if event, ok := s.pending[key]; ok {
+			event.Time = now
+			event.Suppressed++
+		} else {
+			s.pending[key] = &Event{Time: now, Type: eventType, Source: r.source, Message: message}
+		}
+		if s.timer == nil {
+			s.timer = time.AfterFunc(suppressInterval, s.flushPending)
+		}
+		return
+	}
+
+	event := Event{
+		Time:    now,
+		Type:    eventType,
+		Source:  r.source,
+		Message: message,
+	}
+	if pending, ok := s.pending[key]; ok {
+		event.Suppressed = pending.Suppressed + 1
+	}
+	if err := s.write(&event); err == nil {
+		s.last[key] = now
+		delete(s.pending, key)
+	}
+	s.flush(now, false)
+}
+
+// Close 写入所有被合并而尚未写入的事件
+func (r *Recorder) Close() {
+	if r == nil {
+		return
+	}
+	s := r.state
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	s.flush(s.now(), true)
+}
+
+// flushPending 定时写入间隔已结束的被合并事件，仍有未写入的事件时继续定时
+func (s *recorderState) flushPending() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.timer = nil
+	s.flush(s.now(), false)
+	if len(s.pending) > 0 {
+		s.timer = time.AfterFunc(suppressInterval, s.flushPending)
+	}
+}
+
+// flush 写入间隔已结束（ force 为 true 时全部）的被合并事件，并清理过期的写入时间
+//
+// 写入的事件代表最近一次发生的事件， Suppressed 为在此之前被合并的次数
+func (s *recorderState) flush(now time.Time, force bool) {
+	for key, event := range s.pending {
+		if !force && now.Sub(s.last[key]) < suppressInterval {
+			continue
+		}
+		if err := s.write(event); err != nil {
+			continue
+		}
+		s.last[key] = event.Time
+		delete(s.pending, key)
+	}
+	for key, t := range s.last {
+		if _, ok := s.pending[key]; !ok && now.Sub(t) >= suppressInterval {
+			delete(s.last, key)
+		}
+	}
+}
+
+// write 写入事件
+func (s *recorderState) write(event *Event) error {
+	raw, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("encode event to json error: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o700); err != nil {
+		return fmt.Errorf("create audit log directory error: %w", err)
+	}
+	if info, err := os.Stat(s.path); err == nil && info.Size()+int64(len(raw)) >= maxFileSize {
+		if err := os.Rename(s.path, s.path+".1"); err != nil {
+			return fmt.Errorf("rotate audit log error: %w", err)
+		}
+	}
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("open audit log error: %w", err)
+	}
+	defer func() { _ = f.Close() }()
+	if _, err := f.Write(append(raw, '\n')); err != nil {
+		return fmt.Errorf("write audit log error: %w", err)
+	}
+	return nil
+}
+
+// ReadEvents 按时间顺序读取 path 及其轮转文件中的事件，忽略无法解析的行
+func ReadEvents(path string) ([]Event, error) {
+	var events []Event
+	for _, p := range []string{path + ".1", path} {
+		f, err := os.Open(p)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return nil, fmt.Errorf("open audit log %q error: %w", p, err)
+		}
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(nil, 1<<20)
+		for scanner.Scan() {
+			event := Event{}
+			if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+				continue
+			}
+			events = append(events, event)
+		}
+		err = scanner.Err()
+		_ = f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("read audit log %q error: %w", p, err)
+		}
+	}
+	return events, nil
+}
+
+// recorderContextKey 上下文中存放记录器的键
+type recorderContextKey struct{}
+
+// NewContext 创建包含记录器的上下文
+func NewContext(parent context.Context, r *Recorder) context.Context {
+	return context.WithValue(parent, recorderContextKey{}, r)
+}
+
+// FromContext 从上下文获取记录器，不存在时返回 nil （不记录任何事件）
+func FromContext(ctx context.Context) *Recorder {
+	r, _ := ctx.Value(recorderContextKey{}).(*Recorder)
+	return r
+}
@@ -0,0 +1,59 @@
+package audit
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestRecorder 测试 Recorder
+func TestRecorder(t *testing.T) {
+	a := assert.New(t)
+
+	path := filepath.Join(t.TempDir(), "audit.log")
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	r := NewRecorder(path)
+	r.state.now = func() time.Time { return now }
+
+	// 间隔内的相同事件被合并
+	ctx := NewContext(context.Background(), r.WithSource("192.0.2.1"))
+	for i := 0; i < 3; i++ {
+		FromContext(ctx).Record(EventDiscoverySignatureInvalid, "invalid signature")
+	}
+	FromContext(ctx).Record(EventRequestRejected, "forbidden")
+	now = now.Add(suppressInterval)
+	FromContext(ctx).Record(EventDiscoverySignatureInvalid, "invalid signature")
+
+	// 上下文中没有记录器时不记录
+	FromContext(context.Background()).Record(EventRoomRekeyed, "rekey")
+
+	events, err := ReadEvents(path)
+	if !a.NoError(err) || !a.Len(events, 3) {
+		return
+	}
+	a.Equal(EventDiscoverySignatureInvalid, events[0].Type)
+	a.Equal("192.0.2.1", events[0].Source)
+	a.Equal(0, events[0].Suppressed)
+	a.Equal(EventRequestRejected, events[1].Type)
+	a.Equal(2, events[2].Suppressed)
+
+	// 不再出现的被合并事件在 Close 时写入
+	FromContext(ctx).Record(EventDiscoverySignatureInvalid, "invalid signature")
+	now = now.Add(time.Second)
+	FromContext(ctx).Record(EventDiscoverySignatureInvalid, "invalid signature")
+	r.Close()
+	events, err = ReadEvents(path)
+	if a.NoError(err) && a.Len(events, 4) {
+		a.Equal(now, events[3].Time)
+		a.Equal(1, events[3].Suppressed)
+	}
+	a.Empty(r.state.pending)
+
+	// 过期的写入时间被清理
+	now = now.Add(2 * suppressInterval)
+	FromContext(ctx).Record(EventRequestRejected, "forbidden")
+	a.Len(r.state.last, 1)
+}
@@ -0,0 +1,406 @@
+package moderations
+
+import (
+	"bytes"
+	"crypto"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	chatv1 "github.com/yhlooo/bangbang/pkg/apis/chat/v1"
+	metav1 "github.com/yhlooo/bangbang/pkg/apis/meta/v1"
+	"github.com/yhlooo/bangbang/pkg/signatures"
+)
+
+// KickMaxAge 踢出操作的有效期，超过有效期的踢出操作被忽略，避免被重放
+const KickMaxAge = time.Minute
+
+// RekeyMaxAge 更换房间密钥操作的有效期，超过有效期的操作被忽略
+const RekeyMaxAge = time.Minute
+
+// rekeyAAD 加密新房间密钥时一同认证的数据
+const rekeyAAD = "bangbang rekey v1"
+
+// viewerKeyAAD 加密观察者密钥时一同认证的数据
+const viewerKeyAAD = "bangbang viewer key v1"
+
+var (
+	// ErrUnauthorized 签发者无权执行该管理操作
+	ErrUnauthorized = errors.New("Unauthorized")
+	// ErrInvalidModeration 非法的管理操作
+	ErrInvalidModeration = errors.New("InvalidModeration")
+)
+
+// KeyFingerprint 返回 PKIX DER 格式公钥的指纹
+func KeyFingerprint(pub []byte) string {
+	return signatures.SignCert(pub)
+}
+
+// Sign 使用私钥签名管理操作
+//
+// 会设置签发者公钥和签发时间
+func Sign(priv crypto.Signer, content *chatv1.ModerationMessageContent) error {
+	pub, err := signatures.PublicKeyOf(priv)
+	if err != nil {
+		return err
+	}
+	content.Issuer = pub
+	content.IssueTime = time.Now()
+	content.Signature = nil
+	sign, err := signatures.ES256SignObject(priv, content)
+	if err != nil {
+		return fmt.Errorf("sign moderation error: %w", err)
+	}
+	content.Signature = sign
+	return nil
+}
+
+// NewRekey 创建更换房间密钥的管理操作
+//
+// 新密钥 newKey 使用当前房间密钥 key 的内容加密子密钥加密，只有持有当前密钥的成员可以得到新密钥。
+// 返回的操作还需要使用 Sign 签名
+func NewRekey(key, newKey signatures.Key) (*chatv1.ModerationMessageContent, error) {
+	if len(newKey) == 0 {
+		return nil, fmt.Errorf("%w: new key is required", ErrInvalidModeration)
+	}
+	secret, err := signatures.SealContent(key, newKey, []byte(rekeyAAD))
+	if err != nil {
+		return nil, fmt.Errorf("encrypt new key error: %w", err)
+	}
+	return &chatv1.ModerationMessageContent{
+		Action: chatv1.ModerationRekey,
+		Secret: secret,
+	}, nil
+}
+
+// OpenRekey 使用当前房间密钥 key 解密更换房间密钥操作中的新密钥
+//
+// 不校验操作的签名
+func OpenRekey(key signatures.Key, content *chatv1.ModerationMessageContent) (signatures.Key, error) {
+	if content.Action != chatv1.ModerationRekey {
+		return nil, fmt.Errorf("%w: not a rekey moderation", ErrInvalidModeration)
+	}
+	newKey, err := signatures.OpenContent(key, content.Secret, []byte(rekeyAAD))
+	if err != nil {
+		return nil, fmt.Errorf("decrypt new key error: %w", err)
+	}
+	if len(newKey) == 0 {
+		return nil, fmt.Errorf("%w: new key is empty", ErrInvalidModeration)
+	}
+	return newKey, nil
+}
+
+// NewViewerKey 创建设置只读观察者密钥的管理操作
+//
+// 观察者密钥 viewerKey 使用当前房间密钥 key 的内容加密子密钥加密， viewerKey 为空时表示关闭观察者。
+// 返回的操作还需要使用 Sign 签名
+func NewViewerKey(key, viewerKey signatures.Key) (*chatv1.ModerationMessageContent, error) {
+	if len(viewerKey) != 0 && bytes.Equal(key, viewerKey) {
+		return nil, fmt.Errorf("%w: viewer key must differ from room key", ErrInvalidModeration)
+	}
+	content := &chatv1.ModerationMessageContent{Action: chatv1.ModerationSetViewerKey}
+	if len(viewerKey) == 0 {
+		return content, nil
+	}
+	secret, err := signatures.SealContent(key, viewerKey, []byte(viewerKeyAAD))
+	if err != nil {
+		return nil, fmt.Errorf("encrypt viewer key error: %w", err)
+	}
+	content.Secret = secret
+	return content, nil
+}
+
+// OpenViewerKey 使用当前房间密钥 key 解密设置观察者密钥操作中的观察者密钥
+//
+// 关闭观察者的操作返回 nil 。不校验操作的签名
+func OpenViewerKey(key signatures.Key, content *chatv1.ModerationMessageContent) (signatures.Key, error) {
+	if content.Action != chatv1.ModerationSetViewerKey {
+		return nil, fmt.Errorf("%w: not a set viewer key moderation", ErrInvalidModeration)
+	}
+	if len(content.Secret) == 0 {
+		return nil, nil
+	}
+	viewerKey, err := signatures.OpenContent(key, content.Secret, []byte(viewerKeyAAD))
+	if err != nil {
+		return nil, fmt.Errorf("decrypt viewer key error: %w", err)
+	}
+	return viewerKey, nil
+}
+
+// Verify 校验管理操作的签名，返回签发者公钥指纹
+func Verify(content *chatv1.ModerationMessageContent) (string, error) {
+	unsigned := content.DeepCopy()
+	unsigned.Signature = nil
+	if err := signatures.ES256VerifyObject(content.Issuer, content.Signature, unsigned); err != nil {
+		return "", err
+	}
+	return KeyFingerprint(content.Issuer), nil
+}
+
+// 房间设置的记录键
+const (
+	settingLock      = "lock"
+	settingAdmission = "admission"
+	settingViewer    = "viewer"
+)
+
+// NewState 创建管理状态
+//
+// authority 为房间树根房主的公钥指纹，为空时不接受任何管理操作
+func NewState(authority string) *State {
+	return &State{
+		authority: authority,
+		mutes:     map[string]*chatv1.Message{},
+		bans:      map[string]*chatv1.Message{},
+		decisions: map[string]*chatv1.Message{},
+		admins:    map[string]*chatv1.Message{},
+		settings:  map[string]*chatv1.Message{},
+	}
+}
+
+// State 管理状态
+//
+// 按用户身份公钥指纹记录最近的禁言、封禁、准入操作，记录每个公钥最近的授予、撤销管理员操作和最近的房间设置操作，
+// 签发时间早于已记录操作的操作被忽略
+type State struct {
+	lock      sync.RWMutex
+	authority string
+	mutes     map[string]*chatv1.Message
+	bans      map[string]*chatv1.Message
+	decisions map[string]*chatv1.Message
+	admins    map[string]*chatv1.Message
+	settings  map[string]*chatv1.Message
+}
+
+// Authority 返回当前有权签发管理操作的公钥指纹
+func (s *State) Authority() string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.authority
+}
+
+// SetAuthority 设置有权签发管理操作的公钥指纹
+//
+// 变化时清空管理员和房间设置，已生效的禁言、封禁、准入保留
+func (s *State) SetAuthority(authority string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.authority == authority {
+		return
+	}
+	s.authority = authority
+	clear(s.admins)
+	clear(s.settings)
+}
+
+// Apply 校验并应用管理操作消息
+//
+// 返回操作是否生效，过时的操作不生效。签名不正确或签发者无权执行时返回错误
+func (s *State) Apply(msg *chatv1.Message) (bool, error) {
+	content := msg.Content.Moderation
+	if content == nil {
+		return false, fmt.Errorf("%w: not a moderation message", ErrInvalidModeration)
+	}
+	issuer, err := Verify(content)
+	if err != nil {
+		return false, fmt.Errorf("verify moderation error: %w", err)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// 检查权限
+	if s.authority == "" {
+		return false, fmt.Errorf("%w: room has no authority", ErrUnauthorized)
+	}
+	switch content.Action {
+	case chatv1.ModerationRekey:
+		if issuer != s.authority {
+			return false, fmt.Errorf("%w: %s is not the room authority", ErrUnauthorized, issuer)
+		}
+		if time.Since(content.IssueTime) > RekeyMaxAge {
+			return false, nil
+		}
+		// 更换密钥操作不记录状态，仅在有效期内生效。观察者密钥使用旧密钥加密，更换后失效
+		delete(s.settings, settingViewer)
+		return true, nil
+	case chatv1.ModerationSetViewerKey:
+		if issuer != s.authority {
+			return false, fmt.Errorf("%w: %s is not the room authority", ErrUnauthorized, issuer)
+		}
+		return applyRecord(s.settings, settingViewer, msg), nil
+	case chatv1.ModerationGrantAdmin, chatv1.ModerationRevokeAdmin:
+		if issuer != s.authority {
+			return false, fmt.Errorf("%w: %s is not the room authority", ErrUnauthorized, issuer)
+		}
+		if content.AdminKey == "" {
+			return false, fmt.Errorf("%w: admin key is required", ErrInvalidModeration)
+		}
+		return applyRecord(s.admins, content.AdminKey, msg), nil
+	case chatv1.ModerationLock, chatv1.ModerationUnlock:
+		if err := s.checkIssuer(issuer); err != nil {
+			return false, err
+		}
+		return applyRecord(s.settings, settingLock, msg), nil
+	case chatv1.ModerationEnableAdmission, chatv1.ModerationDisableAdmission:
+		if err := s.checkIssuer(issuer); err != nil {
+			return false, err
+		}
+		return applyRecord(s.settings, settingAdmission, msg), nil
+	}
+
+	var records map[string]*chatv1.Message
+	switch content.Action {
+	case chatv1.ModerationKick:
+	case chatv1.ModerationMute, chatv1.ModerationUnmute:
+		records = s.mutes
+	case chatv1.ModerationBan, chatv1.ModerationUnban:
+		records = s.bans
+	case chatv1.ModerationAdmit, chatv1.ModerationDeny:
+		records = s.decisions
+	default:
+		return false, fmt.Errorf("%w: unknown action %q", ErrInvalidModeration, content.Action)
+	}
+	if err := s.checkIssuer(issuer); err != nil {
+		return false, err
+	}
+	if content.UserKey == "" {
+		return false, fmt.Errorf("%w: user key is required", ErrInvalidModeration)
+	}
+
+	if records == nil {
+		// 踢出操作不记录状态，仅在有效期内生效
+		return time.Since(content.IssueTime) <= KickMaxAge, nil
+	}
+	return applyRecord(records, content.UserKey, msg), nil
+}
+
+// checkIssuer 检查操作签发者是否为房间签发者或管理员
+func (s *State) checkIssuer(issuer string) error {
+	if issuer != s.authority && !s.isAdmin(issuer) {
+		return fmt.Errorf("%w: %s is not an admin", ErrUnauthorized, issuer)
+	}
+	return nil
+}
+
+// applyRecord 记录比已有记录新的操作，返回是否记录
+func applyRecord[K comparable](records map[K]*chatv1.Message, key K, msg *chatv1.Message) bool {
+	if last, ok := records[key]; ok && !msg.Content.Moderation.IssueTime.After(last.Content.Moderation.IssueTime) {
+		return false
+	}
+	records[key] = msg.DeepCopy()
+	return true
+}
+
+// lastAction 返回记录的最近操作类型，没有记录时返回空
+func lastAction[K comparable](records map[K]*chatv1.Message, key K) chatv1.ModerationAction {
+	last, ok := records[key]
+	if !ok {
+		return ""
+	}
+	return last.Content.Moderation.Action
+}
+
+// Muted 判断身份公钥指纹为 key 的用户是否被禁言
+func (s *State) Muted(key string) bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return lastAction(s.mutes, key) == chatv1.ModerationMute
+}
+
+// Banned 判断身份公钥指纹为 key 的用户是否被封禁
+func (s *State) Banned(key string) bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return lastAction(s.bans, key) == chatv1.ModerationBan
+}
+
+// HasBans 判断是否有用户被封禁
+func (s *State) HasBans() bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	for key := range s.bans {
+		if lastAction(s.bans, key) == chatv1.ModerationBan {
+			return true
+		}
+	}
+	return false
+}
+
+// Admitted 判断身份公钥指纹为 key 的用户是否被批准加入
+func (s *State) Admitted(key string) bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return lastAction(s.decisions, key) == chatv1.ModerationAdmit
+}
+
+// Denied 判断身份公钥指纹为 key 的用户是否被拒绝加入
+func (s *State) Denied(key string) bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return lastAction(s.decisions, key) == chatv1.ModerationDeny
+}
+
+// Locked 判断房间是否被锁定
+func (s *State) Locked() bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return lastAction(s.settings, settingLock) == chatv1.ModerationLock
+}
+
+// AdmissionRequired 判断房间是否开启了准入模式
+func (s *State) AdmissionRequired() bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return lastAction(s.settings, settingAdmission) == chatv1.ModerationEnableAdmission
+}
+
+// ViewerKey 返回最近的设置观察者密钥操作，没有记录时返回 nil
+func (s *State) ViewerKey() *chatv1.ModerationMessageContent {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	last, ok := s.settings[settingViewer]
+	if !ok {
+		return nil
+	}
+	return last.Content.Moderation.DeepCopy()
+}
+
+// IsAdmin 判断公钥指纹是否为管理员
+func (s *State) IsAdmin(key string) bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.isAdmin(key)
+}
+
+// isAdmin 判断公钥指纹是否为管理员
+func (s *State) isAdmin(key string) bool {
+	return lastAction(s.admins, key) == chatv1.ModerationGrantAdmin
+}
+
+// List 列出记录的管理操作，按签发时间排序
+//
+// 按顺序应用到另一个 State 可以得到相同的状态
+func (s *State) List() *chatv1.MessageList {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	ret := &chatv1.MessageList{
+		APIMeta: metav1.NewAPIMeta(chatv1.KindMessageList),
+		Items: make(
+			[]chatv1.Message, 0,
+			len(s.mutes)+len(s.bans)+len(s.decisions)+len(s.admins)+len(s.settings),
+		),
+	}
+	for _, records := range []map[string]*chatv1.Message{s.mutes, s.bans, s.decisions, s.admins, s.settings} {
+		for _, msg := range records {
+			ret.Items = append(ret.Items, *msg.DeepCopy())
+		}
+	}
+	sort.Slice(ret.Items, func(i, j int) bool {
+		return ret.Items[i].Content.Moderation.IssueTime.Before(ret.Items[j].Content.Moderation.IssueTime)
+	})
+	return ret
+}
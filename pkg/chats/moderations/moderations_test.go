@@ -0,0 +1,251 @@
+package moderations
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	chatv1 "github.com/yhlooo/bangbang/pkg/apis/chat/v1"
+	metav1 "github.com/yhlooo/bangbang/pkg/apis/meta/v1"
+	"github.com/yhlooo/bangbang/pkg/signatures"
+)
+
+// TestState 测试 State
+func TestState(t *testing.T) {
+	a := assert.New(t)
+
+	owner := newKey(t)
+	admin := newKey(t)
+	other := newKey(t)
+	userKey := fingerprint(t, newKey(t))
+
+	s := NewState(fingerprint(t, owner))
+
+	// 非管理员无权操作
+	_, err := s.Apply(newModeration(t, other, chatv1.ModerationMute, userKey, ""))
+	a.ErrorIs(err, ErrUnauthorized)
+	a.False(s.Muted(userKey))
+
+	// 房主授予管理员后管理员可以操作
+	applied, err := s.Apply(newModeration(t, owner, chatv1.ModerationGrantAdmin, "", fingerprint(t, admin)))
+	a.NoError(err)
+	a.True(applied)
+	mute := newModeration(t, admin, chatv1.ModerationMute, userKey, "")
+	applied, err = s.Apply(mute)
+	a.NoError(err)
+	a.True(applied)
+	a.True(s.Muted(userKey))
+	a.False(s.Banned(userKey))
+
+	// 管理员不能授予管理员
+	_, err = s.Apply(newModeration(t, admin, chatv1.ModerationGrantAdmin, "", fingerprint(t, other)))
+	a.ErrorIs(err, ErrUnauthorized)
+
+	// 篡改的操作
+	tampered := newModeration(t, admin, chatv1.ModerationUnmute, userKey, "")
+	tampered.Content.Moderation.UserKey = fingerprint(t, newKey(t))
+	_, err = s.Apply(tampered)
+	a.ErrorIs(err, signatures.ErrSignatureMismatch)
+
+	// 过时的操作不生效
+	unmute := newModeration(t, owner, chatv1.ModerationUnmute, userKey, "")
+	applied, err = s.Apply(unmute)
+	a.NoError(err)
+	a.True(applied)
+	a.False(s.Muted(userKey))
+	applied, err = s.Apply(mute)
+	a.NoError(err)
+	a.False(applied)
+	a.False(s.Muted(userKey))
+
+	// 过期的踢出操作不生效
+	kick := newModeration(t, owner, chatv1.ModerationKick, userKey, "")
+	applied, err = s.Apply(kick)
+	a.NoError(err)
+	a.True(applied)
+	oldKick := &chatv1.ModerationMessageContent{
+		Action:    chatv1.ModerationKick,
+		UserKey:   userKey,
+		IssueTime: time.Now().Add(-2 * KickMaxAge),
+	}
+	oldKick.Issuer, err = signatures.PublicKeyOf(owner)
+	a.NoError(err)
+	oldKick.Signature, err = signatures.ES256SignObject(owner, oldKick)
+	a.NoError(err)
+	applied, err = s.Apply(&chatv1.Message{Content: chatv1.MessageContent{Moderation: oldKick}})
+	a.NoError(err)
+	a.False(applied)
+
+	// 同步到另一个 State
+	applied, err = s.Apply(newModeration(t, admin, chatv1.ModerationBan, userKey, ""))
+	a.NoError(err)
+	a.True(applied)
+	s2 := NewState(fingerprint(t, owner))
+	for _, msg := range s.List().Items {
+		_, err := s2.Apply(&msg)
+		a.NoError(err)
+	}
+	a.True(s2.Banned(userKey))
+	a.True(s2.HasBans())
+	a.False(s2.Muted(userKey))
+	a.True(s2.IsAdmin(fingerprint(t, admin)))
+
+	// 签发者变化时清空管理员
+	s2.SetAuthority(fingerprint(t, other))
+	a.False(s2.IsAdmin(fingerprint(t, admin)))
+	a.True(s2.Banned(userKey))
+}
+
+// TestStateAdmission 测试 State 的准入和锁定
+func TestStateAdmission(t *testing.T) {
+	a := assert.New(t)
+
+	owner := newKey(t)
+	other := newKey(t)
+	userKey := fingerprint(t, newKey(t))
+	s := NewState(fingerprint(t, owner))
+	a.False(s.AdmissionRequired())
+	a.False(s.Locked())
+
+	for _, action := range []chatv1.ModerationAction{chatv1.ModerationEnableAdmission, chatv1.ModerationLock} {
+		applied, err := s.Apply(newModeration(t, owner, action, "", ""))
+		a.NoError(err)
+		a.True(applied)
+	}
+	a.True(s.AdmissionRequired())
+	a.True(s.Locked())
+
+	applied, err := s.Apply(newModeration(t, owner, chatv1.ModerationDeny, userKey, ""))
+	a.NoError(err)
+	a.True(applied)
+	a.True(s.Denied(userKey))
+	applied, err = s.Apply(newModeration(t, owner, chatv1.ModerationAdmit, userKey, ""))
+	a.NoError(err)
+	a.True(applied)
+	a.True(s.Admitted(userKey))
+	a.False(s.Denied(userKey))
+
+	// 非管理员无权解锁
+	_, err = s.Apply(newModeration(t, other, chatv1.ModerationUnlock, "", ""))
+	a.ErrorIs(err, ErrUnauthorized)
+	a.True(s.Locked())
+
+	// 签发者变化时房间设置被清空，准入保留
+	s.SetAuthority(fingerprint(t, other))
+	a.False(s.AdmissionRequired())
+	a.False(s.Locked())
+	a.True(s.Admitted(userKey))
+}
+
+// TestRekey 测试更换房间密钥操作
+func TestRekey(t *testing.T) {
+	a := assert.New(t)
+
+	owner := newKey(t)
+	admin := newKey(t)
+	s := NewState(fingerprint(t, owner))
+	_, err := s.Apply(newModeration(t, owner, chatv1.ModerationGrantAdmin, "", fingerprint(t, admin)))
+	a.NoError(err)
+
+	content, err := NewRekey(signatures.Key("1234"), signatures.Key("5678"))
+	if !a.NoError(err) {
+		return
+	}
+	a.NoError(Sign(owner, content))
+	applied, err := s.Apply(&chatv1.Message{Content: chatv1.MessageContent{Moderation: content}})
+	a.NoError(err)
+	a.True(applied)
+	a.Len(s.List().Items, 1)
+
+	// 只有持有当前密钥的成员可以得到新密钥
+	rotated, err := OpenRekey(signatures.Key("1234"), content)
+	a.NoError(err)
+	a.Equal("5678", string(rotated))
+	_, err = OpenRekey(signatures.Key("4321"), content)
+	a.Error(err)
+
+	// 管理员无权更换密钥
+	content, err = NewRekey(signatures.Key("1234"), signatures.Key("5678"))
+	a.NoError(err)
+	a.NoError(Sign(admin, content))
+	_, err = s.Apply(&chatv1.Message{Content: chatv1.MessageContent{Moderation: content}})
+	a.ErrorIs(err, ErrUnauthorized)
+}
+
+// TestViewerKey 测试设置观察者密钥操作
+func TestViewerKey(t *testing.T) {
+	a := assert.New(t)
+
+	owner := newKey(t)
+	s := NewState(fingerprint(t, owner))
+	a.Nil(s.ViewerKey())
+
+	content, err := NewViewerKey(signatures.Key("1234"), signatures.Key("0000"))
+	if !a.NoError(err) {
+		return
+	}
+	a.NoError(Sign(owner, content))
+	applied, err := s.Apply(&chatv1.Message{Content: chatv1.MessageContent{Moderation: content}})
+	a.NoError(err)
+	a.True(applied)
+
+	// 只有持有房间密钥的成员可以得到观察者密钥
+	viewerKey, err := OpenViewerKey(signatures.Key("1234"), s.ViewerKey())
+	a.NoError(err)
+	a.Equal("0000", string(viewerKey))
+	_, err = OpenViewerKey(signatures.Key("0000"), s.ViewerKey())
+	a.Error(err)
+
+	// 观察者密钥不能与房间密钥相同
+	_, err = NewViewerKey(signatures.Key("1234"), signatures.Key("1234"))
+	a.ErrorIs(err, ErrInvalidModeration)
+
+	// 更换房间密钥后观察者密钥失效
+	content, err = NewRekey(signatures.Key("1234"), signatures.Key("5678"))
+	a.NoError(err)
+	a.NoError(Sign(owner, content))
+	_, err = s.Apply(&chatv1.Message{Content: chatv1.MessageContent{Moderation: content}})
+	a.NoError(err)
+	a.Nil(s.ViewerKey())
+}
+
+// newKey 创建私钥
+func newKey(t *testing.T) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key error: %v", err)
+	}
+	return key
+}
+
+// fingerprint 返回私钥对应公钥的指纹
+func fingerprint(t *testing.T, key *ecdsa.PrivateKey) string {
+	pub, err := signatures.PublicKeyOf(key)
+	if err != nil {
+		t.Fatalf("marshal public key error: %v", err)
+	}
+	return KeyFingerprint(pub)
+}
+
+// newModeration 创建签名的管理操作消息
+func newModeration(
+	t *testing.T,
+	key *ecdsa.PrivateKey,
+	action chatv1.ModerationAction,
+	userKey string,
+	adminKey string,
+) *chatv1.Message {
+	content := &chatv1.ModerationMessageContent{Action: action, UserKey: userKey, AdminKey: adminKey}
+	if err := Sign(key, content); err != nil {
+		t.Fatalf("sign moderation error: %v", err)
+	}
+	return &chatv1.Message{
+		APIMeta:    metav1.NewAPIMeta(chatv1.KindMessage),
+		ObjectMeta: metav1.ObjectMeta{UID: metav1.NewUID()},
+		Content:    chatv1.MessageContent{Moderation: content},
+	}
+}
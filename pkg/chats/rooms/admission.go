@@ -0,0 +1,191 @@
+package rooms
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/go-logr/logr"
+
+	chatv1 "github.com/yhlooo/bangbang/pkg/apis/chat/v1"
+	metav1 "github.com/yhlooo/bangbang/pkg/apis/meta/v1"
+	"github.com/yhlooo/bangbang/pkg/servers/common"
+	"github.com/yhlooo/bangbang/pkg/signatures"
+)
+
+// admissionTimeout 等待批准加入的最长时间
+const admissionTimeout = 5 * time.Minute
+
+// checkBanned 检查身份公钥指纹为 key 的监听者是否被封禁
+//
+// 有用户被封禁时拒绝没有身份的监听者，否则被封禁的用户可以不出示身份绕过封禁
+func (r *localRoom) checkBanned(ctx context.Context, key string) error {
+	switch {
+	case key == "" && r.moderation.HasBans():
+		return common.NewForbiddenError(ctx, "identity is required when users are banned")
+	case key != "" && r.moderation.Banned(key):
+		return common.NewForbiddenError(ctx, fmt.Sprintf("user %s is banned", key))
+	}
+	return nil
+}
+
+// checkRelay 检查身份公钥指纹为 key 的监听者是否可以作为下游房间 relayRoom 转发消息
+//
+// 下游房间信息需要使用当前房间密钥签名且在时间窗口内，其房主身份需要与监听者身份一致
+func (r *localRoom) checkRelay(ctx context.Context, relayRoom *chatv1.Room, key string) error {
+	if key == "" {
+		return common.NewForbiddenError(ctx, "identity is required to relay messages")
+	}
+	now := time.Now()
+	if err := signatures.HS256VerifyAPIObject(
+		r.keys.Get().Subkey(signatures.KeyPurposeAPI), relayRoom.DeepCopy(),
+		now.Add(-r.window), now.Add(r.window),
+	); err != nil {
+		return common.NewForbiddenError(ctx, fmt.Sprintf("verify relay room %s error: %v", relayRoom.UID, err))
+	}
+	switch {
+	case relayRoom.Owner.Key != key:
+		return common.NewForbiddenError(ctx, fmt.Sprintf("relay room %s is not owned by %s", relayRoom.UID, key))
+	case relayRoom.UID == r.uid:
+		return common.NewForbiddenError(ctx, "can not relay messages of the room itself")
+	}
+	return nil
+}
+
+// admit 检查身份公钥指纹为 key 的用户是否可以加入房间
+//
+// 房间开启准入模式时发出加入请求，并等待签发者或管理员批准
+func (r *localRoom) admit(ctx context.Context, user *metav1.ObjectMeta, key string) error {
+	logger := logr.FromContextOrDiscard(ctx)
+
+	switch {
+	case key != "" && r.moderation.Admitted(key):
+		return nil
+	case r.moderation.Locked():
+		return common.NewForbiddenError(ctx, "room is locked")
+	case !r.moderation.AdmissionRequired():
+		return nil
+	case key == "":
+		return common.NewForbiddenError(ctx, "identity is required to request admission")
+	case r.moderation.Denied(key):
+		return common.NewForbiddenError(ctx, fmt.Sprintf("user %s is denied", key))
+	}
+
+	ch := make(chan bool, 1)
+	r.waitersLock.Lock()
+	if r.waiters == nil {
+		r.waiters = make(map[string][]chan bool)
+	}
+	r.waiters[key] = append(r.waiters[key], ch)
+	r.waitersLock.Unlock()
+	defer r.removeWaiter(key, ch)
+
+	// 注册后再检查一次，避免错过检查期间到达的批准
+	if r.moderation.Admitted(key) {
+		return nil
+	}
+
+	logger.Info(fmt.Sprintf("user %q (%s) is waiting for admission", user.Name, user.UID))
+	if err := r.createRoomMessage(ctx, chatv1.MessageContent{
+		JoinRequest: &chatv1.MembersChangeMessageContent{User: *user, Key: key},
+	}); err != nil {
+		return fmt.Errorf("send join request error: %w", err)
+	}
+
+	timer := time.NewTimer(admissionTimeout)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return common.NewForbiddenError(ctx, fmt.Sprintf("admission of user %s timed out", user.UID))
+	case admitted := <-ch:
+		if !admitted {
+			return common.NewForbiddenError(ctx, fmt.Sprintf("user %s is not admitted", user.UID))
+		}
+		return nil
+	}
+}
+
+// admitAnonymous 检查身份公钥指纹为 key 的匿名监听者是否可以监听
+//
+// 房间锁定或开启准入模式时，只有房主、已以成员身份加入或已被批准的身份可以匿名监听，
+// 否则不加入房间即可绕过锁定和准入
+func (r *localRoom) admitAnonymous(ctx context.Context, key string) error {
+	if !r.moderation.Locked() && !r.moderation.AdmissionRequired() {
+		return nil
+	}
+	if key != "" && (key == r.ownerKey || r.moderation.Admitted(key) || r.joined(key)) {
+		return nil
+	}
+	return common.NewForbiddenError(ctx, "room is locked or requires admission, join as a member first")
+}
+
+// joined 判断身份公钥指纹为 key 的用户是否以成员身份在房间中监听
+func (r *localRoom) joined(key string) bool {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	for ch, l := range r.channels {
+		if l.user == nil || l.key != key {
+			continue
+		}
+		select {
+		case <-ch.Done():
+		default:
+			return true
+		}
+	}
+	return false
+}
+
+// waiting 判断身份公钥指纹为 key 的用户是否在等待批准加入
+func (r *localRoom) waiting(key string) bool {
+	r.waitersLock.Lock()
+	defer r.waitersLock.Unlock()
+	return len(r.waiters[key]) > 0
+}
+
+// removeWaiter 移除等待批准加入的信道
+func (r *localRoom) removeWaiter(key string, ch chan bool) {
+	r.waitersLock.Lock()
+	defer r.waitersLock.Unlock()
+	r.waiters[key] = slices.DeleteFunc(r.waiters[key], func(c chan bool) bool { return c == ch })
+	if len(r.waiters[key]) == 0 {
+		delete(r.waiters, key)
+	}
+}
+
+// notifyWaiters 根据管理操作通知等待批准加入的用户
+func (r *localRoom) notifyWaiters(mod *chatv1.ModerationMessageContent) {
+	var (
+		all      bool
+		admitted bool
+	)
+	switch mod.Action {
+	case chatv1.ModerationAdmit:
+		admitted = true
+	case chatv1.ModerationDeny, chatv1.ModerationBan:
+	case chatv1.ModerationDisableAdmission:
+		all, admitted = true, true
+	case chatv1.ModerationLock:
+		all = true
+	default:
+		return
+	}
+
+	r.waitersLock.Lock()
+	defer r.waitersLock.Unlock()
+	for key, chs := range r.waiters {
+		if !all && key != mod.UserKey {
+			continue
+		}
+		for _, ch := range chs {
+			select {
+			case ch <- admitted:
+			default:
+			}
+		}
+		delete(r.waiters, key)
+	}
+}
@@ -0,0 +1,137 @@
+package rooms
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// RateLimits 按发送人限制消息的选项，各项为 0 时不限制
+type RateLimits struct {
+	// 单条消息 JSON 序列化后的最大字节数
+	MaxMessageBytes int
+	// 每个发送人每秒允许的消息数
+	MessageRate float64
+	// 每个发送人允许的突发消息数
+	MessageBurst int
+	// 每个发送人每秒允许的字节数
+	ByteRate float64
+	// 每个发送人允许的突发字节数
+	ByteBurst int
+}
+
+// DefaultRateLimits 默认的消息限制
+var DefaultRateLimits = RateLimits{
+	MaxMessageBytes: 16 << 10,
+	MessageRate:     5,
+	MessageBurst:    20,
+	ByteRate:        16 << 10,
+	ByteBurst:       64 << 10,
+}
+
+// maxSenders 记录的最大发送人数
+const maxSenders = 4096
+
+var (
+	// errMessageTooLarge 消息过大
+	errMessageTooLarge = errors.New("message too large")
+	// errRateLimited 超过发送人速率限制
+	errRateLimited = errors.New("rate limited")
+)
+
+// newSenderLimiter 创建按发送人限制消息的限制器
+func newSenderLimiter(limits RateLimits) *senderLimiter {
+	// 突发量至少允许一条消息
+	if limits.MessageRate > 0 && limits.MessageBurst < 1 {
+		limits.MessageBurst = 1
+	}
+	if limits.ByteRate > 0 && limits.ByteBurst < max(limits.MaxMessageBytes, 1) {
+		limits.ByteBurst = max(limits.MaxMessageBytes, 1)
+	}
+	return &senderLimiter{
+		limits:  limits,
+		senders: map[string]*senderState{},
+	}
+}
+
+// senderLimiter 按发送人限制消息的限制器
+//
+// 发送人为校验过的身份公钥指纹，每个发送人的消息数和字节数各有独立的令牌桶
+type senderLimiter struct {
+	limits RateLimits
+
+	lock    sync.Mutex
+	senders map[string]*senderState
+}
+
+// senderState 发送人状态
+type senderState struct {
+	messages float64
+	bytes    float64
+	last     time.Time
+}
+
+// Allow 检查发送人 sender 是否可以发送 size 字节的消息，允许时消耗令牌
+func (l *senderLimiter) Allow(sender string, size int, now time.Time) error {
+	if l.limits.MaxMessageBytes > 0 && size > l.limits.MaxMessageBytes {
+		return fmt.Errorf("%w: %d bytes (> %d)", errMessageTooLarge, size, l.limits.MaxMessageBytes)
+	}
+	if l.limits.ByteRate > 0 && size > l.limits.ByteBurst {
+		// 超过突发字节数的消息永远无法发送
+		return fmt.Errorf("%w: %d bytes (> %d)", errMessageTooLarge, size, l.limits.ByteBurst)
+	}
+	if l.limits.MessageRate <= 0 && l.limits.ByteRate <= 0 {
+		return nil
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	s := l.get(sender, now)
+	elapsed := now.Sub(s.last).Seconds()
+	s.messages = min(s.messages+elapsed*l.limits.MessageRate, float64(l.limits.MessageBurst))
+	s.bytes = min(s.bytes+elapsed*l.limits.ByteRate, float64(l.limits.ByteBurst))
+	s.last = now
+	if l.limits.MessageRate > 0 && s.messages < 1 {
+		return fmt.Errorf("%w: more than %g messages per second from %s", errRateLimited, l.limits.MessageRate, sender)
+	}
+	if l.limits.ByteRate > 0 && s.bytes < float64(size) {
+		return fmt.Errorf("%w: more than %g bytes per second from %s", errRateLimited, l.limits.ByteRate, sender)
+	}
+	s.messages--
+	s.bytes -= float64(size)
+	return nil
+}
+
+// get 获取发送人状态，不存在时创建
+func (l *senderLimiter) get(sender string, now time.Time) *senderState {
+	s, ok := l.senders[sender]
+	if ok {
+		return s
+	}
+	if len(l.senders) >= maxSenders {
+		l.prune(now)
+	}
+	s = &senderState{
+		messages: float64(l.limits.MessageBurst),
+		bytes:    float64(l.limits.ByteBurst),
+		last:     now,
+	}
+	l.senders[sender] = s
+	return s
+}
+
+// prune 清理令牌已满的发送人，仍然过多时清空
+func (l *senderLimiter) prune(now time.Time) {
+	for sender, s := range l.senders {
+		elapsed := now.Sub(s.last).Seconds()
+		if s.messages+elapsed*l.limits.MessageRate >= float64(l.limits.MessageBurst) &&
+			s.bytes+elapsed*l.limits.ByteRate >= float64(l.limits.ByteBurst) {
+			delete(l.senders, sender)
+		}
+	}
+	if len(l.senders) >= maxSenders {
+		clear(l.senders)
+	}
+}
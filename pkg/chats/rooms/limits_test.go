@@ -0,0 +1,45 @@
+package rooms
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestSenderLimiter 测试 senderLimiter
+func TestSenderLimiter(t *testing.T) {
+	a := assert.New(t)
+
+	l := newSenderLimiter(RateLimits{
+		MaxMessageBytes: 100,
+		MessageRate:     1,
+		MessageBurst:    3,
+		ByteRate:        100,
+		ByteBurst:       200,
+	})
+	now := time.Now()
+	alice, bob := "sha256:alice", "sha256:bob"
+
+	// 消息大小
+	a.ErrorIs(l.Allow(alice, 101, now), errMessageTooLarge)
+
+	// 消息数令牌桶
+	for i := 0; i < 3; i++ {
+		a.NoError(l.Allow(alice, 10, now))
+	}
+	a.ErrorIs(l.Allow(alice, 10, now), errRateLimited)
+	a.NoError(l.Allow(bob, 10, now))
+	a.NoError(l.Allow(alice, 10, now.Add(time.Second)))
+
+	// 字节数令牌桶
+	a.NoError(l.Allow(bob, 100, now))
+	a.ErrorIs(l.Allow(bob, 100, now), errRateLimited)
+	a.NoError(l.Allow(bob, 100, now.Add(time.Second)))
+
+	// 不限制
+	l = newSenderLimiter(RateLimits{})
+	for i := 0; i < 100; i++ {
+		a.NoError(l.Allow(alice, 1<<20, now))
+	}
+}
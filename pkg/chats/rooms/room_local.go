@@ -1,28 +1,58 @@
 package rooms
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/go-logr/logr"
 
 	chatv1 "github.com/yhlooo/bangbang/pkg/apis/chat/v1"
 	metav1 "github.com/yhlooo/bangbang/pkg/apis/meta/v1"
+	"github.com/yhlooo/bangbang/pkg/audit"
 	"github.com/yhlooo/bangbang/pkg/chats/channels"
+	"github.com/yhlooo/bangbang/pkg/chats/moderations"
 	"github.com/yhlooo/bangbang/pkg/deduplicators"
+	"github.com/yhlooo/bangbang/pkg/servers/common"
 	"github.com/yhlooo/bangbang/pkg/signatures"
 )
 
+// LocalRoomOptions 本地房间选项
+type LocalRoomOptions struct {
+	// 房主身份公钥指纹，房间没有上游时有权签发管理操作，为空时不接受管理操作
+	OwnerKey string
+	// 按发送人限制消息，零值表示不限制
+	Limits RateLimits
+	// 消息签名时间窗口，为 0 时使用 DefaultMessageWindow
+	MessageWindow time.Duration
+	// 持有只读观察者密钥，房间签发者设置或关闭观察者时更新，为 nil 时不处理
+	ViewerKeys *signatures.KeyHolder
+}
+
 // NewLocalRoom 创建本地房间实例
-func NewLocalRoom(key signatures.Key, ownerUID metav1.UID, ownerName string) RoomWithUpstream {
+//
+// keys 持有房间密钥，房间签发者更换密钥时会被设置为新密钥
+func NewLocalRoom(keys *signatures.KeyHolder, ownerUID metav1.UID, ownerName string, opts LocalRoomOptions) RoomWithUpstream {
+	if opts.MessageWindow <= 0 {
+		opts.MessageWindow = DefaultMessageWindow
+	}
 	return &localRoom{
-		uid:          metav1.NewUID(),
-		ownerUID:     ownerUID,
-		ownerName:    ownerName,
-		key:          key.Copy(),
-		deduplicator: deduplicators.NewBloomFilter(500, 0.001),
+		uid:        metav1.NewUID(),
+		ownerUID:   ownerUID,
+		ownerName:  ownerName,
+		ownerKey:   opts.OwnerKey,
+		keys:       keys,
+		viewerKeys: opts.ViewerKeys,
+		window:     opts.MessageWindow,
+		// 签名时间最晚为当前时间加窗口，在此之前都需要能识别出重复的消息
+		deduplicator: deduplicators.NewTimeWindow(2 * opts.MessageWindow),
+		moderation:   moderations.NewState(opts.OwnerKey),
+		limiter:      newSenderLimiter(opts.Limits),
 	}
 }
 
@@ -31,14 +61,44 @@ type localRoom struct {
 	uid       metav1.UID
 	ownerUID  metav1.UID
 	ownerName string
-	key       signatures.Key
+	ownerKey  string
+	keys      *signatures.KeyHolder
+	// 只读观察者密钥
+	viewerKeys *signatures.KeyHolder
+	// 消息签名时间窗口
+	window time.Duration
 
 	lock sync.RWMutex
 
 	closed       bool
-	channels     map[channels.ChannelWithSender]*metav1.ObjectMeta
+	channels     map[channels.ChannelWithSender]*listener
 	upstream     Room
 	deduplicator deduplicators.Deduplicator
+	// 已从上游收到或已转发给上游的消息
+	upstreamDeduplicator deduplicators.Deduplicator
+	// 设置上游时上游房间的深度
+	upstreamDepth int
+	// 管理状态，有上游时签发者为上游的签发者
+	moderation *moderations.State
+	// 按发送人限制消息的限制器
+	limiter *senderLimiter
+
+	membersLock sync.Mutex
+	members     map[metav1.UID]chatv1.User
+
+	// 等待批准加入的用户身份公钥指纹及通知其结果的信道
+	waitersLock sync.Mutex
+	waiters     map[string][]chan bool
+}
+
+// listener 监听房间消息的信道信息
+type listener struct {
+	// 以成员身份加入时的用户，匿名监听时为 nil
+	user *metav1.ObjectMeta
+	// 监听者的身份公钥指纹，没有时为空
+	key string
+	// 是否为下游房间转发消息的连接，下游房间的房主身份与监听者身份一致
+	relay bool
 }
 
 var _ RoomWithUpstream = (*localRoom)(nil)
@@ -56,51 +116,370 @@ func (r *localRoom) Info(_ context.Context) (*chatv1.Room, error) {
 				UID:  r.ownerUID,
 				Name: r.ownerName,
 			},
+			Key: r.ownerKey,
 		},
+		Authority: r.moderation.Authority(),
 	}
-	if err := signatures.HS256SignAPIObject(r.key, info); err != nil {
+	r.lock.RLock()
+	if r.upstream != nil {
+		info.Depth = r.upstreamDepth + 1
+	}
+	r.lock.RUnlock()
+	if err := signatures.HS256SignAPIObject(r.keys.Get().Subkey(signatures.KeyPurposeAPI), info); err != nil {
 		return nil, fmt.Errorf("sign room info error: %w", err)
 	}
 
 	return info, nil
 }
 
+// ListMembers 列出房间成员
+//
+// NOTE: 成员根据经过该房间的成员加入、离开消息统计，在接入上游前加入其它房间的成员可能不在其中
+func (r *localRoom) ListMembers(_ context.Context) (*chatv1.UserList, error) {
+	r.membersLock.Lock()
+	defer r.membersLock.Unlock()
+
+	ret := &chatv1.UserList{
+		APIMeta: metav1.NewAPIMeta(chatv1.KindUserList),
+		Items:   make([]chatv1.User, 0, len(r.members)),
+	}
+	for _, member := range r.members {
+		ret.Items = append(ret.Items, *member.DeepCopy())
+	}
+	sort.Slice(ret.Items, func(i, j int) bool {
+		return ret.Items[i].UID.String() < ret.Items[j].UID.String()
+	})
+
+	return ret, nil
+}
+
+// ListModerations 列出生效的管理操作
+func (r *localRoom) ListModerations(_ context.Context) (*chatv1.MessageList, error) {
+	return r.moderation.List(), nil
+}
+
+// updateMembers 根据成员变化消息更新成员列表
+func (r *localRoom) updateMembers(msg *chatv1.Message) {
+	if msg.Content.Join == nil && msg.Content.Leave == nil {
+		return
+	}
+
+	r.membersLock.Lock()
+	defer r.membersLock.Unlock()
+
+	if r.members == nil {
+		r.members = make(map[metav1.UID]chatv1.User)
+	}
+	if join := msg.Content.Join; join != nil {
+		r.members[join.User.UID] = chatv1.User{
+			APIMeta:    metav1.NewAPIMeta(chatv1.KindUser),
+			ObjectMeta: *join.User.DeepCopy(),
+			Key:        join.Key,
+		}
+	}
+	if msg.Content.Leave != nil {
+		delete(r.members, msg.Content.Leave.User.UID)
+	}
+}
+
 // CreateMessage 创建消息
 func (r *localRoom) CreateMessage(ctx context.Context, msg *chatv1.Message) error {
 	logger := logr.FromContextOrDiscard(ctx)
 
-	r.lock.RLock()
-	defer r.lock.RUnlock()
-
+	// 校验签名，拒绝签名时间在窗口外的消息，避免旧消息被重放
 	if msg.UID.IsNil() {
-		msg.UID = metav1.NewUID()
+		return common.NewBadRequestError(ctx, "message uid is required")
+	}
+	// 校验时会临时修改消息，消息可能同时被其它通道读取，因此校验其副本
+	key := r.keys.Get()
+	now := time.Now()
+	if err := signatures.HS256VerifyAPIObject(
+		key.Subkey(signatures.KeyPurposeAPI), msg.DeepCopy(),
+		now.Add(-r.window), now.Add(r.window),
+	); err != nil {
+		return common.NewForbiddenError(ctx, fmt.Sprintf("verify message %s error: %v", msg.UID, err))
 	}
 
-	// 去重
-	if r.deduplicator.Duplicate(msg.UID[:]) {
+	// 已经收到过的消息不再检查，但在通过所有检查后才记录，被拒绝的消息重试时不会被当作重复的消息丢弃
+	if r.deduplicator.Seen(msg.UID[:]) {
 		logger.V(1).Info(fmt.Sprintf("duplicated message: %s", msg.UID))
 		return nil
 	}
 
-	if r.closed {
+	r.lock.RLock()
+	closed := r.closed
+	r.lock.RUnlock()
+	if closed {
 		return fmt.Errorf("room already closed")
 	}
 
+	// 校验发送人身份，管理操作的发送人为其签发者
+	fromRoom := fromTrustedRoom(ctx)
+	var sender string
+	if mod := msg.Content.Moderation; mod != nil {
+		issuer, err := moderations.Verify(mod)
+		if err != nil {
+			return common.NewForbiddenError(ctx, fmt.Sprintf("verify moderation %s error: %v", msg.UID, err))
+		}
+		sender = issuer
+	} else {
+		var err error
+		if sender, err = r.checkSender(ctx, msg, fromRoom || r.fromRelayLink(ctx)); err != nil {
+			return err
+		}
+	}
+
+	// 按发送人身份限制消息大小和速率。房间自己产生和来自上游的消息已经检查过，
+	// 下游房间转发连接转发的成员变化消息没有发送人身份，不限制，否则成员集中加入时会在下一跳被丢弃
+	if !fromRoom && sender != "" {
+		if err := r.checkLimits(ctx, msg, sender); err != nil {
+			return err
+		}
+	}
+
+	// 管理操作
+	var newKey signatures.Key
+	if msg.Content.Moderation != nil {
+		applied, err := r.moderation.Apply(msg)
+		if err != nil {
+			return common.NewForbiddenError(ctx, err.Error())
+		}
+		if !applied {
+			logger.V(1).Info(fmt.Sprintf("outdated moderation: %s", msg.UID))
+			return nil
+		}
+		if msg.Content.Moderation.Action == chatv1.ModerationRekey {
+			newKey, err = moderations.OpenRekey(key, msg.Content.Moderation)
+			if err != nil {
+				return common.NewForbiddenError(ctx, err.Error())
+			}
+		}
+		r.notifyWaiters(msg.Content.Moderation)
+		recordModeration(ctx, msg.Content.Moderation)
+	}
+
+	// 去重，同一消息可能同时从多个连接到达
+	if r.deduplicator.Duplicate(msg.UID[:]) {
+		logger.V(1).Info(fmt.Sprintf("duplicated message: %s", msg.UID))
+		return nil
+	}
+
+	r.updateMembers(msg)
+
 	// 发送到各通道
+	r.lock.RLock()
 	for ch := range r.channels {
 		if err := ch.Send(msg); err != nil && !errors.Is(err, channels.ErrChannelClosed) {
 			logger.Error(err, "send message to channel error")
 		}
 	}
 
+	// 踢出或封禁时关闭用户的所有通道，包括其房间转发消息的连接
+	if mod := msg.Content.Moderation; mod != nil &&
+		(mod.Action == chatv1.ModerationKick || mod.Action == chatv1.ModerationBan) {
+		for ch, l := range r.channels {
+			if l.key != "" && l.key == mod.UserKey {
+				logger.Info(fmt.Sprintf("close channel of user %s: %s", mod.UserKey, mod.Action))
+				_ = ch.Close()
+			}
+		}
+	}
+	upstream, upstreamDeduplicator := r.upstream, r.upstreamDeduplicator
+	r.lock.RUnlock()
+
+	// 使用旧密钥签名的更换密钥消息已发送给各通道，之后改用新密钥，只持有旧密钥的节点无法再加入房间或发送消息
+	if newKey != nil {
+		// 上游仍使用旧密钥，切换前同步转发，否则转发时使用新密钥建立的连接会被上游拒绝。
+		// 转发是网络请求，不持有锁，避免上游响应慢时阻塞房间的其它操作
+		if upstream != nil && !upstreamDeduplicator.Duplicate(msg.UID[:]) {
+			if err := upstream.CreateMessage(ctx, msg); err != nil {
+				logger.Error(err, "forward rekey to upstream error")
+			}
+		}
+		logger.Info(fmt.Sprintf("room key changed by %s", msg.UID))
+		r.keys.Set(newKey)
+	}
+	if mod := msg.Content.Moderation; mod != nil &&
+		(mod.Action == chatv1.ModerationSetViewerKey || mod.Action == chatv1.ModerationRekey) {
+		r.lock.RLock()
+		r.syncViewerKey(ctx)
+		r.lock.RUnlock()
+	}
+
 	return nil
 }
 
+// recordModeration 将踢出、封禁和更换密钥记录为安全事件
+func recordModeration(ctx context.Context, mod *chatv1.ModerationMessageContent) {
+	var eventType audit.EventType
+	switch mod.Action {
+	case chatv1.ModerationKick:
+		eventType = audit.EventUserKicked
+	case chatv1.ModerationBan:
+		eventType = audit.EventUserBanned
+	case chatv1.ModerationRekey:
+		audit.FromContext(ctx).Record(audit.EventRoomRekeyed, fmt.Sprintf(
+			"room key changed by %s", moderations.KeyFingerprint(mod.Issuer),
+		))
+		return
+	default:
+		return
+	}
+	message := fmt.Sprintf(
+		"user %s (%s, key %s) by %s",
+		mod.User.Name, mod.User.UID, mod.UserKey, moderations.KeyFingerprint(mod.Issuer),
+	)
+	if mod.Reason != "" {
+		message += ": " + mod.Reason
+	}
+	audit.FromContext(ctx).Record(eventType, message)
+}
+
+// fromTrustedRoom 判断 ctx 对应的消息是否由房间自己产生或来自上游房间
+func fromTrustedRoom(ctx context.Context) bool {
+	trusted, _ := ctx.Value(trustedOriginContextKey{}).(bool)
+	return trusted
+}
+
+// fromRelayLink 判断 ctx 对应的消息是否来自经过校验的下游房间转发连接
+func (r *localRoom) fromRelayLink(ctx context.Context) bool {
+	key := common.ClientKeyFromContext(ctx)
+	if key == "" {
+		return false
+	}
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	for ch, l := range r.channels {
+		if !l.relay || l.key != key {
+			continue
+		}
+		select {
+		case <-ch.Done():
+		default:
+			return true
+		}
+	}
+	return false
+}
+
+type trustedOriginContextKey struct{}
+
+// newTrustedOriginContext 返回标记消息由房间自己产生或来自上游房间的上下文
+func newTrustedOriginContext(parent context.Context) context.Context {
+	return context.WithValue(parent, trustedOriginContextKey{}, true)
+}
+
+// checkSender 检查消息发送人是否可以发送该消息，返回校验过的发送人身份公钥指纹
+//
+// 成员变化消息只接受来自可信来源 trusted 的（此时返回空），或者由成员自己的身份签名的。
+// 其它消息需要有效的身份签名，按发送人身份公钥指纹检查其是否被封禁、禁言或在等待批准
+func (r *localRoom) checkSender(ctx context.Context, msg *chatv1.Message, trusted bool) (string, error) {
+	content := &msg.Content
+	if content.Text == nil && content.Encrypted == nil && content.SenderKey == nil {
+		var change *chatv1.MembersChangeMessageContent
+		for _, c := range []*chatv1.MembersChangeMessageContent{content.Join, content.Leave, content.JoinRequest} {
+			if c != nil {
+				change = c
+				break
+			}
+		}
+		var key string
+		if !trusted {
+			// 否则任何持有 PIN 的人都可以伪造其他成员离开，使其他成员轮换发送者密钥时排除该成员
+			var err error
+			key, err = VerifySender(msg)
+			if err != nil {
+				return "", common.NewForbiddenError(ctx, fmt.Sprintf("verify sender of message %s error: %v", msg.UID, err))
+			}
+			if change == nil || change.Key != key {
+				return "", common.NewForbiddenError(ctx, fmt.Sprintf(
+					"members change %s must be sent by a room or the user itself", msg.UID,
+				))
+			}
+		}
+		if change != nil && content.Leave == nil && change.Key != "" && r.moderation.Banned(change.Key) {
+			return "", common.NewForbiddenError(ctx, fmt.Sprintf("user %s is banned", change.Key))
+		}
+		return key, nil
+	}
+
+	key, err := VerifySender(msg)
+	if err != nil {
+		return "", common.NewForbiddenError(ctx, fmt.Sprintf("verify sender of message %s error: %v", msg.UID, err))
+	}
+	if content.SenderKey != nil && !bytes.Equal(content.SenderKey.Issuer, msg.FromKey) {
+		return "", common.NewForbiddenError(ctx, fmt.Sprintf("sender key of message %s is not issued by its sender", msg.UID))
+	}
+	if r.moderation.Banned(key) || r.waiting(key) ||
+		// 被禁言的用户仍需要分发发送者密钥才能收到其它成员的密钥
+		(r.moderation.Muted(key) && content.SenderKey == nil) {
+		return "", common.NewForbiddenError(ctx, fmt.Sprintf("user %s (%s) is not allowed to send messages", msg.From.UID, key))
+	}
+	return key, nil
+}
+
+// checkLimits 检查消息是否超过身份公钥指纹为 sender 的发送人的消息大小和速率限制
+func (r *localRoom) checkLimits(ctx context.Context, msg *chatv1.Message, sender string) error {
+	raw := msg.RawJSON()
+	if len(raw) == 0 {
+		var err error
+		if raw, err = json.Marshal(msg); err != nil {
+			return fmt.Errorf("marshal message to json error: %w", err)
+		}
+	}
+	err := r.limiter.Allow(sender, len(raw), time.Now())
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, errMessageTooLarge):
+		return common.NewRequestEntityTooLargeError(ctx, err.Error())
+	case errors.Is(err, errRateLimited):
+		return common.NewTooManyRequestsError(ctx, err.Error())
+	default:
+		return err
+	}
+}
+
 // Listen 获取监听消息的信道
+//
+// 监听者的身份为 ctx 中的客户端身份公钥指纹，被封禁的身份不能监听。
+// 房间锁定或开启准入模式时，匿名监听者只能是房主、已加入或已被批准的身份。
+// ctx 中带有下游房间信息时作为该房间的转发连接，同样检查封禁和准入
 func (r *localRoom) Listen(
 	ctx context.Context,
 	user *metav1.ObjectMeta,
 ) (channels.Channel, error) {
+	l := &listener{
+		key: common.ClientKeyFromContext(ctx),
+	}
+	if user != nil {
+		userCopy := *user
+		l.user = &userCopy
+	}
+
+	// 检查用户是否可以加入
+	if relayRoom := common.RelayRoomFromContext(ctx); relayRoom != nil {
+		if err := r.checkRelay(ctx, relayRoom, l.key); err != nil {
+			return nil, err
+		}
+		l.relay = true
+	}
+	if err := r.checkBanned(ctx, l.key); err != nil {
+		return nil, err
+	}
+	if user != nil {
+		if err := r.admit(ctx, user, l.key); err != nil {
+			return nil, err
+		}
+	} else if err := r.admitAnonymous(ctx, l.key); err != nil {
+		return nil, err
+	}
+
+	return r.listen(ctx, l)
+}
+
+// listen 不经检查注册监听消息的信道
+func (r *localRoom) listen(ctx context.Context, l *listener) (channels.Channel, error) {
 	logger := logr.FromContextOrDiscard(ctx)
 
 	r.lock.Lock()
@@ -111,19 +490,15 @@ func (r *localRoom) Listen(
 	}
 
 	if r.channels == nil {
-		r.channels = make(map[channels.ChannelWithSender]*metav1.ObjectMeta)
+		r.channels = make(map[channels.ChannelWithSender]*listener)
 	}
 	msgCh := channels.NewLocalChannel(10)
-	r.channels[msgCh] = nil
-	if user != nil {
-		userCopy := *user
-		r.channels[msgCh] = &userCopy
+	r.channels[msgCh] = l
+	if l.user != nil {
 		go func() {
 			<-msgCh.Done()
-			_ = r.CreateMessage(context.Background(), &chatv1.Message{
-				APIMeta: metav1.NewAPIMeta(chatv1.KindMessage),
-				From:    metav1.ObjectMeta{UID: r.uid},
-				Content: chatv1.MessageContent{Leave: &chatv1.MembersChangeMessageContent{User: userCopy}},
+			_ = r.createRoomMessage(context.Background(), chatv1.MessageContent{
+				Leave: &chatv1.MembersChangeMessageContent{User: *l.user, Key: l.key},
 			})
 		}()
 	}
@@ -139,11 +514,9 @@ func (r *localRoom) Listen(
 
 	r.lock.Unlock()
 
-	if user != nil {
-		if err := r.CreateMessage(ctx, &chatv1.Message{
-			APIMeta: metav1.NewAPIMeta(chatv1.KindMessage),
-			From:    metav1.ObjectMeta{UID: r.uid},
-			Content: chatv1.MessageContent{Join: &chatv1.MembersChangeMessageContent{User: *user}},
+	if l.user != nil {
+		if err := r.createRoomMessage(ctx, chatv1.MessageContent{
+			Join: &chatv1.MembersChangeMessageContent{User: *l.user, Key: l.key},
 		}); err != nil {
 			logger.Error(err, "send member join message error")
 		}
@@ -152,6 +525,19 @@ func (r *localRoom) Listen(
 	return msgCh, nil
 }
 
+// createRoomMessage 以房间自己的名义签名并创建消息
+func (r *localRoom) createRoomMessage(ctx context.Context, content chatv1.MessageContent) error {
+	msg := &chatv1.Message{
+		APIMeta: metav1.NewAPIMeta(chatv1.KindMessage),
+		From:    metav1.ObjectMeta{UID: r.uid},
+		Content: content,
+	}
+	if err := SignMessage(r.keys.Get(), msg); err != nil {
+		return err
+	}
+	return r.CreateMessage(newTrustedOriginContext(ctx), msg)
+}
+
 // Close 关闭
 func (r *localRoom) Close(_ context.Context) error {
 	r.lock.Lock()
@@ -176,29 +562,88 @@ func (r *localRoom) Upstream() Room {
 func (r *localRoom) SetUpstream(ctx context.Context, room Room) error {
 	logger := logr.FromContextOrDiscard(ctx)
 
-	r.lock.Lock()
-	defer r.lock.Unlock()
-
-	upstream := r.upstream
-	if upstream != nil {
-		_ = upstream.Close(ctx)
-	}
-
+	// 先不持有锁从上游获取房间信息、管理操作和成员，避免上游响应慢时阻塞房间的其它操作
 	info, err := room.Info(ctx)
 	if err != nil {
 		return fmt.Errorf("get upstream room info error: %w", err)
 	}
-
 	logger.V(1).Info(fmt.Sprintf("set upstream: %s", info.UID))
+	moderationList, err := room.ListModerations(ctx)
+	if err != nil {
+		logger.Error(err, "list upstream moderations error")
+	}
+	members, err := room.ListMembers(ctx)
+	if err != nil {
+		logger.Error(err, "list upstream members error")
+	}
+
+	r.lock.Lock()
+	oldUpstream := r.upstream
+
+	// 使用上游的管理状态
+	r.moderation.SetAuthority(info.Authority)
+	if moderationList != nil {
+		for i := range moderationList.Items {
+			if _, err := r.moderation.Apply(&moderationList.Items[i]); err != nil {
+				logger.Error(err, fmt.Sprintf("apply upstream moderation %s error", moderationList.Items[i].UID))
+			}
+		}
+	}
+	r.syncViewerKey(ctx)
+
+	// 合并上游已知的成员
+	if members != nil {
+		r.membersLock.Lock()
+		if r.members == nil {
+			r.members = make(map[metav1.UID]chatv1.User)
+		}
+		for _, member := range members.Items {
+			r.members[member.UID] = *member.DeepCopy()
+		}
+		r.membersLock.Unlock()
+	}
+
 	r.upstream = room
+	r.upstreamDepth = info.Depth
 	upstreamDeduplicator := deduplicators.NewBloomFilter(500, 0.001)
-	done := make(chan struct{})
-	go r.listenUpstream(ctx, r.upstream, done, upstreamDeduplicator)
-	go r.forwardToUpstream(ctx, r.upstream, done, upstreamDeduplicator)
+	r.upstreamDeduplicator = upstreamDeduplicator
+	go r.listenUpstream(ctx, room, upstreamDeduplicator)
+	r.lock.Unlock()
+
+	// 旧上游的监听在关闭后结束，此时上游已经替换，不会重置管理状态
+	if oldUpstream != nil && oldUpstream != room {
+		_ = oldUpstream.Close(ctx)
+	}
 
 	return nil
 }
 
+// syncViewerKey 根据管理状态中的设置更新观察者密钥
+func (r *localRoom) syncViewerKey(ctx context.Context) {
+	if r.viewerKeys == nil {
+		return
+	}
+	logger := logr.FromContextOrDiscard(ctx)
+
+	var viewerKey signatures.Key
+	if content := r.moderation.ViewerKey(); content != nil {
+		var err error
+		viewerKey, err = moderations.OpenViewerKey(r.keys.Get(), content)
+		if err != nil {
+			logger.Error(err, "open viewer key error")
+		}
+	}
+	if bytes.Equal(viewerKey, r.viewerKeys.Get()) {
+		return
+	}
+	if viewerKey == nil {
+		logger.Info("viewer key disabled")
+	} else {
+		logger.Info("viewer key changed")
+	}
+	r.viewerKeys.Set(viewerKey)
+}
+
 // forwardToUpstream 转发消息给上游
 func (r *localRoom) forwardToUpstream(
 	ctx context.Context,
@@ -212,12 +657,14 @@ func (r *localRoom) forwardToUpstream(
 		r.lock.Lock()
 		if r.upstream == upstream {
 			r.upstream = nil
+			r.moderation.SetAuthority(r.ownerKey)
+			r.syncViewerKey(ctx)
 		}
 		r.lock.Unlock()
 		_ = upstream.Close(ctx)
 	}()
 
-	ch, err := r.Listen(ctx, nil)
+	ch, err := r.listen(ctx, &listener{})
 	if err != nil {
 		logger.Error(err, "listen error")
 		return
@@ -245,35 +692,49 @@ func (r *localRoom) forwardToUpstream(
 	}
 }
 
-// listenUpstream 监听上游房间
+// listenUpstream 监听上游房间，建立转发连接后开始转发消息给上游
 func (r *localRoom) listenUpstream(
 	ctx context.Context,
 	upstream Room,
-	done chan<- struct{},
 	upstreamDeduplicator deduplicators.Deduplicator,
 ) {
 	logger := logr.FromContextOrDiscard(ctx)
 
+	done := make(chan struct{})
 	defer func() {
 		r.lock.Lock()
 		if r.upstream == upstream {
 			r.upstream = nil
+			r.moderation.SetAuthority(r.ownerKey)
+			r.syncViewerKey(ctx)
 		}
 		r.lock.Unlock()
 		close(done)
 		_ = upstream.Close(ctx)
 	}()
 
-	ch, err := upstream.Listen(ctx, &metav1.ObjectMeta{UID: r.ownerUID, Name: r.ownerName})
+	// 以转发连接监听上游，带上签名的房间信息证明房主身份对应的房间
+	info, err := r.Info(ctx)
+	if err != nil {
+		logger.Error(err, "get room info error")
+		return
+	}
+	listenCTX := common.NewContextWithRelayRoom(common.NewContextWithClientKey(ctx, r.ownerKey), info)
+	ch, err := upstream.Listen(listenCTX, &metav1.ObjectMeta{UID: r.ownerUID, Name: r.ownerName})
 	if err != nil {
 		logger.Error(err, "listen upstream error")
 		return
 	}
 	defer func() { _ = ch.Close() }()
 
+	// 上游只接受经过转发连接转发的成员变化消息，因此在建立转发连接后再开始转发
+	go r.forwardToUpstream(ctx, upstream, done, upstreamDeduplicator)
+
+	// 上游房间收到的消息已经过上游检查
+	createCTX := newTrustedOriginContext(ctx)
 	for msg := range ch.Messages() {
 		upstreamDeduplicator.Duplicate(msg.UID[:])
-		if err := r.CreateMessage(ctx, msg); err != nil {
+		if err := r.CreateMessage(createCTX, msg); err != nil {
 			logger.Error(err, "create message error")
 		}
 	}
@@ -0,0 +1,536 @@
+package rooms
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	chatv1 "github.com/yhlooo/bangbang/pkg/apis/chat/v1"
+	metav1 "github.com/yhlooo/bangbang/pkg/apis/meta/v1"
+	"github.com/yhlooo/bangbang/pkg/chats/channels"
+	"github.com/yhlooo/bangbang/pkg/chats/moderations"
+	"github.com/yhlooo/bangbang/pkg/servers/common"
+	"github.com/yhlooo/bangbang/pkg/signatures"
+)
+
+// TestLocalRoom_CreateMessage_Replay 测试本地房间拒绝未签名、窗口外和重放的消息
+func TestLocalRoom_CreateMessage_Replay(t *testing.T) {
+	a := assert.New(t)
+	ctx := context.Background()
+
+	key := signatures.Key("1234")
+	identity := newIdentity(t)
+	room := NewLocalRoom(signatures.NewKeyHolder(key), metav1.NewUID(), "owner",
+		LocalRoomOptions{MessageWindow: time.Minute})
+	ch, err := room.Listen(ctx, nil)
+	if !a.NoError(err) {
+		return
+	}
+	defer func() { _ = ch.Close() }()
+
+	newMessage := func() *chatv1.Message {
+		return &chatv1.Message{
+			APIMeta: metav1.NewAPIMeta(chatv1.KindMessage),
+			From:    metav1.ObjectMeta{UID: metav1.NewUID()},
+			Content: chatv1.MessageContent{Text: &chatv1.TextMessageContent{Content: "hello"}},
+		}
+	}
+
+	// 签名的消息被接受，重放的消息被忽略
+	msg := newMessage()
+	a.NoError(SignMessageAs(key, identity, msg))
+	a.NoError(room.CreateMessage(ctx, msg))
+	a.NoError(room.CreateMessage(ctx, msg.DeepCopy()))
+	a.Equal(msg.UID, (<-ch.Messages()).UID)
+	a.Len(ch.Messages(), 0)
+
+	// 未签名或使用其它密钥签名的消息被拒绝
+	unsigned := newMessage()
+	unsigned.UID = metav1.NewUID()
+	a.Error(room.CreateMessage(ctx, unsigned))
+	other := newMessage()
+	a.NoError(SignMessageAs(signatures.Key("4321"), identity, other))
+	a.Error(room.CreateMessage(ctx, other))
+
+	// 没有身份签名或身份签名不匹配的消息被拒绝
+	anonymous := newMessage()
+	a.NoError(SignMessage(key, anonymous))
+	a.Error(room.CreateMessage(ctx, anonymous))
+	forged := newMessage()
+	a.NoError(SignMessageAs(key, identity, forged))
+	forged.FromKey, err = signatures.PublicKeyOf(newIdentity(t))
+	a.NoError(err)
+	a.NoError(SignMessage(key, forged))
+	a.Error(room.CreateMessage(ctx, forged))
+
+	// 签名时间在窗口外的消息被拒绝
+	for _, signTime := range []time.Time{time.Now().Add(-2 * time.Minute), time.Now().Add(2 * time.Minute)} {
+		old := newMessage()
+		old.UID = metav1.NewUID()
+		old.SignTime = signTime
+		old.Signature, err = signatures.HS256SignObject(key.Subkey(signatures.KeyPurposeAPI), old)
+		a.NoError(err)
+		a.Error(room.CreateMessage(ctx, old))
+	}
+	a.Len(ch.Messages(), 0)
+}
+
+// TestLocalRoom_CreateMessage_Rekey 测试本地房间更换密钥
+func TestLocalRoom_CreateMessage_Rekey(t *testing.T) {
+	a := assert.New(t)
+	ctx := context.Background()
+
+	owner, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if !a.NoError(err) {
+		return
+	}
+	pub, err := signatures.PublicKeyOf(owner)
+	if !a.NoError(err) {
+		return
+	}
+	oldKey, newKey := signatures.Key("1234"), signatures.Key("5678")
+	keys := signatures.NewKeyHolder(oldKey)
+	room := NewLocalRoom(keys, metav1.NewUID(), "owner", LocalRoomOptions{OwnerKey: moderations.KeyFingerprint(pub)})
+	changed := keys.Changed()
+
+	content, err := moderations.NewRekey(oldKey, newKey)
+	if !a.NoError(err) {
+		return
+	}
+	a.NoError(moderations.Sign(owner, content))
+	rekey := &chatv1.Message{
+		APIMeta: metav1.NewAPIMeta(chatv1.KindMessage),
+		From:    metav1.ObjectMeta{UID: metav1.NewUID()},
+		Content: chatv1.MessageContent{Moderation: content},
+	}
+	a.NoError(SignMessage(oldKey, rekey))
+	a.NoError(room.CreateMessage(ctx, rekey))
+
+	select {
+	case <-changed:
+	default:
+		a.Fail("key not changed")
+	}
+	a.Equal(newKey, keys.Get())
+
+	// 只持有旧密钥的用户无法再发送消息
+	for _, c := range []struct {
+		key signatures.Key
+		ok  bool
+	}{{key: oldKey}, {key: newKey, ok: true}} {
+		msg := &chatv1.Message{
+			APIMeta: metav1.NewAPIMeta(chatv1.KindMessage),
+			From:    metav1.ObjectMeta{UID: metav1.NewUID()},
+			Content: chatv1.MessageContent{Text: &chatv1.TextMessageContent{Content: "hello"}},
+		}
+		a.NoError(SignMessageAs(c.key, owner, msg))
+		a.Equal(c.ok, room.CreateMessage(ctx, msg) == nil)
+	}
+}
+
+// TestLocalRoom_CreateMessage_Retry 测试被拒绝的消息可以使用相同的 UID 重试
+func TestLocalRoom_CreateMessage_Retry(t *testing.T) {
+	a := assert.New(t)
+	ctx := context.Background()
+
+	key := signatures.Key("1234")
+	owner, alice := newIdentity(t), newIdentity(t)
+	room := NewLocalRoom(signatures.NewKeyHolder(key), metav1.NewUID(), "owner",
+		LocalRoomOptions{OwnerKey: fingerprintOf(t, owner)})
+	ch, err := room.Listen(ctx, nil)
+	if !a.NoError(err) {
+		return
+	}
+	defer func() { _ = ch.Close() }()
+
+	moderate := func(action chatv1.ModerationAction) {
+		content := &chatv1.ModerationMessageContent{Action: action, UserKey: fingerprintOf(t, alice)}
+		a.NoError(moderations.Sign(owner, content))
+		msg := &chatv1.Message{
+			APIMeta: metav1.NewAPIMeta(chatv1.KindMessage),
+			From:    metav1.ObjectMeta{UID: metav1.NewUID()},
+			Content: chatv1.MessageContent{Moderation: content},
+		}
+		a.NoError(SignMessageAs(key, owner, msg))
+		a.NoError(room.CreateMessage(ctx, msg))
+	}
+
+	msg := &chatv1.Message{
+		APIMeta: metav1.NewAPIMeta(chatv1.KindMessage),
+		From:    metav1.ObjectMeta{UID: metav1.NewUID()},
+		Content: chatv1.MessageContent{Text: &chatv1.TextMessageContent{Content: "hello"}},
+	}
+	a.NoError(SignMessageAs(key, alice, msg))
+
+	// 禁言时被拒绝，解除禁言后重试成功并送达
+	moderate(chatv1.ModerationMute)
+	a.Error(room.CreateMessage(ctx, msg))
+	moderate(chatv1.ModerationUnmute)
+	a.NoError(room.CreateMessage(ctx, msg))
+	a.True(waitMessage(ch, msg.UID), "retried message not delivered")
+}
+
+// TestLocalRoom_CreateMessage_MembersChange 测试本地房间只接受可信来源或成员自己签名的成员变化消息
+func TestLocalRoom_CreateMessage_MembersChange(t *testing.T) {
+	a := assert.New(t)
+	ctx := context.Background()
+
+	key := signatures.Key("1234")
+	victim, attacker, downstreamOwner := newIdentity(t), newIdentity(t), newIdentity(t)
+	room := NewLocalRoom(signatures.NewKeyHolder(key), metav1.NewUID(), "owner", LocalRoomOptions{})
+	downstream := NewLocalRoom(signatures.NewKeyHolder(key), metav1.NewUID(), "downstream",
+		LocalRoomOptions{OwnerKey: fingerprintOf(t, downstreamOwner)})
+
+	newLeave := func() *chatv1.Message {
+		return &chatv1.Message{
+			APIMeta: metav1.NewAPIMeta(chatv1.KindMessage),
+			From:    metav1.ObjectMeta{UID: metav1.NewUID()},
+			Content: chatv1.MessageContent{Leave: &chatv1.MembersChangeMessageContent{
+				User: metav1.ObjectMeta{UID: metav1.NewUID(), Name: "victim"},
+				Key:  fingerprintOf(t, victim),
+			}},
+		}
+	}
+
+	// 只有房间密钥签名或由其他人签名的离开消息被拒绝
+	msg := newLeave()
+	a.NoError(SignMessage(key, msg))
+	a.Error(room.CreateMessage(ctx, msg))
+	msg = newLeave()
+	a.NoError(SignMessageAs(key, attacker, msg))
+	a.Error(room.CreateMessage(common.NewContextWithClientKey(ctx, fingerprintOf(t, attacker)), msg))
+
+	// 成员自己签名的离开消息被接受
+	msg = newLeave()
+	a.NoError(SignMessageAs(key, victim, msg))
+	a.NoError(room.CreateMessage(ctx, msg))
+
+	// 经过校验的下游房间转发连接转发的成员变化消息被接受
+	info, err := downstream.Info(ctx)
+	if !a.NoError(err) {
+		return
+	}
+	downstreamCTX := common.NewContextWithClientKey(ctx, fingerprintOf(t, downstreamOwner))
+	relay, err := room.Listen(
+		common.NewContextWithRelayRoom(downstreamCTX, info),
+		&metav1.ObjectMeta{UID: metav1.NewUID(), Name: "downstream"},
+	)
+	if !a.NoError(err) {
+		return
+	}
+	defer func() { _ = relay.Close() }()
+	msg = newLeave()
+	a.NoError(SignMessage(key, msg))
+	a.NoError(room.CreateMessage(downstreamCTX, msg))
+}
+
+// TestLocalRoom_CreateMessage_Limits 测试本地房间按发送人身份限制消息
+func TestLocalRoom_CreateMessage_Limits(t *testing.T) {
+	a := assert.New(t)
+	ctx := context.Background()
+
+	key := signatures.Key("1234")
+	alice, bob, downstreamOwner := newIdentity(t), newIdentity(t), newIdentity(t)
+	room := NewLocalRoom(signatures.NewKeyHolder(key), metav1.NewUID(), "owner", LocalRoomOptions{
+		Limits: RateLimits{MessageRate: 0.001, MessageBurst: 2},
+	})
+	newText := func(identity *ecdsa.PrivateKey) *chatv1.Message {
+		// 每条消息使用不同的发送人 UID
+		msg := &chatv1.Message{
+			APIMeta: metav1.NewAPIMeta(chatv1.KindMessage),
+			From:    metav1.ObjectMeta{UID: metav1.NewUID()},
+			Content: chatv1.MessageContent{Text: &chatv1.TextMessageContent{Content: "hello"}},
+		}
+		a.NoError(SignMessageAs(key, identity, msg))
+		return msg
+	}
+
+	// 更换 UID 不能绕过限制
+	a.NoError(room.CreateMessage(ctx, newText(alice)))
+	a.NoError(room.CreateMessage(ctx, newText(alice)))
+	a.Error(room.CreateMessage(ctx, newText(alice)))
+	a.NoError(room.CreateMessage(ctx, newText(bob)))
+
+	// 下游房间转发的成员变化消息不受限制
+	downstream := NewLocalRoom(signatures.NewKeyHolder(key), metav1.NewUID(), "downstream",
+		LocalRoomOptions{OwnerKey: fingerprintOf(t, downstreamOwner)})
+	info, err := downstream.Info(ctx)
+	if !a.NoError(err) {
+		return
+	}
+	downstreamCTX := common.NewContextWithClientKey(ctx, fingerprintOf(t, downstreamOwner))
+	relay, err := room.Listen(
+		common.NewContextWithRelayRoom(downstreamCTX, info),
+		&metav1.ObjectMeta{UID: metav1.NewUID(), Name: "downstream"},
+	)
+	if !a.NoError(err) {
+		return
+	}
+	defer func() { _ = relay.Close() }()
+	for i := 0; i < 5; i++ {
+		msg := &chatv1.Message{
+			APIMeta: metav1.NewAPIMeta(chatv1.KindMessage),
+			From:    metav1.ObjectMeta{UID: metav1.NewUID()},
+			Content: chatv1.MessageContent{Join: &chatv1.MembersChangeMessageContent{
+				User: metav1.ObjectMeta{UID: metav1.NewUID()},
+				Key:  fingerprintOf(t, newIdentity(t)),
+			}},
+		}
+		a.NoError(SignMessage(key, msg))
+		a.NoError(room.CreateMessage(downstreamCTX, msg))
+	}
+}
+
+// TestLocalRoom_Relay 测试下游房间的转发连接及封禁下游房间房主
+func TestLocalRoom_Relay(t *testing.T) {
+	a := assert.New(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	key := signatures.Key("1234")
+	rootOwner, middleOwner, member := newIdentity(t), newIdentity(t), newIdentity(t)
+	root := NewLocalRoom(signatures.NewKeyHolder(key), metav1.NewUID(), "root",
+		LocalRoomOptions{OwnerKey: fingerprintOf(t, rootOwner)})
+	middle := NewLocalRoom(signatures.NewKeyHolder(key), metav1.NewUID(), "middle",
+		LocalRoomOptions{OwnerKey: fingerprintOf(t, middleOwner)})
+	leaf := NewLocalRoom(signatures.NewKeyHolder(key), metav1.NewUID(), "leaf",
+		LocalRoomOptions{OwnerKey: fingerprintOf(t, member)})
+	if !a.NoError(middle.SetUpstream(ctx, root)) || !a.NoError(leaf.SetUpstream(ctx, middle)) {
+		return
+	}
+
+	// 中间房间的房主和最下游房间的成员分别在各自的房间监听
+	middleCh, err := middle.Listen(
+		common.NewContextWithClientKey(ctx, fingerprintOf(t, middleOwner)),
+		&metav1.ObjectMeta{UID: metav1.NewUID(), Name: "middle"},
+	)
+	if !a.NoError(err) {
+		return
+	}
+	defer func() { _ = middleCh.Close() }()
+	leafCh, err := leaf.Listen(
+		common.NewContextWithClientKey(ctx, fingerprintOf(t, member)),
+		&metav1.ObjectMeta{UID: metav1.NewUID(), Name: "member"},
+	)
+	if !a.NoError(err) {
+		return
+	}
+	defer func() { _ = leafCh.Close() }()
+
+	newText := func(identity *ecdsa.PrivateKey) *chatv1.Message {
+		msg := &chatv1.Message{
+			APIMeta: metav1.NewAPIMeta(chatv1.KindMessage),
+			From:    metav1.ObjectMeta{UID: metav1.NewUID()},
+			Content: chatv1.MessageContent{Text: &chatv1.TextMessageContent{Content: "hello"}},
+		}
+		a.NoError(SignMessageAs(key, identity, msg))
+		return msg
+	}
+
+	// 等待转发连接建立
+	ready := false
+	for i := 0; i < 5 && !ready; i++ {
+		ping := newText(rootOwner)
+		a.NoError(root.CreateMessage(ctx, ping))
+		ready = waitMessage(leafCh, ping.UID)
+	}
+	if !a.True(ready, "relay not ready") {
+		return
+	}
+
+	// 只有房主身份与监听者一致的下游房间可以转发消息
+	leafInfo, err := leaf.Info(ctx)
+	a.NoError(err)
+	rootInfo, err := root.Info(ctx)
+	a.NoError(err)
+	for _, c := range []struct {
+		identity *ecdsa.PrivateKey
+		info     *chatv1.Room
+	}{{rootOwner, leafInfo}, {rootOwner, rootInfo}} {
+		_, err = root.Listen(
+			common.NewContextWithRelayRoom(common.NewContextWithClientKey(ctx, fingerprintOf(t, c.identity)), c.info),
+			&metav1.ObjectMeta{UID: metav1.NewUID()},
+		)
+		a.Error(err)
+	}
+
+	// 封禁中间房间的房主
+	content := &chatv1.ModerationMessageContent{Action: chatv1.ModerationBan, UserKey: fingerprintOf(t, middleOwner)}
+	a.NoError(moderations.Sign(rootOwner, content))
+	ban := &chatv1.Message{
+		APIMeta: metav1.NewAPIMeta(chatv1.KindMessage),
+		From:    metav1.ObjectMeta{UID: metav1.NewUID()},
+		Content: chatv1.MessageContent{Moderation: content},
+	}
+	a.NoError(SignMessageAs(key, rootOwner, ban))
+	a.NoError(root.CreateMessage(ctx, ban))
+	a.True(waitMessage(leafCh, ban.UID), "ban not relayed")
+
+	// 中间房间房主自己的通道和其房间的转发连接都被关闭，且不能再发送消息
+	select {
+	case <-middleCh.Done():
+	case <-time.After(time.Second):
+		a.Fail("channel of banned owner not closed")
+	}
+	disconnected := false
+	for i := 0; i < 100 && !disconnected; i++ {
+		disconnected = middle.Upstream() == nil
+		time.Sleep(10 * time.Millisecond)
+	}
+	a.True(disconnected, "relay link of banned owner not closed")
+	a.Error(root.CreateMessage(ctx, newText(middleOwner)))
+
+	// 被封禁的身份即使作为下游房间也不能监听，没有身份的监听者也不能监听
+	middleInfo, err := middle.Info(ctx)
+	a.NoError(err)
+	middleCTX := common.NewContextWithClientKey(ctx, fingerprintOf(t, middleOwner))
+	_, err = root.Listen(common.NewContextWithRelayRoom(middleCTX, middleInfo), &metav1.ObjectMeta{UID: metav1.NewUID()})
+	a.Error(err)
+	_, err = root.Listen(middleCTX, nil)
+	a.Error(err)
+	_, err = root.Listen(ctx, nil)
+	a.Error(err)
+}
+
+// TestLocalRoom_SetUpstream_Slow 测试上游响应慢时不阻塞房间的其它操作
+func TestLocalRoom_SetUpstream_Slow(t *testing.T) {
+	a := assert.New(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	key := signatures.Key("1234")
+	root := NewLocalRoom(signatures.NewKeyHolder(key), metav1.NewUID(), "root",
+		LocalRoomOptions{OwnerKey: fingerprintOf(t, newIdentity(t))})
+	middle := NewLocalRoom(signatures.NewKeyHolder(key), metav1.NewUID(), "middle",
+		LocalRoomOptions{OwnerKey: fingerprintOf(t, newIdentity(t))})
+	upstream := &slowRoom{Room: root, entered: make(chan struct{}, 1)}
+
+	upstream.lock.Lock()
+	done := make(chan error, 1)
+	go func() { done <- middle.SetUpstream(ctx, upstream) }()
+	<-upstream.entered
+
+	// 正在请求上游时仍然可以监听
+	listened := make(chan error, 1)
+	go func() {
+		ch, err := middle.Listen(ctx, nil)
+		if err == nil {
+			_ = ch.Close()
+		}
+		listened <- err
+	}()
+	select {
+	case err := <-listened:
+		a.NoError(err)
+	case <-time.After(time.Second):
+		a.Fail("listen blocked by upstream request")
+	}
+
+	upstream.lock.Unlock()
+	a.NoError(<-done)
+	a.Equal(Room(upstream), middle.Upstream())
+}
+
+// TestLocalRoom_Listen_Locked 测试房间锁定时的匿名监听
+func TestLocalRoom_Listen_Locked(t *testing.T) {
+	a := assert.New(t)
+	ctx := context.Background()
+
+	key := signatures.Key("1234")
+	owner, member, stranger := newIdentity(t), newIdentity(t), newIdentity(t)
+	room := NewLocalRoom(signatures.NewKeyHolder(key), metav1.NewUID(), "owner",
+		LocalRoomOptions{OwnerKey: fingerprintOf(t, owner)})
+	memberCTX := common.NewContextWithClientKey(ctx, fingerprintOf(t, member))
+	joined, err := room.Listen(memberCTX, &metav1.ObjectMeta{UID: metav1.NewUID(), Name: "member"})
+	if !a.NoError(err) {
+		return
+	}
+	defer func() { _ = joined.Close() }()
+
+	content := &chatv1.ModerationMessageContent{Action: chatv1.ModerationLock}
+	a.NoError(moderations.Sign(owner, content))
+	lock := &chatv1.Message{
+		APIMeta: metav1.NewAPIMeta(chatv1.KindMessage),
+		From:    metav1.ObjectMeta{UID: metav1.NewUID()},
+		Content: chatv1.MessageContent{Moderation: content},
+	}
+	a.NoError(SignMessageAs(key, owner, lock))
+	a.NoError(room.CreateMessage(ctx, lock))
+
+	// 没有加入的身份和没有身份的监听者被拒绝
+	_, err = room.Listen(common.NewContextWithClientKey(ctx, fingerprintOf(t, stranger)), nil)
+	a.Error(err)
+	_, err = room.Listen(ctx, nil)
+	a.Error(err)
+
+	// 房主和已加入的成员可以匿名监听
+	for _, listenCTX := range []context.Context{
+		common.NewContextWithClientKey(ctx, fingerprintOf(t, owner)),
+		memberCTX,
+	} {
+		ch, err := room.Listen(listenCTX, nil)
+		if a.NoError(err) {
+			_ = ch.Close()
+		}
+	}
+}
+
+// slowRoom 获取房间信息时等待 lock 的房间，用于模拟响应慢的上游
+type slowRoom struct {
+	Room
+	lock    sync.Mutex
+	entered chan struct{}
+}
+
+// Info 获取房间信息
+func (r *slowRoom) Info(ctx context.Context) (*chatv1.Room, error) {
+	select {
+	case r.entered <- struct{}{}:
+	default:
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.Room.Info(ctx)
+}
+
+// newIdentity 生成身份私钥
+func newIdentity(t *testing.T) *ecdsa.PrivateKey {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key error: %v", err)
+	}
+	return priv
+}
+
+// fingerprintOf 返回身份私钥对应公钥的指纹
+func fingerprintOf(t *testing.T, priv *ecdsa.PrivateKey) string {
+	pub, err := signatures.PublicKeyOf(priv)
+	if err != nil {
+		t.Fatalf("marshal public key error: %v", err)
+	}
+	return moderations.KeyFingerprint(pub)
+}
+
+// waitMessage 等待通道收到指定 UID 的消息
+func waitMessage(ch channels.Channel, uid metav1.UID) bool {
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case msg, ok := <-ch.Messages():
+			if !ok {
+				return false
+			}
+			if msg.UID == uid {
+				return true
+			}
+		case <-timeout:
+			return false
+		}
+	}
+}
@@ -17,18 +17,46 @@ import (
 
 	chatv1 "github.com/yhlooo/bangbang/pkg/apis/chat/v1"
 	metav1 "github.com/yhlooo/bangbang/pkg/apis/meta/v1"
+	"github.com/yhlooo/bangbang/pkg/audit"
 	"github.com/yhlooo/bangbang/pkg/chats/channels"
+	"github.com/yhlooo/bangbang/pkg/servers/common"
 	"github.com/yhlooo/bangbang/pkg/signatures"
 )
 
 // NewRemoteRoom 创建远程房间实例
-func NewRemoteRoom(endpoint string, certSign string) Room {
+//
+// 连接时校验服务端证书签名为 certSign ，并出示客户端证书 clientCert （为 nil 时不出示）
+func NewRemoteRoom(endpoint string, certSign string, clientCert *tls.Certificate) Room {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify:    true,
+		VerifyPeerCertificate: verifyCertFunc(certSign),
+	}
+	if clientCert != nil {
+		tlsConfig.Certificates = []tls.Certificate{*clientCert}
+	}
+	return newRemoteRoom(endpoint, tlsConfig)
+}
+
+// NewRemoteRoomWithKeys 创建远程房间实例
+//
+// 连接时校验服务端证书签名为 certSign ，并出示绑定 keys 当前密钥的客户端证书，
+// 房间更换密钥后新建立的连接使用新密钥的证书
+func NewRemoteRoomWithKeys(endpoint string, certSign string, keys *signatures.KeyHolder) Room {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify:    true,
+		VerifyPeerCertificate: verifyCertFunc(certSign),
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return keys.ClientCertificate()
+		},
+	}
+	return newRemoteRoom(endpoint, tlsConfig)
+}
+
+// newRemoteRoom 创建使用 tlsConfig 连接的远程房间实例
+func newRemoteRoom(endpoint string, tlsConfig *tls.Config) Room {
 	client := &http.Client{
 		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{
-				InsecureSkipVerify:    true,
-				VerifyPeerCertificate: verifyCertFunc(certSign),
-			},
+			TLSClientConfig: tlsConfig,
 		},
 	}
 	return &remoteRoom{
@@ -49,6 +77,9 @@ type remoteRoom struct {
 
 var _ Room = (*remoteRoom)(nil)
 
+// ErrCertificateMismatch 服务端证书签名与预期不一致
+var ErrCertificateMismatch = errors.New("CertificateMismatch")
+
 // Info 获取房间信息
 func (r *remoteRoom) Info(ctx context.Context) (*chatv1.Room, error) {
 	info := &chatv1.Room{}
@@ -58,6 +89,24 @@ func (r *remoteRoom) Info(ctx context.Context) (*chatv1.Room, error) {
 	return info, nil
 }
 
+// ListMembers 列出房间成员
+func (r *remoteRoom) ListMembers(ctx context.Context) (*chatv1.UserList, error) {
+	members := &chatv1.UserList{}
+	if err := r.doRequest(ctx, http.MethodGet, "/members", nil, members); err != nil {
+		return nil, err
+	}
+	return members, nil
+}
+
+// ListModerations 列出生效的管理操作
+func (r *remoteRoom) ListModerations(ctx context.Context) (*chatv1.MessageList, error) {
+	moderations := &chatv1.MessageList{}
+	if err := r.doRequest(ctx, http.MethodGet, "/moderations", nil, moderations); err != nil {
+		return nil, err
+	}
+	return moderations, nil
+}
+
 // CreateMessage 创建消息
 func (r *remoteRoom) CreateMessage(ctx context.Context, msg *chatv1.Message) error {
 	r.lock.RLock()
@@ -66,7 +115,12 @@ func (r *remoteRoom) CreateMessage(ctx context.Context, msg *chatv1.Message) err
 		return fmt.Errorf("room already closed")
 	}
 	r.lock.RUnlock()
-	return r.doRequest(ctx, http.MethodPost, "/messages", msg, msg)
+	// 转发收到的消息时使用原始 JSON ，不丢失当前版本不认识的字段
+	var body interface{} = msg
+	if raw := msg.RawJSON(); len(raw) != 0 {
+		body = json.RawMessage(raw)
+	}
+	return r.doRequest(ctx, http.MethodPost, "/messages", body, nil)
 }
 
 // Listen 获取监听消息的信道
@@ -76,27 +130,43 @@ func (r *remoteRoom) Listen(
 ) (channels.Channel, error) {
 	logger := logr.FromContextOrDiscard(ctx)
 
-	r.lock.Lock()
-	defer r.lock.Unlock()
-
-	if r.closed {
+	r.lock.RLock()
+	closed := r.closed
+	r.lock.RUnlock()
+	if closed {
 		return nil, fmt.Errorf("room already closed")
 	}
 
 	uri := "/messages"
+	query := url.Values{}
 	if user != nil {
-		uri += "?" + url.Values{
-			"userUID":  {user.UID.String()},
-			"userName": {user.Name},
-		}.Encode()
+		query.Set("userUID", user.UID.String())
+		query.Set("userName", user.Name)
+	}
+	if room := common.RelayRoomFromContext(ctx); room != nil {
+		raw, err := json.Marshal(room)
+		if err != nil {
+			return nil, fmt.Errorf("marshal relay room info to json error: %w", err)
+		}
+		query.Set("relay", string(raw))
+	}
+	if len(query) != 0 {
+		uri += "?" + query.Encode()
 	}
 
-	// 构造请求
+	// 构造请求，房间开启准入模式时会等待批准，期间不持有锁
 	resp, err := r.doGetStreamRequest(ctx, uri)
 	if err != nil {
 		return nil, fmt.Errorf("make request error: %w", err)
 	}
 
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.closed {
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("room already closed")
+	}
+
 	msgCh := channels.NewLocalChannel(10)
 	go func() {
 		<-msgCh.Done()
@@ -159,6 +229,7 @@ func (r *remoteRoom) doRequest(ctx context.Context, method, uri string, reqData,
 	// 发送请求
 	resp, err := r.client.Do(req)
 	if err != nil {
+		r.recordSendError(ctx, err)
 		return fmt.Errorf("send request error: %w", err)
 	}
 	defer func() { _ = resp.Body.Close() }()
@@ -204,20 +275,37 @@ func (r *remoteRoom) doGetStreamRequest(ctx context.Context, uri string) (*http.
 	// 发送请求
 	resp, err := r.client.Do(req)
 	if err != nil {
+		r.recordSendError(ctx, err)
 		return nil, fmt.Errorf("send request error: %w", err)
 	}
 	if resp.StatusCode != http.StatusOK {
 		respBodyRaw, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
 		_ = resp.Body.Close()
-		return nil, fmt.Errorf(
-			"unexpected status code: %d (!= 200), body: %s",
-			resp.StatusCode, string(respBodyRaw),
-		)
+		apiErr := metav1.Status{}
+		if err := json.Unmarshal(respBodyRaw, &apiErr); err != nil {
+			return nil, fmt.Errorf(
+				"unexpected status code: %d (!= 200), body: %s",
+				resp.StatusCode, string(respBodyRaw),
+			)
+		}
+		return nil, &apiErr
 	}
 
 	return resp, nil
 }
 
+// recordSendError 服务端证书与预期不一致时记录安全事件
+func (r *remoteRoom) recordSendError(ctx context.Context, err error) {
+	if !errors.Is(err, ErrCertificateMismatch) {
+		return
+	}
+	source := r.endpoint
+	if u, parseErr := url.Parse(r.endpoint); parseErr == nil {
+		source = u.Hostname()
+	}
+	audit.FromContext(ctx).WithSource(source).Record(audit.EventServerCertificateMismatch, err.Error())
+}
+
 // makeRequest 构造请求
 func (r *remoteRoom) makeRequest(ctx context.Context, method, uri string, reqData interface{}) (*http.Request, error) {
 	var reqBody io.Reader
@@ -243,7 +331,7 @@ func verifyCertFunc(expectedSign string) func(rawCerts [][]byte, verifiedChains
 			return fmt.Errorf("empty certificates")
 		}
 		if sign := signatures.SignCert(rawCerts[0]); sign != expectedSign {
-			return fmt.Errorf("invalid certificate, signature mismatch: %q (expected %q)", sign, expectedSign)
+			return fmt.Errorf("%w: %q (expected %q)", ErrCertificateMismatch, sign, expectedSign)
 		}
 		return nil
 	}
@@ -2,16 +2,29 @@ package rooms
 
 import (
 	"context"
+	"crypto"
+	"fmt"
+	"time"
 
 	chatv1 "github.com/yhlooo/bangbang/pkg/apis/chat/v1"
 	metav1 "github.com/yhlooo/bangbang/pkg/apis/meta/v1"
 	"github.com/yhlooo/bangbang/pkg/chats/channels"
+	"github.com/yhlooo/bangbang/pkg/signatures"
 )
 
+// DefaultMessageWindow 默认的消息签名时间窗口
+//
+// 房间只接受签名时间与当前时间相差不超过该窗口的消息
+const DefaultMessageWindow = 5 * time.Minute
+
 // Room 聊天房间
 type Room interface {
 	// Info 获取房间信息
 	Info(ctx context.Context) (*chatv1.Room, error)
+	// ListMembers 列出房间成员
+	ListMembers(ctx context.Context) (*chatv1.UserList, error)
+	// ListModerations 列出生效的管理操作
+	ListModerations(ctx context.Context) (*chatv1.MessageList, error)
 
 	// CreateMessage 创建消息
 	CreateMessage(ctx context.Context, msg *chatv1.Message) error
@@ -30,3 +43,71 @@ type RoomWithUpstream interface {
 	// SetUpstream 设置上游房间
 	SetUpstream(ctx context.Context, room Room) error
 }
+
+// SignMessage 使用房间密钥的接口认证子密钥签名消息
+//
+// 消息没有 UID 时为其生成 UID ，签名时间为当前时间。房间拒绝没有签名或签名时间在窗口外的消息
+func SignMessage(key signatures.Key, msg *chatv1.Message) error {
+	msg.ResetRawJSON()
+	if msg.UID.IsNil() {
+		msg.UID = metav1.NewUID()
+	}
+	if err := signatures.HS256SignAPIObject(key.Subkey(signatures.KeyPurposeAPI), msg); err != nil {
+		return fmt.Errorf("sign message error: %w", err)
+	}
+	return nil
+}
+
+// SignMessageAs 使用发送人的身份私钥和房间密钥签名消息
+//
+// 身份私钥签名除 Signature 和 FromSignature 外的其余字段，房间按身份公钥指纹判断发送人是否被禁言或封禁。
+// 房间拒绝没有身份签名的文本、加密和密钥分发消息
+func SignMessageAs(key signatures.Key, identity crypto.Signer, msg *chatv1.Message) error {
+	msg.ResetRawJSON()
+	if msg.UID.IsNil() {
+		msg.UID = metav1.NewUID()
+	}
+	pub, err := signatures.PublicKeyOf(identity)
+	if err != nil {
+		return err
+	}
+	msg.FromKey = pub
+	msg.FromSignature = nil
+	msg.Signature = ""
+	msg.SignTime = time.Now()
+	msg.FromSignature, err = signatures.ES256SignObject(identity, msg)
+	if err != nil {
+		return fmt.Errorf("sign message with identity key error: %w", err)
+	}
+	msg.Signature, err = signatures.HS256SignObject(key.Subkey(signatures.KeyPurposeAPI), msg)
+	if err != nil {
+		return fmt.Errorf("sign message error: %w", err)
+	}
+	return nil
+}
+
+// VerifySender 校验消息的身份签名，返回发送人身份公钥指纹
+//
+// 有原始 JSON 时校验原始 JSON
+func VerifySender(msg *chatv1.Message) (string, error) {
+	if len(msg.FromKey) == 0 {
+		return "", signatures.ErrNoSignature
+	}
+	if raw := msg.RawJSON(); len(raw) != 0 {
+		unsigned, err := signatures.RemoveJSONFields(raw, "meta.signature", "fromSignature")
+		if err != nil {
+			return "", fmt.Errorf("remove signatures from json error: %w", err)
+		}
+		if err := signatures.ES256VerifyJSON(msg.FromKey, msg.FromSignature, unsigned); err != nil {
+			return "", err
+		}
+		return signatures.SignCert(msg.FromKey), nil
+	}
+	unsigned := msg.DeepCopy()
+	unsigned.Signature = ""
+	unsigned.FromSignature = nil
+	if err := signatures.ES256VerifyObject(msg.FromKey, msg.FromSignature, unsigned); err != nil {
+		return "", err
+	}
+	return signatures.SignCert(msg.FromKey), nil
+}
@@ -0,0 +1,385 @@
+package senderkeys
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	chatv1 "github.com/yhlooo/bangbang/pkg/apis/chat/v1"
+	metav1 "github.com/yhlooo/bangbang/pkg/apis/meta/v1"
+	"github.com/yhlooo/bangbang/pkg/signatures"
+)
+
+const (
+	// maxKeysPerSender 每个成员保留的发送者密钥数，轮换后仍可以解密使用旧密钥加密的在途消息
+	maxKeysPerSender = 4
+	// senderKeySize 发送者密钥字节数
+	senderKeySize = 32
+
+	// wrapAAD 加密发送者密钥时一同认证的数据前缀
+	wrapAAD = "bangbang sender key v1"
+	// messageAAD 加密消息时一同认证的数据前缀
+	messageAAD = "bangbang message v1"
+	// viewerAAD 为观察者加密发送者密钥时一同认证的数据前缀
+	viewerAAD = "bangbang viewer sender key v1"
+)
+
+var (
+	// ErrUnknownKey 没有收到消息使用的发送者密钥
+	ErrUnknownKey = errors.New("UnknownKey")
+	// ErrIdentityMismatch 成员的身份公钥与之前的不一致
+	ErrIdentityMismatch = errors.New("IdentityMismatch")
+)
+
+// NewSession 创建发送者密钥会话
+//
+// self 为当前成员的 UID ， signer 为当前成员的身份私钥，用于签名密钥分发消息
+func NewSession(self metav1.UID, signer crypto.Signer) (*Session, error) {
+	if signer == nil {
+		return nil, errors.New("identity key is required")
+	}
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("generate x25519 key error: %w", err)
+	}
+	s := &Session{
+		self:    self,
+		signer:  signer,
+		priv:    priv,
+		members: make(map[metav1.UID]*member),
+		keys:    make(map[metav1.UID]*senderKeys),
+	}
+	if err := s.rotate(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Session 发送者密钥会话
+//
+// 每个成员使用自己随机生成的发送者密钥加密发出的消息，并通过 X25519 协商的密钥将其分别加密给其它已知成员。
+// 有成员离开、被踢出或封禁时，其余成员各自轮换发送者密钥并只分发给剩余的成员，离开的成员无法解密之后的消息
+type Session struct {
+	lock   sync.Mutex
+	self   metav1.UID
+	signer crypto.Signer
+	priv   *ecdh.PrivateKey
+
+	// 当前的发送者密钥
+	keyID string
+	key   signatures.Key
+	// 只读观察者密钥，不为空时每条消息附带使用它加密的发送者密钥
+	viewerKey signatures.Key
+
+	// 已知的其它成员
+	members map[metav1.UID]*member
+	// 各成员（包括自己）的发送者密钥
+	keys map[metav1.UID]*senderKeys
+}
+
+// member 已知的成员
+type member struct {
+	// 身份公钥，同一 UID 的身份公钥变化时拒绝其密钥分发消息
+	identity  []byte
+	publicKey *ecdh.PublicKey
+}
+
+// senderKeys 一个成员最近的发送者密钥
+type senderKeys struct {
+	ids  []string
+	keys map[string]signatures.Key
+}
+
+// add 添加发送者密钥，超过 maxKeysPerSender 时移除最旧的
+func (k *senderKeys) add(id string, key signatures.Key) {
+	if _, ok := k.keys[id]; ok {
+		return
+	}
+	k.ids = append(k.ids, id)
+	k.keys[id] = key
+	if len(k.ids) > maxKeysPerSender {
+		delete(k.keys, k.ids[0])
+		k.ids = k.ids[1:]
+	}
+}
+
+// Announce 返回将当前发送者密钥分发给所有已知成员的消息内容
+//
+// 同时公布自己的公钥，其它成员收到后会将它们的发送者密钥发给自己
+func (s *Session) Announce() (*chatv1.SenderKeyMessageContent, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.distribute(s.memberUIDs())
+}
+
+// Handle 处理房间中的消息
+//
+// 记录其它成员分发的发送者密钥，成员离开、被踢出或封禁时轮换发送者密钥。
+// 返回需要发送到房间的密钥分发消息内容，不需要发送时返回 nil
+func (s *Session) Handle(msg *chatv1.Message) (*chatv1.SenderKeyMessageContent, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	switch {
+	case msg.Content.SenderKey != nil:
+		if msg.From.UID == s.self {
+			return nil, nil
+		}
+		return s.handleSenderKey(msg.From.UID, msg.Content.SenderKey)
+	case msg.Content.Join != nil && msg.Content.Join.User.UID == s.self:
+		// 重新连接上游后，其它成员可能已经因为自己离开而移除了自己
+		return s.distribute(s.memberUIDs())
+	case msg.Content.Leave != nil:
+		return s.remove(msg.Content.Leave.User.UID)
+	case msg.Content.Moderation != nil:
+		switch msg.Content.Moderation.Action {
+		case chatv1.ModerationKick, chatv1.ModerationBan:
+			return s.remove(msg.Content.Moderation.User.UID)
+		default:
+		}
+	}
+	return nil, nil
+}
+
+// SetViewerKey 设置只读观察者密钥，为空时表示房间没有观察者
+//
+// 观察者密钥变化时轮换发送者密钥，之前的观察者无法解密之后的消息。
+// 返回需要发送到房间的密钥分发消息内容，不需要发送时返回 nil
+func (s *Session) SetViewerKey(key signatures.Key) (*chatv1.SenderKeyMessageContent, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if bytes.Equal(key, s.viewerKey) {
+		return nil, nil
+	}
+	s.viewerKey = key.Copy()
+	if err := s.rotate(); err != nil {
+		return nil, err
+	}
+	return s.distribute(s.memberUIDs())
+}
+
+// Encrypt 使用当前发送者密钥加密文本消息内容
+func (s *Session) Encrypt(text *chatv1.TextMessageContent) (*chatv1.EncryptedMessageContent, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	raw, err := json.Marshal(text)
+	if err != nil {
+		return nil, fmt.Errorf("marshal text to json error: %w", err)
+	}
+	ciphertext, err := signatures.SealContent(s.key, raw, messageAADFor(s.self, s.keyID))
+	if err != nil {
+		return nil, fmt.Errorf("encrypt message error: %w", err)
+	}
+	content := &chatv1.EncryptedMessageContent{KeyID: s.keyID, Ciphertext: ciphertext}
+	if len(s.viewerKey) != 0 {
+		content.ViewerKey, err = signatures.SealContent(s.viewerKey, s.key, viewerAADFor(s.self, s.keyID))
+		if err != nil {
+			return nil, fmt.Errorf("encrypt sender key for viewers error: %w", err)
+		}
+	}
+	return content, nil
+}
+
+// Decrypt 解密成员 from 发送的消息内容
+func (s *Session) Decrypt(from metav1.UID, content *chatv1.EncryptedMessageContent) (*chatv1.TextMessageContent, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var key signatures.Key
+	if keys := s.keys[from]; keys != nil {
+		key = keys.keys[content.KeyID]
+	}
+	if key == nil {
+		return nil, fmt.Errorf("%w: key %q of %s", ErrUnknownKey, content.KeyID, from)
+	}
+	return decrypt(key, from, content)
+}
+
+// decrypt 使用发送者密钥 key 解密成员 from 发送的消息内容
+func decrypt(
+	key signatures.Key,
+	from metav1.UID,
+	content *chatv1.EncryptedMessageContent,
+) (*chatv1.TextMessageContent, error) {
+	raw, err := signatures.OpenContent(key, content.Ciphertext, messageAADFor(from, content.KeyID))
+	if err != nil {
+		return nil, fmt.Errorf("decrypt message error: %w", err)
+	}
+	text := &chatv1.TextMessageContent{}
+	if err := json.Unmarshal(raw, text); err != nil {
+		return nil, fmt.Errorf("unmarshal text from json error: %w", err)
+	}
+	return text, nil
+}
+
+// DecryptAsViewer 使用只读观察者密钥 viewerKey 解密成员 from 发送的消息内容
+func DecryptAsViewer(
+	viewerKey signatures.Key,
+	from metav1.UID,
+	content *chatv1.EncryptedMessageContent,
+) (*chatv1.TextMessageContent, error) {
+	if len(content.ViewerKey) == 0 {
+		return nil, fmt.Errorf("%w: message of %s is not readable by viewers", ErrUnknownKey, from)
+	}
+	key, err := signatures.OpenContent(viewerKey, content.ViewerKey, viewerAADFor(from, content.KeyID))
+	if err != nil {
+		return nil, fmt.Errorf("decrypt sender key of %s error: %w", from, err)
+	}
+	return decrypt(key, from, content)
+}
+
+// handleSenderKey 处理成员 from 的密钥分发消息
+func (s *Session) handleSenderKey(
+	from metav1.UID,
+	content *chatv1.SenderKeyMessageContent,
+) (*chatv1.SenderKeyMessageContent, error) {
+	unsigned := content.DeepCopy()
+	unsigned.Signature = nil
+	if err := signatures.ES256VerifyObject(content.Issuer, content.Signature, unsigned); err != nil {
+		return nil, fmt.Errorf("verify sender key of %s error: %w", from, err)
+	}
+	pub, err := ecdh.X25519().NewPublicKey(content.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("parse public key of %s error: %w", from, err)
+	}
+	old, known := s.members[from]
+	if known && !bytes.Equal(old.identity, content.Issuer) {
+		return nil, fmt.Errorf("%w: %s", ErrIdentityMismatch, from)
+	}
+	s.members[from] = &member{identity: content.Issuer, publicKey: pub}
+
+	// 新成员或成员更换了公钥（比如重启），将自己的发送者密钥发给它
+	var reply *chatv1.SenderKeyMessageContent
+	if !known || !old.publicKey.Equal(pub) {
+		if reply, err = s.distribute([]metav1.UID{from}); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, recipient := range content.Recipients {
+		if recipient.UID != s.self {
+			continue
+		}
+		shared, err := s.priv.ECDH(pub)
+		if err != nil {
+			return reply, fmt.Errorf("x25519 with %s error: %w", from, err)
+		}
+		key, err := signatures.OpenContent(shared, recipient.Key, wrapAADFor(from, s.self, content.KeyID))
+		if err != nil {
+			return reply, fmt.Errorf("decrypt sender key of %s error: %w", from, err)
+		}
+		s.keysOf(from).add(content.KeyID, key)
+	}
+	return reply, nil
+}
+
+// remove 移除成员并轮换发送者密钥
+func (s *Session) remove(uid metav1.UID) (*chatv1.SenderKeyMessageContent, error) {
+	if uid == s.self {
+		return nil, nil
+	}
+	if _, ok := s.members[uid]; !ok {
+		return nil, nil
+	}
+	delete(s.members, uid)
+	delete(s.keys, uid)
+	if err := s.rotate(); err != nil {
+		return nil, err
+	}
+	return s.distribute(s.memberUIDs())
+}
+
+// rotate 生成新的发送者密钥
+func (s *Session) rotate() error {
+	key := make([]byte, senderKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return fmt.Errorf("generate sender key error: %w", err)
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return fmt.Errorf("generate sender key id error: %w", err)
+	}
+	s.key = key
+	s.keyID = hex.EncodeToString(id)
+	s.keysOf(s.self).add(s.keyID, s.key)
+	return nil
+}
+
+// distribute 创建将当前发送者密钥分发给指定成员的签名消息内容
+func (s *Session) distribute(uids []metav1.UID) (*chatv1.SenderKeyMessageContent, error) {
+	content := &chatv1.SenderKeyMessageContent{
+		PublicKey: s.priv.PublicKey().Bytes(),
+		KeyID:     s.keyID,
+	}
+	for _, uid := range uids {
+		m := s.members[uid]
+		if m == nil {
+			continue
+		}
+		shared, err := s.priv.ECDH(m.publicKey)
+		if err != nil {
+			return nil, fmt.Errorf("x25519 with %s error: %w", uid, err)
+		}
+		sealed, err := signatures.SealContent(shared, s.key, wrapAADFor(s.self, uid, s.keyID))
+		if err != nil {
+			return nil, fmt.Errorf("encrypt sender key for %s error: %w", uid, err)
+		}
+		content.Recipients = append(content.Recipients, chatv1.SenderKeyRecipient{UID: uid, Key: sealed})
+	}
+
+	issuer, err := signatures.PublicKeyOf(s.signer)
+	if err != nil {
+		return nil, err
+	}
+	content.Issuer = issuer
+	content.IssueTime = time.Now()
+	sign, err := signatures.ES256SignObject(s.signer, content)
+	if err != nil {
+		return nil, fmt.Errorf("sign sender key error: %w", err)
+	}
+	content.Signature = sign
+	return content, nil
+}
+
+// memberUIDs 返回所有已知成员的 UID
+func (s *Session) memberUIDs() []metav1.UID {
+	uids := make([]metav1.UID, 0, len(s.members))
+	for uid := range s.members {
+		uids = append(uids, uid)
+	}
+	return uids
+}
+
+// keysOf 返回成员的发送者密钥，不存在时创建
+func (s *Session) keysOf(uid metav1.UID) *senderKeys {
+	keys := s.keys[uid]
+	if keys == nil {
+		keys = &senderKeys{keys: make(map[string]signatures.Key)}
+		s.keys[uid] = keys
+	}
+	return keys
+}
+
+// wrapAADFor 返回 from 加密给 to 的发送者密钥一同认证的数据
+func wrapAADFor(from, to metav1.UID, keyID string) []byte {
+	return []byte(fmt.Sprintf("%s %s %s %s", wrapAAD, from, to, keyID))
+}
+
+// viewerAADFor 返回 from 为观察者加密的发送者密钥一同认证的数据
+func viewerAADFor(from metav1.UID, keyID string) []byte {
+	return []byte(fmt.Sprintf("%s %s %s", viewerAAD, from, keyID))
+}
+
+// messageAADFor 返回 from 使用发送者密钥加密的消息一同认证的数据
+func messageAADFor(from metav1.UID, keyID string) []byte {
+	return []byte(fmt.Sprintf("%s %s %s", messageAAD, from, keyID))
+}
@@ -0,0 +1,127 @@
+package senderkeys
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	chatv1 "github.com/yhlooo/bangbang/pkg/apis/chat/v1"
+	metav1 "github.com/yhlooo/bangbang/pkg/apis/meta/v1"
+	"github.com/yhlooo/bangbang/pkg/signatures"
+)
+
+// TestSession 测试 Session
+func TestSession(t *testing.T) {
+	a := assert.New(t)
+
+	uids := []metav1.UID{metav1.NewUID(), metav1.NewUID(), metav1.NewUID()}
+	sessions := make([]*Session, len(uids))
+	for i, uid := range uids {
+		signer, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if !a.NoError(err) {
+			return
+		}
+		sessions[i], err = NewSession(uid, signer)
+		if !a.NoError(err) {
+			return
+		}
+	}
+
+	// broadcast 模拟房间将消息发送给所有成员，并发送成员回复的密钥分发消息
+	var broadcast func(msg *chatv1.Message)
+	broadcast = func(msg *chatv1.Message) {
+		for i, s := range sessions {
+			reply, err := s.Handle(msg)
+			a.NoError(err)
+			if reply != nil {
+				broadcast(&chatv1.Message{
+					From:    metav1.ObjectMeta{UID: uids[i]},
+					Content: chatv1.MessageContent{SenderKey: reply},
+				})
+			}
+		}
+	}
+	for i, s := range sessions {
+		content, err := s.Announce()
+		a.NoError(err)
+		broadcast(&chatv1.Message{From: metav1.ObjectMeta{UID: uids[i]}, Content: chatv1.MessageContent{SenderKey: content}})
+	}
+
+	// 所有成员都可以解密
+	encrypted, err := sessions[0].Encrypt(&chatv1.TextMessageContent{Content: "hello"})
+	if !a.NoError(err) {
+		return
+	}
+	for _, s := range sessions {
+		text, err := s.Decrypt(uids[0], encrypted)
+		if a.NoError(err) {
+			a.Equal("hello", text.Content)
+		}
+	}
+
+	// 冒充发送人
+	_, err = sessions[1].Decrypt(uids[2], encrypted)
+	a.Error(err)
+
+	// 没有设置观察者密钥时观察者无法解密
+	_, err = DecryptAsViewer(signatures.Key("0000"), uids[0], encrypted)
+	a.ErrorIs(err, ErrUnknownKey)
+
+	// 设置观察者密钥后观察者可以解密，更换后轮换发送者密钥
+	for _, viewerKey := range []signatures.Key{signatures.Key("0000"), signatures.Key("1111")} {
+		reply, err := sessions[0].SetViewerKey(viewerKey)
+		if !a.NoError(err) || !a.NotNil(reply) {
+			return
+		}
+		broadcast(&chatv1.Message{From: metav1.ObjectMeta{UID: uids[0]}, Content: chatv1.MessageContent{SenderKey: reply}})
+		encrypted, err = sessions[0].Encrypt(&chatv1.TextMessageContent{Content: "hi viewers"})
+		if !a.NoError(err) {
+			return
+		}
+		text, err := DecryptAsViewer(viewerKey, uids[0], encrypted)
+		if a.NoError(err) {
+			a.Equal("hi viewers", text.Content)
+		}
+		text, err = sessions[1].Decrypt(uids[0], encrypted)
+		if a.NoError(err) {
+			a.Equal("hi viewers", text.Content)
+		}
+	}
+	_, err = DecryptAsViewer(signatures.Key("0000"), uids[0], encrypted)
+	a.Error(err)
+
+	// 成员离开后其余成员轮换密钥，离开的成员无法解密之后的消息
+	broadcast(&chatv1.Message{Content: chatv1.MessageContent{
+		Leave: &chatv1.MembersChangeMessageContent{User: metav1.ObjectMeta{UID: uids[2]}},
+	}})
+	encrypted, err = sessions[0].Encrypt(&chatv1.TextMessageContent{Content: "secret"})
+	if !a.NoError(err) {
+		return
+	}
+	text, err := sessions[1].Decrypt(uids[0], encrypted)
+	if a.NoError(err) {
+		a.Equal("secret", text.Content)
+	}
+	_, err = sessions[2].Decrypt(uids[0], encrypted)
+	a.ErrorIs(err, ErrUnknownKey)
+
+	// 同一 UID 使用其它身份的密钥分发消息被拒绝
+	signer, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if !a.NoError(err) {
+		return
+	}
+	impostor, err := NewSession(uids[1], signer)
+	if !a.NoError(err) {
+		return
+	}
+	content, err := impostor.Announce()
+	a.NoError(err)
+	_, err = sessions[0].Handle(&chatv1.Message{
+		From:    metav1.ObjectMeta{UID: uids[1]},
+		Content: chatv1.MessageContent{SenderKey: content},
+	})
+	a.ErrorIs(err, ErrIdentityMismatch)
+}
@@ -0,0 +1,441 @@
+package client
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+
+	chatv1 "github.com/yhlooo/bangbang/pkg/apis/chat/v1"
+	metav1 "github.com/yhlooo/bangbang/pkg/apis/meta/v1"
+	"github.com/yhlooo/bangbang/pkg/chats/channels"
+	"github.com/yhlooo/bangbang/pkg/chats/moderations"
+	"github.com/yhlooo/bangbang/pkg/chats/rooms"
+	"github.com/yhlooo/bangbang/pkg/chats/senderkeys"
+	"github.com/yhlooo/bangbang/pkg/discovery"
+	"github.com/yhlooo/bangbang/pkg/signatures"
+)
+
+// ErrRoomNotFound 没有找到可用的房间
+var ErrRoomNotFound = errors.New("RoomNotFound")
+
+// Options 加入房间选项
+type Options struct {
+	// 用户 UID ，为空时随机生成
+	UID metav1.UID
+	// 用户名
+	Name string
+	// 身份私钥，用于签名发出的消息、客户端证书和发送者密钥分发消息，房间按其公钥指纹禁言、封禁和踢出。
+	// 为 nil 时随机生成
+	IdentityKey crypto.Signer
+	// 直接连接的对端房间，可以是 https://HOST:PORT#sha256:... 形式的访问端点或邀请字符串。
+	// 不为空时依次尝试连接，不进行服务发现
+	Peers []string
+	// 服务发现后端，为空时使用 discovery.BackendUDP
+	DiscoveryBackends []string
+	// 服务发现地址（ UDP 后端），为空时使用 discovery.DefaultUDPAddrs
+	DiscoveryAddrs []string
+	// 服务发现使用的网卡，为 nil 时使用 discovery.DefaultInterfaceFilter
+	Interfaces *discovery.InterfaceFilter
+	// 等待发现房间的最长时间，为 0 时使用 DefaultJoinTimeout
+	Timeout time.Duration
+}
+
+// DefaultJoinTimeout 默认等待发现房间的最长时间
+const DefaultJoinTimeout = 10 * time.Second
+
+// Complete 补全选项
+func (o *Options) Complete() {
+	if o.UID.IsNil() {
+		o.UID = metav1.NewUID()
+	}
+	if len(o.DiscoveryBackends) == 0 {
+		o.DiscoveryBackends = []string{discovery.BackendUDP}
+	}
+	if o.Timeout == 0 {
+		o.Timeout = DefaultJoinTimeout
+	}
+}
+
+// Join 使用 PIN 码加入房间
+//
+// 在 opts.Timeout 内持续搜索使用相同 PIN 码的房间，检查访问端点可用性并校验房间签名，
+// 之后与房间的连接会绑定房间广播的服务端证书签名。指定 opts.Peers 时直接连接这些房间。
+// 在超时时间内没有找到可用房间时返回 ErrRoomNotFound 。
+func Join(ctx context.Context, pin string, opts Options) (*Client, error) {
+	if pin == "" {
+		return nil, errors.New("pin is required")
+	}
+	opts.Complete()
+	if opts.IdentityKey == nil {
+		priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("generate identity key error: %w", err)
+		}
+		opts.IdentityKey = priv
+	}
+
+	logger := logr.FromContextOrDiscard(ctx).WithName("client")
+	key := signatures.Key(pin)
+
+	endpoint, certSign, info, err := findRoom(ctx, key, opts)
+	if err != nil {
+		return nil, err
+	}
+	logger.V(1).Info(fmt.Sprintf("joined room %q on %q", info.UID, endpoint))
+
+	senderKeys, err := senderkeys.NewSession(opts.UID, opts.IdentityKey)
+	if err != nil {
+		return nil, fmt.Errorf("init sender keys error: %w", err)
+	}
+
+	// 连接的生命周期由 Close 控制，与 Join 的上下文无关
+	connCTX, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	keys := signatures.NewKeyHolder(key).WithIdentityKey(opts.IdentityKey)
+	c := &Client{
+		ctx:    connCTX,
+		cancel: cancel,
+		self: metav1.ObjectMeta{
+			UID:  opts.UID,
+			Name: opts.Name,
+		},
+		identity:   opts.IdentityKey,
+		senderKeys: senderKeys,
+		info:       info,
+		keys:       keys,
+		room:       rooms.NewRemoteRoomWithKeys(endpoint, certSign, keys),
+	}
+
+	// 房间设置了观察者 PIN 时，发出的消息需要附带使用它加密的发送者密钥
+	if list, err := c.room.ListModerations(connCTX); err != nil {
+		logger.Error(err, "list moderations error")
+	} else {
+		for i := range list.Items {
+			// 之后会公布发送者密钥，不需要发送返回的密钥分发消息
+			_ = c.handleViewerKey(connCTX, &list.Items[i])
+		}
+	}
+
+	// 以用户身份监听，使自己出现在成员列表中
+	presence, err := c.room.Listen(connCTX, c.self.DeepCopy())
+	if err != nil {
+		cancel()
+		_ = c.room.Close(connCTX)
+		return nil, fmt.Errorf("listen room %q error: %w", info.UID, err)
+	}
+	go func() {
+		for msg := range presence.Messages() {
+			c.handleMessage(connCTX, msg)
+		}
+	}()
+	c.presence = presence
+
+	// 公布自己的公钥，其它成员收到后会将它们的发送者密钥发给自己
+	content, err := c.senderKeys.Announce()
+	if err != nil {
+		_ = c.Close(connCTX)
+		return nil, fmt.Errorf("announce sender key error: %w", err)
+	}
+	c.sendSenderKey(connCTX, content)
+
+	return c, nil
+}
+
+// findRoom 查找可用的房间，返回访问端点、服务端证书签名和房间信息
+func findRoom(ctx context.Context, key signatures.Key, opts Options) (string, string, *chatv1.Room, error) {
+	if len(opts.Peers) != 0 {
+		return probePeers(ctx, key, opts.Peers, opts.Timeout)
+	}
+
+	discoverer, err := discovery.NewDiscoverer(opts.DiscoveryBackends, opts.DiscoveryAddrs, opts.Interfaces, false)
+	if err != nil {
+		return "", "", nil, fmt.Errorf("init discoverer error: %w", err)
+	}
+	room, info, err := searchRoom(ctx, discoverer, key, opts.Timeout)
+	if err != nil {
+		return "", "", nil, err
+	}
+	return room.AvailableEndpoint, room.Info.CertSign, info, nil
+}
+
+// probePeers 依次尝试连接指定的对端房间，返回第一个可用的房间
+func probePeers(
+	ctx context.Context,
+	key signatures.Key,
+	peers []string,
+	timeout time.Duration,
+) (string, string, *chatv1.Room, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var errs []error
+	for _, s := range peers {
+		peer, err := discovery.ParsePeer(key, s)
+		if err != nil {
+			return "", "", nil, err
+		}
+		endpoint, info, err := peer.Probe(ctx, key)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		return endpoint, peer.CertSign, info, nil
+	}
+	return "", "", nil, fmt.Errorf("%w: %w", ErrRoomNotFound, errors.Join(errs...))
+}
+
+// searchRoom 搜索可用的房间
+func searchRoom(
+	ctx context.Context,
+	d discovery.Discoverer,
+	key signatures.Key,
+	timeout time.Duration,
+) (*discovery.Room, *chatv1.Room, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	for {
+		roomList, err := d.Search(ctx, key, discovery.SearchOptions{
+			CheckAvailability: true,
+			EarlyExit:         true,
+		})
+		if err != nil {
+			return nil, nil, fmt.Errorf("search rooms error: %w", err)
+		}
+		for _, room := range roomList {
+			if room.AvailableEndpoint == "" {
+				continue
+			}
+			info := room.Info.DeepCopy()
+			return &room, info, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, nil, ErrRoomNotFound
+		default:
+		}
+	}
+}
+
+// Client 已加入房间的客户端
+type Client struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	self       metav1.ObjectMeta
+	identity   crypto.Signer
+	senderKeys *senderkeys.Session
+	info       *chatv1.Room
+	keys       *signatures.KeyHolder
+	room       rooms.Room
+	presence   channels.Channel
+
+	closeOnce sync.Once
+}
+
+// Self 返回当前用户信息
+func (c *Client) Self() metav1.ObjectMeta {
+	return *c.self.DeepCopy()
+}
+
+// Room 返回加入的房间信息
+func (c *Client) Room() *chatv1.Room {
+	return c.info.DeepCopy()
+}
+
+// Send 发送端到端加密的文本消息
+func (c *Client) Send(ctx context.Context, text string) error {
+	return c.SendMessage(ctx, &chatv1.Message{
+		APIMeta: metav1.NewAPIMeta(chatv1.KindMessage),
+		Content: chatv1.MessageContent{
+			Text: &chatv1.TextMessageContent{Content: text},
+		},
+	})
+}
+
+// SendMessage 发送消息
+//
+// 消息的发送人总是会被设置为当前用户，并使用身份私钥和房间密钥签名。
+// 文本内容总是使用发送者密钥加密后发送，不会以明文发送
+func (c *Client) SendMessage(ctx context.Context, msg *chatv1.Message) error {
+	msg = msg.DeepCopy()
+	msg.APIMeta = metav1.NewAPIMeta(chatv1.KindMessage)
+	msg.From = *c.self.DeepCopy()
+	if msg.Content.Text != nil {
+		encrypted, err := c.senderKeys.Encrypt(msg.Content.Text)
+		if err != nil {
+			return fmt.Errorf("encrypt message error: %w", err)
+		}
+		msg.Content.Text = nil
+		msg.Content.Encrypted = encrypted
+	}
+	if err := rooms.SignMessageAs(c.keys.Get(), c.identity, msg); err != nil {
+		return err
+	}
+	if err := c.room.CreateMessage(ctx, msg); err != nil {
+		return fmt.Errorf("create message error: %w", err)
+	}
+	return nil
+}
+
+// handleMessage 处理以用户身份监听收到的消息
+func (c *Client) handleMessage(ctx context.Context, msg *chatv1.Message) {
+	c.handleRekey(ctx, msg)
+	c.sendSenderKey(ctx, c.handleViewerKey(ctx, msg))
+
+	// 记录其它成员的发送者密钥，成员离开、被踢出或封禁时轮换自己的发送者密钥
+	reply, err := c.senderKeys.Handle(msg)
+	if err != nil {
+		logr.FromContextOrDiscard(ctx).Error(err, "handle sender key error")
+	}
+	c.sendSenderKey(ctx, reply)
+}
+
+// handleViewerKey 处理房间签发者设置观察者 PIN 的消息，返回需要发送的密钥分发消息内容
+func (c *Client) handleViewerKey(ctx context.Context, msg *chatv1.Message) *chatv1.SenderKeyMessageContent {
+	logger := logr.FromContextOrDiscard(ctx)
+
+	mod := msg.Content.Moderation
+	if mod == nil || mod.Action != chatv1.ModerationSetViewerKey {
+		return nil
+	}
+	issuer, err := moderations.Verify(mod)
+	if err != nil {
+		logger.Error(err, "verify viewer key error")
+		return nil
+	}
+	if issuer != c.info.Authority {
+		logger.Info(fmt.Sprintf("ignore viewer key from %s", issuer))
+		return nil
+	}
+	viewerKey, err := moderations.OpenViewerKey(c.keys.Get(), mod)
+	if err != nil {
+		logger.Error(err, "open viewer key error")
+		return nil
+	}
+	reply, err := c.senderKeys.SetViewerKey(viewerKey)
+	if err != nil {
+		logger.Error(err, "set viewer key error")
+	}
+	return reply
+}
+
+// sendSenderKey 发送密钥分发消息， content 为 nil 时不发送
+func (c *Client) sendSenderKey(ctx context.Context, content *chatv1.SenderKeyMessageContent) {
+	if content == nil {
+		return
+	}
+	if err := c.SendMessage(ctx, &chatv1.Message{
+		Content: chatv1.MessageContent{SenderKey: content},
+	}); err != nil {
+		logr.FromContextOrDiscard(ctx).Error(err, "send sender key error")
+	}
+}
+
+// handleRekey 处理房间签发者更换房间密钥的消息，之后使用新密钥
+func (c *Client) handleRekey(ctx context.Context, msg *chatv1.Message) {
+	logger := logr.FromContextOrDiscard(ctx)
+
+	mod := msg.Content.Moderation
+	if mod == nil || mod.Action != chatv1.ModerationRekey {
+		return
+	}
+	issuer, err := moderations.Verify(mod)
+	if err != nil {
+		logger.Error(err, "verify rekey error")
+		return
+	}
+	if issuer != c.info.Authority || time.Since(mod.IssueTime) > moderations.RekeyMaxAge {
+		logger.Info(fmt.Sprintf("ignore rekey from %s", issuer))
+		return
+	}
+	newKey, err := moderations.OpenRekey(c.keys.Get(), mod)
+	if err != nil {
+		logger.Error(err, "open rekey error")
+		return
+	}
+	logger.Info("room key changed")
+	c.keys.Set(newKey)
+
+	// 观察者 PIN 使用旧密钥加密，更换密钥后失效
+	reply, err := c.senderKeys.SetViewerKey(nil)
+	if err != nil {
+		logger.Error(err, "reset viewer key error")
+	}
+	c.sendSenderKey(ctx, reply)
+}
+
+// Subscribe 订阅房间内的消息
+//
+// 端到端加密的消息会被解密为 content.text ，还没有收到发送者密钥的消息仍以 content.encrypted 的形式出现。
+// 返回的通道在 Client 关闭或者调用其 Close 方法后关闭
+func (c *Client) Subscribe(ctx context.Context) (channels.Channel, error) {
+	listenCTX := logr.NewContext(c.ctx, logr.FromContextOrDiscard(ctx))
+	ch, err := c.room.Listen(listenCTX, nil)
+	if err != nil {
+		return nil, fmt.Errorf("listen room error: %w", err)
+	}
+
+	decrypted := channels.NewLocalChannel(10)
+	go func() {
+		<-decrypted.Done()
+		_ = ch.Close()
+	}()
+	go func() {
+		defer func() { _ = decrypted.Close() }()
+		for msg := range ch.Messages() {
+			if err := decrypted.Send(c.decryptMessage(listenCTX, msg)); err != nil {
+				if errors.Is(err, channels.ErrChannelClosed) {
+					return
+				}
+				logr.FromContextOrDiscard(listenCTX).Error(err, "send message error")
+			}
+		}
+	}()
+	return decrypted, nil
+}
+
+// decryptMessage 解密端到端加密的消息，返回解密后的副本，无法解密时原样返回
+func (c *Client) decryptMessage(ctx context.Context, msg *chatv1.Message) *chatv1.Message {
+	if msg.Content.Encrypted == nil {
+		return msg
+	}
+	text, err := c.senderKeys.Decrypt(msg.From.UID, msg.Content.Encrypted)
+	if err != nil {
+		logr.FromContextOrDiscard(ctx).V(1).Info(fmt.Sprintf("decrypt message %s error: %v", msg.UID, err))
+		return msg
+	}
+	msg = msg.DeepCopy()
+	msg.ResetRawJSON()
+	msg.Content.Encrypted = nil
+	msg.Content.Text = text
+	return msg
+}
+
+// Members 列出房间成员
+func (c *Client) Members(ctx context.Context) ([]chatv1.User, error) {
+	members, err := c.room.ListMembers(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("list members error: %w", err)
+	}
+	return members.Items, nil
+}
+
+// Close 离开房间并关闭所有订阅
+func (c *Client) Close(ctx context.Context) error {
+	var err error
+	c.closeOnce.Do(func() {
+		_ = c.presence.Close()
+		err = c.room.Close(ctx)
+		c.cancel()
+	})
+	return err
+}
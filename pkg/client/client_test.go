@@ -0,0 +1,160 @@
+package client_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	chatv1 "github.com/yhlooo/bangbang/pkg/apis/chat/v1"
+	metav1 "github.com/yhlooo/bangbang/pkg/apis/meta/v1"
+	"github.com/yhlooo/bangbang/pkg/chats/channels"
+	"github.com/yhlooo/bangbang/pkg/chats/rooms"
+	"github.com/yhlooo/bangbang/pkg/client"
+	"github.com/yhlooo/bangbang/pkg/servers"
+	"github.com/yhlooo/bangbang/pkg/signatures"
+)
+
+// TestJoin 测试 Join
+func TestJoin(t *testing.T) {
+	a := assert.New(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	room, peer := startRoom(t, ctx, "7134")
+
+	alice, err := client.Join(ctx, "7134", client.Options{Name: "alice", Peers: []string{peer}})
+	if !a.NoError(err) {
+		return
+	}
+	defer func() { _ = alice.Close(ctx) }()
+	bob, err := client.Join(ctx, "7134", client.Options{Name: "bob", Peers: []string{peer}})
+	if !a.NoError(err) {
+		return
+	}
+	defer func() { _ = bob.Close(ctx) }()
+
+	info, err := room.Info(ctx)
+	a.NoError(err)
+	a.Equal(info.UID, alice.Room().UID)
+
+	// 两个客户端都以各自的身份公钥出现在成员列表中
+	members, err := alice.Members(ctx)
+	a.NoError(err)
+	names := map[string]string{}
+	for _, m := range members {
+		names[m.Name] = m.Key
+	}
+	a.NotEmpty(names["alice"])
+	a.NotEmpty(names["bob"])
+	a.NotEqual(names["alice"], names["bob"])
+
+	// PIN 不正确时找不到房间
+	_, err = client.Join(ctx, "1234", client.Options{Peers: []string{peer}, Timeout: time.Second})
+	a.ErrorIs(err, client.ErrRoomNotFound)
+}
+
+// TestClient_Send 测试 Client.Send 和 Client.Subscribe
+func TestClient_Send(t *testing.T) {
+	a := assert.New(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	room, peer := startRoom(t, ctx, "7134")
+
+	alice, err := client.Join(ctx, "7134", client.Options{Name: "alice", Peers: []string{peer}})
+	if !a.NoError(err) {
+		return
+	}
+	defer func() { _ = alice.Close(ctx) }()
+	bob, err := client.Join(ctx, "7134", client.Options{Name: "bob", Peers: []string{peer}})
+	if !a.NoError(err) {
+		return
+	}
+
+	sub, err := bob.Subscribe(ctx)
+	if !a.NoError(err) {
+		return
+	}
+	raw, err := room.Listen(ctx, nil)
+	if !a.NoError(err) {
+		return
+	}
+	defer func() { _ = raw.Close() }()
+
+	// 发送者密钥分发完成前发出的消息无法解密，重试直到对方解密成功
+	var received *chatv1.Message
+	for i := 0; i < 10 && received == nil; i++ {
+		text := fmt.Sprintf("hello %d", i)
+		a.NoError(alice.Send(ctx, text))
+		received = waitText(sub, text)
+	}
+	if !a.NotNil(received, "message not decrypted") {
+		return
+	}
+	a.Equal(alice.Self().UID, received.From.UID)
+	a.Nil(received.Content.Encrypted)
+
+	// 房间中只有密文
+	sawEncrypted := false
+	for !sawEncrypted {
+		select {
+		case msg := <-raw.Messages():
+			a.Nil(msg.Content.Text)
+			sawEncrypted = msg.From.UID == alice.Self().UID && msg.Content.Encrypted != nil
+		case <-time.After(time.Second):
+			a.Fail("encrypted message not received")
+			return
+		}
+	}
+
+	// 关闭客户端后订阅随之关闭
+	a.NoError(bob.Close(ctx))
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case _, ok := <-sub.Messages():
+			if !ok {
+				return
+			}
+		case <-timeout:
+			a.Fail("subscription not closed")
+			return
+		}
+	}
+}
+
+// startRoom 在本地回环地址上运行使用 pin 的房间，返回房间和用于 Options.Peers 的对端地址
+func startRoom(t *testing.T, ctx context.Context, pin string) (rooms.Room, string) {
+	keys := signatures.NewKeyHolder(signatures.Key(pin))
+	room := rooms.NewLocalRoom(keys, metav1.NewUID(), "owner", rooms.LocalRoomOptions{})
+	addr, certSign, _, err := servers.RunServer(ctx, servers.Options{
+		ListenAddr: "127.0.0.1:0",
+		Room:       room,
+		Keys:       keys,
+	})
+	if err != nil {
+		t.Fatalf("run server error: %v", err)
+	}
+	return room, fmt.Sprintf("https://%s#%s", addr, certSign)
+}
+
+// waitText 等待通道收到指定内容的文本消息
+func waitText(ch channels.Channel, text string) *chatv1.Message {
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case msg, ok := <-ch.Messages():
+			if !ok {
+				return nil
+			}
+			if msg.Content.Text != nil && msg.Content.Text.Content == text {
+				return msg
+			}
+		case <-timeout:
+			return nil
+		}
+	}
+}
@@ -0,0 +1,15 @@
+// Package client 提供将 BangBang 嵌入其它程序使用的客户端 SDK
+//
+// 通过 Join 使用 PIN 码加入同一局域网内的房间，加入过程会完成服务发现、访问端点可用性检查及服务端证书绑定，
+// 之后可通过返回的 *Client 发送、订阅消息和列出成员，文本消息使用发送者密钥端到端加密。
+//
+// 兼容性保证：
+//
+// 本包导出的类型、函数和方法遵循语义化版本（ https://semver.org ）。
+// 在同一个主版本（ APIVersion ）内，不会删除或修改已导出标识符的签名与语义，仅会新增选项字段、方法或函数；
+// 选项结构体新增的字段的零值总是保持原有行为。
+// 本包以外的 pkg 下的其它包为内部实现，不提供兼容性保证。
+package client
+
+// APIVersion 客户端 SDK 的 API 版本
+const APIVersion = "v1"
@@ -0,0 +1,68 @@
+package client_test
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/yhlooo/bangbang/pkg/client"
+)
+
+// 加入房间并发送一条通知
+func ExampleJoin() {
+	ctx := context.Background()
+
+	c, err := client.Join(ctx, "7134", client.Options{Name: "build-bot"})
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer func() { _ = c.Close(ctx) }()
+
+	if err := c.Send(ctx, "build #42 succeeded"); err != nil {
+		fmt.Println(err)
+	}
+}
+
+// 订阅房间内的文本消息
+func ExampleClient_Subscribe() {
+	ctx := context.Background()
+
+	c, err := client.Join(ctx, "7134", client.Options{Name: "listener"})
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer func() { _ = c.Close(ctx) }()
+
+	ch, err := c.Subscribe(ctx)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	for msg := range ch.Messages() {
+		if msg.Content.Text != nil {
+			fmt.Printf("%s: %s\n", msg.From.Name, msg.Content.Text.Content)
+		}
+	}
+}
+
+// 列出房间成员
+func ExampleClient_Members() {
+	ctx := context.Background()
+
+	c, err := client.Join(ctx, "7134", client.Options{})
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer func() { _ = c.Close(ctx) }()
+
+	members, err := c.Members(ctx)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	for _, member := range members {
+		fmt.Println(member.UID, member.Name)
+	}
+}
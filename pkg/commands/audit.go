@@ -0,0 +1,156 @@
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+
+	"github.com/yhlooo/bangbang/pkg/audit"
+	"github.com/yhlooo/bangbang/pkg/identities"
+)
+
+// defaultAuditLogPath 默认安全事件日志路径
+func defaultAuditLogPath() string {
+	return filepath.Join(identities.DefaultHomeDir(), "audit.log")
+}
+
+// NewAuditOptions 创建默认 AuditOptions
+func NewAuditOptions() AuditOptions {
+	return AuditOptions{
+		Since: 24 * time.Hour,
+	}
+}
+
+// AuditOptions audit 子命令选项
+type AuditOptions struct {
+	// 只显示最近这段时间内的事件，为 0 时显示全部
+	Since time.Duration
+	// 只显示这些类型的事件
+	Types []string
+	// 只显示来自这些地址的事件
+	Sources []string
+	// 输出格式
+	OutputFormat string
+}
+
+// Validate 校验选项
+func (o *AuditOptions) Validate() error {
+	switch o.OutputFormat {
+	case "", "json":
+	default:
+		return fmt.Errorf("invalid output format: %s (must be 'json')", o.OutputFormat)
+	}
+	return nil
+}
+
+// AddPFlags 将选项绑定到命令行参数
+func (o *AuditOptions) AddPFlags(fs *pflag.FlagSet) {
+	fs.DurationVar(&o.Since, "since", o.Since, "Only show events in this duration, 0 to show all")
+	fs.StringSliceVarP(&o.Types, "type", "t", o.Types, fmt.Sprintf("Only show events of these types. One or more of %q", []audit.EventType{
+		audit.EventDiscoverySignatureInvalid,
+		audit.EventClientCertificateRejected,
+		audit.EventServerCertificateMismatch,
+		audit.EventPeerCertificateChanged,
+		audit.EventRequestRejected,
+		audit.EventUserKicked,
+		audit.EventUserBanned,
+		audit.EventRoomRekeyed,
+	}))
+	fs.StringSliceVar(&o.Sources, "source", o.Sources, "Only show events from these addresses")
+	fs.StringVarP(&o.OutputFormat, "output-format", "f", o.OutputFormat, "Output format. One of (json).")
+}
+
+// newAuditCommand 创建 audit 子命令
+func newAuditCommand() *cobra.Command {
+	opts := NewAuditOptions()
+
+	cmd := &cobra.Command{
+		Use:   "audit",
+		Short: "Show security events recorded by chat (failed signatures, rejected certificates and requests, kicks, rekeys)",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := opts.Validate(); err != nil {
+				return err
+			}
+
+			events, err := audit.ReadEvents(defaultAuditLogPath())
+			if err != nil {
+				return err
+			}
+			events = filterAuditEvents(events, opts, time.Now())
+
+			if opts.OutputFormat == "json" {
+				for _, e := range events {
+					raw, err := json.Marshal(e)
+					if err != nil {
+						return err
+					}
+					fmt.Println(string(raw))
+				}
+				return nil
+			}
+			showAuditEvents(events)
+			return nil
+		},
+	}
+
+	opts.AddPFlags(cmd.Flags())
+
+	return cmd
+}
+
+// filterAuditEvents 按选项过滤事件
+func filterAuditEvents(events []audit.Event, opts AuditOptions, now time.Time) []audit.Event {
+	var ret []audit.Event
+	for _, e := range events {
+		if opts.Since > 0 && e.Time.Before(now.Add(-opts.Since)) {
+			continue
+		}
+		if len(opts.Types) > 0 && !slices.Contains(opts.Types, string(e.Type)) {
+			continue
+		}
+		if len(opts.Sources) > 0 && !slices.Contains(opts.Sources, e.Source) {
+			continue
+		}
+		ret = append(ret, e)
+	}
+	return ret
+}
+
+// showAuditEvents 输出事件
+//
+// 事件描述可能包含远端提供的文本，转义其中的控制字符
+func showAuditEvents(events []audit.Event) {
+	if len(events) == 0 {
+		fmt.Println("No security events.")
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	_, _ = fmt.Fprintln(w, "TIME\tTYPE\tSOURCE\tMESSAGE")
+	for _, e := range events {
+		source := escapeAuditText(e.Source)
+		if source == "" {
+			source = "-"
+		}
+		message := escapeAuditText(e.Message)
+		if e.Suppressed > 0 {
+			message += fmt.Sprintf(" (+%d suppressed)", e.Suppressed)
+		}
+		_, _ = fmt.Fprintf(w, "%s\t%s\t%s\t%s\n",
+			e.Time.Local().Format(time.DateTime), escapeAuditText(string(e.Type)), source, message)
+	}
+	_ = w.Flush()
+}
+
+// escapeAuditText 转义文本中的控制字符和不可见字符
+func escapeAuditText(s string) string {
+	quoted := strconv.QuoteToGraphic(s)
+	return quoted[1 : len(quoted)-1]
+}
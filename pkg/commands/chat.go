@@ -3,13 +3,22 @@ package commands
 import (
 	"bytes"
 	"context"
+	"crypto"
 	"fmt"
+	"slices"
 	"text/template"
+	"time"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
 
+	chatv1 "github.com/yhlooo/bangbang/pkg/apis/chat/v1"
 	metav1 "github.com/yhlooo/bangbang/pkg/apis/meta/v1"
+	"github.com/yhlooo/bangbang/pkg/audit"
+	"github.com/yhlooo/bangbang/pkg/chats/moderations"
+	"github.com/yhlooo/bangbang/pkg/chats/rooms"
+	"github.com/yhlooo/bangbang/pkg/discovery"
+	"github.com/yhlooo/bangbang/pkg/identities"
 	"github.com/yhlooo/bangbang/pkg/managers"
 	"github.com/yhlooo/bangbang/pkg/signatures"
 	uitea "github.com/yhlooo/bangbang/pkg/ui/tty/tea"
@@ -18,8 +27,16 @@ import (
 // NewChatOptions 创建默认 ChatOptions
 func NewChatOptions() ChatOptions {
 	return ChatOptions{
-		HTTPAddr:      ":0",
-		DiscoveryAddr: "224.0.0.1:7134",
+		HTTPAddr:          ":0",
+		DiscoveryBackends: []string{discovery.BackendUDP},
+		DiscoveryAddrs:    discovery.DefaultUDPAddrs,
+		SweepAfter:        10 * time.Second,
+		AnnounceInterval:  discovery.DefaultAnnounceInterval,
+		ExcludeInterfaces: discovery.DefaultExcludedInterfaces,
+		RateLimits:        rooms.DefaultRateLimits,
+		MessageWindow:     rooms.DefaultMessageWindow,
+		PINPolicy:         signatures.PINPolicyWarn,
+		PINStyle:          signatures.PINStyleDigits,
 	}
 }
 
@@ -29,39 +46,124 @@ type ChatOptions struct {
 	Name string
 	// HTTP 服务监听地址
 	HTTPAddr string
+	// 服务发现后端
+	DiscoveryBackends []string
 	// 服务发现地址
-	DiscoveryAddr string
+	DiscoveryAddrs []string
+	// 多久没有发现房间后回退到单播扫描子网
+	SweepAfter time.Duration
+	// 主动广播房间信息的平均间隔
+	AnnounceInterval time.Duration
+	// 使用的网卡
+	Interfaces []string
+	// 排除的网卡
+	ExcludeInterfaces []string
+	// 手动指定的上游房间访问端点或邀请
+	Peers []string
+	// 使用临时身份，不读写 ~/.bangbang
+	Ephemeral bool
+	// 新成员加入需要批准
+	Admission bool
+	// 允许只读观察者使用的观察者 PIN 码
+	ViewerPIN string
+	// 以只读观察者身份观察房间，参数为观察者 PIN 码
+	Observe bool
+	// 观察时让成员看到自己
+	Visible bool
+	// 按发送人限制消息
+	RateLimits rooms.RateLimits
+	// 消息签名时间窗口
+	MessageWindow time.Duration
+	// 弱 PIN 码处理策略
+	PINPolicy signatures.PINPolicy
+	// 没有指定 PIN 码时生成的 PIN 码样式
+	PINStyle signatures.PINStyle
+}
+
+// Validate 校验选项是否合法
+func (o *ChatOptions) Validate() error {
+	if err := o.PINPolicy.Validate(); err != nil {
+		return err
+	}
+	if !slices.Contains(signatures.PINStyles, o.PINStyle) {
+		return fmt.Errorf("unknown PIN style: %q (expected one of %q)", o.PINStyle, signatures.PINStyles)
+	}
+	return nil
 }
 
 // AddPFlags 将选项绑定到命令行参数
 func (o *ChatOptions) AddPFlags(fs *pflag.FlagSet) {
 	fs.StringVarP(&o.Name, "name", "n", o.Name, "Your name")
 	fs.StringVarP(&o.HTTPAddr, "listen", "l", o.HTTPAddr, "HTTP listen address")
-	fs.StringVar(&o.DiscoveryAddr, "discovery-addr", o.DiscoveryAddr, "Transponder address")
+	fs.StringSliceVar(&o.DiscoveryBackends, "discovery", o.DiscoveryBackends, fmt.Sprintf(
+		"Discovery backends, multiple backends run at the same time. One or more of %q", discovery.Backends,
+	))
+	fs.StringSliceVar(&o.DiscoveryAddrs, "discovery-addr", o.DiscoveryAddrs, "Transponder addresses (for udp backend)")
+	fs.DurationVar(&o.SweepAfter, "sweep-after", o.SweepAfter,
+		"Fall back to unicast sweeping local subnets if no room is found by multicast for this long (0 to disable)")
+	fs.DurationVar(&o.AnnounceInterval, "announce-interval", o.AnnounceInterval,
+		"Average interval of proactively announcing the room (for udp backend, 0 to disable)")
+	addInterfacesPFlags(fs, &o.Interfaces, &o.ExcludeInterfaces)
+	fs.StringSliceVar(&o.Peers, "peer", o.Peers,
+		"Join the room via these endpoints (https://HOST:PORT#sha256:...) or invites instead of discovery")
+	fs.BoolVar(&o.Ephemeral, "ephemeral", o.Ephemeral,
+		"Use a temporary identity and certificate, do not remember peers or record security events")
+	fs.BoolVar(&o.Admission, "admission", o.Admission,
+		"Require your approval for new members (takes effect while your room is the root of the room tree)")
+	fs.StringVar(&o.ViewerPIN, "viewer-pin", o.ViewerPIN,
+		"Let read-only observers watch the room with this viewer PIN "+
+			"(takes effect while your room is the root of the room tree)")
+	fs.BoolVar(&o.Observe, "observe", o.Observe,
+		"Watch a room read-only, the argument is the viewer PIN set by the room authority")
+	fs.BoolVar(&o.Visible, "visible", o.Visible,
+		"Show yourself in the member list while observing (with --observe)")
+	fs.IntVar(&o.RateLimits.MaxMessageBytes, "max-message-size", o.RateLimits.MaxMessageBytes,
+		"Max size in bytes of a message relayed by your room (0 for unlimited)")
+	fs.Float64Var(&o.RateLimits.MessageRate, "message-rate", o.RateLimits.MessageRate,
+		"Messages per second allowed from each sender through your room (0 for unlimited)")
+	fs.IntVar(&o.RateLimits.MessageBurst, "message-burst", o.RateLimits.MessageBurst,
+		"Burst of messages allowed from each sender through your room")
+	fs.Float64Var(&o.RateLimits.ByteRate, "byte-rate", o.RateLimits.ByteRate,
+		"Bytes per second allowed from each sender through your room (0 for unlimited)")
+	fs.IntVar(&o.RateLimits.ByteBurst, "byte-burst", o.RateLimits.ByteBurst,
+		"Burst of bytes allowed from each sender through your room")
+	fs.DurationVar(&o.MessageWindow, "message-window", o.MessageWindow,
+		"Reject messages signed longer than this ago or ahead by your room, older messages can not be replayed")
+	fs.StringVar((*string)(&o.PINPolicy), "pin-policy", string(o.PINPolicy), fmt.Sprintf(
+		"What to do with weak room or viewer PINs, one of %q", signatures.PINPolicies,
+	))
+	fs.StringVar((*string)(&o.PINStyle), "pin-style", string(o.PINStyle), fmt.Sprintf(
+		"Style of the PIN generated when no PIN is specified, one of %q", signatures.PINStyles,
+	))
 }
 
 var chatExampleTpl = template.Must(template.New("ChatCommand").
-	Parse(`# Create or join a room using the specified PIN code. (e.g. 7134)
-{{ .CommandName }} 7134
+	Parse(`# Create a room with a generated strong PIN code, and share the PIN code shown in the chat.
+{{ .CommandName }}
+{{ .CommandName }} --pin-style words
+
+# Create or join a room using the specified PIN code. (e.g. 739104628351)
+{{ .CommandName }} 739104628351
+
+# Join a room directly when discovery does not work. (e.g. across VLANs)
+{{ .CommandName }} 739104628351 --peer https://192.168.1.2:41234#sha256:...
+{{ .CommandName }} 739104628351 --peer bang-invite:...
+
+# Let others watch the room read-only with a separate viewer PIN, and watch it with that PIN.
+{{ .CommandName }} 739104628351 --viewer-pin 582039174610
+{{ .CommandName }} --observe 582039174610
 `))
 
 func newChatCommand(parentName string) *cobra.Command {
-	exampleBuff := &bytes.Buffer{}
-	if err := chatExampleTpl.Execute(exampleBuff, map[string]interface{}{
-		"CommandName": parentName + " chat",
-	}); err != nil {
-		panic(err)
-	}
-
 	opts := NewChatOptions()
 
 	cmd := &cobra.Command{
-		Use:     "chat PIN",
+		Use:     "chat [PIN]",
 		Short:   "Start chat",
-		Example: exampleBuff.String(),
-		Args:    cobra.ExactArgs(1),
+		Example: chatExample(parentName + " chat"),
+		Args:    cobra.MaximumNArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return runChat(cmd.Context(), opts, signatures.Key(args[0]))
+			return runChatCommand(cmd.Context(), opts, args)
 		},
 	}
 
@@ -70,21 +172,122 @@ func newChatCommand(parentName string) *cobra.Command {
 	return cmd
 }
 
-// run 运行
-func runChat(ctx context.Context, opts ChatOptions, key signatures.Key) error {
-	selfUID := metav1.NewUID()
+// chatExample 返回以 commandName 运行 chat 的示例
+func chatExample(commandName string) string {
+	exampleBuff := &bytes.Buffer{}
+	if err := chatExampleTpl.Execute(exampleBuff, map[string]interface{}{
+		"CommandName": commandName,
+	}); err != nil {
+		panic(err)
+	}
+	return exampleBuff.String()
+}
+
+// runChatCommand 运行 chat 命令
+//
+// 没有指定 PIN 码时生成强随机 PIN 码创建房间，并在聊天中醒目地展示。
+// 指定的房间 PIN 码和观察者 PIN 码按 opts.PINPolicy 检查，观察时使用的是别人设置的观察者 PIN 码，不检查
+func runChatCommand(ctx context.Context, opts ChatOptions, args []string) error {
+	if err := opts.Validate(); err != nil {
+		return err
+	}
+	if opts.Observe {
+		if len(args) == 0 {
+			return fmt.Errorf("viewer PIN is required to observe a room")
+		}
+		return runObserve(ctx, opts, signatures.Key(args[0]))
+	}
+
+	var (
+		key    signatures.Key
+		banner string
+	)
+	if len(args) == 0 {
+		var err error
+		key, err = signatures.GeneratePIN(opts.PINStyle)
+		if err != nil {
+			return fmt.Errorf("generate PIN error: %w", err)
+		}
+		banner = fmt.Sprintf("Room PIN: %s\n\nShare it with the people you want to chat with. Type /pin to show it again.", key)
+	} else {
+		key = signatures.Key(args[0])
+		if _, err := opts.PINPolicy.Check(key); err != nil {
+			return fmt.Errorf("room PIN: %w (use --pin-policy to change the policy)", err)
+		}
+	}
+	if opts.ViewerPIN != "" {
+		if _, err := opts.PINPolicy.Check(signatures.Key(opts.ViewerPIN)); err != nil {
+			return fmt.Errorf("viewer PIN: %w (use --pin-policy to change the policy)", err)
+		}
+	}
+	return runChat(ctx, opts, key, banner)
+}
+
+// runChat 使用房间 PIN 码 key 运行聊天，banner 不为空时在聊天中醒目地展示
+func runChat(ctx context.Context, opts ChatOptions, key signatures.Key, banner string) error {
+	// 加载身份
+	identity, err := loadIdentity(opts.Ephemeral)
+	if err != nil {
+		return err
+	}
+	knownPeers := identities.NewKnownPeers("")
+	if !opts.Ephemeral {
+		knownPeers = identities.NewKnownPeers(identities.DefaultKnownPeersPath())
+		recorder := audit.NewRecorder(defaultAuditLogPath())
+		defer recorder.Close()
+		ctx = audit.NewContext(ctx, recorder)
+	}
+	selfUID := identity.UID
+
+	peers := make([]*discovery.Peer, 0, len(opts.Peers))
+	for _, s := range opts.Peers {
+		peer, err := discovery.ParsePeer(key, s)
+		if err != nil {
+			return err
+		}
+		peers = append(peers, peer)
+	}
 
 	mgr, err := managers.NewManager(managers.Options{
-		Key:           key,
-		OwnerUID:      selfUID,
-		OwnerName:     opts.Name,
-		HTTPAddr:      opts.HTTPAddr,
-		DiscoveryAddr: opts.DiscoveryAddr,
+		Key:               key,
+		OwnerUID:          selfUID,
+		OwnerName:         opts.Name,
+		HTTPAddr:          opts.HTTPAddr,
+		DiscoveryBackends: opts.DiscoveryBackends,
+		DiscoveryAddrs:    opts.DiscoveryAddrs,
+		SweepAfter:        opts.SweepAfter,
+		AnnounceInterval:  opts.AnnounceInterval,
+		Interfaces: &discovery.InterfaceFilter{
+			Allow: opts.Interfaces,
+			Deny:  opts.ExcludeInterfaces,
+		},
+		Peers:         peers,
+		Certificate:   &identity.Certificate,
+		KnownPeers:    knownPeers,
+		RateLimits:    opts.RateLimits,
+		MessageWindow: opts.MessageWindow,
 	})
 	if err != nil {
 		return fmt.Errorf("init manager error: %w", err)
 	}
 
+	signer, _ := identity.Certificate.PrivateKey.(crypto.Signer)
+	if opts.Admission {
+		content := &chatv1.ModerationMessageContent{Action: chatv1.ModerationEnableAdmission}
+		if err := createOwnerModeration(ctx, mgr.SelfRoom(ctx), mgr.Keys().Get(), signer, selfUID, content); err != nil {
+			return fmt.Errorf("enable admission error: %w", err)
+		}
+	}
+	if opts.ViewerPIN != "" {
+		content, err := moderations.NewViewerKey(mgr.Keys().Get(), signatures.Key(opts.ViewerPIN))
+		if err != nil {
+			return err
+		}
+		if err := createOwnerModeration(ctx, mgr.SelfRoom(ctx), mgr.Keys().Get(), signer, selfUID, content); err != nil {
+			return fmt.Errorf("set viewer PIN error: %w", err)
+		}
+	}
+
 	// 运行服务
 	if _, err := mgr.StartServer(ctx); err != nil {
 		return fmt.Errorf("start server error: %w", err)
@@ -101,9 +304,140 @@ func runChat(ctx context.Context, opts ChatOptions, key signatures.Key) error {
 	}
 
 	// 运行 UI
-	ui := uitea.NewChatUI(mgr.SelfRoom(ctx), &metav1.ObjectMeta{
+	ui := uitea.NewChatUI(mgr.SelfRoom(ctx), mgr.Keys(), &metav1.ObjectMeta{
 		UID:  selfUID,
 		Name: opts.Name,
-	})
+	}).WithWarnings(mgr.Warnings()).WithViewerKeys(mgr.ViewerKeys()).WithPINPolicy(opts.PINPolicy)
+	if banner != "" {
+		ui = ui.WithBanner(banner)
+	}
+	if signer != nil {
+		ui = ui.WithIdentityKey(signer)
+	}
 	return ui.Run(ctx)
 }
+
+// runObserve 以只读观察者身份观察房间
+//
+// 不运行自己的房间、服务和应答机，直接连接使用观察者密钥 viewerKey 找到的房间
+func runObserve(ctx context.Context, opts ChatOptions, viewerKey signatures.Key) error {
+	identity, err := loadIdentity(opts.Ephemeral)
+	if err != nil {
+		return err
+	}
+	if !opts.Ephemeral {
+		recorder := audit.NewRecorder(defaultAuditLogPath())
+		defer recorder.Close()
+		ctx = audit.NewContext(ctx, recorder)
+	}
+
+	endpoint, certSign, err := findObservedRoom(ctx, opts, viewerKey)
+	if err != nil {
+		return err
+	}
+
+	signer, _ := identity.Certificate.PrivateKey.(crypto.Signer)
+	keys := signatures.NewKeyHolder(viewerKey).WithIdentityKey(signer)
+	return uitea.NewChatUI(rooms.NewRemoteRoomWithKeys(endpoint, certSign, keys), keys, &metav1.ObjectMeta{
+		UID:  identity.UID,
+		Name: opts.Name,
+	}).WithObserver(opts.Visible).Run(ctx)
+}
+
+// findObservedRoom 使用观察者密钥查找可以观察的房间，返回可用的访问端点及房间证书签名
+//
+// 指定了 opts.Peers 时依次尝试，否则持续通过服务发现搜索直到找到或上下文结束
+func findObservedRoom(ctx context.Context, opts ChatOptions, viewerKey signatures.Key) (string, string, error) {
+	if len(opts.Peers) > 0 {
+		var lastErr error
+		for _, s := range opts.Peers {
+			peer, err := discovery.ParsePeer(viewerKey, s)
+			if err != nil {
+				return "", "", err
+			}
+			endpoint, _, err := peer.Probe(ctx, viewerKey)
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			return endpoint, peer.CertSign, nil
+		}
+		return "", "", fmt.Errorf("no peer available: %w", lastErr)
+	}
+
+	discoverer, err := discovery.NewDiscoverer(opts.DiscoveryBackends, opts.DiscoveryAddrs, &discovery.InterfaceFilter{
+		Allow: opts.Interfaces,
+		Deny:  opts.ExcludeInterfaces,
+	}, opts.AnnounceInterval > 0)
+	if err != nil {
+		return "", "", fmt.Errorf("init discoverer error: %w", err)
+	}
+	for {
+		roomList, err := discoverer.Search(ctx, viewerKey, discovery.SearchOptions{
+			CheckAvailability: true,
+			EarlyExit:         true,
+		})
+		if err != nil {
+			return "", "", fmt.Errorf("search rooms error: %w", err)
+		}
+		for _, room := range roomList {
+			if room.AvailableEndpoint != "" {
+				return room.AvailableEndpoint, room.Info.CertSign, nil
+			}
+		}
+		if err := ctx.Err(); err != nil {
+			return "", "", err
+		}
+	}
+}
+
+// loadIdentity 加载身份， ephemeral 为 true 时使用临时身份
+func loadIdentity(ephemeral bool) (*identities.Identity, error) {
+	var (
+		identity *identities.Identity
+		err      error
+	)
+	if ephemeral {
+		identity, err = identities.New()
+	} else {
+		identity, err = identities.LoadOrCreate(identities.DefaultIdentityDir())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("load identity error: %w", err)
+	}
+	return identity, nil
+}
+
+// createOwnerModeration 以房主身份在自己的房间签发管理操作
+func createOwnerModeration(
+	ctx context.Context,
+	room rooms.Room,
+	key signatures.Key,
+	signer crypto.Signer,
+	selfUID metav1.UID,
+	content *chatv1.ModerationMessageContent,
+) error {
+	if signer == nil {
+		return fmt.Errorf("identity key can not sign moderations")
+	}
+	if err := moderations.Sign(signer, content); err != nil {
+		return err
+	}
+	msg := &chatv1.Message{
+		APIMeta: metav1.NewAPIMeta(chatv1.KindMessage),
+		From:    metav1.ObjectMeta{UID: selfUID},
+		Content: chatv1.MessageContent{Moderation: content},
+	}
+	if err := rooms.SignMessageAs(key, signer, msg); err != nil {
+		return err
+	}
+	return room.CreateMessage(ctx, msg)
+}
+
+// addInterfacesPFlags 绑定网卡选择相关命令行参数
+func addInterfacesPFlags(fs *pflag.FlagSet, allow, deny *[]string) {
+	fs.StringSliceVar(allow, "interface", *allow,
+		"Only use network interfaces matching these patterns (e.g. 'en*'), default all")
+	fs.StringSliceVar(deny, "exclude-interface", *deny,
+		"Do not use network interfaces matching these patterns, virtual bridges are excluded by default")
+}
@@ -0,0 +1,108 @@
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+
+	"github.com/yhlooo/bangbang/pkg/discovery"
+	"github.com/yhlooo/bangbang/pkg/signatures"
+)
+
+// NewInviteOptions 创建默认 InviteOptions
+func NewInviteOptions() InviteOptions {
+	return InviteOptions{
+		TTL:               time.Hour,
+		Backends:          []string{discovery.BackendUDP},
+		DiscoveryAddrs:    discovery.DefaultUDPAddrs,
+		ExcludeInterfaces: discovery.DefaultExcludedInterfaces,
+		Duration:          3 * time.Second,
+	}
+}
+
+// InviteOptions invite 子命令选项
+type InviteOptions struct {
+	// 邀请有效期
+	TTL time.Duration
+	// 邀请中的访问端点，为空时使用房间广播的访问端点
+	Endpoints         []string
+	Backends          []string
+	DiscoveryAddrs    []string
+	Interfaces        []string
+	ExcludeInterfaces []string
+	Duration          time.Duration
+}
+
+// AddPFlags 将选项绑定到命令行参数
+func (o *InviteOptions) AddPFlags(fs *pflag.FlagSet) {
+	fs.DurationVar(&o.TTL, "ttl", o.TTL, "Invite validity period")
+	fs.StringSliceVar(&o.Endpoints, "endpoint", o.Endpoints,
+		"Endpoints in the invite (e.g. port-forwarded addresses), default endpoints advertised by the room")
+	fs.StringSliceVar(&o.Backends, "discovery", o.Backends, fmt.Sprintf(
+		"Discovery backends, multiple backends run at the same time. One or more of %q", discovery.Backends,
+	))
+	fs.StringSliceVar(&o.DiscoveryAddrs, "discovery-addr", o.DiscoveryAddrs, "Transponder addresses (for udp backend)")
+	fs.DurationVarP(&o.Duration, "duration", "d", o.Duration, "Scan duration")
+	addInterfacesPFlags(fs, &o.Interfaces, &o.ExcludeInterfaces)
+}
+
+// newInviteCommand 创建 invite 子命令
+func newInviteCommand(parentName string) *cobra.Command {
+	opts := NewInviteOptions()
+
+	cmd := &cobra.Command{
+		Use:   "invite PIN",
+		Short: "Print an invite for the room on the local network",
+		Long: fmt.Sprintf(`Print a signed, expiring invite for the room on the local network.
+
+Members who cannot discover the room (e.g. across VLANs) can join with:
+
+  %s chat PIN --peer INVITE`, parentName),
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			key := signatures.Key(args[0])
+
+			d, err := discovery.NewDiscoverer(opts.Backends, opts.DiscoveryAddrs, &discovery.InterfaceFilter{
+				Allow: opts.Interfaces,
+				Deny:  opts.ExcludeInterfaces,
+			}, false)
+			if err != nil {
+				return err
+			}
+			roomList, err := d.Search(ctx, key, discovery.SearchOptions{
+				Duration:          opts.Duration,
+				CheckAvailability: true,
+				EarlyExit:         true,
+			})
+			if err != nil {
+				return fmt.Errorf("search rooms error: %w", err)
+			}
+
+			for _, room := range roomList {
+				if room.AvailableEndpoint == "" {
+					continue
+				}
+				endpoints := opts.Endpoints
+				if len(endpoints) == 0 {
+					endpoints = room.Info.Endpoints
+				}
+				invite, err := discovery.NewInvite(key, &room.Info, endpoints, opts.TTL)
+				if err != nil {
+					return fmt.Errorf("create invite error: %w", err)
+				}
+				fmt.Println(invite)
+				return nil
+			}
+
+			return errors.New("no available room found")
+		},
+	}
+
+	opts.AddPFlags(cmd.Flags())
+
+	return cmd
+}
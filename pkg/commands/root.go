@@ -48,13 +48,17 @@ func (o *GlobalOptions) AddPFlags(fs *pflag.FlagSet) {
 // NewCommand 创建根命令
 func NewCommand(name string) *cobra.Command {
 	globalOpts := NewGlobalOptions()
+	chatOpts := NewChatOptions()
 
 	cmd := &cobra.Command{
-		Use:           fmt.Sprintf("%s PIN", name),
-		Short:         "Face-to-face group chat, file transfer.",
-		SilenceUsage:  true,
-		SilenceErrors: true,
-		Version:       version.Version,
+		Use:                        fmt.Sprintf("%s PIN", name),
+		Short:                      "Face-to-face group chat, file transfer.",
+		Long:                       fmt.Sprintf("Face-to-face group chat, file transfer.\n\n%s PIN is a shortcut for %s chat PIN.", name, name),
+		Args:                       rootArgs(name),
+		SuggestionsMinimumDistance: 2,
+		SilenceUsage:               true,
+		SilenceErrors:              true,
+		Version:                    version.Version,
 		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
 			ctx := cmd.Context()
 
@@ -63,8 +67,9 @@ func NewCommand(name string) *cobra.Command {
 			}
 
 			logWriter := io.Writer(os.Stderr)
-			switch cmd.Name() {
-			case "chat":
+			switch {
+			// 根命令带 PIN 码时是 chat 的快捷方式
+			case cmd.Name() == "chat", !cmd.HasParent() && len(args) > 0:
 				logWriter = io.Discard
 				if globalOpts.Debug || globalOpts.Verbosity >= 1 {
 					logPath := filepath.Join(os.ExpandEnv("$HOME"), ".bangbang", "bang.log")
@@ -97,15 +102,45 @@ func NewCommand(name string) *cobra.Command {
 
 			return nil
 		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) == 0 {
+				return cmd.Help()
+			}
+			return runChatCommand(cmd.Context(), chatOpts, args)
+		},
 	}
 
 	globalOpts.AddPFlags(cmd.PersistentFlags())
+	chatOpts.AddPFlags(cmd.Flags())
 
 	cmd.AddCommand(
 		newChatCommand(name),
 		newScanCommand(),
+		newAuditCommand(),
+		newInviteCommand(name),
 		newVersionCommand(),
 	)
 
 	return cmd
 }
+
+// rootArgs 校验根命令参数
+//
+// 参数与某个子命令名相近时大概率是输错了子命令，拒绝将其作为 PIN 码启动聊天，确实要使用这样的 PIN 码时可通过 chat 子命令指定
+func rootArgs(name string) cobra.PositionalArgs {
+	return func(cmd *cobra.Command, args []string) error {
+		if err := cobra.MaximumNArgs(1)(cmd, args); err != nil {
+			return err
+		}
+		if len(args) == 0 {
+			return nil
+		}
+		if suggestions := cmd.SuggestionsFor(args[0]); len(suggestions) > 0 {
+			return fmt.Errorf(
+				"unknown command %q for %q, did you mean %q? (use \"%s chat %s\" to join a room with this PIN)",
+				args[0], cmd.CommandPath(), suggestions[0], name, args[0],
+			)
+		}
+		return nil
+	}
+}
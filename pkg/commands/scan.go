@@ -15,6 +15,8 @@ import (
 func NewScanOptions() ScanOptions {
 	return ScanOptions{
 		Watch:             false,
+		Backends:          []string{discovery.BackendUDP},
+		ExcludeInterfaces: discovery.DefaultExcludedInterfaces,
 		Key:               "",
 		Duration:          3 * time.Second,
 		RequestInterval:   time.Second,
@@ -25,19 +27,26 @@ func NewScanOptions() ScanOptions {
 // ScanOptions scan 子命令选项
 type ScanOptions struct {
 	Watch             bool
+	Backends          []string
 	Key               string
 	Duration          time.Duration
 	RequestInterval   time.Duration
 	CheckAvailability bool
+	Interfaces        []string
+	ExcludeInterfaces []string
 }
 
 // AddPFlags 将选项绑定到命令行参数
 func (o *ScanOptions) AddPFlags(fs *pflag.FlagSet) {
-	fs.BoolVarP(&o.Watch, "watch", "w", o.Watch, "Keep watching")
-	fs.StringVarP(&o.Key, "key", "k", o.Key, "Room Key")
+	fs.BoolVarP(&o.Watch, "watch", "w", o.Watch, "Keep watching and print room events (Added, Updated or Removed)")
+	fs.StringSliceVar(&o.Backends, "discovery", o.Backends, fmt.Sprintf(
+		"Discovery backends, multiple backends run at the same time. One or more of %q", discovery.Backends,
+	))
+	fs.StringVarP(&o.Key, "key", "k", o.Key, "Room Key (PIN), required to decrypt room info")
 	fs.DurationVarP(&o.Duration, "duration", "d", o.Duration, "Scan duration")
 	fs.DurationVar(&o.RequestInterval, "interval", o.RequestInterval, "Send scan request interval")
 	fs.BoolVar(&o.CheckAvailability, "check", o.CheckAvailability, "Check room endpoints availability")
+	addInterfacesPFlags(fs, &o.Interfaces, &o.ExcludeInterfaces)
 }
 
 // newScanCommand 创建 scan 子命令
@@ -45,48 +54,47 @@ func newScanCommand() *cobra.Command {
 	opts := NewScanOptions()
 
 	cmd := &cobra.Command{
-		Use:  "scan [ADDRESS]",
-		Args: cobra.MaximumNArgs(1),
+		Use: "scan [ADDRESS...]",
 		RunE: func(cmd *cobra.Command, args []string) error {
 			ctx := cmd.Context()
 
-			addr := "224.0.0.1:7134"
-			if len(args) > 0 {
-				addr = args[0]
+			d, err := discovery.NewDiscoverer(opts.Backends, args, &discovery.InterfaceFilter{
+				Allow: opts.Interfaces,
+				Deny:  opts.ExcludeInterfaces,
+			}, false)
+			if err != nil {
+				return err
 			}
+			key := signatures.Key(opts.Key)
 
-			d := discovery.NewUDPDiscoverer(addr)
-			var key signatures.Key
-			if opts.Key != "" {
-				key = signatures.Key(opts.Key)
-			}
-
-			ticker := time.NewTicker(opts.Duration + time.Second)
-			for {
-				ret, err := d.Search(ctx, key, discovery.SearchOptions{
-					Duration:          opts.Duration,
-					RequestInterval:   opts.RequestInterval,
-					CheckAvailability: opts.CheckAvailability,
-				})
+			if opts.Watch {
+				events, err := d.Watch(ctx, key)
 				if err != nil {
-					return fmt.Errorf("search rooms error: %w", err)
-				}
-				showScanResult(ret)
-				if !opts.Watch {
-					break
+					return fmt.Errorf("watch rooms error: %w", err)
 				}
-				select {
-				case <-ctx.Done():
-					return nil
-				case <-ticker.C:
+				for e := range events {
+					fmt.Printf("    Event : %s\n", e.Type)
+					showScanResult([]discovery.Room{e.Room})
 				}
+				return nil
 			}
 
+			ret, err := d.Search(ctx, key, discovery.SearchOptions{
+				Duration:          opts.Duration,
+				RequestInterval:   opts.RequestInterval,
+				CheckAvailability: opts.CheckAvailability,
+			})
+			if err != nil {
+				return fmt.Errorf("search rooms error: %w", err)
+			}
+			showScanResult(ret)
+
 			return nil
 		},
 	}
 
 	opts.AddPFlags(cmd.Flags())
+	_ = cmd.MarkFlagRequired("key")
 
 	return cmd
 }
@@ -104,9 +112,9 @@ func showScanResult(result []discovery.Room) {
 		if room.Info.CertSign != "" {
 			fmt.Printf("Cert Sign : %s\n", room.Info.CertSign)
 		}
-		if len(room.Info.Endpoints) > 0 {
+		if len(room.Endpoints) > 0 {
 			fmt.Println("Endpoints :")
-			for _, endpoint := range room.Info.Endpoints {
+			for _, endpoint := range room.Endpoints {
 				if endpoint == room.AvailableEndpoint {
 					fmt.Printf("            %s (Available)\n", endpoint)
 				} else {
@@ -116,6 +124,10 @@ func showScanResult(result []discovery.Room) {
 		} else {
 			fmt.Println("Endpoints : []")
 		}
+		if room.AvailableEndpoint != "" {
+			fmt.Printf("      RTT : %s\n", room.RTT.Round(time.Microsecond))
+			fmt.Printf("    Depth : %d\n", room.Depth)
+		}
 		fmt.Println("---")
 	}
 }
@@ -29,6 +29,13 @@ type BloomFilter struct {
 
 var _ Deduplicator = (*BloomFilter)(nil)
 
+// Seen 校验是否重复的，不记录该内容
+func (d *BloomFilter) Seen(data []byte) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.readonlyBloom.Test(data) || d.bloom.Test(data)
+}
+
 // Duplicate 校验是否重复的并记录下该内容
 func (d *BloomFilter) Duplicate(data []byte) bool {
 	d.lock.Lock()
@@ -4,4 +4,6 @@ package deduplicators
 type Deduplicator interface {
 	// Duplicate 校验是否重复的并记录下该内容
 	Duplicate(data []byte) bool
+	// Seen 校验是否重复的，不记录该内容
+	Seen(data []byte) bool
 }
@@ -0,0 +1,80 @@
+package deduplicators
+
+import (
+	"sync"
+	"time"
+)
+
+// NewTimeWindow 创建精确记录一段时间内内容的 Deduplicator 实现
+//
+// 记录的内容在 window 后过期
+func NewTimeWindow(window time.Duration) *TimeWindow {
+	return &TimeWindow{
+		window:  window,
+		seen:    map[string]time.Time{},
+		nowFunc: time.Now,
+	}
+}
+
+// TimeWindow 精确记录一段时间内内容的 Deduplicator 实现
+//
+// 与 BloomFilter 不同，时间窗口内的内容不会被遗忘也不会误判，占用的内存与窗口内的内容数成正比
+type TimeWindow struct {
+	window time.Duration
+
+	lock sync.Mutex
+	seen map[string]time.Time
+	// 按记录顺序排列的内容，用于清理过期内容
+	queue   []string
+	nowFunc func() time.Time
+}
+
+var _ Deduplicator = (*TimeWindow)(nil)
+
+// Duplicate 校验是否重复的并记录下该内容
+func (d *TimeWindow) Duplicate(data []byte) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	now := d.nowFunc()
+	d.prune(now)
+
+	key := string(data)
+	if _, ok := d.seen[key]; ok {
+		return true
+	}
+	d.seen[key] = now.Add(d.window)
+	d.queue = append(d.queue, key)
+	return false
+}
+
+// Seen 校验是否重复的，不记录该内容
+func (d *TimeWindow) Seen(data []byte) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.prune(d.nowFunc())
+	_, ok := d.seen[string(data)]
+	return ok
+}
+
+// Len 返回记录的内容数
+func (d *TimeWindow) Len() int {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return len(d.seen)
+}
+
+// prune 清理过期的内容
+func (d *TimeWindow) prune(now time.Time) {
+	i := 0
+	for ; i < len(d.queue); i++ {
+		if now.Before(d.seen[d.queue[i]]) {
+			break
+		}
+		delete(d.seen, d.queue[i])
+	}
+	if i > 0 {
+		d.queue = d.queue[i:]
+	}
+}
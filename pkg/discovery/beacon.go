@@ -0,0 +1,135 @@
+package discovery
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	chatv1 "github.com/yhlooo/bangbang/pkg/apis/chat/v1"
+	metav1 "github.com/yhlooo/bangbang/pkg/apis/meta/v1"
+	"github.com/yhlooo/bangbang/pkg/signatures"
+)
+
+// errSealedRoomAuth 房间信息解密失败（使用了不同的 PIN 码或被篡改）
+var errSealedRoomAuth = errors.New("message authentication failed")
+
+const (
+	// beaconKeyInfo 派生服务发现加密密钥的 HKDF info
+	beaconKeyInfo = "bangbang discovery beacon v1"
+	// beaconIDRotation 房间临时标识轮换周期
+	beaconIDRotation = 10 * time.Minute
+)
+
+// sealRoomMessage 签名并加密房间信息，序列化为消息
+//
+// 使用从 key 派生的密钥以 AES-256-GCM 加密，房间 UID 、房主及访问端点都不以明文出现
+func sealRoomMessage(key signatures.Key, room *chatv1.Room) ([]byte, error) {
+	sealed, err := sealRoom(key, room)
+	if err != nil {
+		return nil, err
+	}
+	msg, err := json.Marshal(sealed)
+	if err != nil {
+		return nil, fmt.Errorf("marshal sealed room to json error: %w", err)
+	}
+	return append(msg, '\n'), nil
+}
+
+// openRoomMessage 解密 sealRoomMessage 生成的消息
+//
+// 不校验房间信息的签名
+func openRoomMessage(key signatures.Key, data []byte) (*chatv1.Room, error) {
+	sealed := &chatv1.SealedRoom{}
+	if err := json.Unmarshal(data, sealed); err != nil {
+		return nil, fmt.Errorf("decode sealed room error: %w", err)
+	}
+	return openRoom(key, sealed)
+}
+
+// sealRoom 使用服务发现子密钥签名并加密房间信息
+func sealRoom(key signatures.Key, room *chatv1.Room) (*chatv1.SealedRoom, error) {
+	if err := signatures.HS256SignAPIObject(key.Subkey(signatures.KeyPurposeDiscovery), room); err != nil {
+		return nil, fmt.Errorf("sign room info error: %w", err)
+	}
+	raw, err := json.Marshal(room)
+	if err != nil {
+		return nil, fmt.Errorf("marshal room info to json error: %w", err)
+	}
+
+	aead, bkey, err := beaconAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	sealed := &chatv1.SealedRoom{
+		APIMeta: metav1.NewAPIMeta(chatv1.KindSealedRoom),
+		ID:      beaconID(bkey, room.UID, room.SignTime),
+		Nonce:   make([]byte, aead.NonceSize()),
+	}
+	if _, err := rand.Read(sealed.Nonce); err != nil {
+		return nil, fmt.Errorf("generate nonce error: %w", err)
+	}
+	sealed.Data = aead.Seal(nil, sealed.Nonce, raw, []byte(sealed.ID))
+	return sealed, nil
+}
+
+// openRoom 解密房间信息
+func openRoom(key signatures.Key, sealed *chatv1.SealedRoom) (*chatv1.Room, error) {
+	if !sealed.IsKind(chatv1.KindSealedRoom) {
+		return nil, fmt.Errorf("invalid kind: %q", sealed.Kind)
+	}
+	if key == nil {
+		return nil, errors.New("key is required to open sealed room")
+	}
+	aead, _, err := beaconAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed.Nonce) != aead.NonceSize() {
+		return nil, fmt.Errorf("invalid nonce size: %d", len(sealed.Nonce))
+	}
+	raw, err := aead.Open(nil, sealed.Nonce, sealed.Data, []byte(sealed.ID))
+	if err != nil {
+		return nil, fmt.Errorf("decrypt sealed room error: %w", errSealedRoomAuth)
+	}
+	room := &chatv1.Room{}
+	if err := json.Unmarshal(raw, room); err != nil {
+		return nil, fmt.Errorf("decode room error: %w", err)
+	}
+	return room, nil
+}
+
+// beaconAEAD 从 key 的服务发现子密钥派生服务发现加密密钥
+func beaconAEAD(key signatures.Key) (cipher.AEAD, []byte, error) {
+	bkey, err := hkdf.Key(sha256.New, key.Subkey(signatures.KeyPurposeDiscovery), nil, beaconKeyInfo, 32)
+	if err != nil {
+		return nil, nil, fmt.Errorf("derive beacon key error: %w", err)
+	}
+	block, err := aes.NewCipher(bkey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("init cipher error: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, fmt.Errorf("init gcm error: %w", err)
+	}
+	return aead, bkey, nil
+}
+
+// beaconID 计算房间在 t 所在周期的临时标识
+//
+// 不知道密钥时无法将不同周期的标识关联到同一房间
+func beaconID(bkey []byte, uid metav1.UID, t time.Time) string {
+	mac := hmac.New(sha256.New, bkey)
+	mac.Write(uid[:])
+	_ = binary.Write(mac, binary.BigEndian, t.Unix()/int64(beaconIDRotation/time.Second))
+	return hex.EncodeToString(mac.Sum(nil)[:8])
+}
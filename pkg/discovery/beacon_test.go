@@ -0,0 +1,54 @@
+package discovery
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	chatv1 "github.com/yhlooo/bangbang/pkg/apis/chat/v1"
+	metav1 "github.com/yhlooo/bangbang/pkg/apis/meta/v1"
+	"github.com/yhlooo/bangbang/pkg/signatures"
+)
+
+// TestSealRoomMessage 测试 sealRoomMessage 和 openRoomMessage
+func TestSealRoomMessage(t *testing.T) {
+	a := assert.New(t)
+
+	key := signatures.Key("7134")
+	room := &chatv1.Room{
+		APIMeta:    metav1.NewAPIMeta(chatv1.KindRoom),
+		ObjectMeta: metav1.ObjectMeta{UID: metav1.NewUID()},
+		Owner: chatv1.User{
+			APIMeta:    metav1.NewAPIMeta(chatv1.KindUser),
+			ObjectMeta: metav1.ObjectMeta{UID: metav1.NewUID(), Name: "alice"},
+		},
+		Endpoints: []string{"https://192.168.1.2:7134"},
+	}
+
+	msg, err := sealRoomMessage(key, room)
+	a.NoError(err)
+	a.NotContains(string(msg), room.UID.String())
+	a.NotContains(string(msg), "alice")
+	a.NotContains(string(msg), "192.168.1.2")
+
+	ret, err := openRoomMessage(key, msg)
+	a.NoError(err)
+	a.Equal(room.UID, ret.UID)
+	a.Equal(room.Endpoints, ret.Endpoints)
+	discoveryKey := key.Subkey(signatures.KeyPurposeDiscovery)
+	a.NoError(signatures.HS256VerifyAPIObject(discoveryKey, ret, room.SignTime, room.SignTime))
+
+	_, err = openRoomMessage(signatures.Key("1234"), msg)
+	a.Error(err)
+	_, err = openRoomMessage(nil, msg)
+	a.Error(err)
+
+	// 同一房间的临时标识在周期内不变，跨周期变化
+	_, bkey, err := beaconAEAD(key)
+	a.NoError(err)
+	now := time.Unix(1700000000, 0)
+	a.Equal(beaconID(bkey, room.UID, now), beaconID(bkey, room.UID, now.Add(time.Second)))
+	a.NotEqual(beaconID(bkey, room.UID, now), beaconID(bkey, room.UID, now.Add(beaconIDRotation)))
+	a.NotEqual(beaconID(bkey, room.UID, now), beaconID(bkey, metav1.NewUID(), now))
+}
@@ -0,0 +1,96 @@
+package discovery
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// maxChallenges 挑战集合的最大大小
+const maxChallenges = 4096
+
+// newChallenge 生成随机挑战
+func newChallenge() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// newChallengeSet 创建挑战集合
+//
+// 挑战在加入 ttl 后过期
+func newChallengeSet(ttl time.Duration) *challengeSet {
+	return &challengeSet{
+		ttl:   ttl,
+		items: map[string]time.Time{},
+	}
+}
+
+// challengeSet 挑战集合
+type challengeSet struct {
+	lock  sync.Mutex
+	ttl   time.Duration
+	items map[string]time.Time
+}
+
+// New 生成并加入一个新挑战
+func (s *challengeSet) New() string {
+	c := newChallenge()
+	s.Add(c)
+	return c
+}
+
+// Add 加入挑战，返回挑战是否已经在集合中
+func (s *challengeSet) Add(c string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := time.Now()
+	if t, ok := s.items[c]; ok && now.Before(t) {
+		return true
+	}
+	if len(s.items) >= maxChallenges {
+		s.prune(now)
+	}
+	s.items[c] = now.Add(s.ttl)
+	return false
+}
+
+// Match 判断 challenges 中是否有未过期的挑战
+func (s *challengeSet) Match(challenges []string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := time.Now()
+	for _, c := range challenges {
+		if t, ok := s.items[c]; ok && now.Before(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// prune 清理过期的挑战，仍然过多时清理较早加入的挑战
+func (s *challengeSet) prune(now time.Time) {
+	for c, t := range s.items {
+		if !now.Before(t) {
+			delete(s.items, c)
+		}
+	}
+	if len(s.items) < maxChallenges {
+		return
+	}
+	var threshold time.Time
+	for _, t := range s.items {
+		if threshold.IsZero() || t.Before(threshold) {
+			threshold = t
+		}
+	}
+	threshold = threshold.Add(s.ttl / 2)
+	for c, t := range s.items {
+		if t.Before(threshold) {
+			delete(s.items, c)
+		}
+	}
+}
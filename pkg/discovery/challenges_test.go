@@ -0,0 +1,71 @@
+package discovery
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	chatv1 "github.com/yhlooo/bangbang/pkg/apis/chat/v1"
+)
+
+// TestChallengeSet 测试 challengeSet
+func TestChallengeSet(t *testing.T) {
+	a := assert.New(t)
+
+	s := newChallengeSet(100 * time.Millisecond)
+	c := s.New()
+	a.Len(c, 32)
+	a.True(s.Match([]string{"foo", c}))
+	a.False(s.Match([]string{"foo"}))
+	a.False(s.Match(nil))
+
+	// 重复加入
+	a.True(s.Add(c))
+	a.False(s.Add("bar"))
+
+	// 过期
+	time.Sleep(150 * time.Millisecond)
+	a.False(s.Match([]string{c}))
+	a.False(s.Add(c))
+
+	// 数量有上限
+	for i := 0; i < 2*maxChallenges; i++ {
+		s.New()
+	}
+	a.LessOrEqual(len(s.items), maxChallenges)
+}
+
+// TestAcceptRoom 测试 acceptRoom
+func TestAcceptRoom(t *testing.T) {
+	a := assert.New(t)
+
+	s := newChallengeSet(time.Minute)
+	announcements := newChallengeSet(2 * announceMaxAge)
+	c := s.New()
+
+	// 回复了挑战
+	room := &chatv1.Room{Challenges: []string{c}}
+	room.SignTime = time.Now().Add(-time.Hour)
+	a.True(acceptRoom(room, "eth0", s, nil))
+
+	// 回复了其它挑战
+	room.Challenges = []string{"foo"}
+	room.SignTime = time.Now()
+	a.False(acceptRoom(room, "eth0", s, announcements))
+
+	// 不接受主动广播时丢弃
+	room.Challenges = nil
+	room.Signature = "sig1"
+	a.False(acceptRoom(room, "eth0", s, nil))
+
+	// 主动广播只接受一次，其它网卡收到的同一广播也接受
+	a.True(acceptRoom(room, "eth0", s, announcements))
+	a.False(acceptRoom(room, "eth0", s, announcements))
+	a.True(acceptRoom(room, "wlan0", s, announcements))
+
+	// 过期的主动广播
+	room.Signature = "sig2"
+	room.SignTime = time.Now().Add(-2 * announceMaxAge)
+	a.False(acceptRoom(room, "eth0", s, announcements))
+}
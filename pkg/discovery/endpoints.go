@@ -0,0 +1,94 @@
+package discovery
+
+import (
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// EndpointURL 返回指定地址的访问端点 URL
+//
+// IPv6 链路本地地址会带上 zone （按 RFC 6874 编码为 %25 ）
+func EndpointURL(ip net.IP, zone string, port int) string {
+	host := ip.String()
+	if ip.To4() == nil && ip.IsLinkLocalUnicast() && zone != "" {
+		host += "%" + zone
+	}
+	u := url.URL{
+		Scheme: "https",
+		Host:   net.JoinHostPort(host, strconv.Itoa(port)),
+	}
+	return u.String()
+}
+
+// localizeEndpoints 将访问端点中 IPv6 链路本地地址的 zone 替换为本机网卡
+//
+// 房间广播的 zone 是对端的网卡名，在本机上没有意义，需要替换为接收到广播的网卡
+func localizeEndpoints(endpoints []string, zone string) []string {
+	if endpoints == nil {
+		return nil
+	}
+	ret := make([]string, len(endpoints))
+	for i, endpoint := range endpoints {
+		ret[i] = localizeEndpoint(endpoint, zone)
+	}
+	return ret
+}
+
+// localizeEndpoint 将访问端点中 IPv6 链路本地地址的 zone 替换为本机网卡
+func localizeEndpoint(endpoint string, zone string) string {
+	if zone == "" {
+		return endpoint
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return endpoint
+	}
+	addr, err := net.ResolveTCPAddr("tcp", u.Host)
+	if err != nil || addr.IP.To4() != nil || !addr.IP.IsLinkLocalUnicast() {
+		return endpoint
+	}
+	u.Host = net.JoinHostPort(addr.IP.String()+"%"+zone, strconv.Itoa(addr.Port))
+	return u.String()
+}
+
+// endpointsForInterface 返回将属于指定网卡的访问端点排在前面的访问端点列表
+//
+// 在某个网卡上广播时，对端通过该网卡收到广播，优先尝试该网卡上的地址更可能可用
+func endpointsForInterface(endpoints []string, iface net.Interface) []string {
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return endpoints
+	}
+
+	var own, others []string
+	for _, endpoint := range endpoints {
+		ip, zone := endpointIP(endpoint)
+		belongs := ip != nil && zone == iface.Name
+		for _, addr := range addrs {
+			if belongs || ip == nil {
+				break
+			}
+			if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+				belongs = true
+			}
+		}
+		if belongs {
+			own = append(own, endpoint)
+		} else {
+			others = append(others, endpoint)
+		}
+	}
+	return append(own, others...)
+}
+
+// endpointIP 解析访问端点的 IP 和 zone
+func endpointIP(endpoint string) (net.IP, string) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, ""
+	}
+	host, zone, _ := strings.Cut(u.Hostname(), "%")
+	return net.ParseIP(host), zone
+}
@@ -0,0 +1,35 @@
+package discovery
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestEndpointURL 测试 EndpointURL
+func TestEndpointURL(t *testing.T) {
+	a := assert.New(t)
+
+	a.Equal("https://192.168.1.2:7134", EndpointURL(net.ParseIP("192.168.1.2"), "eth0", 7134))
+	a.Equal("https://[fe80::1%25eth0]:7134", EndpointURL(net.ParseIP("fe80::1"), "eth0", 7134))
+	a.Equal("https://[2001:db8::1]:7134", EndpointURL(net.ParseIP("2001:db8::1"), "eth0", 7134))
+}
+
+// TestLocalizeEndpoints 测试 localizeEndpoints
+func TestLocalizeEndpoints(t *testing.T) {
+	a := assert.New(t)
+
+	a.Equal([]string{
+		"https://192.168.1.2:7134",
+		"https://[fe80::1%25en0]:7134",
+		"https://[fe80::2%25en0]:7134",
+		"https://[2001:db8::1]:7134",
+	}, localizeEndpoints([]string{
+		"https://192.168.1.2:7134",
+		"https://[fe80::1%25eth0]:7134",
+		"https://[fe80::2]:7134",
+		"https://[2001:db8::1]:7134",
+	}, "en0"))
+	a.Equal([]string{"https://[fe80::1%25eth0]:7134"}, localizeEndpoints([]string{"https://[fe80::1%25eth0]:7134"}, ""))
+}
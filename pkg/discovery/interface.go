@@ -10,9 +10,14 @@ import (
 )
 
 // Discoverer 发现器
-
 type Discoverer interface {
+	// Search 搜索房间，阻塞 SearchOptions.Duration 后返回搜索到的房间
 	Search(ctx context.Context, key signatures.Key, opts SearchOptions) ([]Room, error)
+	// Watch 持续监听房间变化，直到 ctx 结束
+	//
+	// 房间首次被发现时产生 EventAdded 事件，信息或可用端点变化时产生 EventUpdated 事件，
+	// 超过 RoomLivenessTTL 没有再被发现时产生 EventRemoved 事件。 ctx 结束后返回的通道被关闭
+	Watch(ctx context.Context, key signatures.Key) (<-chan Event, error)
 }
 
 // SearchOptions 搜索选项
@@ -25,18 +30,68 @@ type SearchOptions struct {
 	CheckAvailability bool
 	// 排除的房间
 	Exclude []metav1.UID
+	// 允许的签名时间误差，为 0 时使用 DefaultTimeWindow
+	TimeWindow time.Duration
+	// 发现第一个可用（ CheckAvailability 为 true 时需要有可用端点）的房间后立即返回，仅返回该房间
+	EarlyExit bool
+}
+
+// DefaultTimeWindow 默认允许的签名时间误差
+const DefaultTimeWindow = 10 * time.Minute
+
+// Complete 补全默认值
+func (opts *SearchOptions) Complete() {
+	if opts.Duration == 0 {
+		opts.Duration = 3 * time.Second
+	}
+	if opts.RequestInterval == 0 {
+		opts.RequestInterval = time.Second
+	}
+	if opts.TimeWindow == 0 {
+		opts.TimeWindow = DefaultTimeWindow
+	}
 }
 
 // Room 房间
 type Room struct {
 	// 房间信息
 	Info chatv1.Room
+	// 本机视角的访问端点
+	//
+	// 与 Info.Endpoints 相同，但 IPv6 链路本地地址的 zone 被替换为本机接收到该房间信息的网卡
+	Endpoints []string
 	// 可用的访问端点
 	AvailableEndpoint string
+	// 访问可用端点的延迟（检查可用性时测量）
+	RTT time.Duration
+	// 房间在房间树中的深度（检查可用性时从可用端点获取）
+	Depth int
+}
+
+// EventType 房间事件类型
+type EventType string
+
+const (
+	// EventAdded 发现新房间
+	EventAdded EventType = "Added"
+	// EventUpdated 房间信息或可用端点变化
+	EventUpdated EventType = "Updated"
+	// EventRemoved 房间消失
+	EventRemoved EventType = "Removed"
+)
+
+// Event 房间事件
+type Event struct {
+	// 事件类型
+	Type EventType
+	// 房间，类型为 EventRemoved 时为房间最后的状态
+	Room Room
 }
 
 // Transponder 应答机
 type Transponder interface {
 	// Start 开始运行应答机
 	Start(ctx context.Context) error
+	// Stats 获取统计信息，用于诊断
+	Stats() TransponderStats
 }
@@ -0,0 +1,118 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"path"
+
+	"github.com/go-logr/logr"
+)
+
+// InterfaceAddr 网卡地址
+type InterfaceAddr struct {
+	// 网卡
+	Interface net.Interface
+	// 地址及所在网段
+	IPNet *net.IPNet
+}
+
+// Zone 返回访问该地址需要的 zone
+//
+// 仅 IPv6 链路本地地址需要 zone
+func (addr InterfaceAddr) Zone() string {
+	if addr.IPNet.IP.To4() == nil && addr.IPNet.IP.IsLinkLocalUnicast() {
+		return addr.Interface.Name
+	}
+	return ""
+}
+
+// InterfaceAddrs 列出 filter 允许的已启用网卡的地址
+//
+// 本地回环网卡总是被列出
+func InterfaceAddrs(ctx context.Context, filter *InterfaceFilter) ([]InterfaceAddr, error) {
+	logger := logr.FromContextOrDiscard(ctx)
+
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return nil, fmt.Errorf("get interfaces error: %w", err)
+	}
+
+	var ret []InterfaceAddr
+	for _, iface := range interfaces {
+		if iface.Flags&net.FlagUp == 0 {
+			continue
+		}
+		if iface.Flags&net.FlagLoopback == 0 && !filter.Match(iface.Name) {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			logger.Error(err, fmt.Sprintf("get interface %q addresses error", iface.Name))
+			continue
+		}
+
+		for _, addr := range addrs {
+			switch v := addr.(type) {
+			case *net.IPNet:
+				ret = append(ret, InterfaceAddr{Interface: iface, IPNet: v})
+			case *net.IPAddr:
+				bits := 8 * net.IPv6len
+				if v.IP.To4() != nil {
+					bits = 8 * net.IPv4len
+				}
+				ret = append(ret, InterfaceAddr{
+					Interface: iface,
+					IPNet:     &net.IPNet{IP: v.IP, Mask: net.CIDRMask(bits, bits)},
+				})
+			}
+		}
+	}
+
+	return ret, nil
+}
+
+// DefaultExcludedInterfaces 默认排除的网卡（虚拟网桥等）
+var DefaultExcludedInterfaces = []string{
+	"docker*",
+	"br-*",
+	"veth*",
+	"virbr*",
+	"vmnet*",
+	"vboxnet*",
+	"cni*",
+}
+
+// DefaultInterfaceFilter 默认网卡过滤器，排除 DefaultExcludedInterfaces
+var DefaultInterfaceFilter = &InterfaceFilter{Deny: DefaultExcludedInterfaces}
+
+// InterfaceFilter 网卡过滤器
+//
+// 为 nil 时等同于 DefaultInterfaceFilter
+type InterfaceFilter struct {
+	// 允许的网卡名模式（ path.Match 语法），为空时允许所有网卡
+	Allow []string
+	// 排除的网卡名模式（ path.Match 语法）
+	Deny []string
+}
+
+// Match 判断网卡是否可用
+func (f *InterfaceFilter) Match(name string) bool {
+	if f == nil {
+		f = DefaultInterfaceFilter
+	}
+	if len(f.Allow) > 0 && !matchAny(f.Allow, name) {
+		return false
+	}
+	return !matchAny(f.Deny, name)
+}
+
+// matchAny 判断名字是否匹配任意模式
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
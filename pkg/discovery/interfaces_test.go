@@ -0,0 +1,26 @@
+package discovery
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestInterfaceFilter_Match 测试 InterfaceFilter.Match
+func TestInterfaceFilter_Match(t *testing.T) {
+	a := assert.New(t)
+
+	var f *InterfaceFilter
+	a.True(f.Match("eth0"))
+	a.False(f.Match("docker0"))
+	a.False(f.Match("br-1a2b3c"))
+
+	f = &InterfaceFilter{Allow: []string{"en*", "docker0"}}
+	a.True(f.Match("en0"))
+	a.True(f.Match("docker0"))
+	a.False(f.Match("utun3"))
+
+	f = &InterfaceFilter{Deny: []string{"utun*"}}
+	a.True(f.Match("docker0"))
+	a.False(f.Match("utun3"))
+}
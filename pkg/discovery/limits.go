@@ -0,0 +1,177 @@
+package discovery
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// sourceRequestRate 单个来源每秒允许的请求数
+	sourceRequestRate = 2
+	// sourceRequestBurst 单个来源允许的突发请求数
+	sourceRequestBurst = 5
+	// signatureFailureThreshold 单个来源连续签名校验失败多少次后开始退避
+	signatureFailureThreshold = 3
+	// signatureFailureBackoff 签名校验失败后的初始退避时长，每次失败翻倍
+	signatureFailureBackoff = time.Second
+	// maxSignatureFailureBackoff 签名校验失败后的最大退避时长
+	maxSignatureFailureBackoff = time.Minute
+	// maxSources 记录的最大来源数
+	maxSources = 4096
+
+	// beaconCoalesceInterval 合并应答的间隔，每个间隔内最多组播一次房间信息
+	beaconCoalesceInterval = 500 * time.Millisecond
+	// maxBeaconChallenges 合并应答时单个房间信息中最多回复的挑战数
+	maxBeaconChallenges = 16
+)
+
+// TransponderStats 应答机统计信息
+type TransponderStats struct {
+	// 收到的请求数
+	Requests uint64
+	// 签名校验失败的请求数
+	SignatureFailures uint64
+	// 因签名校验失败退避而丢弃的请求数
+	BackedOff uint64
+	// 因超过来源速率限制而丢弃的请求数
+	RateLimited uint64
+	// 重放而丢弃的请求数
+	Replayed uint64
+	// 组播的房间信息数
+	Beacons uint64
+	// 单播回复数
+	UnicastReplies uint64
+}
+
+// String 返回统计信息的字符串表示
+func (s TransponderStats) String() string {
+	return fmt.Sprintf(
+		"requests=%d signatureFailures=%d backedOff=%d rateLimited=%d replayed=%d beacons=%d unicastReplies=%d",
+		s.Requests, s.SignatureFailures, s.BackedOff, s.RateLimited, s.Replayed, s.Beacons, s.UnicastReplies,
+	)
+}
+
+// transponderCounters 应答机计数器
+type transponderCounters struct {
+	requests          atomic.Uint64
+	signatureFailures atomic.Uint64
+	backedOff         atomic.Uint64
+	rateLimited       atomic.Uint64
+	replayed          atomic.Uint64
+	beacons           atomic.Uint64
+	unicastReplies    atomic.Uint64
+}
+
+// Stats 获取统计信息
+func (c *transponderCounters) Stats() TransponderStats {
+	return TransponderStats{
+		Requests:          c.requests.Load(),
+		SignatureFailures: c.signatureFailures.Load(),
+		BackedOff:         c.backedOff.Load(),
+		RateLimited:       c.rateLimited.Load(),
+		Replayed:          c.replayed.Load(),
+		Beacons:           c.beacons.Load(),
+		UnicastReplies:    c.unicastReplies.Load(),
+	}
+}
+
+// newSourceLimiter 创建按来源限制请求的限制器
+func newSourceLimiter() *sourceLimiter {
+	return &sourceLimiter{
+		sources: map[string]*sourceState{},
+	}
+}
+
+// sourceLimiter 按来源限制请求的限制器
+//
+// 每个来源有独立的令牌桶，连续签名校验失败的来源会被指数退避地屏蔽
+type sourceLimiter struct {
+	lock    sync.Mutex
+	sources map[string]*sourceState
+}
+
+// sourceState 来源状态
+type sourceState struct {
+	tokens       float64
+	last         time.Time
+	failures     int
+	blockedUntil time.Time
+}
+
+// Blocked 判断来源是否因签名校验失败被屏蔽
+func (l *sourceLimiter) Blocked(src string, now time.Time) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	s, ok := l.sources[src]
+	return ok && now.Before(s.blockedUntil)
+}
+
+// Allow 消耗来源的一个令牌，返回是否允许
+func (l *sourceLimiter) Allow(src string, now time.Time) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	s := l.get(src, now)
+	s.tokens = min(s.tokens+now.Sub(s.last).Seconds()*sourceRequestRate, sourceRequestBurst)
+	s.last = now
+	if s.tokens < 1 {
+		return false
+	}
+	s.tokens--
+	return true
+}
+
+// Fail 记录来源签名校验失败
+func (l *sourceLimiter) Fail(src string, now time.Time) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	s := l.get(src, now)
+	s.failures++
+	if s.failures < signatureFailureThreshold {
+		return
+	}
+	backoff := maxSignatureFailureBackoff
+	if n := s.failures - signatureFailureThreshold; n < 6 {
+		backoff = min(signatureFailureBackoff<<n, maxSignatureFailureBackoff)
+	}
+	s.blockedUntil = now.Add(backoff)
+}
+
+// Succeed 记录来源签名校验成功
+func (l *sourceLimiter) Succeed(src string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if s, ok := l.sources[src]; ok {
+		s.failures = 0
+	}
+}
+
+// get 获取来源状态，不存在时创建
+func (l *sourceLimiter) get(src string, now time.Time) *sourceState {
+	s, ok := l.sources[src]
+	if ok {
+		return s
+	}
+	if len(l.sources) >= maxSources {
+		l.prune(now)
+	}
+	s = &sourceState{tokens: sourceRequestBurst, last: now}
+	l.sources[src] = s
+	return s
+}
+
+// prune 清理令牌已满且没有被屏蔽的来源，仍然过多时清空
+func (l *sourceLimiter) prune(now time.Time) {
+	for src, s := range l.sources {
+		idle := now.Sub(s.last).Seconds()*sourceRequestRate+s.tokens >= sourceRequestBurst
+		if idle && !now.Before(s.blockedUntil) {
+			delete(l.sources, src)
+		}
+	}
+	if len(l.sources) >= maxSources {
+		clear(l.sources)
+	}
+}
@@ -0,0 +1,41 @@
+package discovery
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestSourceLimiter 测试 sourceLimiter
+func TestSourceLimiter(t *testing.T) {
+	a := assert.New(t)
+
+	l := newSourceLimiter()
+	now := time.Now()
+
+	// 令牌桶
+	for i := 0; i < sourceRequestBurst; i++ {
+		a.True(l.Allow("10.0.0.1", now))
+	}
+	a.False(l.Allow("10.0.0.1", now))
+	a.True(l.Allow("10.0.0.2", now))
+	a.True(l.Allow("10.0.0.1", now.Add(time.Second/sourceRequestRate)))
+
+	// 签名校验失败退避
+	for i := 0; i < signatureFailureThreshold-1; i++ {
+		l.Fail("10.0.0.3", now)
+	}
+	a.False(l.Blocked("10.0.0.3", now))
+	l.Fail("10.0.0.3", now)
+	a.True(l.Blocked("10.0.0.3", now))
+	a.False(l.Blocked("10.0.0.3", now.Add(signatureFailureBackoff)))
+	l.Fail("10.0.0.3", now)
+	a.True(l.Blocked("10.0.0.3", now.Add(signatureFailureBackoff)))
+	a.False(l.Blocked("10.0.0.3", now.Add(2*signatureFailureBackoff)))
+
+	// 成功后重置
+	l.Succeed("10.0.0.3")
+	l.Fail("10.0.0.3", now.Add(time.Hour))
+	a.False(l.Blocked("10.0.0.3", now.Add(time.Hour)))
+}
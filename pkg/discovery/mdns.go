@@ -0,0 +1,441 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"golang.org/x/net/dns/dnsmessage"
+
+	chatv1 "github.com/yhlooo/bangbang/pkg/apis/chat/v1"
+	"github.com/yhlooo/bangbang/pkg/signatures"
+)
+
+const (
+	// MDNSService DNS-SD 服务类型
+	MDNSService = "_bangbang._tcp.local."
+
+	// mdnsTTL mDNS 记录的 TTL （秒）
+	mdnsTTL = 120
+	// mdnsTXTChunkSize 单个 TXT 字符串中房间信息的最大长度
+	mdnsTXTChunkSize = 200
+	// mdnsTXTRoomKeyPrefix TXT 中房间信息分片的键前缀
+	mdnsTXTRoomKeyPrefix = "room"
+)
+
+// DefaultMDNSAddrs 默认的 mDNS 地址
+var DefaultMDNSAddrs = []string{
+	"224.0.0.251:5353",
+	"[ff02::fb]:5353",
+}
+
+// NewMDNSDiscoverer 创建基于 mDNS / DNS-SD 的发现器
+//
+// addrs 为空时使用 DefaultMDNSAddrs
+func NewMDNSDiscoverer(addrs ...string) *MDNSDiscoverer {
+	if len(addrs) == 0 {
+		addrs = DefaultMDNSAddrs
+	}
+	return &MDNSDiscoverer{
+		addrs: addrs,
+	}
+}
+
+// MDNSDiscoverer 基于 mDNS / DNS-SD 的发现器
+//
+// 查询 MDNSService 服务的 PTR 记录，从实例的 TXT 记录中获取签名的房间信息。
+// mDNS 查询无法携带挑战，仅依赖签名时间窗口（ SearchOptions.TimeWindow ）防止重放
+type MDNSDiscoverer struct {
+	addrs  []string
+	ifaces *InterfaceFilter
+}
+
+var _ Discoverer = (*MDNSDiscoverer)(nil)
+
+// WithInterfaceFilter 设置使用的网卡，为 nil 时使用 DefaultInterfaceFilter
+func (d *MDNSDiscoverer) WithInterfaceFilter(filter *InterfaceFilter) *MDNSDiscoverer {
+	d.ifaces = filter
+	return d
+}
+
+// Search 搜索房间
+func (d *MDNSDiscoverer) Search(ctx context.Context, key signatures.Key, opts SearchOptions) ([]Room, error) {
+	logger := logr.FromContextOrDiscard(ctx).WithName("mdns-discoverer")
+	ctx = logr.NewContext(ctx, logger)
+
+	opts.Complete()
+
+	query, err := newMDNSQuery()
+	if err != nil {
+		return nil, fmt.Errorf("build mdns query error: %w", err)
+	}
+
+	conn, err := listenMulticast(ctx, d.addrs, d.ifaces)
+	if err != nil {
+		return nil, fmt.Errorf("listen multicast error: %w", err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	go runMDNSQuerier(ctx, conn, query, int(opts.Duration/opts.RequestInterval), opts.RequestInterval)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-time.After(opts.Duration):
+		}
+		_ = conn.Close()
+	}()
+
+	logger.V(1).Info("listening rooms ...")
+	found := newRoomSet(key.Copy(), opts.Exclude, opts.TimeWindow)
+	for p := range conn.Packets(ctx) {
+		if found.Usable() != nil {
+			// 已经提前结束，丢弃剩余数据包
+			continue
+		}
+		pctx := withPacketSource(ctx, p.source())
+		for _, room := range parseMDNSPacket(pctx, key, p.data) {
+			if found.Add(pctx, room, p.iface) && opts.EarlyExit && found.CheckUsable(ctx, room.UID, opts.CheckAvailability) {
+				_ = conn.Close()
+				break
+			}
+		}
+	}
+	if room := found.Usable(); room != nil {
+		logger.V(1).Info(fmt.Sprintf("found usable room %q", room.Info.UID))
+		return []Room{*room}, nil
+	}
+
+	ret := found.List()
+	logger.V(1).Info(fmt.Sprintf("found %d rooms", len(ret)))
+
+	if opts.CheckAvailability {
+		logger.V(1).Info("checking availability for rooms ...")
+		checkAvailability(ctx, key.Copy(), opts.TimeWindow, ret)
+	}
+
+	return ret, nil
+}
+
+// Watch 持续监听房间变化
+func (d *MDNSDiscoverer) Watch(ctx context.Context, key signatures.Key) (<-chan Event, error) {
+	logger := logr.FromContextOrDiscard(ctx).WithName("mdns-discoverer")
+	ctx = logr.NewContext(ctx, logger)
+
+	query, err := newMDNSQuery()
+	if err != nil {
+		return nil, fmt.Errorf("build mdns query error: %w", err)
+	}
+
+	conn, err := listenMulticast(ctx, d.addrs, d.ifaces)
+	if err != nil {
+		return nil, fmt.Errorf("listen multicast error: %w", err)
+	}
+	go func() {
+		<-ctx.Done()
+		_ = conn.Close()
+	}()
+
+	go runMDNSQuerier(ctx, conn, query, -1, watchRequestInterval)
+
+	ch := make(chan sighting)
+	go func() {
+		defer close(ch)
+		for p := range conn.Packets(ctx) {
+			for _, room := range parseMDNSPacket(withPacketSource(ctx, p.source()), key, p.data) {
+				select {
+				case <-ctx.Done():
+					return
+				case ch <- sighting{room: room, zone: p.iface, src: p.source()}:
+				}
+			}
+		}
+	}()
+
+	return trackRooms(ctx, key.Copy(), RoomLivenessTTL, ch), nil
+}
+
+// runMDNSQuerier 每隔 interval 发送一次查询，共发送 n 次， n 小于 0 时持续发送直到 ctx 结束
+func runMDNSQuerier(ctx context.Context, conn *multicastConn, query []byte, n int, interval time.Duration) {
+	logger := logr.FromContextOrDiscard(ctx)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for i := 0; n < 0 || i < n; i++ {
+		logger.V(1).Info("sending mdns query")
+		if err := conn.Send(query); err != nil {
+			logger.Error(err, "send mdns query error")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// parseMDNSPacket 从 mDNS 数据包中解析房间信息，非应答的数据包返回空
+func parseMDNSPacket(ctx context.Context, key signatures.Key, data []byte) []*chatv1.Room {
+	logger := logr.FromContextOrDiscard(ctx)
+
+	var msg dnsmessage.Message
+	if err := msg.Unpack(data); err != nil {
+		logger.V(2).Info(fmt.Sprintf("decode mdns message error: %v", err))
+		return nil
+	}
+	if !msg.Header.Response {
+		return nil
+	}
+	return parseMDNSRooms(ctx, key, &msg)
+}
+
+// NewMDNSTransponder 创建基于 mDNS / DNS-SD 的应答机
+//
+// addrs 为空时使用 DefaultMDNSAddrs
+func NewMDNSTransponder(addrs []string, room *chatv1.Room, key signatures.Key) *MDNSTransponder {
+	if len(addrs) == 0 {
+		addrs = DefaultMDNSAddrs
+	}
+	return &MDNSTransponder{
+		addrs: addrs,
+		room:  room.DeepCopy(),
+		key:   key.Copy(),
+	}
+}
+
+// MDNSTransponder 基于 mDNS / DNS-SD 的应答机
+//
+// 将房间作为 MDNSService 服务的实例广播，签名的房间信息放在 TXT 记录中
+type MDNSTransponder struct {
+	once sync.Once
+
+	addrs  []string
+	ifaces *InterfaceFilter
+	room   *chatv1.Room
+	key    signatures.Key
+	// 只读观察者密钥，为空时不应答观察者
+	viewerKey signatures.Key
+
+	conn     *multicastConn
+	counters transponderCounters
+}
+
+var _ Transponder = (*MDNSTransponder)(nil)
+
+// WithInterfaceFilter 设置使用的网卡，为 nil 时使用 DefaultInterfaceFilter
+func (t *MDNSTransponder) WithInterfaceFilter(filter *InterfaceFilter) *MDNSTransponder {
+	t.ifaces = filter
+	return t
+}
+
+// WithViewerKey 设置只读观察者密钥，为空时不应答观察者
+//
+// 设置后每次应答另外发送使用观察者密钥加密的房间信息
+func (t *MDNSTransponder) WithViewerKey(key signatures.Key) *MDNSTransponder {
+	t.viewerKey = key.Copy()
+	return t
+}
+
+// Stats 获取统计信息
+func (t *MDNSTransponder) Stats() TransponderStats {
+	return t.counters.Stats()
+}
+
+// Start 开始运行应答机
+func (t *MDNSTransponder) Start(ctx context.Context) error {
+	finalErr := fmt.Errorf("already started")
+	t.once.Do(func() {
+		var err error
+		t.conn, err = listenMulticast(ctx, t.addrs, t.ifaces)
+		if err != nil {
+			finalErr = fmt.Errorf("listen multicast error: %w", err)
+			return
+		}
+
+		finalErr = nil
+		go t.run(ctx)
+	})
+	return finalErr
+}
+
+// run 运行应答机
+func (t *MDNSTransponder) run(ctx context.Context) {
+	logger := logr.FromContextOrDiscard(ctx).WithName("mdns-transponder")
+
+	go func() {
+		<-ctx.Done()
+		_ = t.conn.Close()
+	}()
+
+	limiter := newSourceLimiter()
+	var lastResponse time.Time
+	for p := range t.conn.Packets(ctx) {
+		var msg dnsmessage.Message
+		if err := msg.Unpack(p.data); err != nil {
+			logger.V(2).Info(fmt.Sprintf("decode mdns message error: %v", err))
+			continue
+		}
+		if msg.Header.Response || !isMDNSQueryForService(&msg) {
+			continue
+		}
+		t.counters.requests.Add(1)
+
+		now := time.Now()
+		src := ""
+		if p.src != nil {
+			src = p.src.IP.String()
+		}
+		if !limiter.Allow(src, now) {
+			t.counters.rateLimited.Add(1)
+			continue
+		}
+		if now.Sub(lastResponse) < beaconCoalesceInterval {
+			// 应答内容与查询无关，间隔内已经应答过的查询直接忽略
+			continue
+		}
+		lastResponse = now
+
+		// 在各网卡上广播时优先该网卡的访问端点，设置了观察者密钥时分别使用两个密钥加密
+		keys := []signatures.Key{t.key}
+		if len(t.viewerKey) != 0 {
+			keys = append(keys, t.viewerKey)
+		}
+		for _, key := range keys {
+			if err := t.conn.SendEach(func(iface net.Interface) ([]byte, error) {
+				room := t.room.DeepCopy()
+				room.Endpoints = endpointsForInterface(room.Endpoints, iface)
+				return newMDNSResponse(key, room)
+			}); err != nil {
+				logger.Error(err, "publish error")
+				continue
+			}
+			t.counters.beacons.Add(1)
+		}
+	}
+}
+
+// newMDNSQuery 创建查询服务实例的 mDNS 请求
+func newMDNSQuery() ([]byte, error) {
+	msg := dnsmessage.Message{
+		Questions: []dnsmessage.Question{{
+			Name:  dnsmessage.MustNewName(MDNSService),
+			Type:  dnsmessage.TypePTR,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+	return msg.Pack()
+}
+
+// isMDNSQueryForService 判断是否查询 MDNSService 服务的请求
+func isMDNSQueryForService(msg *dnsmessage.Message) bool {
+	for _, q := range msg.Questions {
+		if q.Type != dnsmessage.TypePTR && q.Type != dnsmessage.TypeALL {
+			continue
+		}
+		if strings.EqualFold(q.Name.String(), MDNSService) {
+			return true
+		}
+	}
+	return false
+}
+
+// newMDNSResponse 创建房间的 mDNS 响应
+//
+// 房间信息签名并加密后分片放到 TXT 记录中，实例名为定期轮换的临时标识。
+// 为避免泄露访问端点，不包括 SRV 和 A / AAAA 记录
+func newMDNSResponse(key signatures.Key, room *chatv1.Room) ([]byte, error) {
+	sealed, err := sealRoom(key, room)
+	if err != nil {
+		return nil, err
+	}
+	sealedRaw, err := json.Marshal(sealed)
+	if err != nil {
+		return nil, fmt.Errorf("marshal sealed room to json error: %w", err)
+	}
+
+	service := dnsmessage.MustNewName(MDNSService)
+	instance, err := dnsmessage.NewName(sealed.ID + "." + MDNSService)
+	if err != nil {
+		return nil, fmt.Errorf("invalid instance name: %w", err)
+	}
+
+	// 房间信息分片放到 TXT 中（单个字符串最长 255 字节）
+	txt := []string{"txtvers=2"}
+	for i := 0; i*mdnsTXTChunkSize < len(sealedRaw); i++ {
+		end := min((i+1)*mdnsTXTChunkSize, len(sealedRaw))
+		txt = append(txt, fmt.Sprintf("%s%d=%s", mdnsTXTRoomKeyPrefix, i, sealedRaw[i*mdnsTXTChunkSize:end]))
+	}
+
+	rrHeader := func(name dnsmessage.Name) dnsmessage.ResourceHeader {
+		return dnsmessage.ResourceHeader{Name: name, Class: dnsmessage.ClassINET, TTL: mdnsTTL}
+	}
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{Response: true, Authoritative: true},
+		Answers: []dnsmessage.Resource{{
+			Header: rrHeader(service),
+			Body:   &dnsmessage.PTRResource{PTR: instance},
+		}},
+		Additionals: []dnsmessage.Resource{{
+			Header: rrHeader(instance),
+			Body:   &dnsmessage.TXTResource{TXT: txt},
+		}},
+	}
+
+	return msg.Pack()
+}
+
+// parseMDNSRooms 从 mDNS 响应中解析并解密房间信息
+func parseMDNSRooms(ctx context.Context, key signatures.Key, msg *dnsmessage.Message) []*chatv1.Room {
+	logger := logr.FromContextOrDiscard(ctx)
+
+	var ret []*chatv1.Room
+	resources := append(append([]dnsmessage.Resource{}, msg.Answers...), msg.Additionals...)
+	for _, r := range resources {
+		txt, ok := r.Body.(*dnsmessage.TXTResource)
+		if !ok || !strings.HasSuffix(strings.ToLower(r.Header.Name.String()), "."+MDNSService) {
+			continue
+		}
+
+		// 按序号拼接房间信息分片
+		chunks := map[int]string{}
+		for _, item := range txt.TXT {
+			k, v, ok := strings.Cut(item, "=")
+			if !ok || !strings.HasPrefix(k, mdnsTXTRoomKeyPrefix) {
+				continue
+			}
+			i, err := strconv.Atoi(strings.TrimPrefix(k, mdnsTXTRoomKeyPrefix))
+			if err != nil {
+				continue
+			}
+			chunks[i] = v
+		}
+		indexes := make([]int, 0, len(chunks))
+		for i := range chunks {
+			indexes = append(indexes, i)
+		}
+		sort.Ints(indexes)
+		raw := strings.Builder{}
+		for _, i := range indexes {
+			raw.WriteString(chunks[i])
+		}
+
+		room, err := openRoomMessage(key, []byte(raw.String()))
+		if err != nil {
+			logger.V(1).Info(fmt.Sprintf("open room from txt record %q error: %v", r.Header.Name, err))
+			recordOpenRoomError(ctx, err)
+			continue
+		}
+		if room.UID.IsNil() {
+			continue
+		}
+		ret = append(ret, room)
+	}
+
+	return ret
+}
@@ -0,0 +1,72 @@
+package discovery
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/dns/dnsmessage"
+
+	chatv1 "github.com/yhlooo/bangbang/pkg/apis/chat/v1"
+	metav1 "github.com/yhlooo/bangbang/pkg/apis/meta/v1"
+	"github.com/yhlooo/bangbang/pkg/audit"
+	"github.com/yhlooo/bangbang/pkg/signatures"
+)
+
+// TestMDNSResponse 测试 newMDNSResponse 和 parseMDNSRooms
+func TestMDNSResponse(t *testing.T) {
+	a := assert.New(t)
+
+	room := &chatv1.Room{
+		APIMeta:    metav1.NewAPIMeta(chatv1.KindRoom),
+		ObjectMeta: metav1.ObjectMeta{UID: metav1.NewUID()},
+		CertSign:   "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef",
+		Endpoints: []string{
+			"https://192.168.1.2:7134",
+			"https://10.0.0.2:7134",
+			"https://[fe80::1%25eth0]:7134",
+		},
+	}
+	raw, err := newMDNSResponse(signatures.Key("test"), room)
+	a.NoError(err)
+
+	var msg dnsmessage.Message
+	a.NoError(msg.Unpack(raw))
+	a.True(msg.Header.Response)
+
+	// 不以明文出现房间信息
+	a.NotContains(string(raw), room.UID.String())
+	a.NotContains(string(raw), "192.168.1.2")
+	// 无法解密的房间信息记录为安全事件
+	auditPath := filepath.Join(t.TempDir(), "audit.log")
+	ctx := withPacketSource(audit.NewContext(context.Background(), audit.NewRecorder(auditPath)), "192.0.2.1")
+	a.Empty(parseMDNSRooms(ctx, signatures.Key("wrong"), &msg))
+	events, err := audit.ReadEvents(auditPath)
+	if a.NoError(err) && a.Len(events, 1) {
+		a.Equal(audit.EventDiscoverySignatureInvalid, events[0].Type)
+		a.Equal("192.0.2.1", events[0].Source)
+	}
+
+	ret := parseMDNSRooms(context.Background(), signatures.Key("test"), &msg)
+	if a.Len(ret, 1) {
+		a.Equal(room.UID, ret[0].UID)
+		a.Equal(room.Endpoints, ret[0].Endpoints)
+		discoveryKey := signatures.Key("test").Subkey(signatures.KeyPurposeDiscovery)
+		a.NoError(signatures.HS256VerifyAPIObject(discoveryKey, ret[0], room.SignTime, room.SignTime))
+	}
+}
+
+// TestIsMDNSQueryForService 测试 isMDNSQueryForService
+func TestIsMDNSQueryForService(t *testing.T) {
+	a := assert.New(t)
+
+	raw, err := newMDNSQuery()
+	a.NoError(err)
+	var msg dnsmessage.Message
+	a.NoError(msg.Unpack(raw))
+	a.True(isMDNSQueryForService(&msg))
+
+	msg.Questions[0].Name = dnsmessage.MustNewName("_http._tcp.local.")
+	a.False(isMDNSQueryForService(&msg))
+}
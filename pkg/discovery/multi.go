@@ -0,0 +1,303 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	chatv1 "github.com/yhlooo/bangbang/pkg/apis/chat/v1"
+	metav1 "github.com/yhlooo/bangbang/pkg/apis/meta/v1"
+	"github.com/yhlooo/bangbang/pkg/signatures"
+)
+
+const (
+	// BackendUDP 基于 UDP 组播的服务发现
+	BackendUDP = "udp"
+	// BackendMDNS 基于 mDNS / DNS-SD 的服务发现
+	BackendMDNS = "mdns"
+)
+
+// Backends 支持的服务发现后端
+var Backends = []string{BackendUDP, BackendMDNS}
+
+// NewDiscoverer 创建使用指定后端的发现器
+//
+// udpAddrs 、 announcements 仅用于 BackendUDP ，指定多个后端时同时使用所有后端搜索； ifaces 为 nil 时使用 DefaultInterfaceFilter 。
+// announcements 为 true 时接受不带挑战的主动广播
+func NewDiscoverer(
+	backends []string,
+	udpAddrs []string,
+	ifaces *InterfaceFilter,
+	announcements bool,
+) (Discoverer, error) {
+	var ds []Discoverer
+	for _, backend := range backends {
+		switch backend {
+		case BackendUDP:
+			ds = append(ds, NewUDPDiscoverer(udpAddrs...).
+				WithInterfaceFilter(ifaces).
+				WithAnnouncements(announcements))
+		case BackendMDNS:
+			ds = append(ds, NewMDNSDiscoverer().WithInterfaceFilter(ifaces))
+		default:
+			return nil, fmt.Errorf("unknown discovery backend: %q (expected one of %q)", backend, Backends)
+		}
+	}
+	if len(ds) == 0 {
+		return nil, errors.New("no discovery backend specified")
+	}
+	if len(ds) == 1 {
+		return ds[0], nil
+	}
+	return NewMultiDiscoverer(ds...), nil
+}
+
+// NewTransponder 创建使用指定后端的应答机
+//
+// udpAddrs 、 announce 仅用于 BackendUDP ，指定多个后端时同时运行所有后端； ifaces 为 nil 时使用 DefaultInterfaceFilter 。
+// announce 为主动广播房间信息的平均间隔，为 0 时不主动广播； viewerKey 为只读观察者密钥，为空时不应答观察者
+func NewTransponder(
+	backends []string,
+	udpAddrs []string,
+	ifaces *InterfaceFilter,
+	announce time.Duration,
+	room *chatv1.Room,
+	key, viewerKey signatures.Key,
+) (Transponder, error) {
+	var ts []Transponder
+	for _, backend := range backends {
+		switch backend {
+		case BackendUDP:
+			ts = append(ts, NewUDPTransponder(udpAddrs, room, key).
+				WithInterfaceFilter(ifaces).
+				WithAnnounce(announce).
+				WithViewerKey(viewerKey))
+		case BackendMDNS:
+			ts = append(ts, NewMDNSTransponder(nil, room, key).WithInterfaceFilter(ifaces).WithViewerKey(viewerKey))
+		default:
+			return nil, fmt.Errorf("unknown discovery backend: %q (expected one of %q)", backend, Backends)
+		}
+	}
+	if len(ts) == 0 {
+		return nil, errors.New("no discovery backend specified")
+	}
+	if len(ts) == 1 {
+		return ts[0], nil
+	}
+	return NewMultiTransponder(ts...), nil
+}
+
+// NewMultiDiscoverer 创建同时使用多个发现器搜索的发现器
+func NewMultiDiscoverer(discoverers ...Discoverer) *MultiDiscoverer {
+	return &MultiDiscoverer{
+		discoverers: discoverers,
+	}
+}
+
+// MultiDiscoverer 同时使用多个发现器搜索的发现器
+type MultiDiscoverer struct {
+	discoverers []Discoverer
+}
+
+var _ Discoverer = (*MultiDiscoverer)(nil)
+
+// Search 搜索房间
+//
+// 并行使用所有发现器搜索，合并结果。部分发现器出错时仅在所有发现器都出错时返回错误。
+// opts.EarlyExit 为 true 时任一发现器找到可用房间后取消其它发现器并返回该房间
+func (d *MultiDiscoverer) Search(ctx context.Context, key signatures.Key, opts SearchOptions) ([]Room, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make([][]Room, len(d.discoverers))
+	errs := make([]error, len(d.discoverers))
+	var first []Room
+	firstOnce := &sync.Once{}
+
+	wg := &sync.WaitGroup{}
+	for i, discoverer := range d.discoverers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], errs[i] = discoverer.Search(ctx, key.Copy(), opts)
+			if opts.EarlyExit && errs[i] == nil && len(results[i]) > 0 {
+				firstOnce.Do(func() {
+					first = results[i]
+					cancel()
+				})
+			}
+		}()
+	}
+	wg.Wait()
+	if first != nil {
+		return first, nil
+	}
+
+	roomMap := map[metav1.UID]Room{}
+	failed := 0
+	for i, result := range results {
+		if errs[i] != nil {
+			failed++
+			continue
+		}
+		for _, room := range result {
+			// 优先保留有可用端点且延迟较低的结果
+			if existing, ok := roomMap[room.Info.UID]; ok && existing.AvailableEndpoint != "" &&
+				(room.AvailableEndpoint == "" || existing.RTT <= room.RTT) {
+				continue
+			}
+			roomMap[room.Info.UID] = room
+		}
+	}
+	if failed == len(d.discoverers) {
+		return nil, errors.Join(errs...)
+	}
+	if len(roomMap) == 0 {
+		return nil, nil
+	}
+
+	ret := make([]Room, 0, len(roomMap))
+	for _, room := range roomMap {
+		ret = append(ret, room)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Info.UID.String() < ret[j].Info.UID.String()
+	})
+	return ret, nil
+}
+
+// Watch 持续监听房间变化
+//
+// 同时使用所有发现器监听，合并事件：任一发现器发现房间时产生 EventAdded 事件，
+// 所有发现器都认为房间消失时才产生 EventRemoved 事件。部分发现器出错时仅在所有发现器都出错时返回错误
+func (d *MultiDiscoverer) Watch(ctx context.Context, key signatures.Key) (<-chan Event, error) {
+	type sourceEvent struct {
+		source int
+		event  Event
+	}
+
+	in := make(chan sourceEvent)
+	wg := &sync.WaitGroup{}
+	var errs []error
+	for i, discoverer := range d.discoverers {
+		events, err := discoverer.Watch(ctx, key.Copy())
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for e := range events {
+				select {
+				case <-ctx.Done():
+					return
+				case in <- sourceEvent{source: i, event: e}:
+				}
+			}
+		}()
+	}
+	if len(errs) == len(d.discoverers) {
+		return nil, errors.Join(errs...)
+	}
+	go func() {
+		wg.Wait()
+		close(in)
+	}()
+
+	ch := make(chan Event)
+	go func() {
+		defer close(ch)
+
+		// 各房间被哪些发现器发现
+		sources := map[metav1.UID]map[int]Room{}
+		// 各房间最后产生事件时的状态
+		last := map[metav1.UID]Room{}
+		for se := range in {
+			uid := se.event.Room.Info.UID
+			e := se.event
+			switch e.Type {
+			case EventAdded, EventUpdated:
+				if sources[uid] == nil {
+					sources[uid] = map[int]Room{}
+					e.Type = EventAdded
+				} else {
+					e.Type = EventUpdated
+				}
+				sources[uid][se.source] = e.Room
+				// 优先使用有可用端点的结果
+				if e.Room.AvailableEndpoint == "" {
+					for _, room := range sources[uid] {
+						if room.AvailableEndpoint != "" {
+							e.Room = room
+							break
+						}
+					}
+				}
+				if prev, ok := last[uid]; ok && e.Type == EventUpdated &&
+					sameRoom(&prev, &e.Room) && prev.AvailableEndpoint == e.Room.AvailableEndpoint {
+					// 其它发现器发现了同一房间
+					continue
+				}
+				last[uid] = e.Room
+			case EventRemoved:
+				delete(sources[uid], se.source)
+				if len(sources[uid]) > 0 {
+					continue
+				}
+				delete(sources, uid)
+				delete(last, uid)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case ch <- e:
+			}
+		}
+	}()
+	return ch, nil
+}
+
+// NewMultiTransponder 创建同时运行多个应答机的应答机
+func NewMultiTransponder(transponders ...Transponder) *MultiTransponder {
+	return &MultiTransponder{
+		transponders: transponders,
+	}
+}
+
+// MultiTransponder 同时运行多个应答机的应答机
+type MultiTransponder struct {
+	transponders []Transponder
+}
+
+var _ Transponder = (*MultiTransponder)(nil)
+
+// Stats 获取所有应答机统计信息之和
+func (t *MultiTransponder) Stats() TransponderStats {
+	var ret TransponderStats
+	for _, transponder := range t.transponders {
+		s := transponder.Stats()
+		ret.Requests += s.Requests
+		ret.SignatureFailures += s.SignatureFailures
+		ret.BackedOff += s.BackedOff
+		ret.RateLimited += s.RateLimited
+		ret.Replayed += s.Replayed
+		ret.Beacons += s.Beacons
+		ret.UnicastReplies += s.UnicastReplies
+	}
+	return ret
+}
+
+// Start 开始运行应答机
+func (t *MultiTransponder) Start(ctx context.Context) error {
+	for _, transponder := range t.transponders {
+		if err := transponder.Start(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
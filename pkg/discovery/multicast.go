@@ -0,0 +1,359 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/go-logr/logr"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// DefaultUDPAddrs 默认的 UDP 服务发现地址
+var DefaultUDPAddrs = []string{
+	"224.0.0.1:7134",
+	"[ff02::7134]:7134",
+}
+
+// packet UDP 数据包
+type packet struct {
+	// 数据
+	data []byte
+	// 来源地址
+	src *net.UDPAddr
+	// 接收数据包的网卡名，系统不支持时可能为空
+	iface string
+}
+
+// source 返回数据包来源 IP ，未知时返回空
+func (p packet) source() string {
+	if p.src == nil {
+		return ""
+	}
+	return p.src.IP.String()
+}
+
+// listenMulticast 监听多个组播地址
+//
+// 在 filter 允许的每个网卡上分别加入组播组。
+// 部分地址监听失败时（比如系统没有启用 IPv6 ）仅记录日志，所有地址都监听失败时返回错误
+func listenMulticast(ctx context.Context, addrs []string, filter *InterfaceFilter) (*multicastConn, error) {
+	logger := logr.FromContextOrDiscard(ctx)
+
+	ret := &multicastConn{}
+	var errs []error
+	for _, addr := range addrs {
+		conn, err := listenGroup(addr, filter)
+		if err != nil {
+			logger.V(1).Info(fmt.Sprintf("listen multicast address %q error: %v", addr, err))
+			errs = append(errs, err)
+			continue
+		}
+		ret.conns = append(ret.conns, conn)
+	}
+	if len(ret.conns) == 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	return ret, nil
+}
+
+// multicastConn 多个组播地址的连接
+type multicastConn struct {
+	conns []*groupConn
+
+	closeOnce sync.Once
+}
+
+// Packets 开始读取并返回接收数据包的通道
+//
+// 通道在连接关闭后关闭
+func (c *multicastConn) Packets(ctx context.Context) <-chan packet {
+	ch := make(chan packet, 16)
+	wg := &sync.WaitGroup{}
+	for _, conn := range c.conns {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn.readLoop(ctx, ch)
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(ch)
+	}()
+	return ch
+}
+
+// Send 在每个网卡上发送数据到所有组播地址
+func (c *multicastConn) Send(data []byte) error {
+	return c.SendEach(func(net.Interface) ([]byte, error) {
+		return data, nil
+	})
+}
+
+// SendEach 在每个网卡上发送数据到所有组播地址，发送的数据由 build 根据网卡生成
+func (c *multicastConn) SendEach(build func(iface net.Interface) ([]byte, error)) error {
+	var errs []error
+	for _, conn := range c.conns {
+		if err := conn.sendEach(build); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// SendTo 以单播发送数据到指定地址
+func (c *multicastConn) SendTo(data []byte, dst *net.UDPAddr) error {
+	v4 := dst.IP.To4() != nil
+	for _, conn := range c.conns {
+		if (conn.group.IP.To4() != nil) != v4 {
+			continue
+		}
+		_, err := conn.conn.WriteToUDP(data, dst)
+		return err
+	}
+	return fmt.Errorf("no connection available for %q", dst.String())
+}
+
+// Close 关闭连接
+func (c *multicastConn) Close() error {
+	var errs []error
+	c.closeOnce.Do(func() {
+		for _, conn := range c.conns {
+			if err := conn.conn.Close(); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	})
+	return errors.Join(errs...)
+}
+
+// listenGroup 监听单个组播地址
+func listenGroup(addr string, filter *InterfaceFilter) (*groupConn, error) {
+	group, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("resolve udp address error: %w", err)
+	}
+
+	v4 := group.IP.To4() != nil
+	if !group.IP.IsMulticast() {
+		return nil, fmt.Errorf("%q is not a multicast address", group.IP)
+	}
+	if !v4 && !group.IP.IsLinkLocalMulticast() {
+		return nil, fmt.Errorf("unsupported ipv6 address %q (expected link-local multicast address)", group.IP)
+	}
+
+	ifaces, err := multicastInterfaces(!v4, group.Zone, filter)
+	if err != nil {
+		return nil, err
+	}
+	if len(ifaces) == 0 {
+		return nil, fmt.Errorf("no interface available for %q", group.String())
+	}
+
+	// NOTE: 监听组播地址时实际会监听该端口的所有地址
+	network := "udp6"
+	if v4 {
+		network = "udp4"
+	}
+	conn, err := net.ListenUDP(network, &net.UDPAddr{IP: group.IP, Port: group.Port})
+	if err != nil {
+		return nil, fmt.Errorf("listen udp %q error: %w", group.String(), err)
+	}
+	_ = conn.SetReadBuffer(1 << 20)
+
+	ret := &groupConn{
+		group: &net.UDPAddr{IP: group.IP, Port: group.Port},
+		conn:  conn,
+	}
+
+	// 在每个网卡上分别加入组，而不是由系统选择网卡
+	// NOTE: 部分系统（比如 Windows ）不支持控制消息，此时无法获取接收网卡
+	var join func(iface *net.Interface) error
+	if v4 {
+		ret.p4 = ipv4.NewPacketConn(conn)
+		_ = ret.p4.SetControlMessage(ipv4.FlagInterface, true)
+		join = func(iface *net.Interface) error {
+			err := ret.p4.JoinGroup(iface, &net.UDPAddr{IP: group.IP})
+			if err != nil && group.IP.Equal(net.IPv4allsys) {
+				// 所有主机都在所有主机组（ 224.0.0.1 ）中，部分系统不允许显式加入
+				return nil
+			}
+			return err
+		}
+	} else {
+		ret.p6 = ipv6.NewPacketConn(conn)
+		_ = ret.p6.SetControlMessage(ipv6.FlagInterface, true)
+		join = func(iface *net.Interface) error {
+			return ret.p6.JoinGroup(iface, &net.UDPAddr{IP: group.IP})
+		}
+	}
+	for _, iface := range ifaces {
+		if err := join(&iface); err != nil {
+			continue
+		}
+		ret.ifaces = append(ret.ifaces, iface)
+	}
+	if len(ret.ifaces) == 0 {
+		_ = conn.Close()
+		return nil, fmt.Errorf("join group %q on all interfaces failed", group.String())
+	}
+
+	return ret, nil
+}
+
+// groupConn 单个组播地址的连接
+type groupConn struct {
+	group *net.UDPAddr
+	conn  *net.UDPConn
+	// 加入了组的网卡
+	ifaces []net.Interface
+
+	sendLock sync.Mutex
+	// 根据地址族二者仅其一有值
+	p4 *ipv4.PacketConn
+	p6 *ipv6.PacketConn
+}
+
+// readLoop 循环读取数据包，直到连接关闭
+//
+// 丢弃从未加入组的网卡收到的数据包
+func (c *groupConn) readLoop(ctx context.Context, ch chan<- packet) {
+	logger := logr.FromContextOrDiscard(ctx)
+
+	buffer := make([]byte, 8<<10)
+	for {
+		var (
+			n       int
+			src     net.Addr
+			ifIndex int
+			err     error
+		)
+		if c.p4 != nil {
+			var cm *ipv4.ControlMessage
+			n, cm, src, err = c.p4.ReadFrom(buffer)
+			if cm != nil {
+				ifIndex = cm.IfIndex
+			}
+		} else {
+			var cm *ipv6.ControlMessage
+			n, cm, src, err = c.p6.ReadFrom(buffer)
+			if cm != nil {
+				ifIndex = cm.IfIndex
+			}
+		}
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			logger.Error(err, "read udp packet error")
+		}
+		if n == 0 {
+			continue
+		}
+
+		udpSrc, _ := src.(*net.UDPAddr)
+		iface := ""
+		if ifIndex > 0 {
+			joined := false
+			for _, item := range c.ifaces {
+				if item.Index == ifIndex {
+					iface = item.Name
+					joined = true
+					break
+				}
+			}
+			if !joined {
+				continue
+			}
+		} else if udpSrc != nil {
+			iface = udpSrc.Zone
+		}
+		data := make([]byte, n)
+		copy(data, buffer[:n])
+
+		select {
+		case <-ctx.Done():
+			return
+		case ch <- packet{data: data, src: udpSrc, iface: iface}:
+		}
+	}
+}
+
+// sendEach 在每个网卡上发送数据到组播地址
+func (c *groupConn) sendEach(build func(iface net.Interface) ([]byte, error)) error {
+	c.sendLock.Lock()
+	defer c.sendLock.Unlock()
+
+	var errs []error
+	for _, iface := range c.ifaces {
+		data, err := build(iface)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("build data for %q error: %w", iface.Name, err))
+			continue
+		}
+
+		if c.p4 != nil {
+			err = c.p4.SetMulticastInterface(&iface)
+		} else {
+			err = c.p6.SetMulticastInterface(&iface)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("set multicast interface %q error: %w", iface.Name, err))
+			continue
+		}
+
+		if c.p4 != nil {
+			_, err = c.p4.WriteTo(data, nil, c.group)
+		} else {
+			_, err = c.p6.WriteTo(data, nil, c.group)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("send to %q via %q error: %w", c.group, iface.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// multicastInterfaces 获取可用于组播的网卡
+//
+// v6 为 true 时返回有 IPv6 链路本地地址的网卡，否则返回有 IPv4 地址的网卡；
+// zone 不为空时仅返回指定网卡，否则返回 filter 允许的网卡
+func multicastInterfaces(v6 bool, zone string, filter *InterfaceFilter) ([]net.Interface, error) {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return nil, fmt.Errorf("get interfaces error: %w", err)
+	}
+
+	var ret []net.Interface
+	for _, iface := range interfaces {
+		if zone != "" && iface.Name != zone {
+			continue
+		}
+		if zone == "" && !filter.Match(iface.Name) {
+			continue
+		}
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagMulticast == 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			if (v6 && ipNet.IP.To4() == nil && ipNet.IP.IsLinkLocalUnicast()) || (!v6 && ipNet.IP.To4() != nil) {
+				ret = append(ret, iface)
+				break
+			}
+		}
+	}
+	return ret, nil
+}
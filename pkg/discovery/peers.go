@@ -0,0 +1,157 @@
+package discovery
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	chatv1 "github.com/yhlooo/bangbang/pkg/apis/chat/v1"
+	metav1 "github.com/yhlooo/bangbang/pkg/apis/meta/v1"
+	"github.com/yhlooo/bangbang/pkg/chats/rooms"
+	"github.com/yhlooo/bangbang/pkg/signatures"
+)
+
+// InvitePrefix 邀请字符串前缀
+const InvitePrefix = "bang-invite:"
+
+// Peer 手动指定的对端房间
+type Peer struct {
+	// 访问端点
+	Endpoints []string
+	// 证书签名
+	CertSign string
+}
+
+// ParsePeer 解析对端房间
+//
+// s 可以是 https://HOST:PORT#sha256:... 形式的访问端点（ fragment 为证书签名），
+// 也可以是 NewInvite 生成的邀请字符串
+func ParsePeer(key signatures.Key, s string) (*Peer, error) {
+	if strings.HasPrefix(s, InvitePrefix) {
+		invite, err := ParseInvite(key, s)
+		if err != nil {
+			return nil, err
+		}
+		return &Peer{Endpoints: invite.Endpoints, CertSign: invite.CertSign}, nil
+	}
+
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("parse peer %q error: %w", s, err)
+	}
+	if u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("invalid peer %q (expected https://HOST:PORT#sha256:...)", s)
+	}
+	if !strings.HasPrefix(u.Fragment, "sha256:") {
+		return nil, fmt.Errorf("certificate signature is required for peer %q (expected https://HOST:PORT#sha256:...)", s)
+	}
+	certSign := u.Fragment
+	u.Fragment = ""
+	return &Peer{Endpoints: []string{u.String()}, CertSign: certSign}, nil
+}
+
+// Probe 依次尝试访问端点，返回第一个可用的端点及房间信息
+func (p *Peer) Probe(ctx context.Context, key signatures.Key) (string, *chatv1.Room, error) {
+	var errs []error
+	for _, endpoint := range p.Endpoints {
+		info, err := probeEndpoint(ctx, key, endpoint, p.CertSign)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("endpoint %q not available: %w", endpoint, err))
+			continue
+		}
+		return endpoint, info, nil
+	}
+	if len(errs) == 0 {
+		return "", nil, errors.New("no endpoint")
+	}
+	return "", nil, errors.Join(errs...)
+}
+
+// NewInvite 生成房间的邀请字符串
+//
+// 邀请使用 key 的服务发现子密钥签名，在 ttl 后过期。不包括本地回环访问端点
+func NewInvite(key signatures.Key, room *chatv1.Room, endpoints []string, ttl time.Duration) (string, error) {
+	invite := &chatv1.Invite{
+		APIMeta:    metav1.NewAPIMeta(chatv1.KindInvite),
+		ObjectMeta: metav1.ObjectMeta{UID: metav1.NewUID()},
+		Room:       room.UID,
+		CertSign:   room.CertSign,
+		ExpireTime: time.Now().Add(ttl).Truncate(time.Second),
+	}
+	for _, endpoint := range endpoints {
+		if isLoopbackEndpoint(endpoint) {
+			continue
+		}
+		invite.Endpoints = append(invite.Endpoints, endpoint)
+	}
+	if len(invite.Endpoints) == 0 {
+		return "", errors.New("no endpoint available for invite")
+	}
+
+	if err := signatures.HS256SignAPIObject(key.Subkey(signatures.KeyPurposeDiscovery), invite); err != nil {
+		return "", fmt.Errorf("sign invite error: %w", err)
+	}
+	raw, err := json.Marshal(invite)
+	if err != nil {
+		return "", fmt.Errorf("marshal invite to json error: %w", err)
+	}
+	return InvitePrefix + base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+// ParseInvite 解析并校验邀请字符串
+func ParseInvite(key signatures.Key, s string) (*chatv1.Invite, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(s, InvitePrefix))
+	if err != nil {
+		return nil, fmt.Errorf("decode invite error: %w", err)
+	}
+	invite := &chatv1.Invite{}
+	if err := json.Unmarshal(raw, invite); err != nil {
+		return nil, fmt.Errorf("unmarshal invite error: %w", err)
+	}
+	if !invite.IsKind(chatv1.KindInvite) {
+		return nil, fmt.Errorf("invalid invite kind: %q", invite.Kind)
+	}
+	if err := signatures.HS256VerifyAPIObject(key.Subkey(signatures.KeyPurposeDiscovery), invite, time.Time{}, time.Now().Add(DefaultTimeWindow)); err != nil {
+		return nil, fmt.Errorf("verify invite signature error: %w", err)
+	}
+	if time.Now().After(invite.ExpireTime) {
+		return nil, fmt.Errorf("invite expired at %s", invite.ExpireTime.Format(time.RFC3339))
+	}
+	return invite, nil
+}
+
+// probeEndpoint 访问端点获取房间信息并校验接口认证子密钥的签名
+func probeEndpoint(ctx context.Context, key signatures.Key, endpoint, certSign string) (*chatv1.Room, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	clientCert, err := clientCertificate(key)
+	if err != nil {
+		return nil, fmt.Errorf("create client certificate error: %w", err)
+	}
+	info, err := rooms.NewRemoteRoom(endpoint, certSign, clientCert).Info(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if key != nil {
+		now := time.Now()
+		if err := signatures.HS256VerifyAPIObject(
+			key.Subkey(signatures.KeyPurposeAPI), info,
+			now.Add(-DefaultTimeWindow), now.Add(DefaultTimeWindow),
+		); err != nil {
+			return nil, fmt.Errorf("signature verification error: %w", err)
+		}
+	}
+	return info, nil
+}
+
+// isLoopbackEndpoint 判断是否本地回环访问端点
+func isLoopbackEndpoint(endpoint string) bool {
+	ip, _ := endpointIP(endpoint)
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,55 @@
+package discovery
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	chatv1 "github.com/yhlooo/bangbang/pkg/apis/chat/v1"
+	metav1 "github.com/yhlooo/bangbang/pkg/apis/meta/v1"
+	"github.com/yhlooo/bangbang/pkg/signatures"
+)
+
+// TestParsePeer 测试 ParsePeer
+func TestParsePeer(t *testing.T) {
+	a := assert.New(t)
+	key := signatures.Key("7134")
+
+	peer, err := ParsePeer(key, "https://192.168.1.2:41234#sha256:abcd")
+	a.NoError(err)
+	a.Equal(&Peer{Endpoints: []string{"https://192.168.1.2:41234"}, CertSign: "sha256:abcd"}, peer)
+
+	_, err = ParsePeer(key, "https://192.168.1.2:41234")
+	a.Error(err)
+	_, err = ParsePeer(key, "http://192.168.1.2:41234#sha256:abcd")
+	a.Error(err)
+
+	room := &chatv1.Room{
+		APIMeta:    metav1.NewAPIMeta(chatv1.KindRoom),
+		ObjectMeta: metav1.ObjectMeta{UID: metav1.NewUID()},
+		CertSign:   "sha256:abcd",
+	}
+	invite, err := NewInvite(key, room, []string{
+		"https://127.0.0.1:41234",
+		"https://192.168.1.2:41234",
+		"https://[fe80::1%25eth0]:41234",
+	}, time.Hour)
+	a.NoError(err)
+	peer, err = ParsePeer(key, invite)
+	a.NoError(err)
+	a.Equal(&Peer{
+		Endpoints: []string{"https://192.168.1.2:41234", "https://[fe80::1%25eth0]:41234"},
+		CertSign:  "sha256:abcd",
+	}, peer)
+
+	// 错误的 PIN
+	_, err = ParsePeer(signatures.Key("1234"), invite)
+	a.Error(err)
+
+	// 过期
+	invite, err = NewInvite(key, room, []string{"https://192.168.1.2:41234"}, -time.Minute)
+	a.NoError(err)
+	_, err = ParsePeer(key, invite)
+	a.Error(err)
+}
@@ -0,0 +1,318 @@
+package discovery
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+
+	chatv1 "github.com/yhlooo/bangbang/pkg/apis/chat/v1"
+	metav1 "github.com/yhlooo/bangbang/pkg/apis/meta/v1"
+	"github.com/yhlooo/bangbang/pkg/audit"
+	"github.com/yhlooo/bangbang/pkg/chats/rooms"
+	"github.com/yhlooo/bangbang/pkg/signatures"
+)
+
+const (
+	// probeTimeout 检查单个访问端点的超时时间
+	probeTimeout = time.Second
+	// probeStagger 依次开始检查房间各访问端点的间隔
+	probeStagger = 50 * time.Millisecond
+)
+
+// newRoomSet 创建搜索到的房间集合
+//
+// window 为允许的签名时间误差
+func newRoomSet(key signatures.Key, exclude []metav1.UID, window time.Duration) *roomSet {
+	return &roomSet{
+		key:     key,
+		exclude: exclude,
+		window:  window,
+		rooms:   map[metav1.UID]chatv1.Room{},
+		zones:   map[metav1.UID]string{},
+		checked: map[metav1.UID]bool{},
+	}
+}
+
+// roomSet 搜索到的房间集合
+type roomSet struct {
+	key     signatures.Key
+	exclude []metav1.UID
+	window  time.Duration
+
+	rooms map[metav1.UID]chatv1.Room
+	// 各房间的 IPv6 接收网卡
+	zones map[metav1.UID]string
+	// 已经检查过是否可用的房间
+	checked map[metav1.UID]bool
+	// 第一个可用的房间
+	usable *Room
+}
+
+// Add 校验并添加房间，返回是否添加成功
+//
+// zone 为接收到房间信息的网卡，未知时为空
+func (s *roomSet) Add(ctx context.Context, room *chatv1.Room, zone string) bool {
+	logger := logr.FromContextOrDiscard(ctx)
+
+	if slices.Contains(s.exclude, room.UID) {
+		return false
+	}
+	if !verifyRoom(ctx, s.key, s.window, room) {
+		return false
+	}
+
+	logger.V(1).Info(fmt.Sprintf("found room %q", room.UID))
+	s.rooms[room.UID] = *room
+	if zone != "" {
+		s.zones[room.UID] = zone
+	}
+	return true
+}
+
+// CheckUsable 检查房间是否可用，可用时记录为第一个可用的房间并返回 true
+//
+// checkAvail 为 false 时不检查访问端点可用性。每个房间只检查一次
+func (s *roomSet) CheckUsable(ctx context.Context, uid metav1.UID, checkAvail bool) bool {
+	if s.usable != nil {
+		return true
+	}
+	info, ok := s.rooms[uid]
+	if !ok || s.checked[uid] {
+		return false
+	}
+	s.checked[uid] = true
+
+	room := []Room{{
+		Info:      info,
+		Endpoints: localizeEndpoints(info.Endpoints, s.zones[uid]),
+	}}
+	if checkAvail {
+		checkAvailability(ctx, s.key, s.window, room)
+		if room[0].AvailableEndpoint == "" {
+			return false
+		}
+	}
+	s.usable = &room[0]
+	return true
+}
+
+// Usable 返回第一个可用的房间，没有时返回 nil
+func (s *roomSet) Usable() *Room {
+	return s.usable
+}
+
+// List 列出房间
+func (s *roomSet) List() []Room {
+	if len(s.rooms) == 0 {
+		return nil
+	}
+
+	ret := make([]Room, 0, len(s.rooms))
+	for uid, room := range s.rooms {
+		ret = append(ret, Room{
+			Info:      room,
+			Endpoints: localizeEndpoints(room.Endpoints, s.zones[uid]),
+		})
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Info.UID.String() < ret[j].Info.UID.String()
+	})
+
+	return ret
+}
+
+// verifyRoom 校验服务发现得到的房间信息，返回是否有效
+//
+// 使用 key 的服务发现子密钥校验签名， key 为 nil 时不校验签名， window 为允许的签名时间误差。
+// 签名校验失败时记录到上下文中的安全事件记录器
+func verifyRoom(ctx context.Context, key signatures.Key, window time.Duration, room *chatv1.Room) bool {
+	logger := logr.FromContextOrDiscard(ctx)
+
+	if !room.IsKind(chatv1.KindRoom) {
+		return false
+	}
+	if key != nil {
+		now := time.Now()
+		if err := signatures.HS256VerifyAPIObject(
+			key.Subkey(signatures.KeyPurposeDiscovery), room,
+			now.Add(-window), now.Add(window),
+		); err != nil {
+			logger.V(1).Info(fmt.Sprintf("signature verification error: %s", err))
+			audit.FromContext(ctx).Record(
+				audit.EventDiscoverySignatureInvalid,
+				"invalid room info signature (tampered or out-of-window)",
+			)
+			return false
+		}
+	}
+	return true
+}
+
+// withPacketSource 返回安全事件来源为 src 的上下文，用于记录单个数据包引起的安全事件
+func withPacketSource(ctx context.Context, src string) context.Context {
+	recorder := audit.FromContext(ctx)
+	if recorder == nil {
+		return ctx
+	}
+	return audit.NewContext(ctx, recorder.WithSource(src))
+}
+
+// recordOpenRoomError 记录无法解密的房间信息
+//
+// 只记录解密失败，忽略同一组播地址上的其它消息（比如其它搜索者的请求）
+func recordOpenRoomError(ctx context.Context, err error) {
+	if errors.Is(err, errSealedRoomAuth) {
+		audit.FromContext(ctx).Record(
+			audit.EventDiscoverySignatureInvalid,
+			"undecryptable room info (wrong PIN, another room or tampered)",
+		)
+	}
+}
+
+// checkAvailability 检查房间可访问性
+//
+// 并行检查所有房间，每个房间的访问端点按顺序错开 probeStagger 并行检查，使用最先可用的端点。
+// window 为允许的签名时间误差
+func checkAvailability(ctx context.Context, key signatures.Key, window time.Duration, roomList []Room) {
+	logger := logr.FromContextOrDiscard(ctx)
+
+	clientCert, err := clientCertificate(key)
+	if err != nil {
+		logger.Error(err, "create client certificate error")
+		return
+	}
+
+	wg := &sync.WaitGroup{}
+	for i := range roomList {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			checkRoomAvailability(ctx, key.Copy(), window, clientCert, &roomList[i])
+		}()
+	}
+	wg.Wait()
+}
+
+// clientCertificate 创建访问房间使用的客户端证书， key 为 nil 时返回 nil
+func clientCertificate(key signatures.Key) (*tls.Certificate, error) {
+	if key == nil {
+		return nil, nil
+	}
+	return signatures.NewClientCertificate(key, nil)
+}
+
+// endpointProbeResult 访问端点检查结果
+type endpointProbeResult struct {
+	endpoint string
+	info     *chatv1.Room
+	rtt      time.Duration
+	err      error
+}
+
+// checkRoomAvailability 检查单个房间的可访问性，记录最先可用的端点及其延迟和房间深度
+func checkRoomAvailability(
+	ctx context.Context,
+	key signatures.Key,
+	window time.Duration,
+	clientCert *tls.Certificate,
+	room *Room,
+) {
+	logger := logr.FromContextOrDiscard(ctx)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan endpointProbeResult, len(room.Endpoints))
+	for i, endpoint := range room.Endpoints {
+		go func() {
+			// 靠前的端点优先开始检查
+			select {
+			case <-ctx.Done():
+				results <- endpointProbeResult{endpoint: endpoint, err: ctx.Err()}
+				return
+			case <-time.After(time.Duration(i) * probeStagger):
+			}
+			start := time.Now()
+			info, err := probeRoomEndpoint(ctx, key, window, clientCert, room.Info.UID, room.Info.CertSign, endpoint)
+			results <- endpointProbeResult{endpoint: endpoint, info: info, rtt: time.Since(start), err: err}
+		}()
+	}
+
+	for range room.Endpoints {
+		result := <-results
+		if result.err != nil {
+			logger.V(1).Info(fmt.Sprintf(
+				"endpoint %q for room %q not available: %v",
+				result.endpoint, room.Info.UID, result.err,
+			))
+			continue
+		}
+		room.AvailableEndpoint = result.endpoint
+		room.RTT = result.rtt
+		room.Depth = result.info.Depth
+		logger.V(1).Info(fmt.Sprintf(
+			"room %q available on %q (rtt: %s, depth: %d)",
+			room.Info.UID, result.endpoint, result.rtt, result.info.Depth,
+		))
+		return
+	}
+	logger.V(1).Info(fmt.Sprintf("room %q has no available endpoint", room.Info.UID))
+}
+
+// probeRoomEndpoint 访问端点获取房间信息，校验房间 UID 及接口认证子密钥的签名
+func probeRoomEndpoint(
+	ctx context.Context,
+	key signatures.Key,
+	window time.Duration,
+	clientCert *tls.Certificate,
+	uid metav1.UID,
+	certSign string,
+	endpoint string,
+) (*chatv1.Room, error) {
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+
+	info, err := rooms.NewRemoteRoom(endpoint, certSign, clientCert).Info(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if info.UID != uid {
+		return nil, fmt.Errorf("uid not match: %q", info.UID)
+	}
+	if key != nil {
+		now := time.Now()
+		if err := signatures.HS256VerifyAPIObject(
+			key.Subkey(signatures.KeyPurposeAPI), info,
+			now.Add(-window), now.Add(window),
+		); err != nil {
+			return nil, fmt.Errorf("signature verification error: %w", err)
+		}
+	}
+	return info, nil
+}
+
+// SortRooms 按优先级排序房间
+//
+// 有可用端点的房间优先，其次是在房间树中深度较小的、延迟较低的，最后按 UID 排序
+func SortRooms(roomList []Room) {
+	sort.Slice(roomList, func(i, j int) bool {
+		a, b := roomList[i], roomList[j]
+		if availA, availB := a.AvailableEndpoint != "", b.AvailableEndpoint != ""; availA != availB {
+			return availA
+		}
+		if a.Depth != b.Depth {
+			return a.Depth < b.Depth
+		}
+		if a.RTT != b.RTT {
+			return a.RTT < b.RTT
+		}
+		return a.Info.UID.String() < b.Info.UID.String()
+	})
+}
@@ -0,0 +1,41 @@
+package discovery
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	chatv1 "github.com/yhlooo/bangbang/pkg/apis/chat/v1"
+	metav1 "github.com/yhlooo/bangbang/pkg/apis/meta/v1"
+)
+
+// TestSortRooms 测试 SortRooms
+func TestSortRooms(t *testing.T) {
+	a := assert.New(t)
+
+	newRoom := func(name string, available bool, depth int, rtt time.Duration) Room {
+		room := Room{
+			Info:  chatv1.Room{ObjectMeta: metav1.ObjectMeta{UID: metav1.NewUID(), Name: name}},
+			Depth: depth,
+			RTT:   rtt,
+		}
+		if available {
+			room.AvailableEndpoint = "https://" + name
+		}
+		return room
+	}
+	roomList := []Room{
+		newRoom("unavailable", false, 0, 0),
+		newRoom("deep", true, 2, time.Millisecond),
+		newRoom("slow", true, 0, 20*time.Millisecond),
+		newRoom("fast", true, 0, 2*time.Millisecond),
+	}
+	SortRooms(roomList)
+
+	var names []string
+	for _, room := range roomList {
+		names = append(names, room.Info.Name)
+	}
+	a.Equal([]string{"fast", "slow", "deep", "unavailable"}, names)
+}
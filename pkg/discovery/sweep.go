@@ -0,0 +1,262 @@
+package discovery
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"time"
+
+	"github.com/go-logr/logr"
+
+	chatv1 "github.com/yhlooo/bangbang/pkg/apis/chat/v1"
+	metav1 "github.com/yhlooo/bangbang/pkg/apis/meta/v1"
+	"github.com/yhlooo/bangbang/pkg/signatures"
+)
+
+const (
+	// DefaultSweepRate 默认扫描速率（每秒发送请求数）
+	DefaultSweepRate = 200
+	// SweepWatchInterval 持续监听时扫描子网的间隔
+	SweepWatchInterval = 30 * time.Second
+	// maxSweepPrefixSize 扫描网段的最大大小，更大的网段仅扫描本机地址所在的 /24
+	maxSweepPrefixSize = 22
+	// sweepFallbackPrefixSize 网段过大时扫描的网段大小
+	sweepFallbackPrefixSize = 24
+)
+
+// NewSweepDiscoverer 创建基于单播扫描子网的发现器
+//
+// 向本机所在的各 IPv4 子网中的每个地址的 port 端口单播发送签名的 chatv1.RoomRequest ，
+// 用于组播被完全过滤时的回退。 rate 为每秒发送请求数，为 0 时使用 DefaultSweepRate
+func NewSweepDiscoverer(port int, rate int) *SweepDiscoverer {
+	if rate <= 0 {
+		rate = DefaultSweepRate
+	}
+	return &SweepDiscoverer{
+		port: port,
+		rate: rate,
+	}
+}
+
+// SweepDiscoverer 基于单播扫描子网的发现器
+type SweepDiscoverer struct {
+	port   int
+	rate   int
+	ifaces *InterfaceFilter
+}
+
+var _ Discoverer = (*SweepDiscoverer)(nil)
+
+// WithInterfaceFilter 设置扫描的网卡，为 nil 时使用 DefaultInterfaceFilter
+func (d *SweepDiscoverer) WithInterfaceFilter(filter *InterfaceFilter) *SweepDiscoverer {
+	d.ifaces = filter
+	return d
+}
+
+// Search 搜索房间
+//
+// 只会扫描一轮子网，搜索时长至少为扫描完所有地址的时间加上 opts.RequestInterval 。
+// 为避免被用于放大攻击，应答机只会单播回复签名的请求，因此 key 不能为空
+func (d *SweepDiscoverer) Search(ctx context.Context, key signatures.Key, opts SearchOptions) ([]Room, error) {
+	logger := logr.FromContextOrDiscard(ctx).WithName("sweep-discoverer")
+	ctx = logr.NewContext(ctx, logger)
+
+	if key == nil {
+		return nil, errors.New("key is required for sweep discovery")
+	}
+	opts.Complete()
+
+	targets, err := sweepTargets(ctx, d.ifaces)
+	if err != nil {
+		return nil, err
+	}
+	if len(targets) == 0 {
+		return nil, nil
+	}
+
+	duration := time.Duration(len(targets))*time.Second/time.Duration(d.rate) + opts.RequestInterval
+	if duration < opts.Duration {
+		duration = opts.Duration
+	}
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		return nil, fmt.Errorf("listen udp error: %w", err)
+	}
+	defer func() { _ = conn.Close() }()
+	_ = conn.SetReadBuffer(1 << 20)
+
+	logger.V(1).Info(fmt.Sprintf("sweeping %d addresses at %d/s ...", len(targets), d.rate))
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-time.After(duration):
+		}
+		_ = conn.Close()
+	}()
+
+	challenge := newChallenge()
+	go d.runSender(ctx, conn, key.Copy(), challenge, targets)
+
+	found := newRoomSet(key.Copy(), opts.Exclude, opts.TimeWindow)
+	buffer := make([]byte, 8<<10)
+	for {
+		n, src, err := conn.ReadFromUDP(buffer)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				break
+			}
+			logger.Error(err, "read udp packet error")
+		}
+		if n == 0 {
+			continue
+		}
+
+		pctx := ctx
+		if src != nil {
+			pctx = withPacketSource(ctx, src.IP.String())
+		}
+		room, err := openRoomMessage(key, buffer[:n])
+		if err != nil {
+			logger.V(2).Info(fmt.Sprintf("open room error: %v", err))
+			recordOpenRoomError(pctx, err)
+			continue
+		}
+		if !slices.Contains(room.Challenges, challenge) {
+			logger.V(1).Info(fmt.Sprintf("drop room %q: no matching challenge", room.UID))
+			continue
+		}
+		if found.Add(pctx, room, "") && opts.EarlyExit && found.CheckUsable(ctx, room.UID, opts.CheckAvailability) {
+			break
+		}
+	}
+	if room := found.Usable(); room != nil {
+		logger.V(1).Info(fmt.Sprintf("found usable room %q", room.Info.UID))
+		return []Room{*room}, nil
+	}
+
+	ret := found.List()
+	logger.V(1).Info(fmt.Sprintf("found %d rooms", len(ret)))
+
+	if opts.CheckAvailability {
+		logger.V(1).Info("checking availability for rooms ...")
+		checkAvailability(ctx, key.Copy(), opts.TimeWindow, ret)
+	}
+
+	return ret, nil
+}
+
+// Watch 持续监听房间变化
+//
+// 每隔 SweepWatchInterval 扫描一轮子网
+func (d *SweepDiscoverer) Watch(ctx context.Context, key signatures.Key) (<-chan Event, error) {
+	if key == nil {
+		return nil, errors.New("key is required for sweep discovery")
+	}
+	ch := pollRooms(ctx, SweepWatchInterval, func(ctx context.Context) ([]Room, error) {
+		return d.Search(ctx, key.Copy(), SearchOptions{})
+	})
+	return trackRooms(ctx, key.Copy(), 3*SweepWatchInterval, ch), nil
+}
+
+// runSender 按速率向各地址发送带挑战 challenge 的请求
+func (d *SweepDiscoverer) runSender(
+	ctx context.Context,
+	conn *net.UDPConn,
+	key signatures.Key,
+	challenge string,
+	targets []net.IP,
+) {
+	logger := logr.FromContextOrDiscard(ctx).WithName("sender")
+
+	req := &chatv1.RoomRequest{
+		APIMeta:    metav1.NewAPIMeta(chatv1.KindRoomRequest),
+		ObjectMeta: metav1.ObjectMeta{UID: metav1.NewUID()},
+		Unicast:    true,
+		Challenge:  challenge,
+	}
+	if err := signatures.HS256SignAPIObject(key.Subkey(signatures.KeyPurposeDiscovery), req); err != nil {
+		logger.Error(err, "sign room request error")
+		return
+	}
+	reqRaw, _ := json.Marshal(req)
+	reqRaw = append(reqRaw, '\n')
+
+	ticker := time.NewTicker(time.Second / time.Duration(d.rate))
+	defer ticker.Stop()
+
+	for _, ip := range targets {
+		if _, err := conn.WriteToUDP(reqRaw, &net.UDPAddr{IP: ip, Port: d.port}); err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			logger.V(2).Info(fmt.Sprintf("send room request to %q error: %v", ip, err))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// sweepTargets 获取需要扫描的地址
+//
+// 仅扫描 filter 允许的网卡上的 IPv4 子网，不包括本地回环网卡
+func sweepTargets(ctx context.Context, filter *InterfaceFilter) ([]net.IP, error) {
+	addrs, err := InterfaceAddrs(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := map[[4]byte]bool{}
+	var ret []net.IP
+	for _, addr := range addrs {
+		ip4 := addr.IPNet.IP.To4()
+		if ip4 == nil || addr.Interface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		for _, ip := range subnetHosts(ip4, addr.IPNet.Mask) {
+			k := [4]byte(ip)
+			if seen[k] {
+				continue
+			}
+			seen[k] = true
+			ret = append(ret, ip)
+		}
+	}
+	return ret, nil
+}
+
+// subnetHosts 列出 IPv4 子网中的主机地址（不包括网络地址和广播地址）
+//
+// 网段大于 /22 时仅列出 ip 所在的 /24
+func subnetHosts(ip net.IP, mask net.IPMask) []net.IP {
+	ip = ip.To4()
+	ones, bits := mask.Size()
+	if ip == nil || bits != 32 {
+		return nil
+	}
+	if ones < maxSweepPrefixSize {
+		ones = sweepFallbackPrefixSize
+		mask = net.CIDRMask(ones, 32)
+	}
+	if ones >= 31 {
+		// 点对点链路
+		return nil
+	}
+
+	network := binary.BigEndian.Uint32(ip.Mask(mask))
+	size := uint32(1) << (32 - ones)
+	ret := make([]net.IP, 0, size-2)
+	for i := uint32(1); i < size-1; i++ {
+		host := make(net.IP, net.IPv4len)
+		binary.BigEndian.PutUint32(host, network+i)
+		ret = append(ret, host)
+	}
+	return ret
+}
@@ -0,0 +1,28 @@
+package discovery
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestSubnetHosts 测试 subnetHosts
+func TestSubnetHosts(t *testing.T) {
+	a := assert.New(t)
+
+	hosts := subnetHosts(net.ParseIP("192.168.1.10"), net.CIDRMask(24, 32))
+	if a.Len(hosts, 254) {
+		a.Equal("192.168.1.1", hosts[0].String())
+		a.Equal("192.168.1.254", hosts[253].String())
+	}
+
+	hosts = subnetHosts(net.ParseIP("10.1.2.3"), net.CIDRMask(8, 32))
+	if a.Len(hosts, 254) {
+		a.Equal("10.1.2.1", hosts[0].String())
+	}
+
+	a.Len(subnetHosts(net.ParseIP("172.16.0.5"), net.CIDRMask(22, 32)), 1022)
+	a.Empty(subnetHosts(net.ParseIP("10.0.0.1"), net.CIDRMask(31, 32)))
+	a.Empty(subnetHosts(net.ParseIP("fe80::1"), net.CIDRMask(64, 128)))
+}
@@ -3,10 +3,10 @@ package discovery
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"math/rand/v2"
 	"net"
-	"slices"
-	"sort"
 	"sync"
 	"time"
 
@@ -14,151 +14,215 @@ import (
 
 	chatv1 "github.com/yhlooo/bangbang/pkg/apis/chat/v1"
 	metav1 "github.com/yhlooo/bangbang/pkg/apis/meta/v1"
-	"github.com/yhlooo/bangbang/pkg/chats/rooms"
+	"github.com/yhlooo/bangbang/pkg/audit"
 	"github.com/yhlooo/bangbang/pkg/signatures"
 )
 
+const (
+	// DefaultAnnounceInterval 默认主动广播房间信息的平均间隔
+	DefaultAnnounceInterval = 5 * time.Second
+	// announceMaxAge 接受的主动广播的最大签名时间误差
+	//
+	// 主动广播不回复挑战，只能通过较小的签名时间窗口和去重限制重放
+	announceMaxAge = 10 * time.Second
+)
+
 // NewUDPDiscoverer 创建基于 UDP 的发现器
-func NewUDPDiscoverer(addr string) *UDPDiscoverer {
+//
+// addrs 为空时使用 DefaultUDPAddrs
+func NewUDPDiscoverer(addrs ...string) *UDPDiscoverer {
+	if len(addrs) == 0 {
+		addrs = DefaultUDPAddrs
+	}
 	return &UDPDiscoverer{
-		addr: addr,
+		addrs: addrs,
 	}
 }
 
 // UDPDiscoverer 基于 UDP 的发现器
 type UDPDiscoverer struct {
-	addr string
+	addrs  []string
+	ifaces *InterfaceFilter
+	// 是否接受不带挑战的主动广播
+	announcements bool
 }
 
 var _ Discoverer = (*UDPDiscoverer)(nil)
 
+// WithInterfaceFilter 设置使用的网卡，为 nil 时使用 DefaultInterfaceFilter
+func (d *UDPDiscoverer) WithInterfaceFilter(filter *InterfaceFilter) *UDPDiscoverer {
+	d.ifaces = filter
+	return d
+}
+
+// WithAnnouncements 设置是否接受不带挑战的主动广播，默认不接受
+//
+// 主动广播使加入者不需要等待请求应答即可发现房间，但只能通过签名时间窗口和去重限制重放，
+// 因此只应在需要尽快发现房间时开启
+func (d *UDPDiscoverer) WithAnnouncements(accept bool) *UDPDiscoverer {
+	d.announcements = accept
+	return d
+}
+
+// newAnnouncementSet 创建记录已接受的主动广播的集合，不接受主动广播时返回 nil
+//
+// 签名时间与当前时间相差 announceMaxAge 内的主动广播被接受，因此记录 2*announceMaxAge
+func (d *UDPDiscoverer) newAnnouncementSet() *challengeSet {
+	if !d.announcements {
+		return nil
+	}
+	return newChallengeSet(2 * announceMaxAge)
+}
+
 // Search 搜索房间
 func (d *UDPDiscoverer) Search(ctx context.Context, key signatures.Key, opts SearchOptions) ([]Room, error) {
 	logger := logr.FromContextOrDiscard(ctx).WithName("discoverer")
 	ctx = logr.NewContext(ctx, logger)
 
-	if opts.Duration == 0 {
-		opts.Duration = 3 * time.Second
-	}
-	if opts.RequestInterval == 0 {
-		opts.RequestInterval = time.Second
-	}
+	opts.Complete()
 
-	addr, err := net.ResolveUDPAddr("udp", d.addr)
+	conn, err := listenMulticast(ctx, d.addrs, d.ifaces)
 	if err != nil {
-		return nil, fmt.Errorf("resolve udp address error: %w", err)
+		return nil, fmt.Errorf("listen multicast error: %w", err)
 	}
+	defer func() { _ = conn.Close() }()
 
-	readConn, err := net.ListenUDP("udp", addr)
-	if err != nil {
-		return nil, fmt.Errorf("listen udp %q error: %w", addr.String(), err)
-	}
-	writeConn, err := net.DialUDP("udp", nil, addr)
-	if err != nil {
-		return nil, fmt.Errorf("dial udp %q error: %w", addr.String(), err)
-	}
-
-	go d.runSender(ctx, writeConn, key.Copy(), int(opts.Duration/opts.RequestInterval), opts.RequestInterval)
+	// 只接受回复了本次搜索发出的挑战的房间信息
+	challenges := newChallengeSet(opts.Duration + opts.RequestInterval)
+	go d.runSender(ctx, conn, key.Copy(), challenges, int(opts.Duration/opts.RequestInterval), opts.RequestInterval)
 
 	logger.V(1).Info("listening rooms ...")
-	ret, err := d.runListener(ctx, readConn, key.Copy(), opts.RequestInterval, opts.Exclude)
-	if err != nil {
-		return nil, fmt.Errorf("run listener error: %w", err)
+	found := d.runListener(ctx, conn, key.Copy(), challenges, d.newAnnouncementSet(), opts)
+	if room := found.Usable(); room != nil {
+		logger.V(1).Info(fmt.Sprintf("found usable room %q", room.Info.UID))
+		return []Room{*room}, nil
 	}
+	ret := found.List()
 	logger.V(1).Info(fmt.Sprintf("found %d rooms", len(ret)))
 
 	if opts.CheckAvailability {
 		logger.V(1).Info("checking availability for rooms ...")
-		d.checkAvailability(ctx, key.Copy(), ret)
+		checkAvailability(ctx, key.Copy(), opts.TimeWindow, ret)
 	}
 
 	return ret, nil
 }
 
+// Watch 持续监听房间变化
+func (d *UDPDiscoverer) Watch(ctx context.Context, key signatures.Key) (<-chan Event, error) {
+	logger := logr.FromContextOrDiscard(ctx).WithName("discoverer")
+	ctx = logr.NewContext(ctx, logger)
+
+	conn, err := listenMulticast(ctx, d.addrs, d.ifaces)
+	if err != nil {
+		return nil, fmt.Errorf("listen multicast error: %w", err)
+	}
+	go func() {
+		<-ctx.Done()
+		_ = conn.Close()
+	}()
+
+	challenges := newChallengeSet(RoomLivenessTTL)
+	announcements := d.newAnnouncementSet()
+	go d.runSender(ctx, conn, key.Copy(), challenges, -1, watchRequestInterval)
+
+	ch := make(chan sighting)
+	go func() {
+		defer close(ch)
+		for p := range conn.Packets(ctx) {
+			room, err := openRoomMessage(key, p.data)
+			if err != nil {
+				logger.V(2).Info(fmt.Sprintf("open room error: %v", err))
+				recordOpenRoomError(withPacketSource(ctx, p.source()), err)
+				continue
+			}
+			if !acceptRoom(room, p.iface, challenges, announcements) {
+				logger.V(1).Info(fmt.Sprintf("drop room %q: no matching challenge", room.UID))
+				continue
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case ch <- sighting{room: room, zone: p.iface, src: p.source()}:
+			}
+		}
+	}()
+
+	return trackRooms(ctx, key.Copy(), RoomLivenessTTL, ch), nil
+}
+
 // runListener 运行监听器
+//
+// 丢弃没有回复 challenges 中挑战的房间信息， announcements 不为 nil 时接受新鲜且没有接受过的主动广播。
+// opts.EarlyExit 为 true 时发现可用房间后立即关闭连接
 func (d *UDPDiscoverer) runListener(
 	ctx context.Context,
-	conn *net.UDPConn,
+	conn *multicastConn,
 	key signatures.Key,
-	timeout time.Duration,
-	exclude []metav1.UID,
-) ([]Room, error) {
+	challenges *challengeSet,
+	announcements *challengeSet,
+	opts SearchOptions,
+) *roomSet {
 	logger := logr.FromContextOrDiscard(ctx).WithName("listener")
 	ctx = logr.NewContext(ctx, logger)
 
-	roomMap := map[metav1.UID]chatv1.Room{}
+	found := newRoomSet(key, opts.Exclude, opts.TimeWindow)
 
 	go func() {
 		select {
 		case <-ctx.Done():
-		case <-time.After(timeout):
+		case <-time.After(opts.Duration):
 		}
 		_ = conn.Close()
 	}()
-	_ = conn.SetReadBuffer(1 << 20)
-
-	buffer := make([]byte, 8<<10)
-	for {
-		n, _, err := conn.ReadFromUDP(buffer)
-		if err != nil {
-			if n == 0 {
-				break
-			}
-			logger.Error(err, "read udp packet error")
-		}
-		if n == 0 {
-			continue
-		}
 
-		var room chatv1.Room
-		if err := json.Unmarshal(buffer[:n], &room); err != nil {
-			logger.Error(err, fmt.Sprintf("decode room error: %s", string(buffer[:n])))
+	for p := range conn.Packets(ctx) {
+		if found.Usable() != nil {
+			// 已经提前结束，丢弃剩余数据包
 			continue
 		}
-
-		if !room.IsKind(chatv1.KindRoom) {
+		pctx := withPacketSource(ctx, p.source())
+		room, err := openRoomMessage(key, p.data)
+		if err != nil {
+			logger.V(2).Info(fmt.Sprintf("open room error: %v", err))
+			recordOpenRoomError(pctx, err)
 			continue
 		}
-		if slices.Contains(exclude, room.UID) {
+		if !acceptRoom(room, p.iface, challenges, announcements) {
+			logger.V(1).Info(fmt.Sprintf("drop room %q: no matching challenge", room.UID))
 			continue
 		}
-		if key != nil {
-			now := time.Now()
-			if err := signatures.HS256VerifyAPIObject(
-				key, &room,
-				now.Add(-10*time.Minute), now.Add(10*time.Minute),
-			); err != nil {
-				logger.V(1).Info(fmt.Sprintf("signature verification error: %s", err))
-				continue
-			}
+		if found.Add(pctx, room, p.iface) && opts.EarlyExit && found.CheckUsable(ctx, room.UID, opts.CheckAvailability) {
+			_ = conn.Close()
 		}
-
-		logger.V(1).Info(fmt.Sprintf("found room %q", room.UID))
-		roomMap[room.UID] = room
 	}
 
-	if len(roomMap) == 0 {
-		return nil, nil
-	}
+	return found
+}
 
-	ret := make([]Room, 0, len(roomMap))
-	for _, room := range roomMap {
-		ret = append(ret, Room{
-			Info: room,
-		})
+// acceptRoom 判断是否接受收到的房间信息
+//
+// 接受回复了 challenges 中挑战的房间信息。 announcements 不为 nil 时还接受签名时间在 announceMaxAge 内的主动广播，
+// 每次主动广播的签名不同，同一广播在同一网卡 iface 上只接受一次，窗口内被重放的广播被丢弃
+func acceptRoom(room *chatv1.Room, iface string, challenges, announcements *challengeSet) bool {
+	if challenges.Match(room.Challenges) {
+		return true
 	}
-	sort.Slice(ret, func(i, j int) bool {
-		return ret[i].Info.UID.String() < ret[j].Info.UID.String()
-	})
-
-	return ret, nil
+	if announcements == nil || len(room.Challenges) != 0 || time.Since(room.SignTime).Abs() > announceMaxAge {
+		return false
+	}
+	return !announcements.Add(iface + "/" + room.Signature)
 }
 
 // runSender 运行发送器
+//
+// 每隔 interval 发送一次请求，共发送 n 次， n 小于 0 时持续发送直到 ctx 结束。
+// 每次请求带上新的挑战并加入 challenges
 func (d *UDPDiscoverer) runSender(
 	ctx context.Context,
-	conn *net.UDPConn,
+	conn *multicastConn,
 	key signatures.Key,
+	challenges *challengeSet,
 	n int,
 	interval time.Duration,
 ) {
@@ -166,26 +230,24 @@ func (d *UDPDiscoverer) runSender(
 		APIMeta:    metav1.NewAPIMeta(chatv1.KindRoomRequest),
 		ObjectMeta: metav1.ObjectMeta{UID: metav1.NewUID()},
 	}
-	var reqRaw []byte
-	if key == nil {
-		reqRaw, _ = json.Marshal(req)
-		reqRaw = append(reqRaw, '\n')
-	}
 
 	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
 	logger := logr.FromContextOrDiscard(ctx).WithName("sender")
-	for i := 0; i < n; i++ {
+	for i := 0; n < 0 || i < n; i++ {
+		req.Challenge = challenges.New()
 		if key != nil {
-			_ = signatures.HS256SignAPIObject(key, req)
-			reqRaw, _ = json.Marshal(req)
-			reqRaw = append(reqRaw, '\n')
+			_ = signatures.HS256SignAPIObject(key.Subkey(signatures.KeyPurposeDiscovery), req)
 		}
+		reqRaw, _ := json.Marshal(req)
+		reqRaw = append(reqRaw, '\n')
 
 		logger.V(1).Info("sending room request")
-		_, err := conn.Write(reqRaw)
-		if err != nil {
+		if err := conn.Send(reqRaw); err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
 			logger.Error(err, "send room request error")
 		}
 		select {
@@ -196,101 +258,106 @@ func (d *UDPDiscoverer) runSender(
 	}
 }
 
-// checkAvailability 检查房间可访问性
-func (d *UDPDiscoverer) checkAvailability(ctx context.Context, key signatures.Key, roomList []Room) {
-	logger := logr.FromContextOrDiscard(ctx)
-	for i, room := range roomList {
-		available := ""
-		for _, endpoint := range room.Info.Endpoints {
-			subCTX, cancel := context.WithTimeout(ctx, time.Second)
-			info, err := rooms.NewRemoteRoom(endpoint, room.Info.CertSign).Info(subCTX)
-			cancel()
-			if err != nil {
-				logger.V(1).Info(fmt.Sprintf(
-					"endpoint %q for room %q not available: %v",
-					endpoint, room.Info.UID, err,
-				))
-				continue
-			}
-			if info.UID != room.Info.UID {
-				logger.V(1).Info(fmt.Sprintf(
-					"endpoint %q for room %q not available: uid not match: %q",
-					endpoint, room.Info.UID, info.UID,
-				))
-				continue
-			}
-			if key != nil {
-				now := time.Now()
-				if err := signatures.HS256VerifyAPIObject(
-					key, info,
-					now.Add(-10*time.Minute), now.Add(10*time.Minute),
-				); err != nil {
-					logger.V(1).Info(fmt.Sprintf(
-						"endpoint %q for room %q not available, signature verification error: %s",
-						endpoint, room.Info.UID, err.Error(),
-					))
-					continue
-				}
-			}
-			available = endpoint
-			break
-		}
-
-		if available != "" {
-			roomList[i].AvailableEndpoint = available
-			logger.V(1).Info(fmt.Sprintf("room %q available on %q", room.Info.UID, available))
-		} else {
-			logger.V(1).Info(fmt.Sprintf("room %q has no available endpoint", room.Info.UID))
-		}
-	}
-}
-
 // NewUDPTransponder 创建基于 UDP 的应答机
-func NewUDPTransponder(addr string, room *chatv1.Room, key signatures.Key) *UDPTransponder {
+//
+// addrs 为空时使用 DefaultUDPAddrs
+func NewUDPTransponder(addrs []string, room *chatv1.Room, key signatures.Key) *UDPTransponder {
+	if len(addrs) == 0 {
+		addrs = DefaultUDPAddrs
+	}
 	return &UDPTransponder{
-		addr: addr,
-		room: room.DeepCopy(),
-		key:  key.Copy(),
+		addrs:  addrs,
+		room:   room.DeepCopy(),
+		key:    key.Copy(),
+		window: DefaultTimeWindow,
 	}
 }
 
 // UDPTransponder 基于 UDP 的应答机
+//
+// 为避免被利用放大流量，每个来源的请求有速率限制，连续签名校验失败的来源会被退避屏蔽，
+// 并且每个 beaconCoalesceInterval 内最多组播一次房间信息
 type UDPTransponder struct {
 	once sync.Once
 
-	addr string
-	room *chatv1.Room
-	key  signatures.Key
-
-	readConn  *net.UDPConn
-	writeConn *net.UDPConn
+	addrs  []string
+	ifaces *InterfaceFilter
+	room   *chatv1.Room
+	key    signatures.Key
+	// 只读观察者密钥，为空时不应答观察者
+	viewerKey signatures.Key
+	window    time.Duration
+	// 主动广播的平均间隔，为 0 时不主动广播
+	announce time.Duration
+
+	conn     *multicastConn
+	limiter  *sourceLimiter
+	counters transponderCounters
 }
 
 var _ Transponder = (*UDPTransponder)(nil)
 
+// roomRequest 需要回复的请求
+type roomRequest struct {
+	// 需要单播回复的地址，为 nil 时表示以组播回复
+	replyTo *net.UDPAddr
+	// 请求的挑战
+	challenge string
+	// 是否为使用观察者密钥签名的请求
+	viewer bool
+}
+
+// WithInterfaceFilter 设置使用的网卡，为 nil 时使用 DefaultInterfaceFilter
+func (t *UDPTransponder) WithInterfaceFilter(filter *InterfaceFilter) *UDPTransponder {
+	t.ifaces = filter
+	return t
+}
+
+// WithViewerKey 设置只读观察者密钥，为空时不应答观察者
+//
+// 设置后同时应答使用观察者密钥签名的请求，并另外组播使用观察者密钥加密的房间信息
+func (t *UDPTransponder) WithViewerKey(key signatures.Key) *UDPTransponder {
+	t.viewerKey = key.Copy()
+	return t
+}
+
+// WithTimeWindow 设置允许的请求签名时间误差，为 0 时使用 DefaultTimeWindow
+func (t *UDPTransponder) WithTimeWindow(window time.Duration) *UDPTransponder {
+	if window == 0 {
+		window = DefaultTimeWindow
+	}
+	t.window = window
+	return t
+}
+
+// WithAnnounce 设置主动广播房间信息的平均间隔，为 0 时不主动广播
+//
+// 主动广播使加入者不需要等待请求应答即可发现房间，实际间隔在 [interval/2, interval*3/2) 中随机，
+// 避免多个房间同时广播
+func (t *UDPTransponder) WithAnnounce(interval time.Duration) *UDPTransponder {
+	t.announce = interval
+	return t
+}
+
+// Stats 获取统计信息
+func (t *UDPTransponder) Stats() TransponderStats {
+	return t.counters.Stats()
+}
+
 // Start 开始运行应答机
 func (t *UDPTransponder) Start(ctx context.Context) error {
 	finalErr := fmt.Errorf("already started")
 	t.once.Do(func() {
-		addr, err := net.ResolveUDPAddr("udp", t.addr)
+		var err error
+		t.conn, err = listenMulticast(ctx, t.addrs, t.ifaces)
 		if err != nil {
-			finalErr = fmt.Errorf("resolve udp address error: %w", err)
-			return
-		}
-
-		t.readConn, err = net.ListenUDP("udp", addr)
-		if err != nil {
-			finalErr = fmt.Errorf("listen udp %q error: %w", addr.String(), err)
-			return
-		}
-		t.writeConn, err = net.DialUDP("udp", nil, addr)
-		if err != nil {
-			finalErr = fmt.Errorf("dial udp %q error: %w", addr.String(), err)
+			finalErr = fmt.Errorf("listen multicast error: %w", err)
 			return
 		}
+		t.limiter = newSourceLimiter()
 
 		finalErr = nil
-		ch := make(chan struct{})
+		ch := make(chan roomRequest, 16)
 
 		go t.runListener(ctx, ch)
 		go t.runSender(ctx, ch, t.room.DeepCopy())
@@ -301,84 +368,188 @@ func (t *UDPTransponder) Start(ctx context.Context) error {
 }
 
 // runListener 运行监听器
-func (t *UDPTransponder) runListener(ctx context.Context, ch chan<- struct{}) {
+//
+// 收到请求时将需要回复的请求发送到 ch 。签名时间窗口内重复的挑战被认为是重放的请求，不回复
+func (t *UDPTransponder) runListener(ctx context.Context, ch chan<- roomRequest) {
 	logger := logr.FromContextOrDiscard(ctx).WithName("transponder.listener")
+	recorder := audit.FromContext(ctx)
 
 	defer close(ch)
 
-	buffer := make([]byte, 8<<10)
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		default:
-		}
+	seen := newChallengeSet(2 * t.window)
 
-		n, _, err := t.readConn.ReadFromUDP(buffer)
-		if err != nil {
-			logger.Error(err, "read udp packet error")
-		}
-		if n == 0 {
-			continue
-		}
+	for p := range t.conn.Packets(ctx) {
+		src := p.source()
+		now := time.Now()
 
 		var req chatv1.RoomRequest
-		if err := json.Unmarshal(buffer[:n], &req); err != nil {
-			logger.Error(err, "decode room request error: %s", string(buffer[:n]))
+		if err := json.Unmarshal(p.data, &req); err != nil {
+			logger.V(2).Info(fmt.Sprintf("decode room request from %q error: %v", src, err))
+			continue
 		}
 		if !req.IsKind(chatv1.KindRoomRequest) {
 			continue
 		}
+		t.counters.requests.Add(1)
+
+		if t.limiter.Blocked(src, now) {
+			t.counters.backedOff.Add(1)
+			continue
+		}
+		viewer := false
 		if req.Signature != "" {
-			now := time.Now()
-			if err := signatures.HS256VerifyAPIObject(
-				t.key, &req,
-				now.Add(-10*time.Minute), now.Add(10*time.Minute),
-			); err != nil {
-				logger.V(1).Info(fmt.Sprintf("signature verification error: %s", err))
+			err := t.verifyRequest(t.key, &req, now)
+			if err != nil && len(t.viewerKey) != 0 && t.verifyRequest(t.viewerKey, &req, now) == nil {
+				err = nil
+				viewer = true
+			}
+			if err != nil {
+				logger.V(1).Info(fmt.Sprintf("signature verification error from %q: %s", src, err))
+				recorder.WithSource(src).Record(
+					audit.EventDiscoverySignatureInvalid,
+					"invalid room request signature (wrong PIN, another room or out-of-window)",
+				)
+				t.counters.signatureFailures.Add(1)
+				t.limiter.Fail(src, now)
 				continue
 			}
+			t.limiter.Succeed(src)
+		}
+		if req.Challenge != "" && seen.Add(req.Challenge) {
+			logger.V(1).Info(fmt.Sprintf("drop replayed room request %q", req.UID))
+			t.counters.replayed.Add(1)
+			continue
+		}
+		if !t.limiter.Allow(src, now) {
+			logger.V(2).Info(fmt.Sprintf("drop room request from %q: rate limited", src))
+			t.counters.rateLimited.Add(1)
+			continue
+		}
+
+		r := roomRequest{challenge: req.Challenge, viewer: viewer}
+		if req.Unicast && req.Signature != "" {
+			// 仅对签名的请求单播回复，避免被伪造来源地址的请求利用
+			r.replyTo = p.src
 		}
 		select {
 		case <-ctx.Done():
 			return
-		case ch <- struct{}{}:
+		case ch <- r:
 		}
 	}
 }
 
+// verifyRequest 使用 key 的服务发现子密钥校验请求签名
+func (t *UDPTransponder) verifyRequest(key signatures.Key, req *chatv1.RoomRequest, now time.Time) error {
+	return signatures.HS256VerifyAPIObject(
+		key.Subkey(signatures.KeyPurposeDiscovery), req,
+		now.Add(-t.window), now.Add(t.window),
+	)
+}
+
 // runSender 运行发送器
-func (t *UDPTransponder) runSender(ctx context.Context, ch <-chan struct{}, room *chatv1.Room) {
+//
+// 回复的房间信息中带上请求的挑战。单播请求立即回复；
+// 组播请求合并回复，每个 beaconCoalesceInterval 内最多组播一次，带上期间所有请求的挑战。
+// 启用了主动广播时，每次组播后间隔随机时长再主动组播
+func (t *UDPTransponder) runSender(ctx context.Context, ch <-chan roomRequest, room *chatv1.Room) {
 	logger := logr.FromContextOrDiscard(ctx).WithName("transponder.sender")
 
-	defer func() {
-		_ = t.readConn.Close()
-		_ = t.writeConn.Close()
-	}()
+	defer func() { _ = t.conn.Close() }()
+
+	var (
+		pending    bool
+		challenges []string
+		lastBeacon time.Time
+	)
+	timer := time.NewTimer(0)
+	<-timer.C
+	defer timer.Stop()
+
+	// 主动广播，启动后立即广播一次
+	announceTimer := time.NewTimer(0)
+	defer announceTimer.Stop()
+	if t.announce <= 0 {
+		announceTimer.Stop()
+	}
 
 	for {
 		select {
 		case <-ctx.Done():
 			return
-		case _, ok := <-ch:
+		case req, ok := <-ch:
 			if !ok {
 				return
 			}
-		}
 
-		if err := signatures.HS256SignAPIObject(t.key, room); err != nil {
-			logger.Error(err, "sign room info error")
+			if replyTo := req.replyTo; replyTo != nil {
+				reply := room.DeepCopy()
+				if req.challenge != "" {
+					reply.Challenges = []string{req.challenge}
+				}
+				key := t.key
+				if req.viewer {
+					key = t.viewerKey
+				}
+				replyMsg, err := sealRoomMessage(key, reply)
+				if err != nil {
+					logger.Error(err, "build room info message error")
+					continue
+				}
+				if err := t.conn.SendTo(replyMsg, replyTo); err != nil {
+					logger.Error(err, fmt.Sprintf("reply to %q error", replyTo.String()))
+					continue
+				}
+				t.counters.unicastReplies.Add(1)
+				continue
+			}
+
+			if req.challenge != "" {
+				challenges = append(challenges, req.challenge)
+				if len(challenges) > maxBeaconChallenges {
+					// 保留最新的挑战
+					challenges = challenges[len(challenges)-maxBeaconChallenges:]
+				}
+			}
+			if pending {
+				continue
+			}
+			pending = true
+			timer.Reset(max(beaconCoalesceInterval-time.Since(lastBeacon), 0))
 			continue
+		case <-timer.C:
+		case <-announceTimer.C:
+			if pending {
+				// 等待合并应答
+				continue
+			}
 		}
-		publishMsg, err := json.Marshal(room)
-		if err != nil {
-			logger.Error(err, "marshal room info to json error")
-			continue
+
+		reply := room.DeepCopy()
+		reply.Challenges = challenges
+		pending = false
+		challenges = nil
+		lastBeacon = time.Now()
+		if t.announce > 0 {
+			// 在 [announce/2, announce*3/2) 中随机，避免多个房间同时广播
+			announceTimer.Reset(t.announce/2 + rand.N(t.announce))
 		}
-		publishMsg = append(publishMsg, '\n')
 
-		if _, err := t.writeConn.Write(publishMsg); err != nil {
-			logger.Error(err, "publish error")
+		// 在各网卡上广播时优先该网卡的访问端点，设置了观察者密钥时分别使用两个密钥加密
+		keys := []signatures.Key{t.key}
+		if len(t.viewerKey) != 0 {
+			keys = append(keys, t.viewerKey)
+		}
+		for _, key := range keys {
+			if err := t.conn.SendEach(func(iface net.Interface) ([]byte, error) {
+				ifaceRoom := reply.DeepCopy()
+				ifaceRoom.Endpoints = endpointsForInterface(reply.Endpoints, iface)
+				return sealRoomMessage(key, ifaceRoom)
+			}); err != nil {
+				logger.Error(err, "publish error")
+				continue
+			}
+			t.counters.beacons.Add(1)
 		}
 	}
 }
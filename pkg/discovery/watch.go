@@ -0,0 +1,176 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/go-logr/logr"
+
+	chatv1 "github.com/yhlooo/bangbang/pkg/apis/chat/v1"
+	metav1 "github.com/yhlooo/bangbang/pkg/apis/meta/v1"
+	"github.com/yhlooo/bangbang/pkg/signatures"
+)
+
+const (
+	// RoomLivenessTTL 房间超过该时长没有再被发现时认为已消失
+	RoomLivenessTTL = 10 * time.Second
+	// watchRequestInterval 监听时发送请求的间隔
+	watchRequestInterval = 2 * time.Second
+	// unavailableRecheckInterval 监听时重新检查不可用房间的最小间隔
+	unavailableRecheckInterval = 5 * time.Second
+)
+
+// sighting 收到的一次房间信息
+type sighting struct {
+	room *chatv1.Room
+	// 接收到房间信息的网卡，未知时为空
+	zone string
+	// 房间信息来源 IP ，未知时为空
+	src string
+}
+
+// trackedRoom 监听中的房间
+type trackedRoom struct {
+	room      Room
+	lastSeen  time.Time
+	lastCheck time.Time
+}
+
+// trackRooms 根据收到的房间信息维护房间状态并产生事件
+//
+// 房间超过 ttl 没有再收到时产生 EventRemoved 事件。 in 关闭或 ctx 结束后返回的通道被关闭
+func trackRooms(ctx context.Context, key signatures.Key, ttl time.Duration, in <-chan sighting) <-chan Event {
+	logger := logr.FromContextOrDiscard(ctx)
+
+	ch := make(chan Event, 16)
+	go func() {
+		defer close(ch)
+
+		rooms := map[metav1.UID]*trackedRoom{}
+		send := func(t EventType, room Room) bool {
+			logger.V(1).Info(fmt.Sprintf("room %q %s", room.Info.UID, t))
+			select {
+			case <-ctx.Done():
+				return false
+			case ch <- Event{Type: t, Room: room}:
+				return true
+			}
+		}
+
+		ticker := time.NewTicker(ttl / 4)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				now := time.Now()
+				for uid, tracked := range rooms {
+					if now.Sub(tracked.lastSeen) < ttl {
+						continue
+					}
+					delete(rooms, uid)
+					if !send(EventRemoved, tracked.room) {
+						return
+					}
+				}
+			case s, ok := <-in:
+				if !ok {
+					return
+				}
+				if !verifyRoom(withPacketSource(ctx, s.src), key, DefaultTimeWindow, s.room) {
+					continue
+				}
+
+				now := time.Now()
+				room := Room{
+					Info:      *s.room,
+					Endpoints: localizeEndpoints(s.room.Endpoints, s.zone),
+				}
+				tracked, exists := rooms[room.Info.UID]
+				if !exists {
+					tracked = &trackedRoom{}
+					rooms[room.Info.UID] = tracked
+				}
+				tracked.lastSeen = now
+
+				changed := !exists || !sameRoom(&tracked.room, &room)
+				recheck := !changed && tracked.room.AvailableEndpoint == "" &&
+					now.Sub(tracked.lastCheck) >= unavailableRecheckInterval
+				if !changed && !recheck {
+					continue
+				}
+				roomList := []Room{room}
+				checkAvailability(ctx, key, DefaultTimeWindow, roomList)
+				room = roomList[0]
+				tracked.lastCheck = now
+				if recheck && room.AvailableEndpoint == "" {
+					// 重新检查后仍然不可用
+					continue
+				}
+
+				eventType := EventUpdated
+				if !exists {
+					eventType = EventAdded
+				}
+				tracked.room = room
+				if !send(eventType, room) {
+					return
+				}
+			}
+		}
+	}()
+	return ch
+}
+
+// sameRoom 判断房间信息是否相同
+//
+// 忽略签名及访问端点顺序（从不同网卡收到的访问端点顺序不同）
+func sameRoom(a, b *Room) bool {
+	return a.Info.UID == b.Info.UID &&
+		a.Info.Owner.UID == b.Info.Owner.UID &&
+		a.Info.Owner.Name == b.Info.Owner.Name &&
+		a.Info.CertSign == b.Info.CertSign &&
+		slices.Equal(slices.Sorted(slices.Values(a.Endpoints)), slices.Sorted(slices.Values(b.Endpoints)))
+}
+
+// pollRooms 周期性调用 search 并将结果作为收到的房间信息发送到返回的通道
+//
+// ctx 结束后返回的通道被关闭
+func pollRooms(
+	ctx context.Context,
+	interval time.Duration,
+	search func(ctx context.Context) ([]Room, error),
+) <-chan sighting {
+	logger := logr.FromContextOrDiscard(ctx)
+
+	ch := make(chan sighting)
+	go func() {
+		defer close(ch)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			roomList, err := search(ctx)
+			if err != nil {
+				logger.Error(err, "search rooms error")
+			}
+			for _, room := range roomList {
+				select {
+				case <-ctx.Done():
+					return
+				case ch <- sighting{room: room.Info.DeepCopy()}:
+				}
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return ch
+}
@@ -0,0 +1,58 @@
+package discovery
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	chatv1 "github.com/yhlooo/bangbang/pkg/apis/chat/v1"
+	metav1 "github.com/yhlooo/bangbang/pkg/apis/meta/v1"
+)
+
+// TestTrackRooms 测试 trackRooms
+func TestTrackRooms(t *testing.T) {
+	a := assert.New(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	in := make(chan sighting)
+	events := trackRooms(ctx, nil, 200*time.Millisecond, in)
+
+	room := &chatv1.Room{
+		APIMeta:    metav1.NewAPIMeta(chatv1.KindRoom),
+		ObjectMeta: metav1.ObjectMeta{UID: metav1.NewUID()},
+		Owner:      chatv1.User{ObjectMeta: metav1.ObjectMeta{Name: "alice"}},
+	}
+
+	in <- sighting{room: room.DeepCopy()}
+	e := <-events
+	a.Equal(EventAdded, e.Type)
+	a.Equal(room.UID, e.Room.Info.UID)
+
+	// 没有变化时不产生事件
+	in <- sighting{room: room.DeepCopy()}
+
+	room.Owner.Name = "bob"
+	in <- sighting{room: room.DeepCopy()}
+	e = <-events
+	a.Equal(EventUpdated, e.Type)
+	a.Equal("bob", e.Room.Info.Owner.Name)
+
+	// 非房间信息被忽略
+	in <- sighting{room: &chatv1.Room{APIMeta: metav1.NewAPIMeta(chatv1.KindRoomRequest)}}
+
+	select {
+	case e = <-events:
+		a.Equal(EventRemoved, e.Type)
+		a.Equal(room.UID, e.Room.Info.UID)
+	case <-time.After(time.Second):
+		a.Fail("room not removed")
+	}
+
+	cancel()
+	_, ok := <-events
+	a.False(ok)
+}
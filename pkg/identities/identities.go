@@ -0,0 +1,129 @@
+package identities
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	metav1 "github.com/yhlooo/bangbang/pkg/apis/meta/v1"
+	"github.com/yhlooo/bangbang/pkg/servers"
+	"github.com/yhlooo/bangbang/pkg/signatures"
+)
+
+const (
+	identityFileName = "identity.json"
+	certFileName     = "cert.pem"
+	keyFileName      = "key.pem"
+
+	// renewBefore 证书在过期前多久重新生成
+	renewBefore = 7 * 24 * time.Hour
+)
+
+// DefaultHomeDir 默认数据目录
+func DefaultHomeDir() string {
+	return filepath.Join(os.ExpandEnv("$HOME"), ".bangbang")
+}
+
+// DefaultIdentityDir 默认身份目录
+func DefaultIdentityDir() string {
+	return filepath.Join(DefaultHomeDir(), "identity")
+}
+
+// Identity 本机身份
+type Identity struct {
+	// 用户 UID
+	UID metav1.UID
+	// TLS 证书
+	Certificate tls.Certificate
+}
+
+// CertSign 返回证书签名
+func (id *Identity) CertSign() string {
+	return signatures.SignCert(id.Certificate.Leaf.Raw)
+}
+
+// identityFile 身份文件内容
+type identityFile struct {
+	UID metav1.UID `json:"uid"`
+}
+
+// New 创建临时身份，不持久化
+func New() (*Identity, error) {
+	cert, _, _, err := newCertificate()
+	if err != nil {
+		return nil, err
+	}
+	return &Identity{UID: metav1.NewUID(), Certificate: cert}, nil
+}
+
+// LoadOrCreate 从 dir 加载身份，不存在时创建并保存
+//
+// 证书即将过期时重新生成，用户 UID 不变
+func LoadOrCreate(dir string) (*Identity, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("create identity directory %q error: %w", dir, err)
+	}
+
+	// 用户 UID
+	id := &Identity{}
+	idPath := filepath.Join(dir, identityFileName)
+	raw, err := os.ReadFile(idPath)
+	switch {
+	case err == nil:
+		f := &identityFile{}
+		if err := json.Unmarshal(raw, f); err != nil {
+			return nil, fmt.Errorf("unmarshal identity file %q error: %w", idPath, err)
+		}
+		id.UID = f.UID
+	case errors.Is(err, os.ErrNotExist):
+		id.UID = metav1.NewUID()
+		raw, _ := json.Marshal(&identityFile{UID: id.UID})
+		if err := os.WriteFile(idPath, raw, 0o600); err != nil {
+			return nil, fmt.Errorf("write identity file %q error: %w", idPath, err)
+		}
+	default:
+		return nil, fmt.Errorf("read identity file %q error: %w", idPath, err)
+	}
+
+	// 证书
+	certPath := filepath.Join(dir, certFileName)
+	keyPath := filepath.Join(dir, keyFileName)
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err == nil && time.Now().Add(renewBefore).Before(cert.Leaf.NotAfter) {
+		id.Certificate = cert
+		return id, nil
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("load certificate from %q error: %w", dir, err)
+	}
+
+	cert, certPEM, keyPEM, err := newCertificate()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(keyPath, keyPEM, 0o600); err != nil {
+		return nil, fmt.Errorf("write key file %q error: %w", keyPath, err)
+	}
+	if err := os.WriteFile(certPath, certPEM, 0o644); err != nil {
+		return nil, fmt.Errorf("write certificate file %q error: %w", certPath, err)
+	}
+	id.Certificate = cert
+	return id, nil
+}
+
+// newCertificate 生成自签名证书
+func newCertificate() (tls.Certificate, []byte, []byte, error) {
+	certPEM, keyPEM, err := servers.GenerateECCCertificate("bangbang")
+	if err != nil {
+		return tls.Certificate{}, nil, nil, fmt.Errorf("generate certificate error: %w", err)
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return tls.Certificate{}, nil, nil, fmt.Errorf("create certificate pair error: %w", err)
+	}
+	return cert, certPEM, keyPEM, nil
+}
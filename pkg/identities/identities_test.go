@@ -0,0 +1,35 @@
+package identities
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestLoadOrCreate 测试 LoadOrCreate
+func TestLoadOrCreate(t *testing.T) {
+	a := assert.New(t)
+
+	dir := t.TempDir()
+	id, err := LoadOrCreate(dir)
+	if !a.NoError(err) {
+		return
+	}
+	a.False(id.UID.IsNil())
+
+	// 再次加载身份不变
+	loaded, err := LoadOrCreate(dir)
+	if !a.NoError(err) {
+		return
+	}
+	a.Equal(id.UID, loaded.UID)
+	a.Equal(id.CertSign(), loaded.CertSign())
+
+	// 临时身份每次不同
+	tmp, err := New()
+	if !a.NoError(err) {
+		return
+	}
+	a.NotEqual(id.UID, tmp.UID)
+	a.NotEqual(id.CertSign(), tmp.CertSign())
+}
@@ -0,0 +1,146 @@
+package identities
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	metav1 "github.com/yhlooo/bangbang/pkg/apis/meta/v1"
+)
+
+// DefaultKnownPeersPath 默认已知对端存储路径
+func DefaultKnownPeersPath() string {
+	return filepath.Join(DefaultHomeDir(), "known_peers.json")
+}
+
+// PeerStatus 对端证书检查结果
+type PeerStatus string
+
+const (
+	// PeerNew 首次见到该用户，已记录其证书
+	PeerNew PeerStatus = "New"
+	// PeerKnown 证书与记录的一致
+	PeerKnown PeerStatus = "Known"
+	// PeerChanged 证书与记录的不一致
+	PeerChanged PeerStatus = "Changed"
+)
+
+// KnownPeer 已知对端
+type KnownPeer struct {
+	// 用户名
+	Name string `json:"name,omitempty"`
+	// 证书签名
+	CertSign string `json:"certSign"`
+	// 首次见到的时间
+	FirstSeen time.Time `json:"firstSeen"`
+	// 最近见到的时间
+	LastSeen time.Time `json:"lastSeen"`
+}
+
+// NewKnownPeers 创建已知对端存储
+//
+// path 为空时仅保存在内存中
+func NewKnownPeers(path string) *KnownPeers {
+	return &KnownPeers{path: path}
+}
+
+// KnownPeers 已知对端存储
+//
+// 以用户 UID 为键记录首次见到的证书签名（首次使用时信任），之后证书变化时不会覆盖记录。
+// 需要信任新证书时从存储文件中删除对应条目
+type KnownPeers struct {
+	path string
+
+	lock  sync.Mutex
+	peers map[metav1.UID]KnownPeer
+}
+
+// Check 检查用户的证书签名
+//
+// 首次见到的用户会被记录。返回 PeerChanged 时同时返回之前记录的对端
+func (s *KnownPeers) Check(uid metav1.UID, name, certSign string) (PeerStatus, *KnownPeer, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err := s.load(); err != nil {
+		return "", nil, err
+	}
+
+	now := time.Now()
+	peer, ok := s.peers[uid]
+	status := PeerKnown
+	switch {
+	case !ok:
+		status = PeerNew
+		peer = KnownPeer{Name: name, CertSign: certSign, FirstSeen: now}
+	case peer.CertSign != certSign:
+		return PeerChanged, &peer, nil
+	}
+	peer.Name = name
+	peer.LastSeen = now
+	s.peers[uid] = peer
+
+	if err := s.save(); err != nil {
+		return status, nil, err
+	}
+	return status, nil, nil
+}
+
+// load 加载存储，已加载时跳过
+func (s *KnownPeers) load() error {
+	if s.peers != nil {
+		return nil
+	}
+	s.peers = map[metav1.UID]KnownPeer{}
+	if s.path == "" {
+		return nil
+	}
+
+	raw, err := os.ReadFile(s.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("read known peers file %q error: %w", s.path, err)
+	}
+	peers := map[string]KnownPeer{}
+	if err := json.Unmarshal(raw, &peers); err != nil {
+		return fmt.Errorf("unmarshal known peers file %q error: %w", s.path, err)
+	}
+	for k, peer := range peers {
+		uid, err := uuid.Parse(k)
+		if err != nil {
+			return fmt.Errorf("invalid uid %q in known peers file %q: %w", k, s.path, err)
+		}
+		s.peers[metav1.UID(uid)] = peer
+	}
+	return nil
+}
+
+// save 保存存储
+func (s *KnownPeers) save() error {
+	if s.path == "" {
+		return nil
+	}
+	peers := make(map[string]KnownPeer, len(s.peers))
+	for uid, peer := range s.peers {
+		peers[uid.String()] = peer
+	}
+	raw, err := json.MarshalIndent(peers, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal known peers error: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o700); err != nil {
+		return fmt.Errorf("create directory %q error: %w", filepath.Dir(s.path), err)
+	}
+	if err := os.WriteFile(s.path, raw, 0o600); err != nil {
+		return fmt.Errorf("write known peers file %q error: %w", s.path, err)
+	}
+	return nil
+}
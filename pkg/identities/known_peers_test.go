@@ -0,0 +1,44 @@
+package identities
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	metav1 "github.com/yhlooo/bangbang/pkg/apis/meta/v1"
+)
+
+// TestKnownPeers 测试 KnownPeers
+func TestKnownPeers(t *testing.T) {
+	a := assert.New(t)
+
+	path := filepath.Join(t.TempDir(), "known_peers.json")
+	uid := metav1.NewUID()
+
+	s := NewKnownPeers(path)
+	status, _, err := s.Check(uid, "alice", "sha256:1")
+	a.NoError(err)
+	a.Equal(PeerNew, status)
+	status, _, err = s.Check(uid, "alice", "sha256:1")
+	a.NoError(err)
+	a.Equal(PeerKnown, status)
+
+	// 重新加载后证书变化
+	s = NewKnownPeers(path)
+	status, known, err := s.Check(uid, "alice", "sha256:2")
+	a.NoError(err)
+	a.Equal(PeerChanged, status)
+	if a.NotNil(known) {
+		a.Equal("sha256:1", known.CertSign)
+	}
+	// 不覆盖记录
+	status, _, err = s.Check(uid, "alice", "sha256:2")
+	a.NoError(err)
+	a.Equal(PeerChanged, status)
+
+	// 其它用户
+	status, _, err = s.Check(metav1.NewUID(), "bob", "sha256:2")
+	a.NoError(err)
+	a.Equal(PeerNew, status)
+}
@@ -2,17 +2,25 @@ package managers
 
 import (
 	"context"
+	"crypto"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"net"
+	"slices"
 	"sort"
+	"sync"
 	"time"
 
 	"github.com/go-logr/logr"
 
+	chatv1 "github.com/yhlooo/bangbang/pkg/apis/chat/v1"
 	metav1 "github.com/yhlooo/bangbang/pkg/apis/meta/v1"
+	"github.com/yhlooo/bangbang/pkg/audit"
+	"github.com/yhlooo/bangbang/pkg/chats/moderations"
 	"github.com/yhlooo/bangbang/pkg/chats/rooms"
 	"github.com/yhlooo/bangbang/pkg/discovery"
+	"github.com/yhlooo/bangbang/pkg/identities"
 	"github.com/yhlooo/bangbang/pkg/servers"
 	"github.com/yhlooo/bangbang/pkg/signatures"
 )
@@ -26,8 +34,26 @@ type Options struct {
 	OwnerName string
 	// HTTP 监听地址
 	HTTPAddr string
-	// 服务发现地址
-	DiscoveryAddr string
+	// 服务发现后端
+	DiscoveryBackends []string
+	// 服务发现地址（ UDP 后端）
+	DiscoveryAddrs []string
+	// 服务发现及访问端点使用的网卡，为 nil 时使用 discovery.DefaultInterfaceFilter
+	Interfaces *discovery.InterfaceFilter
+	// 组播搜索持续没有找到房间多久后回退到单播扫描子网，为 0 时不回退（仅 UDP 后端）
+	SweepAfter time.Duration
+	// 主动广播房间信息的平均间隔，为 0 时不主动广播（仅 UDP 后端）
+	AnnounceInterval time.Duration
+	// 手动指定的上游房间，指定时不再通过服务发现搜索上游
+	Peers []*discovery.Peer
+	// HTTP 服务使用的 TLS 证书，为 nil 时生成临时的自签名证书
+	Certificate *tls.Certificate
+	// 已知对端存储，为 nil 时不检查对端证书变化
+	KnownPeers *identities.KnownPeers
+	// 按发送人限制消息，零值表示不限制
+	RateLimits rooms.RateLimits
+	// 消息签名时间窗口，为 0 时使用 rooms.DefaultMessageWindow
+	MessageWindow time.Duration
 }
 
 // Validate 校验选项
@@ -38,8 +64,11 @@ func (o *Options) Validate() error {
 	if o.HTTPAddr == "" {
 		return errors.New(".HTTPAddr is required")
 	}
-	if o.DiscoveryAddr == "" {
-		return errors.New(".DiscoveryAddr is required")
+	if len(o.Peers) == 0 && len(o.DiscoveryBackends) == 0 {
+		return errors.New(".DiscoveryBackends is required")
+	}
+	if slices.Contains(o.DiscoveryBackends, discovery.BackendUDP) && len(o.DiscoveryAddrs) == 0 {
+		return errors.New(".DiscoveryAddrs is required")
 	}
 	return nil
 }
@@ -49,22 +78,65 @@ func NewManager(opts Options) (Manager, error) {
 	if err := opts.Validate(); err != nil {
 		return nil, err
 	}
-	return &defaultManager{
+	// 使用身份证书的公钥签发管理操作，连接其它房间时也使用身份私钥创建客户端证书
+	ownerKey := ""
+	keys := signatures.NewKeyHolder(opts.Key)
+	if opts.Certificate != nil && opts.Certificate.Leaf != nil {
+		ownerKey = moderations.KeyFingerprint(opts.Certificate.Leaf.RawSubjectPublicKeyInfo)
+		if signer, ok := opts.Certificate.PrivateKey.(crypto.Signer); ok {
+			keys.WithIdentityKey(signer)
+		}
+	}
+	viewerKeys := signatures.NewKeyHolder(nil)
+	mgr := &defaultManager{
 		opts:       opts,
-		selfRoom:   rooms.NewLocalRoom(opts.Key, opts.OwnerUID, opts.OwnerName),
-		discoverer: discovery.NewUDPDiscoverer(opts.DiscoveryAddr),
-	}, nil
+		keys:       keys,
+		viewerKeys: viewerKeys,
+		selfRoom: rooms.NewLocalRoom(keys, opts.OwnerUID, opts.OwnerName, rooms.LocalRoomOptions{
+			OwnerKey:      ownerKey,
+			Limits:        opts.RateLimits,
+			MessageWindow: opts.MessageWindow,
+			ViewerKeys:    viewerKeys,
+		}),
+		warnings: make(chan string, 16),
+		warned:   map[string]bool{},
+	}
+	if len(opts.DiscoveryBackends) > 0 {
+		// 房间主动广播时也接受其它房间的主动广播，以便尽快发现上游
+		discoverer, err := discovery.NewDiscoverer(
+			opts.DiscoveryBackends, opts.DiscoveryAddrs, opts.Interfaces, opts.AnnounceInterval > 0,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("init discoverer error: %w", err)
+		}
+		mgr.discoverer = discoverer
+	}
+	if opts.SweepAfter > 0 && slices.Contains(opts.DiscoveryBackends, discovery.BackendUDP) {
+		if port := sweepPort(opts.DiscoveryAddrs); port != 0 {
+			mgr.sweeper = discovery.NewSweepDiscoverer(port, 0).WithInterfaceFilter(opts.Interfaces)
+		}
+	}
+	return mgr, nil
 }
 
 // defaultManager 是 Manager 的默认实现
 type defaultManager struct {
 	opts Options
+	// 持有房间密钥，房间更换密钥后服务、服务发现和上游连接都改用新密钥
+	keys *signatures.KeyHolder
+	// 持有只读观察者密钥，房间签发者设置或关闭观察者时更新
+	viewerKeys *signatures.KeyHolder
 
 	selfRoom   rooms.RoomWithUpstream
 	discoverer discovery.Discoverer
+	sweeper    discovery.Discoverer
 
 	listenAddr net.Addr
 	certSign   string
+
+	warnings   chan string
+	warnedLock sync.Mutex
+	warned     map[string]bool
 }
 
 var _ Manager = (*defaultManager)(nil)
@@ -74,11 +146,24 @@ func (mgr *defaultManager) SelfRoom(_ context.Context) rooms.Room {
 	return mgr.selfRoom
 }
 
+// Keys 返回持有房间密钥的 KeyHolder
+func (mgr *defaultManager) Keys() *signatures.KeyHolder {
+	return mgr.keys
+}
+
+// ViewerKeys 返回持有只读观察者密钥的 KeyHolder
+func (mgr *defaultManager) ViewerKeys() *signatures.KeyHolder {
+	return mgr.viewerKeys
+}
+
 // StartServer 开始运行 HTTP 服务
 func (mgr *defaultManager) StartServer(ctx context.Context) (<-chan struct{}, error) {
 	addr, certSign, done, err := servers.RunServer(ctx, servers.Options{
-		ListenAddr: mgr.opts.HTTPAddr,
-		Room:       mgr.SelfRoom(ctx),
+		ListenAddr:  mgr.opts.HTTPAddr,
+		Room:        mgr.SelfRoom(ctx),
+		Certificate: mgr.opts.Certificate,
+		Keys:        mgr.keys,
+		ViewerKeys:  mgr.viewerKeys,
 	})
 	if err != nil {
 		return nil, err
@@ -89,6 +174,8 @@ func (mgr *defaultManager) StartServer(ctx context.Context) (<-chan struct{}, er
 }
 
 // StartSearchUpstream 开始搜索上游
+//
+// 房间更换密钥后使用新密钥重新搜索
 func (mgr *defaultManager) StartSearchUpstream(ctx context.Context) error {
 	logger := logr.FromContextOrDiscard(ctx)
 
@@ -97,58 +184,246 @@ func (mgr *defaultManager) StartSearchUpstream(ctx context.Context) error {
 		return fmt.Errorf("get self room info error: %w", err)
 	}
 
+	if len(mgr.opts.Peers) > 0 {
+		go mgr.runConnectPeers(ctx, selfRoom.UID)
+		return nil
+	}
+
+	changed := mgr.keys.Changed()
+	watchCTX, cancel := context.WithCancel(ctx)
+	events, err := mgr.discoverer.Watch(watchCTX, mgr.keys.Get())
+	if err != nil {
+		cancel()
+		return fmt.Errorf("watch rooms error: %w", err)
+	}
+
 	go func() {
-		ticker := time.NewTicker(time.Second)
-		defer ticker.Stop()
 		for {
-			select {
-			case <-ctx.Done():
+			rekeyed := mgr.searchUpstream(watchCTX, selfRoom.UID, events, changed)
+			cancel()
+			if !rekeyed {
 				return
-			case <-ticker.C:
 			}
 
-			if mgr.selfRoom.Upstream() != nil {
-				// 已经有上游了
-				continue
+			logger.Info("room key changed, restart searching upstream")
+			changed = mgr.keys.Changed()
+			watchCTX, cancel = context.WithCancel(ctx)
+			events, err = mgr.discoverer.Watch(watchCTX, mgr.keys.Get())
+			if err != nil {
+				cancel()
+				logger.Error(err, "watch rooms error")
+				return
 			}
+		}
+	}()
 
-			roomList, err := mgr.discoverer.Search(ctx, mgr.opts.Key, discovery.SearchOptions{
-				CheckAvailability: true,
-				Exclude:           []metav1.UID{selfRoom.UID},
-			})
-			if err != nil {
-				logger.Error(err, "search rooms error")
+	return nil
+}
+
+// searchUpstream 根据发现的房间设置上游，没有上游时持续搜索
+//
+// 房间更换密钥（ changed 被关闭）时返回 true ，上下文结束或 events 被关闭时返回 false 。
+// 单播扫描在后台进行，结果通过通道送回，扫描期间仍处理服务发现事件
+func (mgr *defaultManager) searchUpstream(
+	ctx context.Context,
+	selfUID metav1.UID,
+	events <-chan discovery.Event,
+	changed <-chan struct{},
+) bool {
+	logger := logr.FromContextOrDiscard(ctx)
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	// 当前发现的房间
+	candidates := map[metav1.UID]discovery.Room{}
+	lastFound := time.Now()
+	lastSweep := time.Time{}
+	// 单播扫描结果
+	sweeps := make(chan []discovery.Room)
+	sweeping := false
+	for {
+		var swept []discovery.Room
+		select {
+		case <-ctx.Done():
+			return false
+		case <-changed:
+			return true
+		case e, ok := <-events:
+			if !ok {
+				return false
+			}
+			if e.Room.Info.UID == selfUID {
 				continue
 			}
+			if e.Type == discovery.EventRemoved {
+				delete(candidates, e.Room.Info.UID)
+			} else {
+				candidates[e.Room.Info.UID] = e.Room
+			}
+		case swept = <-sweeps:
+			sweeping = false
+		case <-ticker.C:
+		}
 
-			for _, room := range roomList {
-				if room.Info.UID == selfRoom.UID {
-					// 跳过自己房间
+		if mgr.selfRoom.Upstream() != nil {
+			// 已经有上游了
+			lastFound = time.Now()
+			continue
+		}
+
+		roomList := make([]discovery.Room, 0, len(candidates))
+		for _, room := range candidates {
+			roomList = append(roomList, room)
+		}
+		roomList = append(roomList, swept...)
+		if len(roomList) > 0 {
+			lastFound = time.Now()
+		} else if mgr.sweeper != nil && !sweeping &&
+			time.Since(lastFound) >= mgr.opts.SweepAfter && time.Since(lastSweep) >= mgr.opts.SweepAfter {
+			// 组播持续找不到房间，可能组播被过滤了，回退到单播扫描子网
+			logger.Info(fmt.Sprintf("no room found for %s, sweeping local subnets", mgr.opts.SweepAfter))
+			lastSweep = time.Now()
+			sweeping = true
+			go mgr.sweep(ctx, selfUID, sweeps)
+			continue
+		}
+
+		// 优先选择深度较小、延迟较低的房间
+		discovery.SortRooms(roomList)
+		mgr.setUpstreamFrom(ctx, selfUID, roomList)
+	}
+}
+
+// sweep 单播扫描子网中的房间，将结果发送到 ch
+func (mgr *defaultManager) sweep(ctx context.Context, selfUID metav1.UID, ch chan<- []discovery.Room) {
+	roomList, err := mgr.sweeper.Search(ctx, mgr.keys.Get(), discovery.SearchOptions{
+		CheckAvailability: true,
+		Exclude:           []metav1.UID{selfUID},
+	})
+	if err != nil {
+		logr.FromContextOrDiscard(ctx).Error(err, "sweep rooms error")
+	}
+	select {
+	case <-ctx.Done():
+	case ch <- roomList:
+	}
+}
+
+// runConnectPeers 持续尝试将手动指定的房间设置为上游，跳过服务发现
+func (mgr *defaultManager) runConnectPeers(ctx context.Context, selfUID metav1.UID) {
+	logger := logr.FromContextOrDiscard(ctx)
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		if mgr.selfRoom.Upstream() == nil {
+			for _, peer := range mgr.opts.Peers {
+				endpoint, info, err := peer.Probe(ctx, mgr.keys.Get())
+				if err != nil {
+					logger.V(1).Info(fmt.Sprintf("peer %q not available: %v", peer.Endpoints, err))
 					continue
 				}
-				if room.AvailableEndpoint == "" {
-					// 跳过不可用的
-					logger.V(1).Info(fmt.Sprintf("skip unavailable room: %s", room.Info.UID))
+				if info.UID == selfUID {
+					// 跳过自己房间
 					continue
 				}
-
-				if err := mgr.selfRoom.SetUpstream(
-					ctx,
-					rooms.NewRemoteRoom(room.AvailableEndpoint, room.Info.CertSign),
-				); err != nil {
+				mgr.checkPeer(ctx, &info.Owner, peer.CertSign)
+				if err := mgr.selfRoom.SetUpstream(ctx, rooms.NewRemoteRoomWithKeys(endpoint, peer.CertSign, mgr.keys)); err != nil {
 					logger.Error(err, "set upstream error")
 					continue
 				}
 				break
 			}
 		}
-	}()
 
-	return nil
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// setUpstreamFrom 从搜索到的房间中选择一个设置为上游
+func (mgr *defaultManager) setUpstreamFrom(ctx context.Context, selfUID metav1.UID, roomList []discovery.Room) {
+	logger := logr.FromContextOrDiscard(ctx)
+
+	for _, room := range roomList {
+		if room.Info.UID == selfUID {
+			// 跳过自己房间
+			continue
+		}
+		if room.AvailableEndpoint == "" {
+			// 跳过不可用的
+			logger.V(1).Info(fmt.Sprintf("skip unavailable room: %s", room.Info.UID))
+			continue
+		}
+
+		mgr.checkPeer(ctx, &room.Info.Owner, room.Info.CertSign)
+		if err := mgr.selfRoom.SetUpstream(
+			ctx,
+			rooms.NewRemoteRoomWithKeys(room.AvailableEndpoint, room.Info.CertSign, mgr.keys),
+		); err != nil {
+			logger.Error(err, "set upstream error")
+			continue
+		}
+		return
+	}
+}
+
+// Warnings 返回需要提示用户的安全警告
+func (mgr *defaultManager) Warnings() <-chan string {
+	return mgr.warnings
+}
+
+// checkPeer 检查上游房主的证书是否与之前见到的一致
+//
+// 不一致时产生警告，同一用户的同一证书只警告一次
+func (mgr *defaultManager) checkPeer(ctx context.Context, owner *chatv1.User, certSign string) {
+	logger := logr.FromContextOrDiscard(ctx)
+
+	if mgr.opts.KnownPeers == nil || owner.UID.IsNil() || certSign == "" {
+		return
+	}
+	status, known, err := mgr.opts.KnownPeers.Check(owner.UID, owner.Name, certSign)
+	if err != nil {
+		logger.Error(err, "check known peer error")
+		return
+	}
+	switch status {
+	case identities.PeerNew:
+		logger.Info(fmt.Sprintf("trust new peer %q (%s) with certificate %s", owner.Name, owner.UID, certSign))
+	case identities.PeerChanged:
+		mgr.warnedLock.Lock()
+		warned := mgr.warned[owner.UID.String()+certSign]
+		mgr.warned[owner.UID.String()+certSign] = true
+		mgr.warnedLock.Unlock()
+		if warned {
+			return
+		}
+		msg := fmt.Sprintf(
+			"certificate of %q (%s) changed from %s to %s, someone may be impersonating this user",
+			owner.Name, owner.UID, known.CertSign, certSign,
+		)
+		logger.Info(msg)
+		audit.FromContext(ctx).Record(audit.EventPeerCertificateChanged, msg)
+		select {
+		case mgr.warnings <- msg:
+		default:
+		}
+	default:
+	}
 }
 
 // StartTransponder 开始运行应答机
+//
+// 房间更换密钥或观察者密钥后使用新密钥重新运行
 func (mgr *defaultManager) StartTransponder(ctx context.Context) error {
+	if len(mgr.opts.DiscoveryBackends) == 0 {
+		// 仅手动指定上游时不需要应答机
+		return nil
+	}
+
 	selfRoom, err := mgr.SelfRoom(ctx).Info(ctx)
 	if err != nil {
 		return fmt.Errorf("get self room info error: %w", err)
@@ -160,15 +435,78 @@ func (mgr *defaultManager) StartTransponder(ctx context.Context) error {
 	}
 	selfRoom.CertSign = mgr.certSign
 
-	t := discovery.NewUDPTransponder(mgr.opts.DiscoveryAddr, selfRoom, mgr.opts.Key)
+	changed, viewerChanged := mgr.keys.Changed(), mgr.viewerKeys.Changed()
+	transponderCTX, cancel := context.WithCancel(ctx)
+	t, err := mgr.startTransponder(transponderCTX, selfRoom)
+	if err != nil {
+		cancel()
+		return err
+	}
+
+	go func() {
+		logger := logr.FromContextOrDiscard(ctx)
+		// 定期记录统计信息便于诊断
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		var last discovery.TransponderStats
+		for {
+			restart := false
+			select {
+			case <-ctx.Done():
+				cancel()
+				return
+			case <-changed:
+				restart = true
+			case <-viewerChanged:
+				restart = true
+			case <-ticker.C:
+			}
+			if restart {
+				cancel()
+				logger.Info("room key or viewer key changed, restart transponder")
+				changed, viewerChanged = mgr.keys.Changed(), mgr.viewerKeys.Changed()
+				transponderCTX, cancel = context.WithCancel(ctx)
+				t, err = mgr.startTransponder(transponderCTX, selfRoom)
+				if err != nil {
+					cancel()
+					logger.Error(err, "restart transponder error")
+					return
+				}
+				last = discovery.TransponderStats{}
+				continue
+			}
+			if stats := t.Stats(); stats != last {
+				logger.V(1).Info(fmt.Sprintf("transponder stats: %s", stats))
+				last = stats
+			}
+		}
+	}()
+
+	return nil
+}
 
-	return t.Start(ctx)
+// startTransponder 使用当前密钥创建并运行应答机
+func (mgr *defaultManager) startTransponder(ctx context.Context, selfRoom *chatv1.Room) (discovery.Transponder, error) {
+	t, err := discovery.NewTransponder(
+		mgr.opts.DiscoveryBackends,
+		mgr.opts.DiscoveryAddrs,
+		mgr.opts.Interfaces,
+		mgr.opts.AnnounceInterval,
+		selfRoom,
+		mgr.keys.Get(),
+		mgr.viewerKeys.Get(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("init transponder error: %w", err)
+	}
+	if err := t.Start(ctx); err != nil {
+		return nil, err
+	}
+	return t, nil
 }
 
 // getEndpoints 获取可能能访问房间的端点
 func (mgr *defaultManager) getEndpoints(ctx context.Context) ([]string, error) {
-	logger := logr.FromContextOrDiscard(ctx)
-
 	if mgr.listenAddr == nil {
 		return nil, nil
 	}
@@ -185,54 +523,56 @@ func (mgr *defaultManager) getEndpoints(ctx context.Context) ([]string, error) {
 	}
 
 	// 获取所有网卡地址
-	interfaces, err := net.Interfaces()
+	ifaceAddrs, err := discovery.InterfaceAddrs(ctx, mgr.opts.Interfaces)
 	if err != nil {
-		return nil, fmt.Errorf("get interfaces error: %w", err)
+		return nil, err
 	}
 
-	var ips []net.IP
-	for _, iface := range interfaces {
-		addrs, err := iface.Addrs()
-		if err != nil {
-			logger.Error(err, fmt.Sprintf("get interface %q addresses error", iface.Name))
-			continue
-		}
-
-		for _, addr := range addrs {
-			switch v := addr.(type) {
-			case *net.IPNet:
-				if allIfaces || v.Contains(listenAddr.IP) {
-					ips = append(ips, v.IP)
-				}
-			case *net.IPAddr:
-				if allIfaces || v.IP.Equal(listenAddr.IP) {
-					ips = append(ips, v.IP)
-				}
-			}
+	var addrs []*net.IPAddr
+	for _, addr := range ifaceAddrs {
+		if allIfaces || addr.IPNet.Contains(listenAddr.IP) {
+			// IPv6 链路本地地址需要 zone 才能访问
+			addrs = append(addrs, &net.IPAddr{IP: addr.IPNet.IP, Zone: addr.Zone()})
 		}
 	}
 
 	// 对 IP 排序
-	sort.Slice(ips, func(i, j int) bool {
+	sort.Slice(addrs, func(i, j int) bool {
+		a, b := addrs[i].IP, addrs[j].IP
 		// IPv4 优先
-		if len(ips[i]) != len(ips[j]) {
-			return len(ips[i]) < len(ips[j])
+		if (a.To4() != nil) != (b.To4() != nil) {
+			return a.To4() != nil
 		}
 		// 私有地址优先
-		if ips[i].IsPrivate() != ips[j].IsPrivate() {
-			return ips[i].IsPrivate()
+		if a.IsPrivate() != b.IsPrivate() {
+			return a.IsPrivate()
 		}
 		// 本地回环优先
-		if ips[i].IsLoopback() != ips[j].IsLoopback() {
-			return ips[i].IsLoopback()
+		if a.IsLoopback() != b.IsLoopback() {
+			return a.IsLoopback()
 		}
-		return ips[i].String() < ips[j].String()
+		return addrs[i].String() < addrs[j].String()
 	})
 
-	ret := make([]string, len(ips))
-	for i, ip := range ips {
-		ret[i] = "https://" + (&net.TCPAddr{IP: ip, Port: port}).String()
+	ret := make([]string, len(addrs))
+	for i, addr := range addrs {
+		ret[i] = discovery.EndpointURL(addr.IP, addr.Zone, port)
 	}
 
 	return ret, nil
 }
+
+// sweepPort 获取单播扫描使用的端口，即第一个 IPv4 服务发现地址的端口
+func sweepPort(addrs []string) int {
+	if len(addrs) == 0 {
+		addrs = discovery.DefaultUDPAddrs
+	}
+	for _, addr := range addrs {
+		udpAddr, err := net.ResolveUDPAddr("udp", addr)
+		if err != nil || udpAddr.IP.To4() == nil {
+			continue
+		}
+		return udpAddr.Port
+	}
+	return 0
+}
@@ -4,16 +4,23 @@ import (
 	"context"
 
 	"github.com/yhlooo/bangbang/pkg/chats/rooms"
+	"github.com/yhlooo/bangbang/pkg/signatures"
 )
 
 // Manager 聊天管理器
 type Manager interface {
 	// SelfRoom 获取自己主持的房间
 	SelfRoom(ctx context.Context) rooms.Room
+	// Keys 返回持有房间密钥的 KeyHolder ，房间更换密钥后其中的密钥随之更换
+	Keys() *signatures.KeyHolder
+	// ViewerKeys 返回持有只读观察者密钥的 KeyHolder ，没有设置观察者时其中的密钥为空
+	ViewerKeys() *signatures.KeyHolder
 	// StartServer 开始运行 HTTP 服务
 	StartServer(ctx context.Context) (<-chan struct{}, error)
 	// StartTransponder 开始运行应答机
 	StartTransponder(ctx context.Context) error
 	// StartSearchUpstream 开始搜索上游
 	StartSearchUpstream(ctx context.Context) error
+	// Warnings 返回需要提示用户的安全警告
+	Warnings() <-chan string
 }
@@ -1,6 +1,7 @@
 package chat
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
@@ -14,12 +15,17 @@ import (
 	metav1 "github.com/yhlooo/bangbang/pkg/apis/meta/v1"
 	"github.com/yhlooo/bangbang/pkg/chats/rooms"
 	"github.com/yhlooo/bangbang/pkg/servers/common"
+	"github.com/yhlooo/bangbang/pkg/signatures"
 )
 
 // Server 聊天服务
 type Server interface {
 	// GetInfo 获取房间信息
 	GetInfo(ctx context.Context, req *EmptyRequest) (*chatv1.Room, error)
+	// ListMembers 列出成员
+	ListMembers(ctx context.Context, req *EmptyRequest) (*chatv1.UserList, error)
+	// ListModerations 列出生效的管理操作
+	ListModerations(ctx context.Context, req *EmptyRequest) (*chatv1.MessageList, error)
 	// CreateMessage 创建消息
 	CreateMessage(ctx context.Context, req *CreateMessageRequest) (*chatv1.Message, error)
 	// ListenMessages 监听消息
@@ -43,18 +49,24 @@ func (req *CreateMessageRequest) Body() interface{} {
 type ListenMessagesRequest struct {
 	UserUID  string `form:"userUID"`
 	UserName string `form:"userName"`
+	// 下游房间转发消息时带上的签名的下游房间信息（ JSON ）
+	Relay string `form:"relay"`
 }
 
 // NewServer 创建 Server
-func NewServer(room rooms.Room) Server {
+//
+// viewerKeys 持有只读观察者密钥，用于为观察者签名房间信息，可以为 nil
+func NewServer(room rooms.Room, viewerKeys *signatures.KeyHolder) Server {
 	return &chatServer{
-		room: room,
+		room:       room,
+		viewerKeys: viewerKeys,
 	}
 }
 
 // chatServer Server 的默认实现
 type chatServer struct {
-	room rooms.Room
+	room       rooms.Room
+	viewerKeys *signatures.KeyHolder
 }
 
 // GetInfo 获取房间信息
@@ -67,14 +79,59 @@ func (s *chatServer) GetInfo(ctx context.Context, _ *EmptyRequest) (*chatv1.Room
 		return nil, fmt.Errorf("get room info error: %w", err)
 	}
 
+	// 观察者不持有房间密钥，使用观察者密钥重新签名
+	if common.ClientRoleFromContext(ctx) == common.ClientRoleViewer {
+		var viewerKey signatures.Key
+		if s.viewerKeys != nil {
+			viewerKey = s.viewerKeys.Get()
+		}
+		if len(viewerKey) == 0 {
+			return nil, common.NewForbiddenError(ctx, "viewers are not allowed")
+		}
+		info = info.DeepCopy()
+		if err := signatures.HS256SignAPIObject(viewerKey.Subkey(signatures.KeyPurposeAPI), info); err != nil {
+			return nil, fmt.Errorf("sign room info error: %w", err)
+		}
+	}
+
 	return info, nil
 }
 
+// ListMembers 列出成员
+func (s *chatServer) ListMembers(ctx context.Context, _ *EmptyRequest) (*chatv1.UserList, error) {
+	logger := logr.FromContextOrDiscard(ctx)
+	logger.Info("list members")
+
+	members, err := s.room.ListMembers(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("list members error: %w", err)
+	}
+
+	return members, nil
+}
+
+// ListModerations 列出生效的管理操作
+func (s *chatServer) ListModerations(ctx context.Context, _ *EmptyRequest) (*chatv1.MessageList, error) {
+	logger := logr.FromContextOrDiscard(ctx)
+	logger.Info("list moderations")
+
+	moderations, err := s.room.ListModerations(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("list moderations error: %w", err)
+	}
+
+	return moderations, nil
+}
+
 // CreateMessage 创建消息
 func (s *chatServer) CreateMessage(ctx context.Context, req *CreateMessageRequest) (*chatv1.Message, error) {
 	logger := logr.FromContextOrDiscard(ctx)
 	logger.Info("create message in room")
 
+	if common.ClientRoleFromContext(ctx) == common.ClientRoleViewer {
+		return nil, common.NewForbiddenError(ctx, "viewers can not create messages")
+	}
+
 	if err := s.room.CreateMessage(ctx, &req.Message); err != nil {
 		return nil, fmt.Errorf("create message in room error: %w", err)
 	}
@@ -99,7 +156,26 @@ func (s *chatServer) ListenMessages(ctx context.Context, req *ListenMessagesRequ
 		}
 	}
 
-	ch, err := s.room.Listen(ctx, user)
+	// 观察者密钥更换或关闭后结束观察者的监听，之前的观察者无法继续收到消息
+	var viewerChanged <-chan struct{}
+	if common.ClientRoleFromContext(ctx) == common.ClientRoleViewer && s.viewerKeys != nil {
+		viewerChanged = s.viewerKeys.Changed()
+	}
+
+	// 只有持有房间密钥的成员可以作为下游房间转发消息，房间校验下游房间信息与监听者身份是否一致
+	listenCTX := context.Context(ctx)
+	if req.Relay != "" {
+		if user == nil || common.ClientRoleFromContext(ctx) != common.ClientRoleMember {
+			return nil, common.NewForbiddenError(ctx, "only members can relay messages")
+		}
+		relayRoom := &chatv1.Room{}
+		if err := json.Unmarshal([]byte(req.Relay), relayRoom); err != nil {
+			return nil, common.NewBadRequestError(ctx, fmt.Sprintf("invalid relay room info: %v", err))
+		}
+		listenCTX = common.NewContextWithRelayRoom(ctx, relayRoom)
+	}
+
+	ch, err := s.room.Listen(listenCTX, user)
 	if err != nil {
 		return nil, fmt.Errorf("listen message in room error: %w", err)
 	}
@@ -125,6 +201,9 @@ mainLoop:
 			break mainLoop
 		case <-ginCTX.Writer.CloseNotify():
 			break mainLoop
+		case <-viewerChanged:
+			logger.Info("viewer key changed, stop listening")
+			break mainLoop
 		case msg, ok = <-ch.Messages():
 			if !ok {
 				break mainLoop
@@ -132,7 +211,7 @@ mainLoop:
 		}
 
 		logger.Info(fmt.Sprintf("send message %q to client", msg.UID))
-		raw, err := json.Marshal(msg)
+		raw, err := messageJSON(msg)
 		if err != nil {
 			return nil, fmt.Errorf("marshal message %q to json error: %w", msg.UID, err)
 		}
@@ -145,3 +224,18 @@ mainLoop:
 
 	return common.NewOkStatus(ctx), nil
 }
+
+// messageJSON 返回消息的单行 JSON
+//
+// 转发收到的消息时使用原始 JSON ，不丢失当前版本不认识的字段
+func messageJSON(msg *chatv1.Message) ([]byte, error) {
+	raw := msg.RawJSON()
+	if len(raw) == 0 {
+		return json.Marshal(msg)
+	}
+	buf := &bytes.Buffer{}
+	if err := json.Compact(buf, raw); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -6,7 +6,10 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/go-logr/logr"
 
+	chatv1 "github.com/yhlooo/bangbang/pkg/apis/chat/v1"
 	metav1 "github.com/yhlooo/bangbang/pkg/apis/meta/v1"
+	"github.com/yhlooo/bangbang/pkg/audit"
+	"github.com/yhlooo/bangbang/pkg/signatures"
 )
 
 // InjectRequestContext 注入请求上下文
@@ -31,6 +34,55 @@ func InjectRequestID(ctx *gin.Context) {
 	ctx.Header(RequestIDHeader, reqID.String())
 }
 
+// InjectClientCert 将客户端证书的公钥指纹注入到上下文和 logger
+//
+// 客户端证书使用客户端的身份私钥，公钥指纹即客户端身份
+func InjectClientCert(ctx *gin.Context) {
+	if ctx.Request.TLS == nil || len(ctx.Request.TLS.PeerCertificates) == 0 {
+		return
+	}
+	fingerprint := signatures.SignCert(ctx.Request.TLS.PeerCertificates[0].RawSubjectPublicKeyInfo)
+	reqCTX := ctx.Request.Context()
+	reqCTX = NewContextWithClientKey(reqCTX, fingerprint)
+	reqCTX = logr.NewContext(reqCTX, logr.FromContextOrDiscard(reqCTX).WithValues("client", fingerprint))
+	ctx.Request = ctx.Request.WithContext(reqCTX)
+}
+
+// InjectAuditSource 将以客户端地址为来源的安全事件记录器注入到上下文
+func InjectAuditSource(ctx *gin.Context) {
+	reqCTX := ctx.Request.Context()
+	reqCTX = audit.NewContext(reqCTX, audit.FromContext(reqCTX).WithSource(ctx.RemoteIP()))
+	ctx.Request = ctx.Request.WithContext(reqCTX)
+}
+
+type clientKeyContextKey struct{}
+
+// ClientKeyFromContext 从 ctx 获取客户端身份公钥指纹，没有时返回空
+func ClientKeyFromContext(ctx context.Context) string {
+	v, _ := ctx.Value(clientKeyContextKey{}).(string)
+	return v
+}
+
+// NewContextWithClientKey 返回携带客户端身份公钥指纹的上下文
+func NewContextWithClientKey(parent context.Context, fingerprint string) context.Context {
+	return context.WithValue(parent, clientKeyContextKey{}, fingerprint)
+}
+
+type relayRoomContextKey struct{}
+
+// RelayRoomFromContext 从 ctx 获取监听者声明的下游房间信息，没有时返回 nil
+func RelayRoomFromContext(ctx context.Context) *chatv1.Room {
+	v, _ := ctx.Value(relayRoomContextKey{}).(*chatv1.Room)
+	return v
+}
+
+// NewContextWithRelayRoom 返回携带下游房间信息的上下文，以该房间的转发连接监听
+//
+// 房间校验其签名，且房主身份公钥指纹需要与监听者的身份一致
+func NewContextWithRelayRoom(parent context.Context, room *chatv1.Room) context.Context {
+	return context.WithValue(parent, relayRoomContextKey{}, room)
+}
+
 type reqIDContextKey struct{}
 
 // RequestIDFromContext 从 ctx 获取请求 ID
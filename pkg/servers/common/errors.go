@@ -3,22 +3,33 @@ package common
 import (
 	"context"
 	"errors"
+	"fmt"
 	"net/http"
 
 	"github.com/gin-gonic/gin"
 
 	metav1 "github.com/yhlooo/bangbang/pkg/apis/meta/v1"
+	"github.com/yhlooo/bangbang/pkg/audit"
 )
 
 const (
 	ReasonOk                     = "Ok"
 	ErrReasonBadRequest          = "BadRequest"
+	ErrReasonForbidden           = "Forbidden"
+	ErrReasonRequestTooLarge     = "RequestEntityTooLarge"
+	ErrReasonTooManyRequests     = "TooManyRequests"
 	ErrReasonInternalServerError = "InternalServerError"
 )
 
 // HandleError 处理错误
 func HandleError(ctx *gin.Context, err error) {
 	status := StatusFromError(ctx, err)
+	switch status.Code {
+	case http.StatusForbidden, http.StatusRequestEntityTooLarge, http.StatusTooManyRequests:
+		audit.FromContext(ctx).Record(audit.EventRequestRejected, fmt.Sprintf(
+			"%s %s: %s: %s", ctx.Request.Method, ctx.Request.URL.Path, status.Reason, status.Message,
+		))
+	}
 	ctx.JSON(status.Code, status)
 }
 
@@ -52,6 +63,21 @@ func NewBadRequestError(ctx context.Context, message string) *metav1.Status {
 	return NewStatus(ctx, http.StatusBadRequest, ErrReasonBadRequest, message)
 }
 
+// NewForbiddenError 创建 Forbidden 错误
+func NewForbiddenError(ctx context.Context, message string) *metav1.Status {
+	return NewStatus(ctx, http.StatusForbidden, ErrReasonForbidden, message)
+}
+
+// NewRequestEntityTooLargeError 创建 RequestEntityTooLarge 错误
+func NewRequestEntityTooLargeError(ctx context.Context, message string) *metav1.Status {
+	return NewStatus(ctx, http.StatusRequestEntityTooLarge, ErrReasonRequestTooLarge, message)
+}
+
+// NewTooManyRequestsError 创建 TooManyRequests 错误
+func NewTooManyRequestsError(ctx context.Context, message string) *metav1.Status {
+	return NewStatus(ctx, http.StatusTooManyRequests, ErrReasonTooManyRequests, message)
+}
+
 // NewInternalServerError 创建 InternalServerError 错误
 func NewInternalServerError(ctx context.Context, message string) *metav1.Status {
 	return NewStatus(ctx, http.StatusInternalServerError, ErrReasonInternalServerError, message)
@@ -0,0 +1,75 @@
+package common
+
+import (
+	"context"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ClientRole 客户端角色
+type ClientRole string
+
+const (
+	// ClientRoleMember 持有房间密钥的成员
+	ClientRoleMember ClientRole = "member"
+	// ClientRoleViewer 只持有观察者密钥的只读观察者
+	ClientRoleViewer ClientRole = "viewer"
+)
+
+// NewClientRoles 创建 ClientRoles
+func NewClientRoles() *ClientRoles {
+	return &ClientRoles{}
+}
+
+// ClientRoles 记录 TLS 握手时确定的客户端证书角色
+//
+// 按连接的对端地址索引，同一连接上的请求使用握手时的角色，不受之后更换密钥的影响。连接关闭时删除
+type ClientRoles struct {
+	roles sync.Map
+}
+
+// Set 记录对端地址为 remoteAddr 的连接的角色
+func (r *ClientRoles) Set(remoteAddr string, role ClientRole) {
+	r.roles.Store(remoteAddr, role)
+}
+
+// Get 获取对端地址为 remoteAddr 的连接的角色，没有记录时返回空
+func (r *ClientRoles) Get(remoteAddr string) ClientRole {
+	v, _ := r.roles.Load(remoteAddr)
+	role, _ := v.(ClientRole)
+	return role
+}
+
+// Delete 删除对端地址为 remoteAddr 的连接的角色
+func (r *ClientRoles) Delete(remoteAddr string) {
+	r.roles.Delete(remoteAddr)
+}
+
+// InjectClientRole 将客户端证书的角色注入到上下文
+func InjectClientRole(roles *ClientRoles) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if ctx.Request.TLS == nil || len(ctx.Request.TLS.PeerCertificates) == 0 {
+			return
+		}
+		ctx.Request = ctx.Request.WithContext(NewContextWithClientRole(ctx.Request.Context(), roles.Get(ctx.Request.RemoteAddr)))
+	}
+}
+
+type clientRoleContextKey struct{}
+
+// ClientRoleFromContext 从 ctx 获取客户端角色
+//
+// 没有记录时（比如服务不要求客户端证书）视为成员
+func ClientRoleFromContext(ctx context.Context) ClientRole {
+	v, _ := ctx.Value(clientRoleContextKey{}).(ClientRole)
+	if v == "" {
+		return ClientRoleMember
+	}
+	return v
+}
+
+// NewContextWithClientRole 返回携带客户端角色的上下文
+func NewContextWithClientRole(parent context.Context, role ClientRole) context.Context {
+	return context.WithValue(parent, clientRoleContextKey{}, role)
+}
@@ -13,6 +13,7 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/go-logr/logr"
 
+	"github.com/yhlooo/bangbang/pkg/audit"
 	"github.com/yhlooo/bangbang/pkg/chats/rooms"
 	"github.com/yhlooo/bangbang/pkg/log"
 	"github.com/yhlooo/bangbang/pkg/servers/chat"
@@ -24,6 +25,12 @@ import (
 type Options struct {
 	ListenAddr string
 	Room       rooms.Room
+	// TLS 证书，为 nil 时生成临时的自签名证书
+	Certificate *tls.Certificate
+	// 持有房间密钥，不为 nil 时要求客户端出示使用当前密钥以 signatures.NewClientCertificate 创建的证书
+	Keys *signatures.KeyHolder
+	// 持有只读观察者密钥，使用当前观察者密钥创建证书的客户端作为观察者，只能获取信息和监听消息
+	ViewerKeys *signatures.KeyHolder
 }
 
 // Complete 补全选项
@@ -43,22 +50,33 @@ func RunServer(ctx context.Context, opts Options) (net.Addr, string, <-chan stru
 		gin.SetMode(gin.ReleaseMode)
 	}
 
-	r := newGin(ctx, opts.Room, log.WriterFromContext(ctx))
+	roles := common.NewClientRoles()
+	r := newGin(ctx, opts.Room, opts.ViewerKeys, roles, log.WriterFromContext(ctx))
 	srv := &http.Server{
 		Handler:  r,
 		ErrorLog: stdlog.New(log.WriterFromContext(ctx), "", stdlog.LstdFlags),
+		ConnState: func(conn net.Conn, state http.ConnState) {
+			if state == http.StateClosed || state == http.StateHijacked {
+				roles.Delete(conn.RemoteAddr().String())
+			}
+		},
 	}
 
-	// 生成ECC自签名证书
-	certPEM, keyPEM, err := GenerateECCCertificate("bangbang")
-	if err != nil {
-		return nil, "", nil, fmt.Errorf("generate certificate error: %w", err)
-	}
+	var cert tls.Certificate
+	if opts.Certificate != nil {
+		cert = *opts.Certificate
+	} else {
+		// 生成ECC自签名证书
+		certPEM, keyPEM, err := GenerateECCCertificate("bangbang")
+		if err != nil {
+			return nil, "", nil, fmt.Errorf("generate certificate error: %w", err)
+		}
 
-	// 创建证书对
-	cert, err := tls.X509KeyPair(certPEM, keyPEM)
-	if err != nil {
-		return nil, "", nil, fmt.Errorf("create certificate pair error: %w", err)
+		// 创建证书对
+		cert, err = tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			return nil, "", nil, fmt.Errorf("create certificate pair error: %w", err)
+		}
 	}
 
 	// 配置TLS
@@ -66,6 +84,15 @@ func RunServer(ctx context.Context, opts Options) (net.Addr, string, <-chan stru
 		Certificates: []tls.Certificate{cert},
 		MinVersion:   tls.VersionTLS12,
 	}
+	if opts.Keys != nil {
+		tlsConfig.ClientAuth = tls.RequireAnyClientCert
+		tlsConfig.GetConfigForClient = configForClientFunc(
+			tlsConfig.Clone(),
+			verifyClientCertFunc(opts.Keys, opts.ViewerKeys),
+			roles,
+			audit.FromContext(ctx),
+		)
+	}
 
 	// 监听
 	l, err := tls.Listen("tcp", opts.ListenAddr, tlsConfig)
@@ -91,7 +118,76 @@ func RunServer(ctx context.Context, opts Options) (net.Addr, string, <-chan stru
 	return l.Addr(), signatures.SignCert(cert.Leaf.Raw), done, nil
 }
 
-func newGin(reqCTX context.Context, room rooms.Room, logWriter io.Writer) *gin.Engine {
+// verifyClientCertFunc 创建校验客户端证书的函数
+//
+// 总是使用 keys 的当前密钥校验，房间更换密钥后只持有旧密钥的客户端无法再建立连接。
+// 使用 viewerKeys 的当前密钥创建证书的客户端作为观察者，返回客户端角色。
+// 恢复的会话也会校验，避免只持有旧密钥的客户端通过会话恢复绕过校验
+func verifyClientCertFunc(
+	keys, viewerKeys *signatures.KeyHolder,
+) func(cs tls.ConnectionState) (common.ClientRole, error) {
+	return func(cs tls.ConnectionState) (common.ClientRole, error) {
+		if len(cs.PeerCertificates) == 0 {
+			return "", errors.New("no client certificate")
+		}
+		cert := cs.PeerCertificates[0]
+		err := signatures.VerifyClientCertificate(keys.Get(), cert)
+		if err == nil {
+			return common.ClientRoleMember, nil
+		}
+		if viewerKeys != nil {
+			if viewerKey := viewerKeys.Get(); len(viewerKey) != 0 &&
+				signatures.VerifyClientCertificate(viewerKey, cert) == nil {
+				return common.ClientRoleViewer, nil
+			}
+		}
+		return "", fmt.Errorf("verify client certificate error: %w", err)
+	}
+}
+
+// configForClientFunc 创建为每个连接返回配置的函数
+//
+// 每个连接使用 base 的副本，以 verify 校验客户端证书，校验通过时按对端地址将角色记录到 roles ，
+// 校验失败时将对端地址作为来源记录安全事件
+func configForClientFunc(
+	base *tls.Config,
+	verify func(cs tls.ConnectionState) (common.ClientRole, error),
+	roles *common.ClientRoles,
+	recorder *audit.Recorder,
+) func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		remoteAddr, source := "", ""
+		if hello.Conn != nil {
+			remoteAddr = hello.Conn.RemoteAddr().String()
+			source = remoteAddr
+			if host, _, err := net.SplitHostPort(source); err == nil {
+				source = host
+			}
+		}
+		config := base.Clone()
+		config.VerifyConnection = func(cs tls.ConnectionState) error {
+			role, err := verify(cs)
+			if err != nil {
+				recorder.WithSource(source).Record(
+					audit.EventClientCertificateRejected,
+					"client certificate not issued for the current room or viewer PIN",
+				)
+				return err
+			}
+			roles.Set(remoteAddr, role)
+			return nil
+		}
+		return config, nil
+	}
+}
+
+func newGin(
+	reqCTX context.Context,
+	room rooms.Room,
+	viewerKeys *signatures.KeyHolder,
+	roles *common.ClientRoles,
+	logWriter io.Writer,
+) *gin.Engine {
 	gin.DefaultWriter = logWriter
 	gin.DefaultErrorWriter = logWriter
 	r := gin.New()
@@ -102,13 +198,19 @@ func newGin(reqCTX context.Context, room rooms.Room, logWriter io.Writer) *gin.E
 		gin.LoggerWithWriter(logWriter),
 		common.InjectRequestContext(reqCTX),
 		common.InjectRequestID,
+		common.InjectAuditSource,
+		common.InjectClientCert,
+		common.InjectClientRole(roles),
 	)
 
 	chatV1Group := r.Group("/chat/v1")
 
-	chatServer := chat.NewServer(room)
+	chatServer := chat.NewServer(room, viewerKeys)
 
 	chatV1Group.GET("/info", typedHandler(chatServer.GetInfo))
+	// 列出成员
+	chatV1Group.GET("/members", typedHandler(chatServer.ListMembers))
+	chatV1Group.GET("/moderations", typedHandler(chatServer.ListModerations))
 	// 创建消息（发送消息）
 	chatV1Group.POST("/messages", typedHandler(chatServer.CreateMessage))
 	// 监听消息
@@ -117,6 +219,9 @@ func newGin(reqCTX context.Context, room rooms.Room, logWriter io.Writer) *gin.E
 	return r
 }
 
+// maxRequestBodyBytes 请求体的最大字节数，消息大小由房间按发送人进一步限制
+const maxRequestBodyBytes = 1 << 20
+
 // typedHandler 有类型的 HTTP 处理器
 func typedHandler[REQ any, RESP any](handler func(context.Context, *REQ) (*RESP, error)) gin.HandlerFunc {
 	return func(ctx *gin.Context) {
@@ -136,7 +241,16 @@ func typedHandler[REQ any, RESP any](handler func(context.Context, *REQ) (*RESP,
 			return
 		}
 		if withBody, ok := interface{}(req).(common.RequestWithBody); ok {
+			ctx.Request.Body = http.MaxBytesReader(ctx.Writer, ctx.Request.Body, maxRequestBodyBytes)
 			if err := ctx.ShouldBindJSON(withBody.Body()); err != nil {
+				var tooLarge *http.MaxBytesError
+				if errors.As(err, &tooLarge) {
+					common.HandleError(ctx, common.NewRequestEntityTooLargeError(ctx, fmt.Sprintf(
+						"request body too large: > %d bytes",
+						tooLarge.Limit,
+					)))
+					return
+				}
 				common.HandleError(ctx, common.NewBadRequestError(ctx, fmt.Sprintf(
 					"bind request body error: %s",
 					err.Error(),
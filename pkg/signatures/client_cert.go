@@ -0,0 +1,108 @@
+package signatures
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"math/big"
+	"time"
+)
+
+// OIDClientCertSignature 客户端证书中存放公钥指纹签名的扩展
+var OIDClientCertSignature = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 7134, 1, 1}
+
+// clientCertSignaturePrefix 计算客户端证书公钥指纹签名时的前缀，避免与其它签名混淆
+const clientCertSignaturePrefix = "bangbang client certificate v1\n"
+
+// NewClientCertificate 创建绑定密钥的客户端证书
+//
+// 证书为自签名证书，扩展 OIDClientCertSignature 中包含使用 key 的接口认证子密钥对公钥指纹的签名，
+// 只有知道 key 的节点可以为自己的公钥生成有效的证书。
+// 证书使用身份私钥 identity ，房间据此识别客户端身份，为 nil 时使用随机生成的私钥（匿名）
+func NewClientCertificate(key Key, identity crypto.Signer) (*tls.Certificate, error) {
+	priv := identity
+	if priv == nil {
+		var err error
+		priv, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("generate key error: %w", err)
+		}
+	}
+	spki, err := x509.MarshalPKIXPublicKey(priv.Public())
+	if err != nil {
+		return nil, fmt.Errorf("marshal public key error: %w", err)
+	}
+	sign, err := signClientPublicKey(key, spki)
+	if err != nil {
+		return nil, err
+	}
+	ext, err := asn1.Marshal([]byte(sign))
+	if err != nil {
+		return nil, fmt.Errorf("marshal extension error: %w", err)
+	}
+
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("generate serial number error: %w", err)
+	}
+	template := x509.Certificate{
+		SerialNumber:    serialNumber,
+		Subject:         pkix.Name{CommonName: "bangbang-client"},
+		NotBefore:       time.Now().Add(-time.Hour),
+		NotAfter:        time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:        x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		ExtraExtensions: []pkix.Extension{{Id: OIDClientCertSignature, Value: ext}},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, priv.Public(), priv)
+	if err != nil {
+		return nil, fmt.Errorf("create certificate error: %w", err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, fmt.Errorf("parse certificate error: %w", err)
+	}
+	return &tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  priv,
+		Leaf:        leaf,
+	}, nil
+}
+
+// VerifyClientCertificate 校验客户端证书中的公钥指纹签名
+func VerifyClientCertificate(key Key, cert *x509.Certificate) error {
+	var sign []byte
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(OIDClientCertSignature) {
+			continue
+		}
+		if _, err := asn1.Unmarshal(ext.Value, &sign); err != nil {
+			return fmt.Errorf("unmarshal extension error: %w", err)
+		}
+		break
+	}
+	if len(sign) == 0 {
+		return ErrNoSignature
+	}
+
+	expected, err := signClientPublicKey(key, cert.RawSubjectPublicKeyInfo)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(sign, []byte(expected)) {
+		return fmt.Errorf("%w: client certificate %s", ErrSignatureMismatch, SignCert(cert.RawSubjectPublicKeyInfo))
+	}
+	return nil
+}
+
+// signClientPublicKey 对客户端公钥指纹签名
+func signClientPublicKey(key Key, spki []byte) (string, error) {
+	return HS256Sign(key.Subkey(KeyPurposeAPI), []byte(clientCertSignaturePrefix+SignCert(spki)))
+}
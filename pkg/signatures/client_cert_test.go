@@ -0,0 +1,43 @@
+package signatures
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestClientCertificate 测试 NewClientCertificate 和 VerifyClientCertificate
+func TestClientCertificate(t *testing.T) {
+	a := assert.New(t)
+
+	identity, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if !a.NoError(err) {
+		return
+	}
+	cert, err := NewClientCertificate(Key("1234"), identity)
+	if !a.NoError(err) {
+		return
+	}
+	a.NoError(VerifyClientCertificate(Key("1234"), cert.Leaf))
+	// 使用身份公钥
+	pub, err := PublicKeyOf(identity)
+	a.NoError(err)
+	a.Equal(pub, cert.Leaf.RawSubjectPublicKeyInfo)
+	a.True(errors.Is(VerifyClientCertificate(Key("4321"), cert.Leaf), ErrSignatureMismatch))
+
+	// 把签名放到其它公钥的证书中
+	other, err := NewClientCertificate(Key("4321"), nil)
+	if !a.NoError(err) {
+		return
+	}
+	other.Leaf.Extensions = cert.Leaf.Extensions
+	a.True(errors.Is(VerifyClientCertificate(Key("1234"), other.Leaf), ErrSignatureMismatch))
+
+	// 没有签名
+	other.Leaf.Extensions = nil
+	a.True(errors.Is(VerifyClientCertificate(Key("1234"), other.Leaf), ErrNoSignature))
+}
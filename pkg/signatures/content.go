@@ -0,0 +1,56 @@
+package signatures
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+)
+
+// SealContent 使用 key 的内容加密子密钥以 AES-256-GCM 加密内容
+//
+// 返回随机 nonce 与密文的拼接， aad 为需要一同认证但不加密的数据
+func SealContent(key Key, plaintext, aad []byte) ([]byte, error) {
+	aead, err := contentAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("generate nonce error: %w", err)
+	}
+	return aead.Seal(nonce, nonce, plaintext, aad), nil
+}
+
+// OpenContent 解密 SealContent 加密的内容
+func OpenContent(key Key, sealed, aad []byte) ([]byte, error) {
+	aead, err := contentAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("%w: sealed content too short", ErrDecryptFailed)
+	}
+	plaintext, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], aad)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrDecryptFailed, err)
+	}
+	return plaintext, nil
+}
+
+// contentAEAD 创建使用内容加密子密钥的 AEAD
+func contentAEAD(key Key) (cipher.AEAD, error) {
+	if key == nil {
+		return nil, errors.New("key is required to encrypt content")
+	}
+	block, err := aes.NewCipher(key.Subkey(KeyPurposeContent))
+	if err != nil {
+		return nil, fmt.Errorf("init cipher error: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("init gcm error: %w", err)
+	}
+	return aead, nil
+}
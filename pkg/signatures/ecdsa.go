@@ -0,0 +1,86 @@
+package signatures
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+)
+
+// ES256SignObject 使用私钥对可 JSON 序列化的对象签名
+//
+// 签名对象为 RFC 8785 规范化的 JSON ，返回 ASN.1 格式的签名
+func ES256SignObject(priv crypto.Signer, obj interface{}) ([]byte, error) {
+	digest, err := objectDigest(obj)
+	if err != nil {
+		return nil, err
+	}
+	sign, err := priv.Sign(rand.Reader, digest, crypto.SHA256)
+	if err != nil {
+		return nil, fmt.Errorf("sign error: %w", err)
+	}
+	return sign, nil
+}
+
+// ES256VerifyObject 使用 PKIX DER 格式的 ECDSA 公钥校验对象签名
+func ES256VerifyObject(pub []byte, sign []byte, obj interface{}) error {
+	raw, err := json.Marshal(obj)
+	if err != nil {
+		return fmt.Errorf("marshal object to json error: %w", err)
+	}
+	return ES256VerifyJSON(pub, sign, raw)
+}
+
+// ES256VerifyJSON 使用 PKIX DER 格式的 ECDSA 公钥校验对 RFC 8785 规范化的 JSON 的签名
+func ES256VerifyJSON(pub []byte, sign []byte, raw []byte) error {
+	if len(sign) == 0 {
+		return ErrNoSignature
+	}
+	parsed, err := x509.ParsePKIXPublicKey(pub)
+	if err != nil {
+		return fmt.Errorf("parse public key error: %w", err)
+	}
+	ecdsaPub, ok := parsed.(*ecdsa.PublicKey)
+	if !ok {
+		return fmt.Errorf("%w: public key type %T", ErrUnsupportedScheme, parsed)
+	}
+	digest, err := jsonDigest(raw)
+	if err != nil {
+		return err
+	}
+	if !ecdsa.VerifyASN1(ecdsaPub, digest, sign) {
+		return fmt.Errorf("%w: public key %s", ErrSignatureMismatch, SignCert(pub))
+	}
+	return nil
+}
+
+// PublicKeyOf 返回私钥对应的 PKIX DER 格式公钥
+func PublicKeyOf(priv crypto.Signer) ([]byte, error) {
+	pub, err := x509.MarshalPKIXPublicKey(priv.Public())
+	if err != nil {
+		return nil, fmt.Errorf("marshal public key error: %w", err)
+	}
+	return pub, nil
+}
+
+// objectDigest 计算对象规范化 JSON 的 SHA256 摘要
+func objectDigest(obj interface{}) ([]byte, error) {
+	raw, err := json.Marshal(obj)
+	if err != nil {
+		return nil, fmt.Errorf("marshal object to json error: %w", err)
+	}
+	return jsonDigest(raw)
+}
+
+// jsonDigest 计算规范化 JSON 的 SHA256 摘要
+func jsonDigest(raw []byte) ([]byte, error) {
+	canonical, err := CanonicalizeJSON(raw)
+	if err != nil {
+		return nil, fmt.Errorf("canonicalize json error: %w", err)
+	}
+	digest := sha256.Sum256(canonical)
+	return digest[:], nil
+}
@@ -11,4 +11,10 @@ var (
 	ErrInvalidSignTime = errors.New("InvalidSignTime")
 	// ErrSignatureMismatch 签名不匹配
 	ErrSignatureMismatch = errors.New("SignatureMismatch")
+	// ErrUnsupportedScheme 不支持的签名方案
+	ErrUnsupportedScheme = errors.New("UnsupportedScheme")
+	// ErrDecryptFailed 解密失败
+	ErrDecryptFailed = errors.New("DecryptFailed")
+	// ErrWeakPIN PIN 码太弱
+	ErrWeakPIN = errors.New("WeakPIN")
 )
@@ -5,6 +5,7 @@ import (
 	"crypto/sha256"
 	"encoding/json"
 	"fmt"
+	"strings"
 	"time"
 
 	metav1 "github.com/yhlooo/bangbang/pkg/apis/meta/v1"
@@ -41,6 +42,16 @@ func HS256VerifyAPIObject(key Key, obj metav1.Object, allowSince, allowUntil tim
 		return fmt.Errorf("%w: sign time: %q (expected before %q)", ErrInvalidSignTime, meta.SignTime, allowUntil)
 	}
 
+	// 有原始 JSON 时校验原始 JSON ，其中当前版本不认识的字段也被签名
+	if rawObj, ok := obj.(RawJSONObject); ok && len(rawObj.RawJSON()) != 0 &&
+		strings.HasPrefix(meta.Signature, SchemeHS256JCS+":") {
+		raw, err := RemoveJSONFields(rawObj.RawJSON(), "meta.signature")
+		if err != nil {
+			return fmt.Errorf("remove signature from json error: %w", err)
+		}
+		return HS256VerifyJSON(key, meta.Signature, raw)
+	}
+
 	signature := meta.Signature
 	meta.Signature = ""
 	err := HS256VerifyObject(key, signature, obj)
@@ -48,14 +59,62 @@ func HS256VerifyAPIObject(key Key, obj metav1.Object, allowSince, allowUntil tim
 	return err
 }
 
+// RawJSONObject 保留了反序列化时收到的原始 JSON 的对象
+type RawJSONObject interface {
+	// RawJSON 返回原始 JSON ，没有时返回 nil
+	RawJSON() []byte
+}
+
+// HS256VerifyJSON 校验使用 SchemeHS256JCS 签名方案对 JSON 的签名
+func HS256VerifyJSON(key Key, expected string, raw []byte) error {
+	scheme, _, _ := strings.Cut(expected, ":")
+	if scheme != SchemeHS256JCS {
+		return fmt.Errorf("%w: %q", ErrUnsupportedScheme, scheme)
+	}
+	sign, err := HS256SignJSON(key, raw)
+	if err != nil {
+		return fmt.Errorf("sign json error: %w", err)
+	}
+	if !hmac.Equal([]byte(sign), []byte(expected)) {
+		return fmt.Errorf("%w: signature: %q (expected %q)", ErrSignatureMismatch, sign, expected)
+	}
+	return nil
+}
+
+// 签名方案标识，为签名字符串中 ":" 之前的部分
+const (
+	// SchemeHS256JCS 对 RFC 8785 规范化的 JSON 进行 HMAC-SHA256 签名
+	SchemeHS256JCS = "hs256-jcs"
+	// SchemeHS256 对数据直接进行 HMAC-SHA256 签名
+	//
+	// 旧版本对 API 对象使用该方案签名 Go 序列化的 JSON ，仅用于兼容校验
+	SchemeHS256 = "hs256"
+)
+
 // HS256VerifyObject 校验可 JSON 序列化的对象的签名
+//
+// 根据 expected 的签名方案标识选择签名方案，支持 SchemeHS256JCS 和 SchemeHS256
 func HS256VerifyObject(key Key, expected string, obj interface{}) error {
-	sign, err := HS256SignObject(key, obj)
+	scheme, _, _ := strings.Cut(expected, ":")
+
+	raw, err := json.Marshal(obj)
+	if err != nil {
+		return fmt.Errorf("marshal object to json error: %w", err)
+	}
+	var sign string
+	switch scheme {
+	case SchemeHS256JCS:
+		sign, err = HS256SignJSON(key, raw)
+	case SchemeHS256:
+		sign, err = HS256Sign(key, raw)
+	default:
+		return fmt.Errorf("%w: %q", ErrUnsupportedScheme, scheme)
+	}
 	if err != nil {
 		return fmt.Errorf("sign object error: %w", err)
 	}
 
-	if sign != expected {
+	if !hmac.Equal([]byte(sign), []byte(expected)) {
 		return fmt.Errorf("%w: signature: %q (expected %q)", ErrSignatureMismatch, sign, expected)
 	}
 
@@ -63,6 +122,8 @@ func HS256VerifyObject(key Key, expected string, obj interface{}) error {
 }
 
 // HS256SignObject 对任意可 JSON 序列化的对象进行签名
+//
+// 使用 SchemeHS256JCS 签名方案
 func HS256SignObject(key Key, obj interface{}) (string, error) {
 	// JSON 序列化
 	raw, err := json.Marshal(obj)
@@ -71,10 +132,25 @@ func HS256SignObject(key Key, obj interface{}) (string, error) {
 	}
 
 	// 签名
-	return HS256Sign(key, raw)
+	return HS256SignJSON(key, raw)
+}
+
+// HS256SignJSON 对 JSON 使用 SchemeHS256JCS 签名方案签名
+//
+// 签名为 "hs256-jcs:" 加上 RFC 8785 规范化的 JSON 的 HMAC-SHA256 的十六进制表示
+func HS256SignJSON(key Key, raw []byte) (string, error) {
+	canonical, err := CanonicalizeJSON(raw)
+	if err != nil {
+		return "", fmt.Errorf("canonicalize json error: %w", err)
+	}
+	hash := hmac.New(sha256.New, key)
+	hash.Write(canonical)
+	return fmt.Sprintf("%s:%x", SchemeHS256JCS, hash.Sum(nil)), nil
 }
 
 // HS256Sign 对数据 hmac + sha256 签名
+//
+// 使用 SchemeHS256 签名方案
 func HS256Sign(key Key, data []byte) (string, error) {
 	hash := hmac.New(sha256.New, key)
 	_, err := hash.Write(data)
@@ -82,7 +158,7 @@ func HS256Sign(key Key, data []byte) (string, error) {
 		return "", err
 	}
 	sign := hash.Sum(nil)
-	signStr := fmt.Sprintf("hs256:%x", sign)
+	signStr := fmt.Sprintf("%s:%x", SchemeHS256, sign)
 
 	return signStr, nil
 }
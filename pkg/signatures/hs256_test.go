@@ -1,6 +1,9 @@
 package signatures
 
 import (
+	"encoding/json"
+	"os"
+	"strings"
 	"testing"
 	"time"
 
@@ -66,5 +69,127 @@ func TestHS256SignObject(t *testing.T) {
 
 	sign, err := HS256SignObject(Key("test-secret"), obj)
 	a.NoError(err)
-	a.Equal("hs256:11f3b4b3a71e7c98db8cda725f79a4db53431bb688be319fc2f73cb952fbc983", sign)
+	a.Equal("hs256-jcs:6c79295d641d392d75435a22f5e4793ea932c8d93d3ce6c52e88fcd765824132", sign)
+	a.NoError(HS256VerifyObject(Key("test-secret"), sign, obj))
+
+	// 兼容旧版本签名
+	a.NoError(HS256VerifyObject(
+		Key("test-secret"),
+		"hs256:11f3b4b3a71e7c98db8cda725f79a4db53431bb688be319fc2f73cb952fbc983",
+		obj,
+	))
+	a.ErrorIs(HS256VerifyObject(Key("test-secret"), "foo:11f3b4b3", obj), ErrUnsupportedScheme)
+}
+
+// hs256JCSVectors 签名测试向量，供其它语言的实现验证互通性
+type hs256JCSVectors struct {
+	Canonicalization []struct {
+		Name      string `json:"name"`
+		Input     string `json:"input"`
+		Canonical string `json:"canonical"`
+	} `json:"canonicalization"`
+	Signatures []struct {
+		Name      string `json:"name"`
+		Key       string `json:"key"`
+		Input     string `json:"input"`
+		Canonical string `json:"canonical"`
+		Signature string `json:"signature"`
+	} `json:"signatures"`
+}
+
+// TestHS256JCSVectors 测试 testdata/hs256_jcs_vectors.json 中的测试向量
+func TestHS256JCSVectors(t *testing.T) {
+	a := assert.New(t)
+
+	raw, err := os.ReadFile("testdata/hs256_jcs_vectors.json")
+	if !a.NoError(err) {
+		return
+	}
+	vectors := &hs256JCSVectors{}
+	if !a.NoError(json.Unmarshal(raw, vectors)) {
+		return
+	}
+
+	for _, v := range vectors.Canonicalization {
+		canonical, err := CanonicalizeJSON([]byte(v.Input))
+		a.NoError(err, v.Name)
+		a.Equal(v.Canonical, string(canonical), v.Name)
+	}
+
+	for _, v := range vectors.Signatures {
+		canonical, err := CanonicalizeJSON([]byte(v.Input))
+		a.NoError(err, v.Name)
+		a.Equal(v.Canonical, string(canonical), v.Name)
+
+		sign, err := HS256SignJSON(Key(v.Key), []byte(v.Input))
+		a.NoError(err, v.Name)
+		a.Equal(v.Signature, sign, v.Name)
+
+		// 反序列化为 API 对象后校验签名
+		var obj metav1.Object
+		switch {
+		case strings.Contains(v.Input, `"kind":"Room"`):
+			obj = &chatv1.Room{}
+		case strings.Contains(v.Input, `"kind":"Message"`):
+			obj = &chatv1.Message{}
+		default:
+			continue
+		}
+		a.NoError(json.Unmarshal([]byte(v.Input), obj), v.Name)
+		obj.GetMeta().Signature = v.Signature
+		a.NoError(HS256VerifyAPIObject(Key(v.Key), obj, time.Time{}, time.Now()), v.Name)
+	}
+}
+
+// TestHS256VerifyAPIObject_RawJSON 测试使用原始 JSON 校验带有未知字段的消息
+func TestHS256VerifyAPIObject_RawJSON(t *testing.T) {
+	a := assert.New(t)
+
+	raw, err := os.ReadFile("testdata/hs256_jcs_vectors.json")
+	if !a.NoError(err) {
+		return
+	}
+	vectors := &hs256JCSVectors{}
+	if !a.NoError(json.Unmarshal(raw, vectors)) {
+		return
+	}
+	for _, v := range vectors.Signatures {
+		if v.Name != "message with unknown fields" {
+			continue
+		}
+		// 签名放在原始 JSON 中，校验时被删除
+		signed := strings.Replace(v.Input, `"meta":{`, `"meta":{"signature":"`+v.Signature+`",`, 1)
+		msg := &chatv1.Message{}
+		if !a.NoError(json.Unmarshal([]byte(signed), msg)) {
+			return
+		}
+		a.NoError(HS256VerifyAPIObject(Key(v.Key), msg, time.Time{}, time.Now()))
+
+		// 重新序列化会丢失未知字段
+		reencoded := msg.DeepCopy()
+		reencoded.ResetRawJSON()
+		a.ErrorIs(HS256VerifyAPIObject(Key(v.Key), reencoded, time.Time{}, time.Now()), ErrSignatureMismatch)
+
+		// 未知字段也被签名
+		tampered := &chatv1.Message{}
+		a.NoError(json.Unmarshal([]byte(strings.Replace(signed, `"priority":1.50`, `"priority":2`, 1)), tampered))
+		a.ErrorIs(HS256VerifyAPIObject(Key(v.Key), tampered, time.Time{}, time.Now()), ErrSignatureMismatch)
+		return
+	}
+	a.Fail("vector not found")
+}
+
+// TestCanonicalizeJSON_Invalid 测试 CanonicalizeJSON 拒绝非法输入
+func TestCanonicalizeJSON_Invalid(t *testing.T) {
+	a := assert.New(t)
+
+	for _, input := range []string{
+		`{"a":1,"a":2}`,
+		`[1e400]`,
+		`{"a":1} {}`,
+		`{"a":`,
+	} {
+		_, err := CanonicalizeJSON([]byte(input))
+		a.Error(err, input)
+	}
 }
@@ -0,0 +1,229 @@
+package signatures
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// CanonicalizeJSON 按 RFC 8785 JSON Canonicalization Scheme (JCS) 规范化 JSON
+//
+// 对象的键按 UTF-16 码元排序，字符串仅转义必须转义的字符，数字按 ECMAScript 规则格式化，不包括空白。
+// 对象中有重复的键时返回错误
+func CanonicalizeJSON(raw []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+
+	buf := &bytes.Buffer{}
+	if err := canonicalizeValue(dec, buf); err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); !errors.Is(err, io.EOF) {
+		return nil, errors.New("unexpected data after top-level value")
+	}
+	return buf.Bytes(), nil
+}
+
+// RemoveJSONFields 删除 JSON 对象中以 "." 分隔的路径指定的字段，返回 RFC 8785 规范化的结果
+//
+// 不存在的字段被忽略。对象中有重复的键时返回错误
+func RemoveJSONFields(raw []byte, paths ...string) ([]byte, error) {
+	canonical, err := CanonicalizeJSON(raw)
+	if err != nil {
+		return nil, err
+	}
+	var obj map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(canonical))
+	dec.UseNumber()
+	if err := dec.Decode(&obj); err != nil {
+		return nil, fmt.Errorf("decode json object error: %w", err)
+	}
+	for _, path := range paths {
+		keys := strings.Split(path, ".")
+		parent := obj
+		for _, key := range keys[:len(keys)-1] {
+			parent, _ = parent[key].(map[string]interface{})
+		}
+		delete(parent, keys[len(keys)-1])
+	}
+	ret, err := json.Marshal(obj)
+	if err != nil {
+		return nil, fmt.Errorf("encode json object error: %w", err)
+	}
+	return CanonicalizeJSON(ret)
+}
+
+// canonicalizeValue 读取一个 JSON 值并写入规范化形式
+func canonicalizeValue(dec *json.Decoder, buf *bytes.Buffer) error {
+	token, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	switch v := token.(type) {
+	case nil:
+		buf.WriteString("null")
+	case bool:
+		buf.WriteString(strconv.FormatBool(v))
+	case string:
+		writeJCSString(buf, v)
+	case json.Number:
+		f, err := strconv.ParseFloat(v.String(), 64)
+		if err != nil || math.IsInf(f, 0) {
+			return fmt.Errorf("invalid number: %s", v)
+		}
+		buf.WriteString(formatJCSNumber(f))
+	case json.Delim:
+		switch v {
+		case '[':
+			buf.WriteByte('[')
+			for i := 0; dec.More(); i++ {
+				if i > 0 {
+					buf.WriteByte(',')
+				}
+				if err := canonicalizeValue(dec, buf); err != nil {
+					return err
+				}
+			}
+			buf.WriteByte(']')
+		case '{':
+			return canonicalizeObject(dec, buf)
+		default:
+			return fmt.Errorf("unexpected delimiter: %s", v)
+		}
+		// 读取结束符
+		if _, err := dec.Token(); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unexpected token: %v", token)
+	}
+	return nil
+}
+
+// canonicalizeObject 读取 JSON 对象（起始符已读取）并写入规范化形式
+func canonicalizeObject(dec *json.Decoder, buf *bytes.Buffer) error {
+	type member struct {
+		key   string
+		utf16 []uint16
+		value []byte
+	}
+	var members []member
+	seen := map[string]bool{}
+	for dec.More() {
+		token, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		key, ok := token.(string)
+		if !ok {
+			return fmt.Errorf("unexpected object key: %v", token)
+		}
+		if seen[key] {
+			return fmt.Errorf("duplicate object key: %q", key)
+		}
+		seen[key] = true
+
+		value := &bytes.Buffer{}
+		if err := canonicalizeValue(dec, value); err != nil {
+			return err
+		}
+		members = append(members, member{key: key, utf16: utf16.Encode([]rune(key)), value: value.Bytes()})
+	}
+	// 读取结束符
+	if _, err := dec.Token(); err != nil {
+		return err
+	}
+
+	slices.SortFunc(members, func(a, b member) int {
+		return slices.Compare(a.utf16, b.utf16)
+	})
+	buf.WriteByte('{')
+	for i, m := range members {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		writeJCSString(buf, m.key)
+		buf.WriteByte(':')
+		buf.Write(m.value)
+	}
+	buf.WriteByte('}')
+	return nil
+}
+
+// writeJCSString 写入规范化的 JSON 字符串
+func writeJCSString(buf *bytes.Buffer, s string) {
+	buf.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '\b':
+			buf.WriteString(`\b`)
+		case '\t':
+			buf.WriteString(`\t`)
+		case '\n':
+			buf.WriteString(`\n`)
+		case '\f':
+			buf.WriteString(`\f`)
+		case '\r':
+			buf.WriteString(`\r`)
+		case '"':
+			buf.WriteString(`\"`)
+		case '\\':
+			buf.WriteString(`\\`)
+		default:
+			if r < 0x20 {
+				fmt.Fprintf(buf, `\u%04x`, r)
+			} else {
+				buf.WriteRune(r)
+			}
+		}
+	}
+	buf.WriteByte('"')
+}
+
+// formatJCSNumber 按 ECMAScript Number.prototype.toString 规则格式化数字
+func formatJCSNumber(f float64) string {
+	if f == 0 {
+		// 包括 -0
+		return "0"
+	}
+
+	sign := ""
+	if f < 0 {
+		sign = "-"
+		f = -f
+	}
+
+	// 最短表示的有效数字及指数， f = 0.digits * 10^n
+	s := strconv.FormatFloat(f, 'e', -1, 64)
+	mantissa, expStr, _ := strings.Cut(s, "e")
+	digits := strings.Replace(mantissa, ".", "", 1)
+	exp, _ := strconv.Atoi(expStr)
+	k, n := len(digits), exp+1
+
+	switch {
+	case k <= n && n <= 21:
+		return sign + digits + strings.Repeat("0", n-k)
+	case 0 < n && n <= 21:
+		return sign + digits[:n] + "." + digits[n:]
+	case -6 < n && n <= 0:
+		return sign + "0." + strings.Repeat("0", -n) + digits
+	}
+
+	e := n - 1
+	expSign := "+"
+	if e < 0 {
+		expSign = "-"
+		e = -e
+	}
+	if k == 1 {
+		return sign + digits + "e" + expSign + strconv.Itoa(e)
+	}
+	return sign + digits[:1] + "." + digits[1:] + "e" + expSign + strconv.Itoa(e)
+}
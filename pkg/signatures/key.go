@@ -1,5 +1,10 @@
 package signatures
 
+import (
+	"crypto/hkdf"
+	"crypto/sha256"
+)
+
 // Key 密钥
 type Key []byte
 
@@ -12,3 +17,30 @@ func (k Key) Copy() Key {
 	copy(out, k)
 	return out
 }
+
+// KeyPurpose 子密钥用途，作为 HKDF 的 info
+type KeyPurpose string
+
+const (
+	// KeyPurposeDiscovery 服务发现，用于加密、签名服务发现消息和邀请
+	KeyPurposeDiscovery KeyPurpose = "bangbang discovery v1"
+	// KeyPurposeAPI 接口认证，用于签名房间信息、消息和客户端证书
+	KeyPurposeAPI KeyPurpose = "bangbang api v1"
+	// KeyPurposeContent 内容加密，用于加密消息中的机密内容
+	KeyPurposeContent KeyPurpose = "bangbang content v1"
+)
+
+// Subkey 使用 HKDF-SHA256 从房间密钥派生指定用途的子密钥
+//
+// 不同用途的子密钥相互独立，从一个子密钥无法得到房间密钥或其它子密钥。 k 为 nil 时返回 nil
+func (k Key) Subkey(purpose KeyPurpose) Key {
+	if k == nil {
+		return nil
+	}
+	sub, err := hkdf.Key(sha256.New, k, nil, string(purpose), sha256.Size)
+	if err != nil {
+		// 仅在派生长度超过限制时出错
+		panic(err)
+	}
+	return sub
+}
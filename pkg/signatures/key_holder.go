@@ -0,0 +1,79 @@
+package signatures
+
+import (
+	"crypto"
+	"crypto/tls"
+	"sync"
+)
+
+// NewKeyHolder 创建持有房间密钥的 KeyHolder
+func NewKeyHolder(key Key) *KeyHolder {
+	return &KeyHolder{
+		key:     key.Copy(),
+		changed: make(chan struct{}),
+	}
+}
+
+// KeyHolder 持有可在运行时更换的房间密钥
+//
+// 房间更换密钥后，共享同一 KeyHolder 的房间、服务、服务发现和 UI 都改用新密钥
+type KeyHolder struct {
+	lock    sync.RWMutex
+	key     Key
+	changed chan struct{}
+	// 客户端证书使用的身份私钥，为 nil 时使用随机私钥
+	identity crypto.Signer
+	// 当前密钥对应的客户端证书，按需创建
+	clientCert *tls.Certificate
+}
+
+// WithIdentityKey 设置客户端证书使用的身份私钥
+func (h *KeyHolder) WithIdentityKey(identity crypto.Signer) *KeyHolder {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.identity = identity
+	h.clientCert = nil
+	return h
+}
+
+// Get 获取当前密钥
+func (h *KeyHolder) Get() Key {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	return h.key.Copy()
+}
+
+// Set 更换密钥
+//
+// 会通知 Changed 返回的通道
+func (h *KeyHolder) Set(key Key) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.key = key.Copy()
+	h.clientCert = nil
+	close(h.changed)
+	h.changed = make(chan struct{})
+}
+
+// Changed 返回在密钥下次更换时关闭的通道
+func (h *KeyHolder) Changed() <-chan struct{} {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	return h.changed
+}
+
+// ClientCertificate 获取绑定当前密钥的客户端证书
+//
+// 证书使用 WithIdentityKey 设置的身份私钥，在密钥更换前复用
+func (h *KeyHolder) ClientCertificate() (*tls.Certificate, error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.clientCert == nil {
+		cert, err := NewClientCertificate(h.key, h.identity)
+		if err != nil {
+			return nil, err
+		}
+		h.clientCert = cert
+	}
+	return h.clientCert, nil
+}
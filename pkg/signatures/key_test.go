@@ -17,3 +17,28 @@ func TestKey_Copy(t *testing.T) {
 	a.Equal("hello", string(key1))
 	a.Equal("hewlo", string(key2))
 }
+
+// TestKey_Subkey 测试 Key.Subkey
+func TestKey_Subkey(t *testing.T) {
+	a := assert.New(t)
+
+	key := Key("1234")
+	discovery := key.Subkey(KeyPurposeDiscovery)
+	api := key.Subkey(KeyPurposeAPI)
+	a.Len(discovery, 32)
+	a.Equal(discovery, key.Subkey(KeyPurposeDiscovery))
+	a.NotEqual(discovery, api)
+	a.NotEqual(api, Key("4321").Subkey(KeyPurposeAPI))
+	a.Nil(Key(nil).Subkey(KeyPurposeAPI))
+
+	// 内容加密
+	sealed, err := SealContent(key, []byte("hello"), []byte("aad"))
+	a.NoError(err)
+	plaintext, err := OpenContent(key, sealed, []byte("aad"))
+	a.NoError(err)
+	a.Equal("hello", string(plaintext))
+	_, err = OpenContent(key, sealed, []byte("other"))
+	a.ErrorIs(err, ErrDecryptFailed)
+	_, err = OpenContent(Key("4321"), sealed, []byte("aad"))
+	a.ErrorIs(err, ErrDecryptFailed)
+}
@@ -0,0 +1,311 @@
+package signatures
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math"
+	"math/big"
+	"strings"
+	"unicode"
+)
+
+// PINStyle 生成的 PIN 码样式
+type PINStyle string
+
+const (
+	// PINStyleDigits 数字
+	PINStyleDigits PINStyle = "digits"
+	// PINStyleWords 由单词组成的短语
+	PINStyleWords PINStyle = "words"
+)
+
+// PINStyles 所有 PIN 码样式
+var PINStyles = []PINStyle{PINStyleDigits, PINStyleWords}
+
+// PINPolicy 弱 PIN 码处理策略
+type PINPolicy string
+
+const (
+	// PINPolicyOff 不检查
+	PINPolicyOff PINPolicy = "off"
+	// PINPolicyWarn 警告
+	PINPolicyWarn PINPolicy = "warn"
+	// PINPolicyReject 拒绝
+	PINPolicyReject PINPolicy = "reject"
+)
+
+// PINPolicies 所有弱 PIN 码处理策略
+var PINPolicies = []PINPolicy{PINPolicyOff, PINPolicyWarn, PINPolicyReject}
+
+const (
+	// MinPINBits 不视为弱 PIN 码的最小估计熵（比特）
+	//
+	// 截获一条发现消息即可离线猜测 PIN 码，因此 4 位数字这样的短 PIN 码只能防住不认真的人
+	MinPINBits = 36
+	// generatedPINDigits 生成的数字 PIN 码位数，约 40 比特
+	generatedPINDigits = 12
+	// generatedPINWords 生成的短语单词数，约 40 比特
+	generatedPINWords = 5
+)
+
+// GeneratePIN 使用安全随机数生成 PIN 码
+//
+// 偶尔生成的看起来有规律的 PIN 码会被丢弃重新生成
+func GeneratePIN(style PINStyle) (Key, error) {
+	for {
+		pin, err := generatePIN(style)
+		if err != nil {
+			return nil, err
+		}
+		if EstimatePINBits(pin) >= MinPINBits {
+			return pin, nil
+		}
+	}
+}
+
+// generatePIN 生成 PIN 码
+func generatePIN(style PINStyle) (Key, error) {
+	switch style {
+	case PINStyleDigits:
+		digits := make([]byte, generatedPINDigits)
+		for i := range digits {
+			n, err := randomInt(10)
+			if err != nil {
+				return nil, err
+			}
+			digits[i] = byte('0' + n)
+		}
+		return digits, nil
+	case PINStyleWords:
+		words := make([]string, generatedPINWords)
+		for i := range words {
+			n, err := randomInt(len(pinWords))
+			if err != nil {
+				return nil, err
+			}
+			words[i] = pinWords[n]
+		}
+		return Key(strings.Join(words, "-")), nil
+	default:
+		return nil, fmt.Errorf("unknown PIN style: %q (expected one of %q)", style, PINStyles)
+	}
+}
+
+// randomInt 返回 [0, n) 中的安全随机数
+func randomInt(n int) (int, error) {
+	v, err := rand.Int(rand.Reader, big.NewInt(int64(n)))
+	if err != nil {
+		return 0, fmt.Errorf("generate random number error: %w", err)
+	}
+	return int(v.Int64()), nil
+}
+
+// Validate 校验策略是否合法
+func (p PINPolicy) Validate() error {
+	switch p {
+	case PINPolicyOff, PINPolicyWarn, PINPolicyReject:
+		return nil
+	}
+	return fmt.Errorf("unknown PIN policy: %q (expected one of %q)", p, PINPolicies)
+}
+
+// Check 按策略检查 PIN 码
+//
+// 弱 PIN 码在 warn 策略下返回警告，在 reject 策略下返回 ErrWeakPIN ，策略为空时视为 off
+func (p PINPolicy) Check(pin Key) (warning string, err error) {
+	if p == PINPolicyOff || p == "" {
+		return "", nil
+	}
+	bits := EstimatePINBits(pin)
+	if bits >= MinPINBits {
+		return "", nil
+	}
+	msg := fmt.Sprintf(
+		"PIN is weak (about %d bits, at least %d recommended), "+
+			"anyone nearby can guess it offline from a captured discovery message",
+		int(bits), MinPINBits,
+	)
+	if p == PINPolicyReject {
+		return "", fmt.Errorf("%w: %s", ErrWeakPIN, msg)
+	}
+	return msg, nil
+}
+
+// EstimatePINBits 粗略估计 PIN 码的熵（比特）
+//
+// 按使用的字符类别估计每个字符的熵，只由一两种字符组成时只计长度的熵。
+// 常见密码整体只计常见密码表的熵。其余按字母、数字和其它字符分成片段估计：
+// 常见密码和生成短语使用的单词按所在表的大小计，重复出现的片段只计 1 比特，
+// 由更短的部分重复组成的片段（比如 abcabc ）只计该部分和重复次数的熵，
+// 延续前两个字符步长不超过 1 的序列（比如 123456 、 abcdef ）的字符只计 1 比特
+func EstimatePINBits(pin Key) float64 {
+	runes := []rune(string(pin))
+	if len(runes) == 0 {
+		return 0
+	}
+	if _, ok := commonPINs[strings.ToLower(string(pin))]; ok {
+		return commonPINBits
+	}
+	var lower, upper, digit, other bool
+	distinct := make(map[rune]struct{}, len(runes))
+	for _, r := range runes {
+		distinct[r] = struct{}{}
+		switch {
+		case r >= 'a' && r <= 'z':
+			lower = true
+		case r >= 'A' && r <= 'Z':
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			other = true
+		}
+	}
+	charset := 0
+	for _, c := range []struct {
+		used bool
+		size int
+	}{{lower, 26}, {upper, 26}, {digit, 10}, {other, 33}} {
+		if c.used {
+			charset += c.size
+		}
+	}
+	if len(distinct) <= 2 {
+		return math.Log2(float64(len(runes) * charset))
+	}
+
+	bits := 0.0
+	seen := make(map[string]struct{})
+	for _, token := range splitPINTokens(runes) {
+		word := strings.ToLower(string(token))
+		if _, ok := seen[word]; ok {
+			bits++
+			continue
+		}
+		seen[word] = struct{}{}
+		bits += estimateTokenBits(token, charset)
+	}
+	return bits
+}
+
+// splitPINTokens 将 PIN 码分成由字母、数字或其它字符组成的连续片段
+func splitPINTokens(runes []rune) [][]rune {
+	class := func(r rune) int {
+		switch {
+		case unicode.IsLetter(r):
+			return 0
+		case unicode.IsDigit(r):
+			return 1
+		default:
+			return 2
+		}
+	}
+	var tokens [][]rune
+	start := 0
+	for i := 1; i <= len(runes); i++ {
+		if i == len(runes) || class(runes[i]) != class(runes[start]) {
+			tokens = append(tokens, runes[start:i])
+			start = i
+		}
+	}
+	return tokens
+}
+
+// estimateTokenBits 估计 PIN 码中一个片段的熵（比特）
+func estimateTokenBits(token []rune, charset int) float64 {
+	word := strings.ToLower(string(token))
+	if _, ok := commonPINs[word]; ok {
+		return commonPINBits
+	}
+	if _, ok := pinWordSet[word]; ok {
+		return pinWordBits
+	}
+	if period := repeatPeriod(token); period < len(token) {
+		return estimateTokenBits(token[:period], charset) + math.Log2(float64(len(token))/float64(period))
+	}
+	bits := 0.0
+	for i := range token {
+		if i >= 2 {
+			step := token[i] - token[i-1]
+			if step >= -1 && step <= 1 && step == token[i-1]-token[i-2] {
+				bits++
+				continue
+			}
+		}
+		bits += math.Log2(float64(charset))
+	}
+	return bits
+}
+
+// repeatPeriod 返回片段重复部分的最小长度，片段没有重复时返回其长度
+func repeatPeriod(token []rune) int {
+	for period := 1; period <= len(token)/2; period++ {
+		repeated := true
+		for i := period; i < len(token); i++ {
+			if token[i] != token[i-period] {
+				repeated = false
+				break
+			}
+		}
+		if repeated {
+			return period
+		}
+	}
+	return len(token)
+}
+
+// pinWordBits 生成短语 PIN 码使用的每个单词的熵（比特）
+const pinWordBits = 8
+
+// pinWords 生成短语 PIN 码使用的单词，共 256 个，每个单词约 8 比特
+var pinWords = []string{
+	"acid", "acorn", "actor", "adult", "agent", "alarm", "album", "alert", "alley", "amber", "angel",
+	"ankle", "apple", "apron", "arena", "armor", "arrow", "aspen", "atlas", "attic", "audio", "award",
+	"bacon", "badge", "bagel", "baker", "bamboo", "banjo", "barn", "basil", "basin", "beach", "beard",
+	"berry", "bison", "blade", "bloom", "board", "bonus", "boots", "brave", "bread", "brick",
+	"bridge", "brook", "brush", "bucket", "cabin", "cable", "cactus", "camel", "candle", "canoe",
+	"canyon", "cargo", "carpet", "carrot", "castle", "cedar", "chair", "chalk", "charm", "cheese",
+	"cherry", "chess", "chief", "cider", "circus", "cliff", "clock", "cloud", "clover", "coast",
+	"cobra", "cocoa", "comet", "coral", "cotton", "couch", "crane", "crayon", "creek", "crown",
+	"cupid", "daisy", "dance", "delta", "denim", "desert", "diary", "dingo", "disco", "donkey",
+	"dragon", "dream", "drift", "drum", "eagle", "easel", "echo", "elbow", "elder", "ember", "engine",
+	"falcon", "fancy", "feast", "fence", "ferry", "fiber", "field", "flame", "flute", "focus",
+	"forest", "fossil", "fox", "frost", "fudge", "galaxy", "garden", "garlic", "gecko", "giant",
+	"ginger", "globe", "glove", "goose", "grape", "gravel", "guitar", "hammer", "harbor", "hazel",
+	"helmet", "hero", "honey", "hornet", "hotel", "igloo", "iron", "island", "ivory", "jacket",
+	"jaguar", "jelly", "jewel", "jungle", "kayak", "kettle", "kiwi", "koala", "ladder", "lagoon",
+	"lemon", "lens", "lily", "lime", "linen", "lion", "lizard", "llama", "locket", "lotus", "lunar",
+	"magnet", "mango", "maple", "marble", "meadow", "melon", "meteor", "mint", "mirror", "mocha",
+	"monkey", "moose", "mosaic", "motor", "muffin", "nectar", "needle", "nickel", "noodle", "nugget",
+	"oasis", "ocean", "olive", "onion", "opal", "orbit", "orchid", "otter", "owl", "paddle", "palace",
+	"panda", "paper", "parrot", "peach", "pearl", "pebble", "pepper", "piano", "pickle", "pilot",
+	"pine", "pixel", "planet", "plum", "pocket", "polar", "pony", "poppy", "potato", "prism",
+	"puzzle", "quartz", "quill", "rabbit", "radar", "radio", "raven", "ribbon", "river", "robin",
+	"rocket", "ruby", "saddle", "salmon", "sand", "satin", "scarf", "shadow", "shell", "silver",
+	"sled", "slope", "snail", "sonic", "spark", "squid", "star", "stone", "storm", "sugar", "swan",
+	"table", "tango", "tiger", "toast", "topaz", "torch", "tulip", "whale", "zebra",
+}
+
+// pinWordSet 生成短语 PIN 码使用的单词集合
+var pinWordSet = toSet(pinWords)
+
+// commonPINBits 常见密码的熵（比特），猜测时会最先尝试这些密码
+var commonPINBits = math.Log2(float64(len(commonPINs)))
+
+// commonPINs 常见密码，不区分大小写
+var commonPINs = toSet([]string{
+	"password", "password1", "passw0rd", "pass", "secret", "letmein", "welcome", "iloveyou",
+	"admin", "administrator", "root", "guest", "test", "login", "default", "changeme",
+	"qwerty", "qwerty123", "qwertyuiop", "asdfgh", "asdfghjkl", "zxcvbn", "zxcvbnm", "abc123",
+	"monkey", "dragon", "shadow", "master", "sunshine", "princess", "football", "baseball",
+	"superman", "batman", "trustno1", "freedom", "whatever", "starwars", "hello", "bangbang",
+})
+
+// toSet 将字符串列表转换为集合
+func toSet(items []string) map[string]struct{} {
+	set := make(map[string]struct{}, len(items))
+	for _, item := range items {
+		set[item] = struct{}{}
+	}
+	return set
+}
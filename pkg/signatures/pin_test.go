@@ -0,0 +1,55 @@
+package signatures
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestGeneratePIN 测试 GeneratePIN
+func TestGeneratePIN(t *testing.T) {
+	a := assert.New(t)
+
+	a.Len(pinWords, 256)
+
+	for style, pattern := range map[PINStyle]string{
+		PINStyleDigits: `^[0-9]{12}$`,
+		PINStyleWords:  `^[a-z]+(-[a-z]+){4}$`,
+	} {
+		pin, err := GeneratePIN(style)
+		if !a.NoError(err) {
+			continue
+		}
+		a.Regexp(regexp.MustCompile(pattern), string(pin))
+		a.GreaterOrEqual(EstimatePINBits(pin), float64(MinPINBits))
+	}
+	_, err := GeneratePIN("emoji")
+	a.Error(err)
+}
+
+// TestPINPolicy_Check 测试 PINPolicy.Check
+func TestPINPolicy_Check(t *testing.T) {
+	a := assert.New(t)
+
+	for _, pin := range []string{
+		"7134", "123456789012", "000000000000", "abcdefgh",
+		// 常见密码、重复的单词和片段
+		"password", "Password1", "apple-apple-apple-apple-apple", "appleappleappleappleapple", "1234-1234-1234",
+	} {
+		warning, err := PINPolicyWarn.Check(Key(pin))
+		a.NoError(err)
+		a.NotEmpty(warning, pin)
+		_, err = PINPolicyReject.Check(Key(pin))
+		a.ErrorIs(err, ErrWeakPIN, pin)
+		warning, err = PINPolicyOff.Check(Key(pin))
+		a.NoError(err)
+		a.Empty(warning)
+	}
+
+	for _, pin := range []string{"483920175526", "apple-tiger-lemon-mango-pearl"} {
+		warning, err := PINPolicyReject.Check(Key(pin))
+		a.NoError(err, pin)
+		a.Empty(warning, pin)
+	}
+}
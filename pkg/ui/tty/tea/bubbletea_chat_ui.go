@@ -2,6 +2,8 @@ package tea
 
 import (
 	"context"
+	"crypto"
+	"errors"
 	"fmt"
 	"strings"
 
@@ -13,24 +15,88 @@ import (
 
 	chatv1 "github.com/yhlooo/bangbang/pkg/apis/chat/v1"
 	metav1 "github.com/yhlooo/bangbang/pkg/apis/meta/v1"
+	"github.com/yhlooo/bangbang/pkg/chats/moderations"
 	"github.com/yhlooo/bangbang/pkg/chats/rooms"
+	"github.com/yhlooo/bangbang/pkg/chats/senderkeys"
+	"github.com/yhlooo/bangbang/pkg/servers/common"
+	"github.com/yhlooo/bangbang/pkg/signatures"
 )
 
 // NewChatUI 创建聊天 UI
-func NewChatUI(room rooms.Room, self *metav1.ObjectMeta) *ChatUI {
+//
+// keys 持有房间密钥，用于签名发出的消息
+func NewChatUI(room rooms.Room, keys *signatures.KeyHolder, self *metav1.ObjectMeta) *ChatUI {
 	return &ChatUI{
-		self: self,
-		room: room,
+		self:     self,
+		room:     room,
+		roomKeys: keys,
 	}
 }
 
+// WithWarnings 设置需要提示用户的安全警告来源
+func (ui *ChatUI) WithWarnings(warnings <-chan string) *ChatUI {
+	ui.warnings = warnings
+	return ui
+}
+
+// WithViewerKeys 设置持有只读观察者密钥的 KeyHolder
+//
+// 观察者密钥变化时轮换发送者密钥，使当前的观察者可以解密之后的消息
+func (ui *ChatUI) WithViewerKeys(keys *signatures.KeyHolder) *ChatUI {
+	ui.viewerKeys = keys
+	return ui
+}
+
+// WithObserver 以只读观察者身份运行
+//
+// 此时 NewChatUI 的 keys 持有观察者密钥，不能发送消息。 visible 为 true 时以当前用户身份监听，使自己出现在成员列表中
+func (ui *ChatUI) WithObserver(visible bool) *ChatUI {
+	ui.observer = true
+	ui.visible = visible
+	return ui
+}
+
+// WithPINPolicy 设置弱 PIN 码处理策略
+//
+// 用于启动时提示房间 PIN 码过弱，以及检查 /rekey 和 /viewers 设置的新 PIN 码
+func (ui *ChatUI) WithPINPolicy(policy signatures.PINPolicy) *ChatUI {
+	ui.pinPolicy = policy
+	return ui
+}
+
+// WithBanner 在聊天记录开头醒目地展示 banner （比如生成的房间 PIN 码）
+func (ui *ChatUI) WithBanner(banner string) *ChatUI {
+	ui.entries = append(ui.entries, chatEntry{banner: banner})
+	return ui
+}
+
+// WithIdentityKey 设置签名管理操作使用的身份私钥
+func (ui *ChatUI) WithIdentityKey(key crypto.Signer) *ChatUI {
+	ui.identityKey = key
+	return ui
+}
+
 // ChatUI 聊天 UI
 type ChatUI struct {
 	ctx context.Context
 
-	self     *metav1.ObjectMeta
-	room     rooms.Room
-	messages []*chatv1.Message
+	self        *metav1.ObjectMeta
+	room        rooms.Room
+	roomKeys    *signatures.KeyHolder
+	identityKey crypto.Signer
+	// 端到端加密文本消息的发送者密钥会话，没有身份私钥或为观察者时为 nil ，以明文发送
+	senderKeys *senderkeys.Session
+	// 持有只读观察者密钥
+	viewerKeys *signatures.KeyHolder
+	// 是否以只读观察者身份运行，以及是否让成员看到自己
+	observer bool
+	visible  bool
+	// 弱 PIN 码处理策略
+	pinPolicy signatures.PINPolicy
+	warnings  <-chan string
+	entries   []chatEntry
+	// 等待批准加入的用户
+	pending map[string]chatv1.MembersChangeMessageContent
 
 	width, height int
 	vp            viewport.Model
@@ -40,6 +106,23 @@ type ChatUI struct {
 
 var _ tea.Model = (*ChatUI)(nil)
 
+// chatEntry 聊天记录中的一项，消息、警告、命令输出或醒目展示的本地信息
+type chatEntry struct {
+	message *chatv1.Message
+	warning string
+	notice  string
+	banner  string
+}
+
+// warningMsg 安全警告
+type warningMsg string
+
+// noticeMsg 需要展示给用户的提示
+type noticeMsg string
+
+// viewerKeyChangedMsg 观察者密钥发生变化
+type viewerKeyChangedMsg struct{}
+
 // Init 初始操作
 func (ui *ChatUI) Init() tea.Cmd {
 	return textarea.Blink
@@ -51,19 +134,99 @@ func (ui *ChatUI) Run(ctx context.Context) error {
 	ui.vp = viewport.New(30, 5)
 	ui.ctx = ctx
 
-	msgCh, err := ui.room.Listen(ctx, nil)
+	if !ui.observer {
+		if warning, _ := ui.pinPolicy.Check(ui.roomKeys.Get()); warning != "" {
+			ui.entries = append(ui.entries, chatEntry{warning: "room " + warning})
+		}
+		if ui.identityKey == nil {
+			ui.entries = append(ui.entries, chatEntry{
+				warning: "no identity key, messages can not be signed or end-to-end encrypted and will not be sent",
+			})
+		}
+		if ui.viewerKeys != nil && len(ui.viewerKeys.Get()) != 0 {
+			if warning, _ := ui.pinPolicy.Check(ui.viewerKeys.Get()); warning != "" {
+				ui.entries = append(ui.entries, chatEntry{warning: "viewer " + warning})
+			}
+		}
+	}
+
+	// 成员通过自己的房间加入，观察者仅在选择可见时以自己的身份监听
+	var listenAs *metav1.ObjectMeta
+	if ui.observer && ui.visible {
+		listenAs = ui.self
+	}
+	// 房间按身份公钥指纹管理监听者，本地房间从上下文获取
+	listenCTX := ctx
+	if ui.identityKey != nil {
+		pub, err := signatures.PublicKeyOf(ui.identityKey)
+		if err != nil {
+			return err
+		}
+		listenCTX = common.NewContextWithClientKey(ctx, moderations.KeyFingerprint(pub))
+	}
+	msgCh, err := ui.room.Listen(listenCTX, listenAs)
 	if err != nil {
 		return fmt.Errorf("listen messages in room error: %w", err)
 	}
 	defer func() { _ = msgCh.Close() }()
 
+	if ui.identityKey != nil && !ui.observer {
+		ui.senderKeys, err = senderkeys.NewSession(ui.self.UID, ui.identityKey)
+		if err != nil {
+			return fmt.Errorf("init sender keys error: %w", err)
+		}
+		if ui.viewerKeys != nil {
+			// 之后会公布发送者密钥，不需要发送返回的密钥分发消息
+			if _, err := ui.senderKeys.SetViewerKey(ui.viewerKeys.Get()); err != nil {
+				return fmt.Errorf("set viewer key error: %w", err)
+			}
+		}
+		// 公布自己的公钥，其它成员收到后会将它们的发送者密钥发给自己
+		content, err := ui.senderKeys.Announce()
+		if err != nil {
+			return fmt.Errorf("announce sender key error: %w", err)
+		}
+		if err := ui.sendMessage(ctx, chatv1.MessageContent{SenderKey: content}); err != nil {
+			logr.FromContextOrDiscard(ctx).Error(err, "send sender key error")
+		}
+	}
+
 	p := tea.NewProgram(ui)
 
 	go func() {
 		for msg := range msgCh.Messages() {
 			p.Send(msg)
 		}
+		if ui.observer {
+			p.Send(noticeMsg("disconnected from the room, the viewer PIN may have been changed or disabled"))
+		}
 	}()
+	if ui.viewerKeys != nil && ui.senderKeys != nil {
+		go func() {
+			changed := ui.viewerKeys.Changed()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-changed:
+					changed = ui.viewerKeys.Changed()
+					p.Send(viewerKeyChangedMsg{})
+				}
+			}
+		}()
+	}
+	if ui.warnings != nil {
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case warning := <-ui.warnings:
+					p.Send(warningMsg(warning))
+				}
+			}
+		}()
+	}
 
 	_, err = p.Run()
 	return err
@@ -77,6 +240,7 @@ func (ui *ChatUI) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	var (
 		inputCmd tea.Cmd
 		vpCmd    tea.Cmd
+		keysCmd  tea.Cmd
 	)
 
 	ui.input, inputCmd = ui.input.Update(msg)
@@ -107,15 +271,11 @@ func (ui *ChatUI) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		case tea.KeyEnter:
 			content := strings.TrimRight(ui.input.Value(), "\n")
 			if !ui.multilineMode && content != "" {
-				err := ui.room.CreateMessage(ctx, &chatv1.Message{
-					APIMeta: metav1.NewAPIMeta(chatv1.KindMessage),
-					From:    *ui.self,
-					Content: chatv1.MessageContent{
-						Text: &chatv1.TextMessageContent{Content: content},
-					},
-				})
-				if err != nil {
+				if strings.HasPrefix(content, "/") {
+					ui.addEntry(chatEntry{notice: ui.runCommand(ctx, content)})
+				} else if err := ui.sendText(ctx, content); err != nil {
 					logger.Error(err, "send message to room error")
+					ui.addEntry(chatEntry{notice: fmt.Sprintf("message rejected: %v", err)})
 				}
 				ui.input.Reset()
 				ui.vp.GotoBottom()
@@ -124,9 +284,21 @@ func (ui *ChatUI) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		}
 
 	case *chatv1.Message:
-		ui.messages = append(ui.messages, typed)
-		ui.vp.SetContent(lipgloss.NewStyle().Width(ui.vp.Width).Render(ui.messagesContent()))
-		ui.vp.GotoBottom()
+		keysCmd = ui.handleSenderKeys(ctx, typed)
+		if typed.Content.SenderKey != nil {
+			break
+		}
+		ui.updatePending(typed)
+		ui.addEntry(chatEntry{message: ui.decryptMessage(ctx, typed)})
+
+	case warningMsg:
+		ui.addEntry(chatEntry{warning: string(typed)})
+
+	case noticeMsg:
+		ui.addEntry(chatEntry{notice: string(typed)})
+
+	case viewerKeyChangedMsg:
+		keysCmd = ui.updateViewerKey(ctx)
 
 	case error:
 		logger.Error(typed, "error")
@@ -135,7 +307,138 @@ func (ui *ChatUI) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		logger.V(1).Info(fmt.Sprintf("unknown message: %#v", msg))
 	}
 
-	return ui, tea.Batch(inputCmd, vpCmd)
+	return ui, tea.Batch(inputCmd, vpCmd, keysCmd)
+}
+
+// updatePending 根据消息更新等待批准加入的用户
+func (ui *ChatUI) updatePending(msg *chatv1.Message) {
+	if ui.pending == nil {
+		ui.pending = make(map[string]chatv1.MembersChangeMessageContent)
+	}
+	switch {
+	case msg.Content.JoinRequest != nil:
+		ui.pending[msg.Content.JoinRequest.Key] = *msg.Content.JoinRequest.DeepCopy()
+	case msg.Content.Join != nil:
+		delete(ui.pending, msg.Content.Join.Key)
+	case msg.Content.Moderation != nil:
+		switch msg.Content.Moderation.Action {
+		case chatv1.ModerationAdmit, chatv1.ModerationDeny, chatv1.ModerationBan:
+			delete(ui.pending, msg.Content.Moderation.UserKey)
+		case chatv1.ModerationLock, chatv1.ModerationDisableAdmission:
+			clear(ui.pending)
+		default:
+		}
+	}
+}
+
+// handleSenderKeys 根据消息记录其它成员的发送者密钥或轮换自己的发送者密钥，返回发送密钥分发消息的命令
+func (ui *ChatUI) handleSenderKeys(ctx context.Context, msg *chatv1.Message) tea.Cmd {
+	if ui.senderKeys == nil {
+		return nil
+	}
+	reply, err := ui.senderKeys.Handle(msg)
+	if err != nil {
+		logr.FromContextOrDiscard(ctx).Error(err, "handle sender key error")
+		if errors.Is(err, senderkeys.ErrIdentityMismatch) {
+			ui.addEntry(chatEntry{warning: fmt.Sprintf(
+				"%s sent a sender key signed by another identity key, someone may be impersonating them",
+				userString(&msg.From),
+			)})
+		}
+	}
+	return ui.sendSenderKey(ctx, reply)
+}
+
+// updateViewerKey 使用当前观察者密钥轮换发送者密钥，返回发送密钥分发消息的命令
+func (ui *ChatUI) updateViewerKey(ctx context.Context) tea.Cmd {
+	if ui.senderKeys == nil || ui.viewerKeys == nil {
+		return nil
+	}
+	reply, err := ui.senderKeys.SetViewerKey(ui.viewerKeys.Get())
+	if err != nil {
+		logr.FromContextOrDiscard(ctx).Error(err, "set viewer key error")
+	}
+	return ui.sendSenderKey(ctx, reply)
+}
+
+// sendSenderKey 返回发送密钥分发消息的命令， content 为 nil 时返回 nil
+func (ui *ChatUI) sendSenderKey(ctx context.Context, content *chatv1.SenderKeyMessageContent) tea.Cmd {
+	if content == nil {
+		return nil
+	}
+	return func() tea.Msg {
+		if err := ui.sendMessage(ctx, chatv1.MessageContent{SenderKey: content}); err != nil {
+			return fmt.Errorf("send sender key error: %w", err)
+		}
+		return nil
+	}
+}
+
+// sendText 使用发送者密钥加密并发送文本消息，没有发送者密钥会话时拒绝以明文发送
+func (ui *ChatUI) sendText(ctx context.Context, text string) error {
+	if ui.observer {
+		return errors.New("observers can not send messages")
+	}
+	if ui.senderKeys == nil {
+		return errors.New("no sender key to encrypt messages, refuse to send plain text")
+	}
+	encrypted, err := ui.senderKeys.Encrypt(&chatv1.TextMessageContent{Content: text})
+	if err != nil {
+		return err
+	}
+	return ui.sendMessage(ctx, chatv1.MessageContent{Encrypted: encrypted})
+}
+
+// decryptMessage 解密端到端加密的消息，返回解密后的副本，无法解密时原样返回
+//
+// 观察者使用观察者密钥解密消息中附带的发送者密钥
+func (ui *ChatUI) decryptMessage(ctx context.Context, msg *chatv1.Message) *chatv1.Message {
+	if msg.Content.Encrypted == nil || (ui.senderKeys == nil && !ui.observer) {
+		return msg
+	}
+	var (
+		text *chatv1.TextMessageContent
+		err  error
+	)
+	if ui.observer {
+		text, err = senderkeys.DecryptAsViewer(ui.roomKeys.Get(), msg.From.UID, msg.Content.Encrypted)
+	} else {
+		text, err = ui.senderKeys.Decrypt(msg.From.UID, msg.Content.Encrypted)
+	}
+	if err != nil {
+		logr.FromContextOrDiscard(ctx).V(1).Info(fmt.Sprintf("decrypt message %s error: %v", msg.UID, err))
+		return msg
+	}
+	msg = msg.DeepCopy()
+	msg.Content.Encrypted = nil
+	msg.Content.Text = text
+	return msg
+}
+
+// sendMessage 以当前用户的名义使用身份私钥签名并发送消息
+func (ui *ChatUI) sendMessage(ctx context.Context, content chatv1.MessageContent) error {
+	if ui.identityKey == nil {
+		return errors.New("no identity key to sign messages")
+	}
+	msg := &chatv1.Message{
+		APIMeta: metav1.NewAPIMeta(chatv1.KindMessage),
+		From:    *ui.self,
+		Content: content,
+	}
+	if err := rooms.SignMessageAs(ui.roomKeys.Get(), ui.identityKey, msg); err != nil {
+		return err
+	}
+	return ui.room.CreateMessage(ctx, msg)
+}
+
+// addEntry 添加聊天记录并滚动到底部，内容为空的记录被忽略
+func (ui *ChatUI) addEntry(entry chatEntry) {
+	if entry.message == nil && entry.warning == "" && entry.notice == "" && entry.banner == "" {
+		return
+	}
+	ui.entries = append(ui.entries, entry)
+	ui.vp.SetContent(lipgloss.NewStyle().Width(ui.vp.Width).Render(ui.messagesContent()))
+	ui.vp.GotoBottom()
 }
 
 // View 生成显示内容
@@ -152,18 +455,25 @@ func (ui *ChatUI) View() string {
 			"ESC" +
 			faint.Render(" to send message and exit multiline input mode)")
 	}
+	name := getUserShowingName(ui.self)
+	if ui.observer {
+		name += faint.Render(" (observing, read-only)")
+	}
 	return fmt.Sprintf(`%s
 
 ┃ %s:
 %s
 ┃
-┃ %s`, ui.vp.View(), getUserShowingName(ui.self), ui.input.View(), inputTips)
+┃ %s`, ui.vp.View(), name, ui.input.View(), inputTips)
 }
 
 // initInputBox 初始化输入框
 func (ui *ChatUI) initInputBox() {
 	ui.input = textarea.New()
 	ui.input.Placeholder = "Send a message..."
+	if ui.observer {
+		ui.input.Placeholder = "Observing, only commands are available..."
+	}
 	ui.input.Focus()
 	ui.input.Prompt = "┃ "
 	ui.input.CharLimit = 1024
@@ -188,13 +498,42 @@ func (ui *ChatUI) fixSize() {
 }
 
 // messagesContent 获取消息文本形式展示的内容
+//
+// 来自远端的文本都经过 sanitizeText 清理
 func (ui *ChatUI) messagesContent() string {
-	retLines := make([]string, 0, len(ui.messages)*2)
-	for _, msg := range ui.messages {
+	retLines := make([]string, 0, len(ui.entries)*2)
+	for _, entry := range ui.entries {
+		if entry.warning != "" {
+			retLines = append(retLines,
+				lipgloss.NewStyle().Bold(true).Foreground(lipgloss.Color("1")).Render("WARNING: "+sanitizeText(entry.warning, true)),
+				"",
+			)
+			continue
+		}
+		if entry.notice != "" {
+			retLines = append(retLines, lipgloss.NewStyle().Faint(true).Render(sanitizeText(entry.notice, true)), "")
+			continue
+		}
+		if entry.banner != "" {
+			retLines = append(retLines,
+				lipgloss.NewStyle().Bold(true).Foreground(lipgloss.Color("6")).
+					Border(lipgloss.RoundedBorder()).Padding(0, 1).Render(entry.banner),
+				"",
+			)
+			continue
+		}
+		msg := entry.message
 		if msg.Content.Text != nil {
 			retLines = append(retLines,
 				getUserShowingName(&msg.From)+":",
-				lipgloss.NewStyle().PaddingLeft(1).Render(msg.Content.Text.Content),
+				lipgloss.NewStyle().PaddingLeft(1).Render(sanitizeText(msg.Content.Text.Content, true)),
+				"",
+			)
+		}
+		if msg.Content.Encrypted != nil {
+			retLines = append(retLines,
+				getUserShowingName(&msg.From)+":",
+				lipgloss.NewStyle().PaddingLeft(1).Faint(true).Render("[encrypted message, sender key not received]"),
 				"",
 			)
 		}
@@ -204,6 +543,24 @@ func (ui *ChatUI) messagesContent() string {
 		if msg.Content.Leave != nil && msg.Content.Leave.User.UID != ui.self.UID {
 			retLines = append(retLines, fmt.Sprintf("%s left", getUserShowingName(&msg.Content.Leave.User)), "")
 		}
+		if msg.Content.JoinRequest != nil {
+			user := &msg.Content.JoinRequest.User
+			retLines = append(retLines,
+				lipgloss.NewStyle().Foreground(lipgloss.Color("3")).Render(fmt.Sprintf(
+					"%s is waiting for approval (/approve %s or /deny %s)",
+					userString(user), user.UID.Short(), user.UID.Short(),
+				)),
+				"",
+			)
+		}
+		if msg.Content.Moderation != nil {
+			retLines = append(retLines,
+				lipgloss.NewStyle().Foreground(lipgloss.Color("3")).Render(
+					sanitizeText(describeModeration(msg.Content.Moderation), false),
+				),
+				"",
+			)
+		}
 	}
 	return strings.Join(retLines, "\n")
 }
@@ -214,6 +571,6 @@ func getUserShowingName(user *metav1.ObjectMeta) string {
 	if user.Name == "" {
 		return lipgloss.NewStyle().Bold(true).Render(uid)
 	}
-	return lipgloss.NewStyle().Bold(true).Render(user.Name) + " " +
+	return lipgloss.NewStyle().Bold(true).Render(sanitizeText(user.Name, false)) + " " +
 		lipgloss.NewStyle().Faint(true).Render("("+uid+")")
 }
@@ -0,0 +1,348 @@
+package tea
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	chatv1 "github.com/yhlooo/bangbang/pkg/apis/chat/v1"
+	metav1 "github.com/yhlooo/bangbang/pkg/apis/meta/v1"
+	"github.com/yhlooo/bangbang/pkg/chats/moderations"
+	"github.com/yhlooo/bangbang/pkg/signatures"
+)
+
+// commandsHelp 命令帮助
+const commandsHelp = `Commands:
+  /whoami                 Show your user UID and identity key
+  /mods                   Show the room authority, admins, muted and banned users
+  /kick USER [REASON]     Kick a user out of the room
+  /mute USER [REASON]     Mute a user
+  /unmute USER            Unmute a user
+  /ban USER [REASON]      Kick a user and forbid rejoining
+  /unban USER             Unban a user
+  /admin KEY              Grant admin to an identity key (room authority only)
+  /unadmin KEY            Revoke admin from an identity key (room authority only)
+  /pending                Show users waiting for approval
+  /approve USER           Let a waiting user join
+  /deny USER [REASON]     Reject a waiting user
+  /admission on|off       Require approval for new members or not
+  /lock                   Reject all new members
+  /unlock                 Accept new members again
+  /pin                    Show the current room PIN
+  /rekey PIN              Change the room PIN, only current members move to the new PIN (room authority only)
+  /viewers [PIN|off]      Show, set or disable the viewer PIN for read-only observers (room authority only)
+USER is a name, a short ID (shown after the name) or a UID prefix of a member or a waiting user.`
+
+// userModerationCommands 对用户的管理命令
+var userModerationCommands = map[string]chatv1.ModerationAction{
+	"/kick":    chatv1.ModerationKick,
+	"/mute":    chatv1.ModerationMute,
+	"/unmute":  chatv1.ModerationUnmute,
+	"/ban":     chatv1.ModerationBan,
+	"/unban":   chatv1.ModerationUnban,
+	"/approve": chatv1.ModerationAdmit,
+	"/deny":    chatv1.ModerationDeny,
+}
+
+// roomModerationCommands 房间设置命令
+var roomModerationCommands = map[string]chatv1.ModerationAction{
+	"/lock":   chatv1.ModerationLock,
+	"/unlock": chatv1.ModerationUnlock,
+}
+
+// adminModerationCommands 授予、撤销管理员的命令
+var adminModerationCommands = map[string]chatv1.ModerationAction{
+	"/admin":   chatv1.ModerationGrantAdmin,
+	"/unadmin": chatv1.ModerationRevokeAdmin,
+}
+
+// runCommand 执行以 / 开头的命令，返回需要展示给用户的内容
+func (ui *ChatUI) runCommand(ctx context.Context, line string) string {
+	fields := strings.Fields(line)
+	name, args := fields[0], fields[1:]
+
+	if action, ok := userModerationCommands[name]; ok {
+		if len(args) < 1 {
+			return fmt.Sprintf("usage: %s USER [REASON]", name)
+		}
+		user, err := ui.findUser(ctx, args[0])
+		if err != nil {
+			return err.Error()
+		}
+		return ui.sendModeration(ctx, &chatv1.ModerationMessageContent{
+			Action:  action,
+			User:    user.ObjectMeta,
+			UserKey: user.Key,
+			Reason:  strings.Join(args[1:], " "),
+		})
+	}
+	if action, ok := adminModerationCommands[name]; ok {
+		if len(args) != 1 {
+			return fmt.Sprintf("usage: %s KEY", name)
+		}
+		return ui.sendModeration(ctx, &chatv1.ModerationMessageContent{
+			Action:   action,
+			AdminKey: args[0],
+		})
+	}
+
+	if action, ok := roomModerationCommands[name]; ok {
+		return ui.sendModeration(ctx, &chatv1.ModerationMessageContent{Action: action})
+	}
+
+	switch name {
+	case "/admission":
+		switch {
+		case len(args) == 1 && args[0] == "on":
+			return ui.sendModeration(ctx, &chatv1.ModerationMessageContent{Action: chatv1.ModerationEnableAdmission})
+		case len(args) == 1 && args[0] == "off":
+			return ui.sendModeration(ctx, &chatv1.ModerationMessageContent{Action: chatv1.ModerationDisableAdmission})
+		}
+		return "usage: /admission on|off"
+	case "/rekey":
+		if len(args) != 1 {
+			return "usage: /rekey PIN"
+		}
+		warning, err := ui.pinPolicy.Check(signatures.Key(args[0]))
+		if err != nil {
+			return err.Error()
+		}
+		content, err := moderations.NewRekey(ui.roomKeys.Get(), signatures.Key(args[0]))
+		if err != nil {
+			return err.Error()
+		}
+		return joinOutput(warning, ui.sendModeration(ctx, content))
+	case "/pin":
+		if ui.observer {
+			return fmt.Sprintf("viewer PIN: %s", ui.roomKeys.Get())
+		}
+		return fmt.Sprintf("room PIN: %s", ui.roomKeys.Get())
+	case "/viewers":
+		switch {
+		case len(args) == 0:
+			if ui.viewerKeys == nil || len(ui.viewerKeys.Get()) == 0 {
+				return "viewers: off"
+			}
+			return fmt.Sprintf("viewer PIN: %s", ui.viewerKeys.Get())
+		case len(args) == 1:
+			var (
+				viewerKey signatures.Key
+				warning   string
+				err       error
+			)
+			if args[0] != "off" {
+				viewerKey = signatures.Key(args[0])
+				if warning, err = ui.pinPolicy.Check(viewerKey); err != nil {
+					return err.Error()
+				}
+			}
+			content, err := moderations.NewViewerKey(ui.roomKeys.Get(), viewerKey)
+			if err != nil {
+				return err.Error()
+			}
+			return joinOutput(warning, ui.sendModeration(ctx, content))
+		}
+		return "usage: /viewers [PIN|off]"
+	case "/pending":
+		pending := make([]string, 0, len(ui.pending))
+		for _, req := range ui.pending {
+			pending = append(pending, userString(&req.User))
+		}
+		sort.Strings(pending)
+		return "pending: " + listString(pending)
+	case "/help":
+		return commandsHelp
+	case "/whoami":
+		key := "(none)"
+		if ui.identityKey != nil {
+			pub, err := signatures.PublicKeyOf(ui.identityKey)
+			if err != nil {
+				return err.Error()
+			}
+			key = moderations.KeyFingerprint(pub)
+		}
+		return fmt.Sprintf("uid: %s\nkey: %s", ui.self.UID, key)
+	case "/mods":
+		return ui.moderationsSummary(ctx)
+	}
+	return fmt.Sprintf("unknown command %q, type /help for help", name)
+}
+
+// sendModeration 签名并发送管理操作
+func (ui *ChatUI) sendModeration(ctx context.Context, content *chatv1.ModerationMessageContent) string {
+	if ui.identityKey == nil {
+		return "no identity key to sign moderations"
+	}
+	if err := moderations.Sign(ui.identityKey, content); err != nil {
+		return err.Error()
+	}
+	if err := ui.sendMessage(ctx, chatv1.MessageContent{Moderation: content}); err != nil {
+		return fmt.Sprintf("moderation rejected: %v", err)
+	}
+	return ""
+}
+
+// joinOutput 按行拼接非空的命令输出
+func joinOutput(outputs ...string) string {
+	nonEmpty := make([]string, 0, len(outputs))
+	for _, output := range outputs {
+		if output != "" {
+			nonEmpty = append(nonEmpty, output)
+		}
+	}
+	return strings.Join(nonEmpty, "\n")
+}
+
+// findUser 根据用户名、短 ID 或 UID 前缀查找房间成员、等待批准或已被封禁的用户
+//
+// 返回的用户带有身份公钥指纹，管理操作按该指纹生效
+func (ui *ChatUI) findUser(ctx context.Context, s string) (*chatv1.User, error) {
+	var candidates []chatv1.User
+	members, err := ui.room.ListMembers(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("list members error: %w", err)
+	}
+	candidates = append(candidates, members.Items...)
+	for _, req := range ui.pending {
+		candidates = append(candidates, chatv1.User{ObjectMeta: req.User, Key: req.Key})
+	}
+	if mods, err := ui.room.ListModerations(ctx); err == nil {
+		for _, msg := range mods.Items {
+			if mod := msg.Content.Moderation; mod.UserKey != "" {
+				candidates = append(candidates, chatv1.User{ObjectMeta: mod.User, Key: mod.UserKey})
+			}
+		}
+	}
+
+	var found *chatv1.User
+	for _, user := range candidates {
+		if user.Key == "" ||
+			(user.Name != s && !strings.EqualFold(user.UID.Short(), s) && !strings.HasPrefix(user.UID.String(), s)) {
+			continue
+		}
+		if found != nil && found.Key != user.Key {
+			return nil, fmt.Errorf("more than one user matches %q", s)
+		}
+		found = user.DeepCopy()
+	}
+	if found == nil {
+		return nil, fmt.Errorf("no user matches %q", s)
+	}
+	return found, nil
+}
+
+// moderationsSummary 返回房间管理状态的摘要
+func (ui *ChatUI) moderationsSummary(ctx context.Context) string {
+	info, err := ui.room.Info(ctx)
+	if err != nil {
+		return fmt.Sprintf("get room info error: %v", err)
+	}
+	mods, err := ui.room.ListModerations(ctx)
+	if err != nil {
+		return fmt.Sprintf("list moderations error: %v", err)
+	}
+
+	authority := info.Authority
+	if authority == "" {
+		authority = "(none)"
+	}
+	var admins, muted, banned []string
+	locked, admission, viewers := "no", "off", "off"
+	for _, msg := range mods.Items {
+		mod := msg.Content.Moderation
+		switch mod.Action {
+		case chatv1.ModerationLock:
+			locked = "yes"
+		case chatv1.ModerationEnableAdmission:
+			admission = "on"
+		case chatv1.ModerationSetViewerKey:
+			if len(mod.Secret) != 0 {
+				viewers = "on"
+			}
+		case chatv1.ModerationGrantAdmin:
+			admins = append(admins, mod.AdminKey)
+		case chatv1.ModerationMute:
+			muted = append(muted, userString(&mod.User))
+		case chatv1.ModerationBan:
+			banned = append(banned, userString(&mod.User))
+		default:
+		}
+	}
+	return fmt.Sprintf(
+		"authority: %s\nlocked: %s\nadmission: %s\nviewers: %s\nadmins: %s\nmuted: %s\nbanned: %s",
+		authority, locked, admission, viewers, listString(admins), listString(muted), listString(banned),
+	)
+}
+
+// describeModeration 返回管理操作的描述
+func describeModeration(mod *chatv1.ModerationMessageContent) string {
+	issuer := shortKey(moderations.KeyFingerprint(mod.Issuer))
+	var ret string
+	switch mod.Action {
+	case chatv1.ModerationKick:
+		ret = fmt.Sprintf("%s was kicked by %s", userString(&mod.User), issuer)
+	case chatv1.ModerationMute:
+		ret = fmt.Sprintf("%s was muted by %s", userString(&mod.User), issuer)
+	case chatv1.ModerationUnmute:
+		ret = fmt.Sprintf("%s was unmuted by %s", userString(&mod.User), issuer)
+	case chatv1.ModerationBan:
+		ret = fmt.Sprintf("%s was banned by %s", userString(&mod.User), issuer)
+	case chatv1.ModerationUnban:
+		ret = fmt.Sprintf("%s was unbanned by %s", userString(&mod.User), issuer)
+	case chatv1.ModerationGrantAdmin:
+		ret = fmt.Sprintf("%s was granted admin by %s", shortKey(mod.AdminKey), issuer)
+	case chatv1.ModerationRevokeAdmin:
+		ret = fmt.Sprintf("%s was revoked admin by %s", shortKey(mod.AdminKey), issuer)
+	case chatv1.ModerationLock:
+		ret = fmt.Sprintf("room was locked by %s", issuer)
+	case chatv1.ModerationUnlock:
+		ret = fmt.Sprintf("room was unlocked by %s", issuer)
+	case chatv1.ModerationEnableAdmission:
+		ret = fmt.Sprintf("new members need approval now, set by %s", issuer)
+	case chatv1.ModerationDisableAdmission:
+		ret = fmt.Sprintf("new members no longer need approval, set by %s", issuer)
+	case chatv1.ModerationAdmit:
+		ret = fmt.Sprintf("%s was approved by %s", userString(&mod.User), issuer)
+	case chatv1.ModerationDeny:
+		ret = fmt.Sprintf("%s was denied by %s", userString(&mod.User), issuer)
+	case chatv1.ModerationRekey:
+		ret = fmt.Sprintf("room PIN was changed by %s, type /pin to show the new PIN", issuer)
+	case chatv1.ModerationSetViewerKey:
+		if len(mod.Secret) == 0 {
+			ret = fmt.Sprintf("read-only observers were disabled by %s", issuer)
+		} else {
+			ret = fmt.Sprintf("viewer PIN for read-only observers was set by %s, type /viewers to show it", issuer)
+		}
+	default:
+		ret = fmt.Sprintf("unknown moderation %q by %s", mod.Action, issuer)
+	}
+	if mod.Reason != "" {
+		ret += ": " + mod.Reason
+	}
+	return ret
+}
+
+// userString 返回用户的纯文本展示名
+func userString(user *metav1.ObjectMeta) string {
+	if user.Name == "" {
+		return user.UID.Short()
+	}
+	return fmt.Sprintf("%s (%s)", sanitizeText(user.Name, false), user.UID.Short())
+}
+
+// shortKey 返回公钥指纹的缩写
+func shortKey(key string) string {
+	if len(key) > 15 {
+		return key[:15]
+	}
+	return key
+}
+
+// listString 返回列表的展示形式
+func listString(items []string) string {
+	if len(items) == 0 {
+		return "(none)"
+	}
+	return strings.Join(items, ", ")
+}
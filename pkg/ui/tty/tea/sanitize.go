@@ -0,0 +1,157 @@
+package tea
+
+import (
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// sanitizeText 清理来自远端的文本，使其可以安全地输出到终端
+//
+// 只设置颜色、字体的 SGR 序列被移除，其它 ESC 或 C1 开头的控制序列（移动光标、清屏、 OSC 52 设置剪贴板等）、
+// 控制字符、双向文本控制字符等不可见的格式字符和非法 UTF-8 字节被替换为可见的转义形式（如 \x1b 、 \u202e ）。
+// multiline 为 true 时保留换行
+func sanitizeText(s string, multiline bool) string {
+	b := &strings.Builder{}
+	b.Grow(len(s))
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		switch {
+		case r == utf8.RuneError && size == 1:
+			b.WriteString(`\x` + strconv.FormatUint(uint64(s[i]), 16))
+		case r == '\x1b' || (r >= 0x80 && r <= 0x9f):
+			size = controlSequenceLen(s[i:])
+			if seq := s[i : i+size]; !isSGR(seq) {
+				escapeText(b, seq)
+			}
+		case r == '\n' && multiline:
+			b.WriteByte('\n')
+		case r == '\t' && multiline:
+			b.WriteString("    ")
+		case r == '\t':
+			b.WriteByte(' ')
+		case suspiciousRune(r):
+			b.WriteString(escapeRune(r))
+		default:
+			b.WriteRune(r)
+		}
+		i += size
+	}
+	return b.String()
+}
+
+// suspiciousRune 判断字符是否需要转义后展示
+//
+// 包括控制字符、格式字符（双向文本控制、零宽字符等，零宽连接符除外）和行、段分隔符
+func suspiciousRune(r rune) bool {
+	switch {
+	case unicode.IsControl(r):
+		return true
+	case r == '\u200d':
+		// 零宽连接符用于组合 emoji
+		return false
+	case unicode.Is(unicode.Cf, r), unicode.Is(unicode.Zl, r), unicode.Is(unicode.Zp, r):
+		return true
+	}
+	return false
+}
+
+// escapeRune 返回字符的可见转义形式
+func escapeRune(r rune) string {
+	q := strconv.QuoteRuneToASCII(r)
+	return q[1 : len(q)-1]
+}
+
+// escapeText 将文本中的可疑字符转义后写入 b
+func escapeText(b *strings.Builder, s string) {
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		switch {
+		case r == utf8.RuneError && size == 1:
+			b.WriteString(`\x` + strconv.FormatUint(uint64(s[i]), 16))
+		case suspiciousRune(r):
+			b.WriteString(escapeRune(r))
+		default:
+			b.WriteRune(r)
+		}
+		i += size
+	}
+}
+
+// controlSequenceLen 返回 s 开头的 ESC 或 C1 控制序列的字节数
+//
+// 不完整的序列延续到 s 结尾
+func controlSequenceLen(s string) int {
+	var kind byte
+	start := 1
+	if s[0] == '\x1b' {
+		if len(s) < 2 {
+			return 1
+		}
+		kind, start = s[1], 2
+	} else {
+		// C1 控制字符 0x80-0x9f 等价于 ESC 加 0x40-0x5f
+		r, size := utf8.DecodeRuneInString(s)
+		kind, start = byte(r-0x40), size
+	}
+
+	switch kind {
+	case '[':
+		// CSI: 参数和中间字节 0x20-0x3f ，结束字节 0x40-0x7e
+		for i := start; i < len(s); i++ {
+			switch {
+			case s[i] >= 0x40 && s[i] <= 0x7e:
+				return i + 1
+			case s[i] < 0x20 || s[i] > 0x3f:
+				return i
+			}
+		}
+		return len(s)
+	case ']', 'P', 'X', '^', '_':
+		// OSC 、 DCS 、 SOS 、 PM 、 APC: 以 BEL 、 ESC \ 或 C1 ST 结束的字符串
+		for i := start; i < len(s); i++ {
+			switch {
+			case s[i] == '\a':
+				return i + 1
+			case s[i] == '\x1b' && i+1 < len(s) && s[i+1] == '\\':
+				return i + 2
+			case strings.HasPrefix(s[i:], "\u009c"):
+				return i + len("\u009c")
+			}
+		}
+		return len(s)
+	}
+	if s[0] != '\x1b' {
+		// 其它 C1 控制字符
+		return start
+	}
+	// 其它 ESC 序列: 中间字节 0x20-0x2f ，结束字节 0x30-0x7e
+	for i := 1; i < len(s); i++ {
+		switch {
+		case s[i] >= 0x20 && s[i] <= 0x2f:
+		case s[i] >= 0x30 && s[i] <= 0x7e:
+			return i + 1
+		default:
+			return i
+		}
+	}
+	return len(s)
+}
+
+// isSGR 判断控制序列是否为只设置颜色、字体的 SGR 序列
+func isSGR(seq string) bool {
+	var params string
+	switch {
+	case strings.HasPrefix(seq, "\x1b["):
+		params = seq[2:]
+	case strings.HasPrefix(seq, "\u009b"):
+		params = seq[len("\u009b"):]
+	default:
+		return false
+	}
+	if !strings.HasSuffix(params, "m") {
+		return false
+	}
+	return strings.Trim(params[:len(params)-1], "0123456789;:") == ""
+}
@@ -0,0 +1,55 @@
+package tea
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestSanitizeText 测试 sanitizeText
+func TestSanitizeText(t *testing.T) {
+	a := assert.New(t)
+
+	cases := []struct {
+		input     string
+		multiline bool
+		expected  string
+	}{
+		{input: "hello, 世界 👋", expected: "hello, 世界 👋"},
+		// emoji 中的零宽连接符保留
+		{input: "👩\u200d💻", expected: "👩\u200d💻"},
+		// 颜色被移除
+		{input: "\x1b[1;31mred\x1b[0m", expected: "red"},
+		{input: "\u009b31mred", expected: "red"},
+		// 移动光标、清屏
+		{input: "\x1b[2J\x1b[Hfake", expected: `\x1b[2J\x1b[Hfake`},
+		{input: "\x1b[1A\x1b[2Kalice: hi", expected: `\x1b[1A\x1b[2Kalice: hi`},
+		// OSC 52 设置剪贴板
+		{input: "\x1b]52;c;cm0gLXJmIH4=\x07x", expected: `\x1b]52;c;cm0gLXJmIH4=\ax`},
+		{input: "\x1b]8;;http://evil\x1b\\link", expected: `\x1b]8;;http://evil\x1b\link`},
+		{input: "\u009d52;c;Zm9v\u009cx", expected: `\u009d52;c;Zm9v\u009cx`},
+		// 不完整的序列
+		{input: "\x1b]0;title", expected: `\x1b]0;title`},
+		{input: "a\x1b", expected: `a\x1b`},
+		{input: "\x1bc", expected: `\x1bc`},
+		// 控制字符
+		{input: "a\rb\bc\x00", expected: `a\rb\bc\x00`},
+		{input: "a\nb", expected: `a\nb`},
+		{input: "a\nb\tc", multiline: true, expected: "a\nb    c"},
+		// 双向文本控制和零宽字符
+		{input: "abc\u202etxt.exe", expected: `abc\u202etxt.exe`},
+		{input: "\u2066x\u2069\u200bal\u200fice", expected: `\u2066x\u2069\u200bal\u200fice`},
+		{input: "a\u2028b", multiline: true, expected: `a\u2028b`},
+		// 非法 UTF-8
+		{input: "a\xffb", expected: `a\xffb`},
+	}
+	for _, c := range cases {
+		a.Equal(c.expected, sanitizeText(c.input, c.multiline), "%q", c.input)
+	}
+
+	// 清理后的文本再次清理不变
+	for _, c := range cases {
+		once := sanitizeText(c.input, c.multiline)
+		a.Equal(once, sanitizeText(once, c.multiline), "%q", c.input)
+	}
+}